@@ -2,9 +2,12 @@ package basalt
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/smallnest/log"
@@ -19,134 +22,426 @@ const (
 	BmOpRemove     = 3
 	BmOpDrop       = 4
 	BmOpClear      = 5
+	// BmOpCheckpoint is a checkpoint of state hashes, which is not applied to bitmaps.
+	BmOpCheckpoint = 6
+	// BmOpExpire sets the deadline of a bitmap in unix seconds, 0 removes it.
+	BmOpExpire = 7
+	// BmOpDropExpired removes a bitmap if its deadline is still the value.
+	BmOpDropExpired = 8
+	// BmOpSetQuota sets the quota of a namespace encoded in the config.
+	BmOpSetQuota = 9
+	// BmOpSetValue sets the value of a member of a field.
+	BmOpSetValue = 10
+	// BmOpClearValue removes the value of a member of a field.
+	BmOpClearValue = 11
+	// BmOpDropField removes a field.
+	BmOpDropField = 12
+	// BmOpCreateSeries sets the config of a series encoded in the config.
+	BmOpCreateSeries = 13
+	// BmOpDropSeries removes a series and its buckets.
+	BmOpDropSeries = 14
+	// BmOpRollupBucket rolls up a bucket of a series.
+	BmOpRollupBucket = 15
+	// BmOpAddKeys adds keys to a bitmap.
+	BmOpAddKeys = 16
+	// BmOpPFAdd adds elements in the keys to a HyperLogLog.
+	BmOpPFAdd = 17
+	// BmOpPFMerge merges HyperLogLogs in the keys to the destination.
+	BmOpPFMerge = 18
+	// BmOpReserveFilter creates a filter encoded in the config.
+	BmOpReserveFilter = 19
+	// BmOpBloomAdd adds items in the keys to a Bloom filter.
+	BmOpBloomAdd = 20
+	// BmOpCuckooAdd adds an item to a Cuckoo filter encoded like BmOpBloomAdd.
+	BmOpCuckooAdd = 21
+	// BmOpCuckooAddNX adds an item to a Cuckoo filter if it isn't contained.
+	BmOpCuckooAddNX = 22
+	// BmOpCuckooDelete deletes an item from a Cuckoo filter.
+	BmOpCuckooDelete = 23
+	// BmOpDropFilter removes a filter.
+	BmOpDropFilter = 24
+	// BmOpStore replaces a bitmap by the roaring bitmap in the config.
+	BmOpStore = 25
 )
 
-// Bitmaps contains all bitmaps of namespace.
+var (
+	// errInvalidExpiry is returned if an expiry record isn't followed by its bitmap.
+	errInvalidExpiry = errors.New("expiry record is not followed by its bitmap")
+	// errInvalidField is returned if a field record is malformed.
+	errInvalidField = errors.New("invalid record of field")
+	// errInvalidSeries is returned if a series record is malformed.
+	errInvalidSeries = errors.New("invalid record of series")
+	// errUnexpectedNamespace is returned if bitmaps of one namespace are read
+	// from bitmaps of multiple namespaces.
+	errUnexpectedNamespace = errors.New("unexpected header of namespace")
+)
+
+// bitmapShards is the number of shards of the name map, which is a power of 2.
+const bitmapShards = 64
+
+// Bitmaps contains all bitmaps of a namespace. Names are partitioned into
+// shards by their hash, so writes to unrelated bitmaps don't contend on one
+// lock. Locks of shards are taken before locks of bitmaps, and locks of
+// multiple shards or bitmaps in ascending order of their indexes or names.
 type Bitmaps struct {
-	mu            sync.RWMutex
-	bitmaps       map[string]*Bitmap
-	writeCallback func(op OP, value string)
+	hash          uint64 // state hash, accessed atomically
+	used          uint64 // used memory, accessed atomically
+	maxMemory     uint64 // memory budget, accessed atomically
+	evicted       uint64 // number of evicted bitmaps, accessed atomically
+	expired       uint64 // number of expired bitmaps, accessed atomically
+	count         int64  // number of bitmaps, accessed atomically
+	policy        atomic.Value
+	quota         atomic.Value
+	tier          *coldTier // nil if cold bitmaps are not spilled to disk
+	shards        [bitmapShards]bitmapShard
+	fieldsMu      sync.RWMutex
+	fields        map[string]*BSI // bit-sliced indexes, see bsi.go
+	seriesMu      sync.RWMutex
+	series        map[string]SeriesConfig // configs of series, see series.go
+	dictMu        sync.RWMutex
+	dict          *Dictionary // ids of string keys, see dict.go
+	filtersMu     sync.RWMutex
+	filters       map[string]*filter // Bloom and Cuckoo filters, see filter.go
+	writeCallback func(op operation) error
+	isLeader      func() bool // whether this node is the raft leader, nil if there is no cluster
+}
+
+// bitmapShard is a partition of the name map.
+type bitmapShard struct {
+	mu        sync.RWMutex
+	bitmaps   map[string]*Bitmap
+	hlls      map[string]*hyperLogLog // HyperLogLogs, see hll.go
+	deadlines map[string]uint32       // deadlines of bitmaps and HyperLogLogs with a TTL in unix seconds
 }
 
 // NewBitmaps creates a Bitmaps.
 func NewBitmaps() *Bitmaps {
-	return &Bitmaps{
-		bitmaps: make(map[string]*Bitmap),
+	bs := &Bitmaps{
+		fields:  make(map[string]*BSI),
+		series:  make(map[string]SeriesConfig),
+		dict:    NewDictionary(),
+		filters: make(map[string]*filter),
+	}
+	for i := range bs.shards {
+		bs.shards[i].bitmaps = make(map[string]*Bitmap)
+		bs.shards[i].hlls = make(map[string]*hyperLogLog)
+		bs.shards[i].deadlines = make(map[string]uint32)
+	}
+	return bs
+}
+
+// shardIndex returns the index of the shard of the name by its FNV-1a hash.
+func shardIndex(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h & (bitmapShards - 1))
+}
+
+func (bs *Bitmaps) shard(name string) *bitmapShard {
+	return &bs.shards[shardIndex(name)]
+}
+
+// get returns the named bitmap, which is nil if it doesn't exist.
+func (bs *Bitmaps) get(name string) *Bitmap {
+	shard := bs.shard(name)
+	shard.mu.RLock()
+	bm := shard.bitmaps[name]
+	shard.mu.RUnlock()
+	if bm != nil {
+		bm.touch()
+	}
+	return bm
+}
+
+// lockAll locks all shards for writing.
+func (bs *Bitmaps) lockAll() {
+	for i := range bs.shards {
+		bs.shards[i].mu.Lock()
+	}
+}
+
+func (bs *Bitmaps) unlockAll() {
+	for i := range bs.shards {
+		bs.shards[i].mu.Unlock()
+	}
+}
+
+// rlockAll locks all shards for reading.
+func (bs *Bitmaps) rlockAll() {
+	for i := range bs.shards {
+		bs.shards[i].mu.RLock()
+	}
+}
+
+func (bs *Bitmaps) runlockAll() {
+	for i := range bs.shards {
+		bs.shards[i].mu.RUnlock()
 	}
 }
 
 // Bitmap is the goroutine-safe bitmap.
 type Bitmap struct {
-	mu     sync.RWMutex
-	bitmap *roaring.Bitmap
+	access  int64 // last access time in unix nanoseconds, accessed atomically
+	mu      sync.RWMutex
+	bitmap  *roaring.Bitmap
+	sum     uint64 // checksum of values
+	size    uint64 // serialized size of bitmap, estimated after changes
+	changes int    // number of changed values since size is computed
+	dropped bool   // removed from bitmaps, so it's not in the state hash and used memory
+	file    string // file of the spilled bitmap, bitmap is nil until it's loaded
 }
 
-// Add adds a value.
-func (bs *Bitmaps) Add(name string, v uint32, callback bool) {
-	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpAdd, fmt.Sprintf("%s,%d", name, v))
-		return
+// newBitmap returns a Bitmap of bm, which is not added to bitmaps yet.
+func newBitmap(bm *roaring.Bitmap) *Bitmap {
+	b := &Bitmap{bitmap: bm, sum: Checksum(bm), size: bm.GetSerializedSizeInBytes()}
+	b.touch()
+	return b
+}
+
+// clone returns a copy-on-write clone of bm, bm.mu must be held for writing
+// because cloning marks the shared containers of both bitmaps. Later writes
+// to bm copy the containers they change, so the clone is never changed.
+func (bm *Bitmap) clone() *roaring.Bitmap {
+	bm.bitmap.SetCopyOnWrite(true)
+	return bm.bitmap.Clone()
+}
+
+// bitmap returns the named bitmap, which is created if it doesn't exist.
+func (bs *Bitmaps) bitmap(name string) *Bitmap {
+	if bm := bs.get(name); bm != nil {
+		return bm
 	}
 
-	bs.mu.Lock()
-	bm := bs.bitmaps[name]
+	shard := bs.shard(name)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	bm := shard.bitmaps[name]
 	if bm == nil {
-		bm = &Bitmap{
-			bitmap: roaring.NewBitmap(),
-		}
-		bs.bitmaps[name] = bm
+		bm = newBitmap(roaring.NewBitmap())
+		shard.bitmaps[name] = bm
+		atomic.AddInt64(&bs.count, 1)
+		atomic.AddUint64(&bs.hash, StateHashOf(name, 0))
+		atomic.AddUint64(&bs.used, uint64(len(name))+bm.size)
 	}
-	bs.mu.Unlock()
+	return bm
+}
+
+// setChecksum updates the checksum of bm and the state hash, bm.mu must be held.
+func (bs *Bitmaps) setChecksum(name string, bm *Bitmap, sum uint64) {
+	if !bm.dropped {
+		atomic.AddUint64(&bs.hash, StateHashOf(name, sum)-StateHashOf(name, bm.sum))
+	}
+	bm.sum = sum
+}
 
+// drop removes bm from the state hash and used memory, and removes its
+// deadline and file if it's spilled. The lock of its shard must be held.
+func (bs *Bitmaps) drop(name string, bm *Bitmap) {
 	bm.mu.Lock()
-	bm.bitmap.Add(v)
+	if !bm.dropped {
+		bm.dropped = true
+		atomic.AddInt64(&bs.count, -1)
+		atomic.AddUint64(&bs.hash, -StateHashOf(name, bm.sum))
+		size := bm.size
+		if bm.bitmap == nil {
+			size = 0
+			bs.discard(bm)
+		}
+		atomic.AddUint64(&bs.used, -(uint64(len(name)) + size))
+	}
 	bm.mu.Unlock()
+	delete(bs.shard(name).deadlines, name)
+}
+
+// store replaces the named bitmap or HyperLogLog with bm, which has no TTL.
+func (bs *Bitmaps) store(name string, bm *roaring.Bitmap) {
+	b := newBitmap(bm)
+
+	shard := bs.shard(name)
+	shard.mu.Lock()
+	if old := shard.bitmaps[name]; old != nil {
+		bs.drop(name, old)
+	}
+	if old := shard.hlls[name]; old != nil {
+		bs.dropHLL(name, old)
+		delete(shard.hlls, name)
+	}
+	shard.bitmaps[name] = b
+	atomic.AddInt64(&bs.count, 1)
+	atomic.AddUint64(&bs.hash, StateHashOf(name, b.sum))
+	atomic.AddUint64(&bs.used, uint64(len(name))+b.size)
+	shard.mu.Unlock()
 }
 
-// AddMany adds multiple values.
-func (bs *Bitmaps) AddMany(name string, v []uint32, callback bool) {
+// storeBitmap replaces the named bitmap like store. The result is proposed
+// in the roaring format, so replicas store the same bitmap.
+func (bs *Bitmaps) storeBitmap(name string, bm *roaring.Bitmap, callback bool) error {
 	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpAddMany, fmt.Sprintf("%s,%d", name, ints2str(v)))
-		return
+		data, err := bm.ToBytes()
+		if err != nil {
+			return err
+		}
+		return bs.writeCallback(operation{OP: BmOpStore, Name: name, Config: data})
 	}
 
-	bs.mu.Lock()
-	bm := bs.bitmaps[name]
+	bs.store(name, bm)
+	return nil
+}
+
+// Hash returns the state hash of all bitmaps, which is maintained on every
+// change so it's cheap to get. Replicas with the same bitmaps have the same hash.
+func (bs *Bitmaps) Hash() uint64 {
+	return atomic.LoadUint64(&bs.hash)
+}
+
+// Checksum returns the checksum of values of the named bitmap.
+func (bs *Bitmaps) Checksum(name string) uint64 {
+	bm := bs.get(name)
 	if bm == nil {
-		bm = &Bitmap{
-			bitmap: roaring.NewBitmap(),
+		return 0
+	}
+
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.sum
+}
+
+// Add adds a value. It returns ErrOOM if the used memory exceeds the budget
+// and no bitmaps can be evicted, or ErrQuotaExceeded if the bitmap can't be
+// created because of the quota.
+func (bs *Bitmaps) Add(name string, v uint32, callback bool) error {
+	if callback {
+		if err := bs.reserve(name); err != nil {
+			return err
 		}
-		bs.bitmaps[name] = bm
 	}
-	bs.mu.Unlock()
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpAdd, Name: name, Values: []uint32{v}})
+	}
 
-	bm.mu.Lock()
-	bm.bitmap.AddMany(v)
+	bm := bs.bitmap(name)
+
+	if err := bs.lockBitmap(bm); err != nil {
+		return err
+	}
+	if bm.bitmap.CheckedAdd(v) {
+		bs.setChecksum(name, bm, bm.sum+valueHash(v))
+		bs.resize(bm, 1)
+	}
 	bm.mu.Unlock()
+
+	return nil
 }
 
-// Remove removes a value.
-func (bs *Bitmaps) Remove(name string, v uint32, callback bool) {
+// AddMany adds multiple values. It returns errors like Add.
+func (bs *Bitmaps) AddMany(name string, v []uint32, callback bool) error {
+	if callback {
+		if err := bs.reserve(name); err != nil {
+			return err
+		}
+	}
 	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpRemove, fmt.Sprintf("%s,%d", name, v))
-		return
+		return bs.writeCallback(operation{OP: BmOpAddMany, Name: name, Values: v})
 	}
 
-	bs.mu.Lock()
-	bm := bs.bitmaps[name]
-	if bm == nil {
-		bm = &Bitmap{
-			bitmap: roaring.NewBitmap(),
+	bm := bs.bitmap(name)
+
+	if err := bs.lockBitmap(bm); err != nil {
+		return err
+	}
+	sum := bm.sum
+	added := 0
+	for _, x := range v {
+		if bm.bitmap.CheckedAdd(x) {
+			sum += valueHash(x)
+			added++
 		}
-		bs.bitmaps[name] = bm
 	}
-	bs.mu.Unlock()
+	bs.setChecksum(name, bm, sum)
+	bs.resize(bm, added)
+	bm.mu.Unlock()
 
-	bm.mu.Lock()
-	bm.bitmap.Remove(v)
+	return nil
+}
+
+// Remove removes a value.
+func (bs *Bitmaps) Remove(name string, v uint32, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpRemove, Name: name, Values: []uint32{v}})
+	}
+
+	bm := bs.bitmap(name)
+
+	if err := bs.lockBitmap(bm); err != nil {
+		return err
+	}
+	if bm.bitmap.CheckedRemove(v) {
+		bs.setChecksum(name, bm, bm.sum-valueHash(v))
+		bs.resize(bm, -1)
+	}
 	bm.mu.Unlock()
+
+	return nil
 }
 
-// RemoveBitmap removes a bitmap.
-func (bs *Bitmaps) RemoveBitmap(name string, callback bool) {
+// RemoveBitmap removes a bitmap, or a HyperLogLog of the name.
+func (bs *Bitmaps) RemoveBitmap(name string, callback bool) error {
 	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpDrop, name)
-		return
+		return bs.writeCallback(operation{OP: BmOpDrop, Name: name})
 	}
 
-	bs.mu.Lock()
-	delete(bs.bitmaps, name)
-	bs.mu.Unlock()
+	shard := bs.shard(name)
+	shard.mu.Lock()
+	if bm := shard.bitmaps[name]; bm != nil {
+		bs.drop(name, bm)
+		delete(shard.bitmaps, name)
+	}
+	if h := shard.hlls[name]; h != nil {
+		bs.dropHLL(name, h)
+		delete(shard.hlls, name)
+	}
+	shard.mu.Unlock()
+
+	return nil
 }
 
 // ClearBitmap clear a bitmap.
-func (bs *Bitmaps) ClearBitmap(name string, callback bool) {
+func (bs *Bitmaps) ClearBitmap(name string, callback bool) error {
 	if bs.writeCallback != nil && callback {
-		bs.writeCallback(BmOpClear, name)
-		return
+		return bs.writeCallback(operation{OP: BmOpClear, Name: name})
 	}
 
-	bs.mu.RLock()
-	bm := bs.bitmaps[name]
+	bm := bs.get(name)
 	if bm == nil {
-		bs.mu.RUnlock()
-		return
+		return nil
+	}
+
+	if err := bs.lockBitmap(bm); err != nil {
+		return err
 	}
-	bs.mu.RUnlock()
 	bm.bitmap.Clear()
+	bs.setChecksum(name, bm, 0)
+	bm.changes = 0
+	bs.setSize(bm, bm.bitmap.GetSerializedSizeInBytes())
+	bm.mu.Unlock()
+
+	return nil
 }
 
 // Exists checks whether a value exists.
 func (bs *Bitmaps) Exists(name string, v uint32) bool {
-	bs.mu.RLock()
-	bm := bs.bitmaps[name]
+	bm := bs.get(name)
 	if bm == nil {
-		bs.mu.RUnlock()
 		return false
 	}
-	bs.mu.RUnlock()
 
-	bm.mu.RLock()
+	if bs.rlockBitmap(bm) != nil {
+		return false
+	}
 	existed := bm.bitmap.Contains(v)
 	bm.mu.RUnlock()
 
@@ -155,21 +450,42 @@ func (bs *Bitmaps) Exists(name string, v uint32) bool {
 
 // Card returns the number of integers contained in the bitmap.
 func (bs *Bitmaps) Card(name string) uint64 {
-	bs.mu.RLock()
-	bm := bs.bitmaps[name]
+	bm := bs.get(name)
 	if bm == nil {
-		bs.mu.RUnlock()
 		return 0
 	}
-	bs.mu.RUnlock()
 
-	bm.mu.RLock()
+	if bs.rlockBitmap(bm) != nil {
+		return 0
+	}
 	num := bm.bitmap.GetCardinality()
 	bm.mu.RUnlock()
 
 	return num
 }
 
+// Scan returns up to count values of the bitmap which are not less than
+// cursor in ascending order, so a bitmap can be iterated by pages.
+func (bs *Bitmaps) Scan(name string, cursor uint32, count int) []uint32 {
+	bm := bs.get(name)
+	if bm == nil {
+		return nil
+	}
+
+	if bs.rlockBitmap(bm) != nil {
+		return nil
+	}
+	defer bm.mu.RUnlock()
+
+	var values []uint32
+	it := bm.bitmap.Iterator()
+	it.AdvanceIfNeeded(cursor)
+	for len(values) < count && it.HasNext() {
+		values = append(values, it.Next())
+	}
+	return values
+}
+
 type Stats struct {
 	Cardinality uint64
 	Containers  uint64
@@ -189,35 +505,74 @@ type Stats struct {
 
 // Stats gets the stats of named bitmap.
 func (bs *Bitmaps) Stats(name string) Stats {
-	bs.mu.RLock()
-	bm := bs.bitmaps[name]
+	bm := bs.get(name)
 	if bm == nil {
-		bs.mu.RUnlock()
 		return Stats{}
 	}
-	bs.mu.RUnlock()
 
-	bm.mu.RLock()
+	if bs.rlockBitmap(bm) != nil {
+		return Stats{}
+	}
 	stats := bm.bitmap.Stats()
 	bm.mu.RUnlock()
 
 	return Stats(stats)
 }
 
-func (bs *Bitmaps) intersection(names ...string) *roaring.Bitmap {
-	var bms []*roaring.Bitmap
-
-	bs.mu.RLock()
+// snapshot returns clones of the named bitmaps taken at the same point in
+// time, which are nil if they don't exist. All bitmaps are locked while they
+// are cloned, so set operations computed on the clones see a consistent view
+// of their operands, and writes only wait for the containers to be cloned
+// instead of the whole operation. Spilled bitmaps which can't be loaded are
+// nil like missing ones.
+func (bs *Bitmaps) snapshot(names ...string) []*roaring.Bitmap {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	var shards [bitmapShards]bool
 	for _, name := range names {
-		bm := bs.bitmaps[name]
+		shards[shardIndex(name)] = true
+	}
+	for i := range bs.shards {
+		if shards[i] {
+			bs.shards[i].mu.RLock()
+			defer bs.shards[i].mu.RUnlock()
+		}
+	}
+
+	var locked []*Bitmap
+	clones := make(map[*Bitmap]*roaring.Bitmap, len(sorted))
+	for i, name := range sorted {
+		if i > 0 && name == sorted[i-1] {
+			continue
+		}
+		if bm := bs.shard(name).bitmaps[name]; bm != nil && bs.lockBitmap(bm) == nil {
+			locked = append(locked, bm)
+			clones[bm] = bm.clone()
+			bm.touch()
+		}
+	}
+
+	bms := make([]*roaring.Bitmap, len(names))
+	for i, name := range names {
+		if bm := bs.shard(name).bitmaps[name]; bm != nil {
+			bms[i] = clones[bm]
+		}
+	}
+
+	for _, bm := range locked {
+		bm.mu.Unlock()
+	}
+	return bms
+}
+
+func (bs *Bitmaps) intersection(names ...string) *roaring.Bitmap {
+	bms := bs.snapshot(names...)
+	for _, bm := range bms {
 		if bm == nil {
-			bs.mu.RUnlock()
 			return nil
 		}
-		bms = append(bms, bm.bitmap)
-
 	}
-	bs.mu.RUnlock()
 
 	return roaring.ParAnd(0, bms...)
 }
@@ -232,32 +587,46 @@ func (bs *Bitmaps) Inter(names ...string) []uint32 {
 }
 
 // InterStore computes the intersection (AND) of all provided bitmaps and save to destination.
-func (bs *Bitmaps) InterStore(destination string, names ...string) uint64 {
-	bm := bs.intersection(names...)
-	if bm == nil {
-		return 0
-	}
+// It returns errors like Add.
+func (bs *Bitmaps) InterStore(destination string, names []string, callback bool) (uint64, error) {
+	return bs.storeResult(destination, callback, func() *roaring.Bitmap {
+		return bs.intersection(names...)
+	})
+}
 
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
+// storeResult saves the result of a set operation computed by op to
+// destination and returns its cardinality, nothing is saved if op returns nil.
+// The destination is reserved first like the bitmap written by Add.
+func (bs *Bitmaps) storeResult(destination string, callback bool, op func() *roaring.Bitmap) (uint64, error) {
+	if callback {
+		if err := bs.reserve(destination); err != nil {
+			return 0, err
+		}
+	}
 
-	return bm.GetCardinality()
+	bm := op()
+	if bm == nil {
+		return 0, nil
+	}
+	if err := bs.storeBitmap(destination, bm, callback); err != nil {
+		return 0, err
+	}
+	return bm.GetCardinality(), nil
 }
 
-func (bs *Bitmaps) union(names ...string) *roaring.Bitmap {
+// existing returns the snapshot of the named bitmaps which exist.
+func (bs *Bitmaps) existing(names ...string) []*roaring.Bitmap {
 	var bms []*roaring.Bitmap
-
-	bs.mu.RLock()
-	for _, name := range names {
-		bm := bs.bitmaps[name]
+	for _, bm := range bs.snapshot(names...) {
 		if bm != nil {
-			bms = append(bms, bm.bitmap)
+			bms = append(bms, bm)
 		}
 	}
-	bs.mu.RUnlock()
+	return bms
+}
 
-	return roaring.ParHeapOr(0, bms...)
+func (bs *Bitmaps) union(names ...string) *roaring.Bitmap {
+	return roaring.ParHeapOr(0, bs.existing(names...)...)
 }
 
 // Union computes the union (OR) of all provided bitmaps.
@@ -267,190 +636,767 @@ func (bs *Bitmaps) Union(names ...string) []uint32 {
 }
 
 // UnionStore computes the union (OR) of all provided bitmaps and store to destination.
-func (bs *Bitmaps) UnionStore(destination string, names ...string) uint64 {
-	bm := bs.union(names...)
-
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
-
-	return bm.GetCardinality()
+// It returns errors like Add.
+func (bs *Bitmaps) UnionStore(destination string, names []string, callback bool) (uint64, error) {
+	return bs.storeResult(destination, callback, func() *roaring.Bitmap {
+		return bs.union(names...)
+	})
 }
 
-func (bs *Bitmaps) xor(name1, name2 string) *roaring.Bitmap {
-	var rbm1, rbm2 *roaring.Bitmap
+// pair returns the snapshot of the named bitmaps, which are empty if they
+// don't exist.
+func (bs *Bitmaps) pair(name1, name2 string) (*roaring.Bitmap, *roaring.Bitmap) {
+	bms := bs.operands(name1, name2)
+	return bms[0], bms[1]
+}
 
-	bs.mu.RLock()
-	bm1 := bs.bitmaps[name1]
-	if bm1 == nil {
-		rbm1 = roaring.NewBitmap()
-	} else {
-		rbm1 = bm1.bitmap
+// operands returns the snapshot of the named bitmaps, which are empty if
+// they don't exist.
+func (bs *Bitmaps) operands(names ...string) []*roaring.Bitmap {
+	bms := bs.snapshot(names...)
+	for i, bm := range bms {
+		if bm == nil {
+			bms[i] = roaring.NewBitmap()
+		}
 	}
-	bm2 := bs.bitmaps[name2]
-	if bm2 == nil {
-		rbm2 = roaring.NewBitmap()
-	} else {
-		rbm2 = bm2.bitmap
+	return bms
+}
+
+func (bs *Bitmaps) xor(names ...string) *roaring.Bitmap {
+	bms := bs.operands(names...)
+	switch len(bms) {
+	case 1:
+		return bms[0]
+	case 2:
+		return roaring.Xor(bms[0], bms[1])
 	}
-	bs.mu.RUnlock()
+	return roaring.HeapXor(bms...)
+}
 
-	return roaring.Xor(rbm1, rbm2)
+// Xor computes the symmetric difference of all provided bitmaps, the values
+// contained in an odd number of them, and returns the result.
+func (bs *Bitmaps) Xor(names ...string) []uint32 {
+	bm := bs.xor(names...)
+	return bm.ToArray()
+}
+
+// XorStore computes the symmetric difference of all provided bitmaps and save the result to destination.
+// It returns errors like Add.
+func (bs *Bitmaps) XorStore(destination string, names []string, callback bool) (uint64, error) {
+	return bs.storeResult(destination, callback, func() *roaring.Bitmap {
+		return bs.xor(names...)
+	})
+}
+
+func (bs *Bitmaps) diff(names ...string) *roaring.Bitmap {
+	bms := bs.operands(names...)
+	switch len(bms) {
+	case 0:
+		return roaring.NewBitmap()
+	case 1:
+		return bms[0]
+	case 2:
+		return roaring.AndNot(bms[0], bms[1])
+	}
+	return roaring.AndNot(bms[0], roaring.FastOr(bms[1:]...))
 }
 
-// Xor computes the symmetric difference between two bitmaps and returns the result
-func (bs *Bitmaps) Xor(name1, name2 string) []uint32 {
-	bm := bs.xor(name1, name2)
+// Diff computes the difference between the first bitmap and the others, the
+// values contained in the first but none of the others, and returns the result.
+func (bs *Bitmaps) Diff(names ...string) []uint32 {
+	bm := bs.diff(names...)
 	return bm.ToArray()
 }
 
-// XorStore computes the symmetric difference between two bitmaps and save the result to destination.
-func (bs *Bitmaps) XorStore(destination, name1, name2 string) uint64 {
-	bm := bs.xor(name1, name2)
+// DiffStore computes the difference between the first bitmap and the others and save the result to destination.
+// It returns errors like Add.
+func (bs *Bitmaps) DiffStore(destination string, names []string, callback bool) (uint64, error) {
+	return bs.storeResult(destination, callback, func() *roaring.Bitmap {
+		return bs.diff(names...)
+	})
+}
+
+// InterBitmap computes the intersection (AND) of all provided bitmaps and
+// returns the result as a bitmap, which is empty if any bitmap doesn't exist.
+func (bs *Bitmaps) InterBitmap(names ...string) *roaring.Bitmap {
+	bm := bs.intersection(names...)
+	if bm == nil {
+		return roaring.NewBitmap()
+	}
+	return bm
+}
 
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
+// UnionBitmap computes the union (OR) of all provided bitmaps and returns the result as a bitmap.
+func (bs *Bitmaps) UnionBitmap(names ...string) *roaring.Bitmap {
+	return bs.union(names...)
+}
 
-	return bm.GetCardinality()
+// XorBitmap computes the symmetric difference of all provided bitmaps and returns the result as a bitmap.
+func (bs *Bitmaps) XorBitmap(names ...string) *roaring.Bitmap {
+	return bs.xor(names...)
 }
 
-func (bs *Bitmaps) diff(name1, name2 string) *roaring.Bitmap {
-	var rbm1, rbm2 *roaring.Bitmap
+// DiffBitmap computes the difference between the first bitmap and the others and returns the result as a bitmap.
+func (bs *Bitmaps) DiffBitmap(names ...string) *roaring.Bitmap {
+	return bs.diff(names...)
+}
 
-	bs.mu.RLock()
-	bm1 := bs.bitmaps[name1]
-	if bm1 == nil {
-		rbm1 = roaring.NewBitmap()
-	} else {
-		rbm1 = bm1.bitmap
+// InterCard computes the cardinality of the intersection (AND) of all
+// provided bitmaps. The intersection is not materialized for two bitmaps.
+// For more, the smaller ones are intersected in place from the smallest one
+// until the result is empty, and the last step is only counted.
+func (bs *Bitmaps) InterCard(names ...string) uint64 {
+	bms := bs.snapshot(names...)
+	for _, bm := range bms {
+		if bm == nil {
+			return 0
+		}
 	}
-	bm2 := bs.bitmaps[name2]
-	if bm2 == nil {
-		rbm2 = roaring.NewBitmap()
-	} else {
-		rbm2 = bm2.bitmap
+
+	switch len(bms) {
+	case 0:
+		return 0
+	case 1:
+		return bms[0].GetCardinality()
+	case 2:
+		return bms[0].AndCardinality(bms[1])
+	}
+	sort.Slice(bms, func(i, j int) bool { return bms[i].GetCardinality() < bms[j].GetCardinality() })
+	last := len(bms) - 1
+	acc := roaring.And(bms[0], bms[1])
+	for _, bm := range bms[2:last] {
+		if acc.IsEmpty() {
+			return 0
+		}
+		acc.And(bm)
 	}
-	bs.mu.RUnlock()
+	return acc.AndCardinality(bms[last])
+}
+
+// UnionCard computes the cardinality of the union (OR) of all provided
+// bitmaps. The union is not materialized for two bitmaps. For more, only the
+// union of all but the last one is, which the count of a union can't avoid.
+func (bs *Bitmaps) UnionCard(names ...string) uint64 {
+	bms := bs.existing(names...)
 
-	return roaring.AndNot(rbm1, rbm2)
+	switch len(bms) {
+	case 0:
+		return 0
+	case 1:
+		return bms[0].GetCardinality()
+	case 2:
+		return bms[0].OrCardinality(bms[1])
+	}
+	last := len(bms) - 1
+	return roaring.ParHeapOr(0, bms[:last]...).OrCardinality(bms[last])
 }
 
-// Diff computes the difference between two bitmaps and returns the result.
-func (bs *Bitmaps) Diff(name1, name2 string) []uint32 {
-	bm := bs.diff(name1, name2)
-	return bm.ToArray()
+// XorCard computes the cardinality of the symmetric difference of all
+// provided bitmaps. The result is not materialized for two bitmaps, and only
+// that of the others for more.
+func (bs *Bitmaps) XorCard(names ...string) uint64 {
+	bms := bs.operands(names...)
+	switch len(bms) {
+	case 0:
+		return 0
+	case 1:
+		return bms[0].GetCardinality()
+	}
+	last := len(bms) - 1
+	bm1, bm2 := bms[0], bms[last]
+	if last > 1 {
+		bm1 = roaring.HeapXor(bms[:last]...)
+	}
+	return bm1.GetCardinality() + bm2.GetCardinality() - 2*bm1.AndCardinality(bm2)
 }
 
-// DiffStore computes the difference between two bitmaps and save the result to destination.
-func (bs *Bitmaps) DiffStore(destination, name1, name2 string) uint64 {
-	bm := bs.diff(name1, name2)
+// DiffCard computes the cardinality of the difference between the first
+// bitmap and the others. The result is not materialized for two bitmaps.
+// For more, the others but the last one are removed in place from a copy of
+// the first one until it is empty, and the last step is only counted.
+func (bs *Bitmaps) DiffCard(names ...string) uint64 {
+	bms := bs.operands(names...)
+	switch len(bms) {
+	case 0:
+		return 0
+	case 1:
+		return bms[0].GetCardinality()
+	}
+	last := len(bms) - 1
+	acc := bms[0]
+	if last > 1 {
+		acc = roaring.AndNot(bms[0], bms[1])
+		for _, bm := range bms[2:last] {
+			if acc.IsEmpty() {
+				return 0
+			}
+			acc.AndNot(bm)
+		}
+	}
+	return acc.GetCardinality() - acc.AndCardinality(bms[last])
+}
 
-	bs.mu.Lock()
-	bs.bitmaps[destination] = &Bitmap{bitmap: bm}
-	bs.mu.Unlock()
+// Jaccard computes the Jaccard index of two bitmaps, the cardinality of their
+// intersection divided by that of their union. It is 0 if both are empty.
+func (bs *Bitmaps) Jaccard(name1, name2 string) float64 {
+	bm1, bm2 := bs.pair(name1, name2)
+	and := bm1.AndCardinality(bm2)
+	or := bm1.GetCardinality() + bm2.GetCardinality() - and
+	if or == 0 {
+		return 0
+	}
+	return float64(and) / float64(or)
+}
 
-	return bm.GetCardinality()
+// Names returns names of all bitmaps.
+func (bs *Bitmaps) Names() []string {
+	var names []string
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		shard.mu.RLock()
+		for name := range shard.bitmaps {
+			names = append(names, name)
+		}
+		shard.mu.RUnlock()
+	}
+	return names
 }
 
 // Save saves bitmaps to the io.Writer.
 func (bs *Bitmaps) Save(w io.Writer) error {
-	var keys []string
-	bs.mu.RLock()
-	for k := range bs.bitmaps {
-		keys = append(keys, k)
+	_, err := bs.Snapshot().WriteTo(w)
+	return err
+}
+
+// BitmapsSnapshot is a point-in-time copy of bitmaps.
+type BitmapsSnapshot struct {
+	names        []string
+	bitmaps      []*roaring.Bitmap
+	deadlines    []uint32
+	fieldNames   []string
+	fields       []*BSI
+	seriesNames  []string
+	series       []SeriesConfig
+	keys         []string // keys of the dictionary by id
+	hllNames     []string
+	hlls         [][]byte // registers of HyperLogLogs
+	hllDeadlines []uint32
+	filterNames  []string
+	filters      []*filter
+	err          error // error of reading spilled bitmaps
+}
+
+// Snapshot takes a point-in-time copy of all bitmaps. Bitmaps are cloned
+// copy-on-write, so the snapshot shares containers with the live bitmaps
+// until they are modified and taking it is cheap even for big datasets.
+func (bs *Bitmaps) Snapshot() *BitmapsSnapshot {
+	// no bitmaps are created or removed while the snapshot is taken
+	bs.rlockAll()
+	defer bs.runlockAll()
+
+	return bs.snapshotLocked()
+}
+
+// snapshotLocked takes a snapshot of all bitmaps, all shards must be locked.
+func (bs *Bitmaps) snapshotLocked() *BitmapsSnapshot {
+	snapshot := &BitmapsSnapshot{}
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		for name, bm := range shard.bitmaps {
+			snapshot.add(name, bm, shard.deadlines[name])
+		}
 	}
-	bs.mu.RUnlock()
+	bs.snapshotHLLs(snapshot)
+	bs.snapshotFields(snapshot)
+	bs.snapshotSeries(snapshot)
+	bs.snapshotFilters(snapshot)
+	snapshot.keys = bs.dictionary().snapshot()
 
-	for _, k := range keys {
-		bs.mu.RLock()
-		bm := bs.bitmaps[k]
-		bs.mu.RUnlock()
-		if bm != nil {
-			if err := bs.saveBitmap(w, k, bm.bitmap); err != nil {
-				return err
+	return snapshot
+}
+
+// SnapshotOf takes a point-in-time copy of the named bitmaps,
+// bitmaps not found are skipped.
+func (bs *Bitmaps) SnapshotOf(names ...string) *BitmapsSnapshot {
+	snapshot := &BitmapsSnapshot{}
+	for _, name := range names {
+		shard := bs.shard(name)
+		shard.mu.RLock()
+		if bm := shard.bitmaps[name]; bm != nil {
+			snapshot.add(name, bm, shard.deadlines[name])
+		}
+		shard.mu.RUnlock()
+	}
+
+	return snapshot
+}
+
+// add adds a clone of bm to the snapshot. A spilled bitmap is read from its
+// file without loading it into bitmaps.
+func (s *BitmapsSnapshot) add(name string, bm *Bitmap, deadline uint32) {
+	var clone *roaring.Bitmap
+	var err error
+	bm.mu.Lock()
+	if bm.bitmap != nil {
+		clone = bm.clone()
+	} else {
+		clone, err = readColdFile(bm.file)
+	}
+	bm.mu.Unlock()
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	s.names = append(s.names, name)
+	s.bitmaps = append(s.bitmaps, clone)
+	s.deadlines = append(s.deadlines, deadline)
+}
+
+// WriteTo writes the bitmaps one by one to w, a bitmap with a TTL is
+// preceded by its expiry record. HyperLogLogs, which are preceded by their
+// expiry records too, fields, series, filters and the dictionary are written
+// after bitmaps.
+func (s *BitmapsSnapshot) WriteTo(w io.Writer) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	var total int64
+	for i, name := range s.names {
+		if s.deadlines[i] != 0 {
+			n, err := writeExpiry(w, name, s.deadlines[i])
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+
+		n, err := writeBitmap(w, name, s.bitmaps[i])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	for i, name := range s.hllNames {
+		if s.hllDeadlines[i] != 0 {
+			n, err := writeExpiry(w, name, s.hllDeadlines[i])
+			total += n
+			if err != nil {
+				return total, err
 			}
 		}
+
+		n, err := writeHLL(w, name, s.hlls[i])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	for i, name := range s.fieldNames {
+		n, err := writeField(w, name, s.fields[i])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	for i, name := range s.seriesNames {
+		n, err := writeSeries(w, name, s.series[i])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	for i, name := range s.filterNames {
+		n, err := writeFilter(w, name, s.filters[i])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	if len(s.keys) > 0 {
+		n, err := writeDictionary(w, s.keys)
+		total += n
+		if err != nil {
+			return total, err
+		}
 	}
 
-	return nil
+	return total, nil
 }
 
-func (bs *Bitmaps) saveBitmap(w io.Writer, name string, bm *roaring.Bitmap) error {
-	if bm == nil {
-		return nil
+// expiryRecord is set in the length of name of an expiry record, which is
+// followed by the name and the deadline of the next bitmap in unix seconds
+// instead of a bitmap. Names are never so long.
+const expiryRecord = 1 << 31
+
+func writeExpiry(w io.Writer, name string, deadline uint32) (int64, error) {
+	buf := make([]byte, 8+len(name))
+	binary.LittleEndian.PutUint32(buf, uint32(len(name))|expiryRecord)
+	copy(buf[4:], name)
+	binary.LittleEndian.PutUint32(buf[4+len(name):], deadline)
+	n, err := w.Write(buf)
+	if err != nil {
+		log.Errorf("failed to write expiry of %s: %v", name, err)
 	}
+	return int64(n), err
+}
 
+func writeBitmap(w io.Writer, name string, bm *roaring.Bitmap) (int64, error) {
 	err := binary.Write(w, binary.LittleEndian, uint32(len(name)))
 	if err != nil {
 		log.Errorf("failed to write len of name %s: %v", name, err)
-		return err
+		return 0, err
 	}
 	_, err = w.Write([]byte(name))
 	if err != nil {
 		log.Errorf("failed to write name %s: %v", name, err)
-		return err
+		return 4, err
 	}
 
-	bs.mu.RLock()
-	pBitmap := bm.Clone()
-	bs.mu.RUnlock()
-	_, err = pBitmap.WriteTo(w)
+	n, err := bm.WriteTo(w)
 	if err != nil {
 		log.Errorf("failed to write bitmap %s: %v", name, err)
-		return err
 	}
 
-	return nil
+	return 4 + int64(len(name)) + n, err
 }
 
 // Read restores bitmaps from a io.Reader.
 func (bs *Bitmaps) Read(r io.Reader) error {
 	for {
-		name, bm, err := readBitmap(r)
+		rec, err := readBitmap(r)
 		if err == io.EOF {
 			return nil
 		}
 		if err != nil {
 			return err
 		}
+		bs.read(rec)
+	}
+}
 
-		b := &Bitmap{
-			bitmap: bm,
+// read stores the bitmap, the HyperLogLog, the field, the series, the filter
+// or the dictionary of the record.
+func (bs *Bitmaps) read(rec record) {
+	if rec.filter != nil {
+		bs.storeFilter(rec.name, rec.filter)
+		return
+	}
+	if rec.hll != nil {
+		bs.readHLLRecord(rec)
+		return
+	}
+	if rec.dict != nil {
+		bs.setDictionary(rec.dict)
+		return
+	}
+	if rec.field != nil {
+		bs.storeField(rec.name, rec.field)
+		return
+	}
+	if rec.series != nil {
+		bs.setSeries(rec.name, *rec.series)
+		return
+	}
+
+	bs.store(rec.name, rec.bitmap)
+	if rec.deadline != 0 {
+		bs.Expire(rec.name, time.Unix(int64(rec.deadline), 0), false)
+	}
+}
+
+// Merge moves bitmaps of other with their TTLs into bs, replacing the ones
+// with the same names. Bitmaps can be read into other first, so bs is left
+// unchanged if they are malformed. other must not be used after Merge.
+func (bs *Bitmaps) Merge(other *Bitmaps) {
+	for i := range other.shards {
+		shard := &other.shards[i]
+		shard.mu.Lock()
+		for name, bm := range shard.bitmaps {
+			bs.store(name, bm.bitmap)
+			if deadline := shard.deadlines[name]; deadline != 0 {
+				bs.Expire(name, time.Unix(int64(deadline), 0), false)
+			}
 		}
+		shard.mu.Unlock()
+	}
+}
+
+// Restore replaces all bitmaps with the ones read from r.
+func (bs *Bitmaps) Restore(r io.Reader) error {
+	restored := newRestoredBitmaps()
+	for {
+		rec, err := readBitmap(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		restored.add(rec)
+	}
+
+	bs.lockAll()
+	bs.replace(restored)
+	bs.unlockAll()
+
+	return nil
+}
 
-		bs.mu.Lock()
-		bs.bitmaps[name] = b
-		bs.mu.Unlock()
+// restoredBitmaps is the name map read from a snapshot, which replaces the
+// name map of Bitmaps at once.
+type restoredBitmaps struct {
+	shards     [bitmapShards]bitmapShard
+	fields     map[string]*BSI
+	series     map[string]SeriesConfig
+	dict       *Dictionary
+	filters    map[string]*filter
+	hash, used uint64
+	count      int64
+}
 
+func newRestoredBitmaps() *restoredBitmaps {
+	restored := &restoredBitmaps{
+		fields:  make(map[string]*BSI),
+		series:  make(map[string]SeriesConfig),
+		dict:    NewDictionary(),
+		filters: make(map[string]*filter),
 	}
+	for i := range restored.shards {
+		restored.shards[i].bitmaps = make(map[string]*Bitmap)
+		restored.shards[i].hlls = make(map[string]*hyperLogLog)
+		restored.shards[i].deadlines = make(map[string]uint32)
+	}
+	return restored
 }
 
-func readBitmap(r io.Reader) (name string, bm *roaring.Bitmap, err error) {
+// add adds the bitmap, the HyperLogLog, the field, the series, the filter or
+// the dictionary of the record, which replaces the one of the same name.
+func (rb *restoredBitmaps) add(rec record) {
+	if rec.filter != nil {
+		name := filterHashPrefix + rec.name
+		if old := rb.filters[rec.name]; old != nil {
+			rb.hash -= StateHashOf(name, old.sum)
+		}
+		rb.filters[rec.name] = rec.filter
+		rb.hash += StateHashOf(name, rec.filter.sum)
+		return
+	}
+	if rec.dict != nil {
+		rb.hash += rec.dict.Hash() - rb.dict.Hash()
+		rb.dict = rec.dict
+		return
+	}
+	if rec.series != nil {
+		name := seriesHashPrefix + rec.name
+		if old, ok := rb.series[rec.name]; ok {
+			rb.hash -= StateHashOf(name, old.checksum())
+		}
+		rb.series[rec.name] = *rec.series
+		rb.hash += StateHashOf(name, rec.series.checksum())
+		return
+	}
+	if rec.field != nil {
+		name := fieldHashPrefix + rec.name
+		if old := rb.fields[rec.name]; old != nil {
+			rb.hash -= StateHashOf(name, old.sum)
+		}
+		rb.fields[rec.name] = rec.field
+		rb.hash += StateHashOf(name, rec.field.sum)
+		return
+	}
+
+	name, bm, deadline := rec.name, rec.bitmap, rec.deadline
+	shard := &rb.shards[shardIndex(name)]
+	if old := shard.bitmaps[name]; old != nil {
+		rb.hash -= StateHashOf(name, old.sum)
+		rb.used -= uint64(len(name)) + old.size
+		rb.count--
+		delete(shard.bitmaps, name)
+	}
+	if old := shard.hlls[name]; old != nil {
+		rb.hash -= StateHashOf(name, old.sum)
+		rb.used -= uint64(len(name)) + hllRegisters
+		rb.count--
+		delete(shard.hlls, name)
+	}
+	if rec.hll != nil {
+		shard.hlls[name] = rec.hll
+		rb.hash += StateHashOf(name, rec.hll.sum)
+		rb.used += uint64(len(name)) + hllRegisters
+	} else {
+		b := newBitmap(bm)
+		shard.bitmaps[name] = b
+		rb.hash += StateHashOf(name, b.sum)
+		rb.used += uint64(len(name)) + b.size
+	}
+	rb.count++
+	if deadline != 0 {
+		shard.deadlines[name] = deadline
+	} else {
+		delete(shard.deadlines, name)
+	}
+}
+
+// replace replaces all bitmaps with the restored ones, all shards must be
+// locked for writing.
+func (bs *Bitmaps) replace(restored *restoredBitmaps) {
+	for i := range bs.shards {
+		for name, bm := range bs.shards[i].bitmaps {
+			bs.drop(name, bm)
+		}
+		for name, h := range bs.shards[i].hlls {
+			bs.dropHLL(name, h)
+		}
+		bs.shards[i].bitmaps = restored.shards[i].bitmaps
+		bs.shards[i].hlls = restored.shards[i].hlls
+		bs.shards[i].deadlines = restored.shards[i].deadlines
+	}
+	bs.fieldsMu.Lock()
+	for name, b := range bs.fields {
+		bs.dropField(name, b)
+	}
+	bs.fields = restored.fields
+	bs.fieldsMu.Unlock()
+	bs.seriesMu.Lock()
+	bs.series = restored.series
+	bs.seriesMu.Unlock()
+	bs.dictMu.Lock()
+	bs.dict = restored.dict
+	bs.dictMu.Unlock()
+	bs.filtersMu.Lock()
+	for name, f := range bs.filters {
+		bs.dropFilter(name, f)
+	}
+	bs.filters = restored.filters
+	bs.filtersMu.Unlock()
+	atomic.StoreUint64(&bs.hash, restored.hash)
+	atomic.StoreUint64(&bs.used, restored.used)
+	atomic.StoreInt64(&bs.count, restored.count)
+}
+
+// readBitmap reads the next bitmap or HyperLogLog with its deadline, the next
+// field, series, filter or dictionary, headers of namespaces are not expected.
+func readBitmap(r io.Reader) (record, error) {
+	rec, err := readRecord(r)
+	if err != nil {
+		return record{}, err
+	}
+	if rec.header() {
+		log.Errorf("unexpected header of namespace %s in bitmaps of one namespace", rec.name)
+		return record{}, errUnexpectedNamespace
+	}
+	return rec, nil
+}
+
+// record is a bitmap or a HyperLogLog with its deadline, a field, the config
+// of a series, a filter, the dictionary, or the header of a namespace whose
+// bitmaps follow it.
+type record struct {
+	name     string
+	bitmap   *roaring.Bitmap
+	hll      *hyperLogLog
+	field    *BSI
+	series   *SeriesConfig
+	filter   *filter
+	dict     *Dictionary
+	deadline uint32
+	quota    Quota
+}
+
+// header returns whether the record is the header of a namespace.
+func (rec *record) header() bool {
+	return rec.bitmap == nil && rec.hll == nil && rec.field == nil && rec.series == nil && rec.filter == nil && rec.dict == nil
+}
+
+// readRecord reads the next bitmap or HyperLogLog with the expiry record
+// before it, a field, a series, a filter, the dictionary, or the header of a
+// namespace.
+func readRecord(r io.Reader) (rec record, err error) {
 	var l uint32
 	err = binary.Read(r, binary.LittleEndian, &l)
 	if err != nil {
 		if err == io.EOF {
-			return "", nil, err
+			return rec, err
 		}
 		log.Errorf("failed to read len of name: %v", err)
-		return "", nil, err
+		return rec, err
 	}
 
-	var data = make([]byte, int(l))
+	var data = make([]byte, int(l&^(expiryRecord|namespaceRecord|bsiRecord|seriesRecord|dictRecord|hllRecord|filterRecord)))
 	_, err = io.ReadFull(r, data)
 	if err != nil {
 		log.Errorf("failed to read name: %v", err)
-		return "", nil, err
+		return rec, err
+	}
+	rec.name = string(data)
+
+	switch {
+	case l&namespaceRecord != 0:
+		if rec.quota, err = readQuota(r); err != nil {
+			log.Errorf("failed to read header of namespace %s: %v", rec.name, err)
+			return record{}, err
+		}
+		return rec, nil
+	case l&bsiRecord != 0:
+		if rec.field, err = readField(r); err != nil {
+			log.Errorf("failed to read field %s: %v", rec.name, err)
+			return record{}, errInvalidField
+		}
+		return rec, nil
+	case l&filterRecord != 0:
+		if rec.filter, err = readFilter(r); err != nil {
+			log.Errorf("failed to read filter %s: %v", rec.name, err)
+			return record{}, errInvalidFilterRecord
+		}
+		return rec, nil
+	case l&hllRecord != 0:
+		if rec.hll, err = readHLL(r); err != nil {
+			log.Errorf("failed to read hyperloglog %s: %v", rec.name, err)
+			return record{}, errInvalidHLL
+		}
+		return rec, nil
+	case l&dictRecord != 0:
+		if rec.dict, err = readDictionary(r); err != nil {
+			log.Errorf("failed to read dictionary: %v", err)
+			return record{}, errInvalidDictionary
+		}
+		return rec, nil
+	case l&seriesRecord != 0:
+		c, err := readSeriesConfig(r)
+		if err != nil {
+			log.Errorf("failed to read series %s: %v", rec.name, err)
+			return record{}, errInvalidSeries
+		}
+		rec.series = &c
+		return rec, nil
+	case l&expiryRecord != 0:
+		if err = binary.Read(r, binary.LittleEndian, &rec.deadline); err != nil {
+			log.Errorf("failed to read expiry of %s: %v", rec.name, err)
+			return record{}, err
+		}
+		next, err := readBitmap(r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return record{}, err
+		}
+		if next.name != rec.name || (next.bitmap == nil && next.hll == nil) {
+			log.Errorf("expiry of %s is followed by %s", rec.name, next.name)
+			return record{}, errInvalidExpiry
+		}
+		rec.bitmap, rec.hll = next.bitmap, next.hll
+		return rec, nil
 	}
-	name = string(data)
 
-	bm = roaring.NewBitmap()
-	_, err = bm.ReadFrom(r)
+	rec.bitmap = roaring.NewBitmap()
+	_, err = rec.bitmap.ReadFrom(r)
 	if err != nil {
-		log.Errorf("failed to read name %s: %v", name, err)
-		return "", nil, err
+		log.Errorf("failed to read name %s: %v", rec.name, err)
+		return record{}, err
 	}
 
-	return name, bm, nil
+	return rec, nil
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestBitmaps_Persistence(t *testing.T) {
@@ -15,13 +16,13 @@ func TestBitmaps_Persistence(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		v := uint32(rand.Int31())
 		values1 = append(values1, v)
-		bms.Add("test1", v)
+		bms.Add("test1", v, false)
 	}
 	var values2 []uint32
 	for i := 0; i < 100; i++ {
 		v := uint32(rand.Int31())
 		values2 = append(values2, v)
-		bms.Add("test2", v)
+		bms.Add("test2", v, false)
 	}
 
 	err := bms.Save(buf)
@@ -48,3 +49,85 @@ func TestBitmaps_Persistence(t *testing.T) {
 		}
 	}
 }
+
+func TestBitmaps_Snapshot(t *testing.T) {
+	bms := NewBitmaps()
+	for i := 0; i < 100000; i++ {
+		bms.Add("test1", uint32(i), false)
+	}
+	bms.AddMany("test2", []uint32{1, 2, 3}, false)
+
+	snapshot := bms.Snapshot()
+
+	// changes after the snapshot is taken are not in the snapshot.
+	bms.Remove("test1", 1, false)
+	bms.AddMany("test1", []uint32{200000, 200001}, false)
+	bms.RemoveBitmap("test2", false)
+	bms.Add("test3", 1, false)
+
+	var buf = bytes.NewBuffer(nil)
+	if _, err := snapshot.WriteTo(buf); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	restored := NewBitmaps()
+	restored.Add("stale", 1, false)
+	if err := restored.Restore(buf); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+
+	if n := restored.Card("test1"); n != 100000 || !restored.Exists("test1", 1) {
+		t.Fatalf("expect 100000 elements including 1 in test1 but got %d", n)
+	}
+	if n := restored.Card("test2"); n != 3 {
+		t.Fatalf("expect 3 elements in test2 but got %d", n)
+	}
+	if restored.Card("test3") != 0 || restored.Card("stale") != 0 {
+		t.Fatal("expect test3 and stale not restored")
+	}
+
+	// the live bitmaps are not affected by the snapshot.
+	if n := bms.Card("test1"); n != 100001 || bms.Exists("test1", 1) {
+		t.Fatalf("expect 100001 elements excluding 1 in test1 but got %d", n)
+	}
+}
+
+func TestBitmaps_Merge(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("test1", []uint32{1, 2}, false)
+	bms.Add("test2", 1, false)
+	hash := bms.Hash()
+
+	from := NewBitmaps()
+	from.AddMany("test1", []uint32{3, 4, 5}, false)
+	from.Add("test3", 1, false)
+	from.Expire("test3", time.Now().Add(time.Hour), false)
+	var buf bytes.Buffer
+	if err := from.Save(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	// malformed bitmaps are rejected before bitmaps are changed.
+	read := NewBitmaps()
+	if err := read.Read(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Fatal("expect the truncated bitmaps are rejected")
+	}
+	if bms.Hash() != hash {
+		t.Fatal("expect bitmaps are unchanged")
+	}
+
+	read = NewBitmaps()
+	if err := read.Read(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	bms.Merge(read)
+	if n := bms.Card("test1"); n != 3 || bms.Exists("test1", 1) {
+		t.Fatalf("expect test1 is replaced but got %d elements", n)
+	}
+	if bms.Card("test2") != 1 {
+		t.Fatal("expect test2 is kept")
+	}
+	if deadline, _ := bms.Deadline("test3"); deadline.IsZero() {
+		t.Fatal("expect the deadline of test3 is merged")
+	}
+}
@@ -2,7 +2,13 @@ package basalt
 
 import (
 	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+
+	"github.com/RoaringBitmap/roaring"
 )
 
 func TestBitmaps_Basic(t *testing.T) {
@@ -12,7 +18,7 @@ func TestBitmaps_Basic(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		v := uint32(rand.Int31())
 		values = append(values, v)
-		bms.Add("test", v)
+		bms.Add("test", v, false)
 	}
 
 	for _, v := range values {
@@ -22,7 +28,7 @@ func TestBitmaps_Basic(t *testing.T) {
 	}
 
 	for _, v := range values {
-		bms.Remove("test", v)
+		bms.Remove("test", v, false)
 	}
 
 	for _, v := range values {
@@ -32,7 +38,7 @@ func TestBitmaps_Basic(t *testing.T) {
 	}
 
 	for i := 0; i < 10; i++ {
-		bms.AddMany("test", values[i*10:i*10+10])
+		bms.AddMany("test", values[i*10:i*10+10], false)
 	}
 	for _, v := range values {
 		if !bms.Exists("test", v) {
@@ -49,8 +55,8 @@ func TestBitmaps_Basic(t *testing.T) {
 func TestBitmaps_Inter(t *testing.T) {
 	bms := NewBitmaps()
 
-	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11})
-	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21})
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21}, false)
 
 	result := bms.Inter("test1", "test2")
 	if result[0] != 1 || result[1] != 2 || result[2] != 3 {
@@ -61,8 +67,8 @@ func TestBitmaps_Inter(t *testing.T) {
 func TestBitmaps_Union(t *testing.T) {
 	bms := NewBitmaps()
 
-	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11})
-	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21})
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21}, false)
 
 	result := bms.Union("test1", "test2")
 	if len(result) != 7 || result[0] != 1 || result[1] != 2 || result[2] != 3 ||
@@ -75,8 +81,8 @@ func TestBitmaps_Union(t *testing.T) {
 func TestBitmaps_Xor(t *testing.T) {
 	bms := NewBitmaps()
 
-	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11})
-	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21})
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21}, false)
 
 	result := bms.Xor("test1", "test2")
 	if len(result) != 4 || result[0] != 10 || result[1] != 11 || result[2] != 20 || result[3] != 21 {
@@ -87,11 +93,237 @@ func TestBitmaps_Xor(t *testing.T) {
 func TestBitmaps_Diff(t *testing.T) {
 	bms := NewBitmaps()
 
-	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11})
-	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21})
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21}, false)
 
 	result := bms.Diff("test1", "test2")
 	if len(result) != 2 || result[0] != 10 || result[1] != 11 {
 		t.Fatalf("expect 10,11 but got %v", result)
 	}
 }
+
+func TestBitmaps_ManyXorDiff(t *testing.T) {
+	bms := NewBitmaps()
+
+	bms.AddMany("test1", []uint32{1, 2, 3, 10}, false)
+	bms.AddMany("test2", []uint32{1, 2, 20}, false)
+	bms.AddMany("test3", []uint32{2, 3, 30}, false)
+
+	if result := bms.Xor("test1", "test2", "test3", "missing"); !reflect.DeepEqual(result, []uint32{2, 10, 20, 30}) {
+		t.Fatalf("expect 2,10,20,30 but got %v", result)
+	}
+	if n := bms.XorCard("test1", "test2", "test3"); n != 4 {
+		t.Fatalf("expect xor cardinality 4 but got %d", n)
+	}
+	if result := bms.Diff("test1", "test2", "test3"); !reflect.DeepEqual(result, []uint32{10}) {
+		t.Fatalf("expect 10 but got %v", result)
+	}
+	if n := bms.DiffCard("test1", "test2", "test3"); n != 1 {
+		t.Fatalf("expect diff cardinality 1 but got %d", n)
+	}
+
+	// the result of one bitmap is a copy
+	if n, _ := bms.XorStore("dst", []string{"test1"}, false); n != 4 {
+		t.Fatalf("expect 4 values stored but got %d", n)
+	}
+	bms.Add("dst", 100, false)
+	if bms.Card("test1") != 4 {
+		t.Fatalf("expect the source is not changed but got %v", bms.Union("test1"))
+	}
+}
+
+func TestBitmaps_Scan(t *testing.T) {
+	bms := NewBitmaps()
+
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11, 70000, 1 << 31}, false)
+
+	result := bms.Scan("test1", 0, 3)
+	if len(result) != 3 || result[0] != 1 || result[2] != 3 {
+		t.Fatalf("expect 1,2,3 but got %v", result)
+	}
+
+	result = bms.Scan("test1", 4, 3)
+	if len(result) != 3 || result[0] != 10 || result[1] != 11 || result[2] != 70000 {
+		t.Fatalf("expect 10,11,70000 but got %v", result)
+	}
+
+	result = bms.Scan("test1", 70001, 3)
+	if len(result) != 1 || result[0] != 1<<31 {
+		t.Fatalf("expect %d but got %v", 1<<31, result)
+	}
+
+	if result := bms.Scan("test2", 0, 3); len(result) != 0 {
+		t.Fatalf("expect no values but got %v", result)
+	}
+}
+
+func TestBitmaps_Bitmap(t *testing.T) {
+	bms := NewBitmaps()
+
+	bms.AddMany("test1", []uint32{1, 2, 3, 10, 11}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3, 20, 21}, false)
+
+	bm := bms.InterBitmap("test1", "test2")
+	if !reflect.DeepEqual(bm.ToArray(), []uint32{1, 2, 3}) {
+		t.Fatalf("expect 1,2,3 but got %v", bm.ToArray())
+	}
+	if bm := bms.InterBitmap("test1", "test3"); !bm.IsEmpty() {
+		t.Fatalf("expect empty intersection but got %v", bm.ToArray())
+	}
+
+	data, err := bms.UnionBitmap("test1", "test2").ToBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	bm = roaring.NewBitmap()
+	if err := bm.UnmarshalBinary(data); err != nil {
+		t.Fatalf("failed to deserialize: %v", err)
+	}
+	if !reflect.DeepEqual(bm.ToArray(), bms.Union("test1", "test2")) {
+		t.Fatalf("expect %v but got %v", bms.Union("test1", "test2"), bm.ToArray())
+	}
+
+	if n := bms.XorBitmap("test1", "test2").GetCardinality(); n != 4 {
+		t.Fatalf("expect 4 values of xor but got %d", n)
+	}
+	if n := bms.DiffBitmap("test1", "test2").GetCardinality(); n != 2 {
+		t.Fatalf("expect 2 values of diff but got %d", n)
+	}
+
+	// results are not shared with bitmaps
+	bms.UnionBitmap("test1").Add(100)
+	if bms.Exists("test1", 100) {
+		t.Fatal("expect test1 is not changed by the result")
+	}
+}
+
+func TestBitmaps_SetCard(t *testing.T) {
+	bms := NewBitmaps()
+
+	for _, name := range []string{"a", "b", "c", "e"} {
+		for i := 0; i < 1000; i++ {
+			bms.Add(name, uint32(rand.Intn(3000)), false)
+		}
+	}
+
+	for _, names := range [][]string{{"a"}, {"a", "b"}, {"a", "b", "c"}, {"a", "d"}, {"e", "a", "c", "b"}} {
+		if got, want := bms.InterCard(names...), uint64(len(bms.Inter(names...))); got != want {
+			t.Errorf("expect InterCard(%v) %d but got %d", names, want, got)
+		}
+		if got, want := bms.UnionCard(names...), uint64(len(bms.Union(names...))); got != want {
+			t.Errorf("expect UnionCard(%v) %d but got %d", names, want, got)
+		}
+	}
+
+	for _, names := range [][]string{{"a", "b"}, {"a", "a"}, {"a", "d"}, {"d", "a"}, {"a", "b", "c", "e"}, {"a", "a", "b", "c", "e"}} {
+		if got, want := bms.XorCard(names...), uint64(len(bms.Xor(names...))); got != want {
+			t.Errorf("expect XorCard(%v) %d but got %d", names, want, got)
+		}
+		if got, want := bms.DiffCard(names...), uint64(len(bms.Diff(names...))); got != want {
+			t.Errorf("expect DiffCard(%v) %d but got %d", names, want, got)
+		}
+	}
+
+	want := float64(bms.InterCard("a", "b")) / float64(bms.UnionCard("a", "b"))
+	if got := bms.Jaccard("a", "b"); got != want {
+		t.Errorf("expect Jaccard %v but got %v", want, got)
+	}
+	if got := bms.Jaccard("a", "a"); got != 1 {
+		t.Errorf("expect Jaccard of the same bitmap 1 but got %v", got)
+	}
+	if got := bms.Jaccard("d", "e"); got != 0 {
+		t.Errorf("expect Jaccard of empty bitmaps 0 but got %v", got)
+	}
+}
+
+func TestBitmaps_ConcurrentSetOps(t *testing.T) {
+	bms := NewBitmaps()
+
+	const n = 1000
+	values := make([]uint32, n)
+	for i := range values {
+		values[i] = uint32(i * 70) // values span many containers
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	// bitmaps always have all values or none of them
+	for _, name := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				bms.AddMany(name, values, false)
+				bms.ClearBitmap(name, false)
+			}
+		}(name)
+	}
+
+	// results are written while sources are changed
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			bms.UnionStore("dst", []string{"a"}, false)
+			bms.Add("dst", 1, false)
+			bms.RemoveBitmap("dst", false)
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		if c := uint64(len(bms.Union("a"))); c != 0 && c != n {
+			t.Fatalf("expect 0 or %d values but got %d", n, c)
+		}
+		if c := bms.InterCard("a", "b"); c != 0 && c != n {
+			t.Fatalf("expect intersection of 0 or %d values but got %d", n, c)
+		}
+		if c := bms.XorCard("a", "a"); c != 0 {
+			t.Fatalf("expect empty xor of the same bitmap but got %d", c)
+		}
+		if c := bms.DiffCard("a", "a", "b"); c != 0 {
+			t.Fatalf("expect empty diff of the same bitmap but got %d", c)
+		}
+		if c, _ := bms.QueryCard("a ANDNOT a", ""); c != 0 {
+			t.Fatalf("expect empty query but got %d", c)
+		}
+		bms.Query("(a XOR b) OR dst", "")
+		bms.Jaccard("a", "b")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// Run with -cpu 1,2,4,8 to see how writes to distinct bitmaps scale.
+func BenchmarkBitmaps_AddDistinct(b *testing.B) {
+	bms := NewBitmaps()
+	var id uint32
+	b.RunParallel(func(pb *testing.PB) {
+		name := "bench" + strconv.Itoa(int(atomic.AddUint32(&id, 1)))
+		var v uint32
+		for pb.Next() {
+			bms.Add(name, v, false)
+			v++
+		}
+	})
+}
+
+// BenchmarkBitmaps_AddNew creates a bitmap on every write.
+func BenchmarkBitmaps_AddNew(b *testing.B) {
+	bms := NewBitmaps()
+	var id uint32
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bms.Add("bench"+strconv.Itoa(int(atomic.AddUint32(&id, 1))), 1, false)
+		}
+	})
+}
@@ -0,0 +1,565 @@
+package basalt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/smallnest/log"
+)
+
+// A field keeps an int64 attribute of members in a bit-sliced index (BSI):
+// the exists bitmap has members with a value, the sign bitmap has members
+// with a negative value, and the i-th slice has members whose absolute value
+// has the i-th bit set. Comparisons and aggregations are computed with a few
+// operations per slice instead of visiting members one by one.
+//
+// Fields are kept apart from bitmaps, so they don't take part in set
+// operations, eviction, TTLs or spilling, and their memory isn't counted in
+// the memory budget. They are replicated by raft and saved in snapshots with
+// bitmaps, and a field contributes to the state hash like a bitmap whose
+// checksum is the sum of hashes of its members and values.
+
+// bsiRecord is set in the length of name of a field record, which is
+// followed by the number of bitmaps of the field and the bitmaps: exists,
+// sign and slices from the lowest bit.
+const bsiRecord = 1 << 29
+
+// fieldHashPrefix separates names of fields from names of bitmaps in the state hash.
+const fieldHashPrefix = "\x00bsi\x00"
+
+// RangeOp is a comparison of values of a field.
+type RangeOp string
+
+const (
+	// RangeEQ selects members whose value is equal to the value.
+	RangeEQ RangeOp = "eq"
+	// RangeLT selects members whose value is less than the value.
+	RangeLT RangeOp = "lt"
+	// RangeLE selects members whose value is less than or equal to the value.
+	RangeLE RangeOp = "le"
+	// RangeGT selects members whose value is greater than the value.
+	RangeGT RangeOp = "gt"
+	// RangeGE selects members whose value is greater than or equal to the value.
+	RangeGE RangeOp = "ge"
+	// RangeBetween selects members whose value is between the value and the end, inclusive.
+	RangeBetween RangeOp = "between"
+)
+
+// ErrInvalidRangeOp is returned for unknown comparisons.
+var ErrInvalidRangeOp = errors.New("invalid range operation")
+
+// ParseRangeOp parses the name of a comparison like GT or between.
+func ParseRangeOp(s string) (RangeOp, error) {
+	switch op := RangeOp(strings.ToLower(s)); op {
+	case RangeEQ, RangeLT, RangeLE, RangeGT, RangeGE, RangeBetween:
+		return op, nil
+	}
+	return "", ErrInvalidRangeOp
+}
+
+// BSI is the goroutine-safe bit-sliced index of a field.
+type BSI struct {
+	mu      sync.RWMutex
+	exists  *roaring.Bitmap
+	sign    *roaring.Bitmap
+	slices  []*roaring.Bitmap
+	sum     uint64 // checksum of members and values
+	dropped bool
+}
+
+func newBSI() *BSI {
+	return &BSI{exists: roaring.NewBitmap(), sign: roaring.NewBitmap()}
+}
+
+// memberHash is the hash of a member and its value in the checksum of a field.
+func memberHash(member uint32, value int64) uint64 {
+	return mix64(valueHash(member) ^ uint64(value))
+}
+
+// magnitude returns the absolute value of v, which doesn't overflow for math.MinInt64.
+func magnitude(v int64) uint64 {
+	if v < 0 {
+		return uint64(-v)
+	}
+	return uint64(v)
+}
+
+// value returns the value of the member, b.mu must be held.
+func (b *BSI) value(member uint32) (int64, bool) {
+	if !b.exists.Contains(member) {
+		return 0, false
+	}
+	var mag uint64
+	for i, slice := range b.slices {
+		if slice.Contains(member) {
+			mag |= 1 << uint(i)
+		}
+	}
+	if b.sign.Contains(member) {
+		return -int64(mag), true
+	}
+	return int64(mag), true
+}
+
+// set sets the value of the member and returns the change of the checksum,
+// b.mu must be held for writing.
+func (b *BSI) set(member uint32, value int64) uint64 {
+	old, ok := b.value(member)
+	if ok && old == value {
+		return 0
+	}
+
+	mag := magnitude(value)
+	for len(b.slices) < bits.Len64(mag) {
+		b.slices = append(b.slices, roaring.NewBitmap())
+	}
+	for i, slice := range b.slices {
+		if mag&(1<<uint(i)) != 0 {
+			slice.Add(member)
+		} else {
+			slice.Remove(member)
+		}
+	}
+	if value < 0 {
+		b.sign.Add(member)
+	} else {
+		b.sign.Remove(member)
+	}
+	b.exists.Add(member)
+
+	delta := memberHash(member, value)
+	if ok {
+		delta -= memberHash(member, old)
+	}
+	return delta
+}
+
+// clear removes the value of the member and returns the change of the
+// checksum, b.mu must be held for writing.
+func (b *BSI) clear(member uint32) uint64 {
+	old, ok := b.value(member)
+	if !ok {
+		return 0
+	}
+	for _, slice := range b.slices {
+		slice.Remove(member)
+	}
+	b.sign.Remove(member)
+	b.exists.Remove(member)
+	return -memberHash(member, old)
+}
+
+// clone returns a full copy of the index which can be saved while the index
+// is written, b.mu must be held.
+func (b *BSI) clone() *BSI {
+	c := &BSI{exists: b.exists.Clone(), sign: b.sign.Clone(), sum: b.sum}
+	for _, slice := range b.slices {
+		c.slices = append(c.slices, slice.Clone())
+	}
+	return c
+}
+
+// checksum computes the checksum of the index from scratch.
+func (b *BSI) checksum() uint64 {
+	var sum uint64
+	it := b.exists.Iterator()
+	for it.HasNext() {
+		member := it.Next()
+		v, _ := b.value(member)
+		sum += memberHash(member, v)
+	}
+	return sum
+}
+
+// compareMagnitude splits candidates into members whose absolute value is
+// less than, equal to and greater than c, b.mu must be held.
+func (b *BSI) compareMagnitude(candidates *roaring.Bitmap, c uint64) (lt, eq, gt *roaring.Bitmap) {
+	lt, eq, gt = roaring.NewBitmap(), candidates.Clone(), roaring.NewBitmap()
+	if bits.Len64(c) > len(b.slices) {
+		// c has bits above the highest slice
+		return eq, roaring.NewBitmap(), gt
+	}
+
+	for i := len(b.slices) - 1; i >= 0 && !eq.IsEmpty(); i-- {
+		slice := b.slices[i]
+		if c&(1<<uint(i)) != 0 {
+			lt.Or(roaring.AndNot(eq, slice))
+			eq.And(slice)
+		} else {
+			gt.Or(roaring.And(eq, slice))
+			eq.AndNot(slice)
+		}
+	}
+	return lt, eq, gt
+}
+
+// compare splits candidates, which have values, into members whose value is
+// less than, equal to and greater than v, b.mu must be held.
+func (b *BSI) compare(candidates *roaring.Bitmap, v int64) (lt, eq, gt *roaring.Bitmap) {
+	neg := roaring.And(candidates, b.sign)
+	pos := roaring.AndNot(candidates, b.sign)
+	if v >= 0 {
+		lt, eq, gt = b.compareMagnitude(pos, magnitude(v))
+		lt.Or(neg)
+		return lt, eq, gt
+	}
+
+	// the greater the absolute value of a negative value, the less it is
+	gt, eq, lt = b.compareMagnitude(neg, magnitude(v))
+	gt.Or(pos)
+	return lt, eq, gt
+}
+
+// rangeOf returns members of candidates whose value matches the comparison,
+// b.mu must be held.
+func (b *BSI) rangeOf(candidates *roaring.Bitmap, op RangeOp, value, end int64) *roaring.Bitmap {
+	lt, eq, gt := b.compare(candidates, value)
+	switch op {
+	case RangeEQ:
+		return eq
+	case RangeLT:
+		return lt
+	case RangeLE:
+		lt.Or(eq)
+		return lt
+	case RangeGT:
+		return gt
+	case RangeGE:
+		gt.Or(eq)
+		return gt
+	case RangeBetween:
+		if end < value {
+			return roaring.NewBitmap()
+		}
+		gt.Or(eq)
+		lt, eq, _ = b.compare(gt, end)
+		lt.Or(eq)
+		return lt
+	}
+	return roaring.NewBitmap()
+}
+
+// extreme returns the max value of candidates if max is set and the min
+// value otherwise, candidates must not be empty. b.mu must be held.
+func (b *BSI) extreme(candidates *roaring.Bitmap, max bool) int64 {
+	neg := roaring.And(candidates, b.sign)
+	pos := roaring.AndNot(candidates, b.sign)
+
+	switch {
+	case max && !pos.IsEmpty():
+		return int64(b.greatestMagnitude(pos))
+	case max:
+		return -int64(b.leastMagnitude(neg))
+	case !neg.IsEmpty():
+		return -int64(b.greatestMagnitude(neg))
+	default:
+		return int64(b.leastMagnitude(pos))
+	}
+}
+
+// greatestMagnitude returns the greatest absolute value of candidates, which
+// is found by keeping members with the bit set from the highest slice.
+func (b *BSI) greatestMagnitude(candidates *roaring.Bitmap) uint64 {
+	var mag uint64
+	for i := len(b.slices) - 1; i >= 0; i-- {
+		if next := roaring.And(candidates, b.slices[i]); !next.IsEmpty() {
+			candidates = next
+			mag |= 1 << uint(i)
+		}
+	}
+	return mag
+}
+
+// leastMagnitude returns the least absolute value of candidates.
+func (b *BSI) leastMagnitude(candidates *roaring.Bitmap) uint64 {
+	var mag uint64
+	for i := len(b.slices) - 1; i >= 0; i-- {
+		if next := roaring.AndNot(candidates, b.slices[i]); !next.IsEmpty() {
+			candidates = next
+		} else {
+			mag |= 1 << uint(i)
+		}
+	}
+	return mag
+}
+
+// field returns the named field, which is nil if it doesn't exist.
+func (bs *Bitmaps) field(name string) *BSI {
+	bs.fieldsMu.RLock()
+	defer bs.fieldsMu.RUnlock()
+	return bs.fields[name]
+}
+
+// fieldOrCreate returns the named field, which is created if it doesn't exist.
+func (bs *Bitmaps) fieldOrCreate(name string) *BSI {
+	if b := bs.field(name); b != nil {
+		return b
+	}
+
+	bs.fieldsMu.Lock()
+	defer bs.fieldsMu.Unlock()
+	b := bs.fields[name]
+	if b == nil {
+		b = newBSI()
+		bs.fields[name] = b
+		atomic.AddUint64(&bs.hash, StateHashOf(fieldHashPrefix+name, 0))
+	}
+	return b
+}
+
+// setFieldChecksum updates the checksum of the field and the state hash, b.mu must be held.
+func (bs *Bitmaps) setFieldChecksum(name string, b *BSI, sum uint64) {
+	if !b.dropped {
+		atomic.AddUint64(&bs.hash, StateHashOf(fieldHashPrefix+name, sum)-StateHashOf(fieldHashPrefix+name, b.sum))
+	}
+	b.sum = sum
+}
+
+// storeField replaces the named field with b.
+func (bs *Bitmaps) storeField(name string, b *BSI) {
+	bs.fieldsMu.Lock()
+	if old := bs.fields[name]; old != nil {
+		bs.dropField(name, old)
+	}
+	bs.fields[name] = b
+	atomic.AddUint64(&bs.hash, StateHashOf(fieldHashPrefix+name, b.sum))
+	bs.fieldsMu.Unlock()
+}
+
+// dropField removes b from the state hash, bs.fieldsMu must be held for writing.
+func (bs *Bitmaps) dropField(name string, b *BSI) {
+	b.mu.Lock()
+	if !b.dropped {
+		b.dropped = true
+		atomic.AddUint64(&bs.hash, -StateHashOf(fieldHashPrefix+name, b.sum))
+	}
+	b.mu.Unlock()
+	delete(bs.fields, name)
+}
+
+// SetValue sets the value of the member in the field.
+func (bs *Bitmaps) SetValue(field string, member uint32, value int64, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpSetValue, Name: field, Values: []uint32{member}, Value: value})
+	}
+
+	b := bs.fieldOrCreate(field)
+	b.mu.Lock()
+	bs.setFieldChecksum(field, b, b.sum+b.set(member, value))
+	b.mu.Unlock()
+
+	return nil
+}
+
+// ClearValue removes the value of the member from the field.
+func (bs *Bitmaps) ClearValue(field string, member uint32, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpClearValue, Name: field, Values: []uint32{member}})
+	}
+
+	b := bs.field(field)
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	bs.setFieldChecksum(field, b, b.sum+b.clear(member))
+	b.mu.Unlock()
+
+	return nil
+}
+
+// DropField removes the field.
+func (bs *Bitmaps) DropField(field string, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpDropField, Name: field})
+	}
+
+	bs.fieldsMu.Lock()
+	if b := bs.fields[field]; b != nil {
+		bs.dropField(field, b)
+	}
+	bs.fieldsMu.Unlock()
+
+	return nil
+}
+
+// Value returns the value of the member in the field, it returns false if
+// the member has no value.
+func (bs *Bitmaps) Value(field string, member uint32) (int64, bool) {
+	b := bs.field(field)
+	if b == nil {
+		return 0, false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.value(member)
+}
+
+// Fields returns names of all fields.
+func (bs *Bitmaps) Fields() []string {
+	bs.fieldsMu.RLock()
+	defer bs.fieldsMu.RUnlock()
+
+	names := make([]string, 0, len(bs.fields))
+	for name := range bs.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// candidates returns members of the field which are in the filter bitmap,
+// or all members of the field if filter is empty. b.mu must be held.
+func (b *BSI) candidates(filter *roaring.Bitmap) *roaring.Bitmap {
+	if filter == nil {
+		return b.exists.Clone()
+	}
+	return roaring.And(b.exists, filter)
+}
+
+// withField calls fn with the locked field and the snapshot of the filter
+// bitmap, which is nil if filter is empty. fn isn't called if the field or
+// the filter bitmap doesn't exist.
+func (bs *Bitmaps) withField(field, filter string, fn func(b *BSI, filter *roaring.Bitmap)) {
+	var fbm *roaring.Bitmap
+	if filter != "" {
+		if fbm = bs.snapshot(filter)[0]; fbm == nil {
+			return
+		}
+	}
+
+	b := bs.field(field)
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	fn(b, fbm)
+	b.mu.RUnlock()
+}
+
+// RangeBitmap returns members of the field whose value matches the
+// comparison and which are in the filter bitmap, or all members if filter is
+// empty. end is only used by RangeBetween.
+func (bs *Bitmaps) RangeBitmap(field string, op RangeOp, value, end int64, filter string) *roaring.Bitmap {
+	result := roaring.NewBitmap()
+	bs.withField(field, filter, func(b *BSI, filter *roaring.Bitmap) {
+		result = b.rangeOf(b.candidates(filter), op, value, end)
+	})
+	return result
+}
+
+// Range returns members of the field whose value matches the comparison.
+func (bs *Bitmaps) Range(field string, op RangeOp, value, end int64, filter string) []uint32 {
+	return bs.RangeBitmap(field, op, value, end, filter).ToArray()
+}
+
+// RangeCard returns the number of members of the field whose value matches the comparison.
+func (bs *Bitmaps) RangeCard(field string, op RangeOp, value, end int64, filter string) uint64 {
+	return bs.RangeBitmap(field, op, value, end, filter).GetCardinality()
+}
+
+// Sum returns the sum of values of members of the field which are in the
+// filter bitmap, and the number of them. The sum wraps around on overflow.
+func (bs *Bitmaps) Sum(field, filter string) (sum int64, count uint64) {
+	bs.withField(field, filter, func(b *BSI, filter *roaring.Bitmap) {
+		cand := b.candidates(filter)
+		neg := roaring.And(cand, b.sign)
+		pos := roaring.AndNot(cand, b.sign)
+
+		var total uint64
+		for i, slice := range b.slices {
+			n := slice.AndCardinality(pos) - slice.AndCardinality(neg)
+			total += n << uint(i)
+		}
+		sum, count = int64(total), cand.GetCardinality()
+	})
+	return sum, count
+}
+
+// Min returns the min value of members of the field which are in the filter
+// bitmap, it returns false if there are no such members.
+func (bs *Bitmaps) Min(field, filter string) (min int64, ok bool) {
+	bs.withField(field, filter, func(b *BSI, filter *roaring.Bitmap) {
+		if cand := b.candidates(filter); !cand.IsEmpty() {
+			min, ok = b.extreme(cand, false), true
+		}
+	})
+	return min, ok
+}
+
+// Max returns the max value of members of the field which are in the filter
+// bitmap, it returns false if there are no such members.
+func (bs *Bitmaps) Max(field, filter string) (max int64, ok bool) {
+	bs.withField(field, filter, func(b *BSI, filter *roaring.Bitmap) {
+		if cand := b.candidates(filter); !cand.IsEmpty() {
+			max, ok = b.extreme(cand, true), true
+		}
+	})
+	return max, ok
+}
+
+// snapshotFields adds clones of all fields to the snapshot.
+func (bs *Bitmaps) snapshotFields(snapshot *BitmapsSnapshot) {
+	bs.fieldsMu.RLock()
+	defer bs.fieldsMu.RUnlock()
+
+	for name, b := range bs.fields {
+		b.mu.Lock()
+		snapshot.fieldNames = append(snapshot.fieldNames, name)
+		snapshot.fields = append(snapshot.fields, b.clone())
+		b.mu.Unlock()
+	}
+}
+
+func writeField(w io.Writer, name string, b *BSI) (int64, error) {
+	buf := make([]byte, 8+len(name))
+	binary.LittleEndian.PutUint32(buf, uint32(len(name))|bsiRecord)
+	copy(buf[4:], name)
+	binary.LittleEndian.PutUint32(buf[4+len(name):], uint32(2+len(b.slices)))
+	total, err := w.Write(buf)
+	if err != nil {
+		log.Errorf("failed to write field %s: %v", name, err)
+		return int64(total), err
+	}
+
+	for _, bm := range append([]*roaring.Bitmap{b.exists, b.sign}, b.slices...) {
+		n, err := bm.WriteTo(w)
+		total += int(n)
+		if err != nil {
+			log.Errorf("failed to write field %s: %v", name, err)
+			return int64(total), err
+		}
+	}
+	return int64(total), nil
+}
+
+// readField reads bitmaps of a field after its name.
+func readField(r io.Reader) (*BSI, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n < 2 || n > 2+64 {
+		return nil, errors.New("invalid number of bitmaps of field")
+	}
+
+	bms := make([]*roaring.Bitmap, n)
+	for i := range bms {
+		bms[i] = roaring.NewBitmap()
+		if _, err := bms[i].ReadFrom(r); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &BSI{exists: bms[0], sign: bms[1], slices: bms[2:]}
+	b.sum = b.checksum()
+	return b, nil
+}
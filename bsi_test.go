@@ -0,0 +1,169 @@
+package basalt
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+func TestBitmaps_FieldRange(t *testing.T) {
+	bms := NewBitmaps()
+
+	values := make(map[uint32]int64)
+	for i := uint32(0); i < 2000; i++ {
+		v := rand.Int63n(2000) - 1000
+		values[i] = v
+		bms.SetValue("score", i, v, false)
+	}
+	extremes := []int64{math.MinInt64, math.MaxInt64, 0}
+	for i, v := range extremes {
+		values[3000+uint32(i)] = v
+		bms.SetValue("score", 3000+uint32(i), v, false)
+	}
+	bms.ClearValue("score", 1, false)
+	delete(values, 1)
+	bms.AddMany("filter", []uint32{2, 3, 4, 5, 3000, 3001}, false)
+
+	match := func(op RangeOp, v, end, x int64) bool {
+		switch op {
+		case RangeEQ:
+			return x == v
+		case RangeLT:
+			return x < v
+		case RangeLE:
+			return x <= v
+		case RangeGT:
+			return x > v
+		case RangeGE:
+			return x >= v
+		case RangeBetween:
+			return x >= v && x <= end
+		}
+		return false
+	}
+
+	ops := []RangeOp{RangeEQ, RangeLT, RangeLE, RangeGT, RangeGE, RangeBetween}
+	for _, v := range []int64{-1001, -500, -1, 0, 1, 100, 999, math.MinInt64, math.MaxInt64} {
+		for _, op := range ops {
+			end := v + 300
+			if v == math.MaxInt64 {
+				end = v
+			}
+
+			var expected []uint32
+			for member, x := range values {
+				if match(op, v, end, x) {
+					expected = append(expected, member)
+				}
+			}
+			got := bms.RangeBitmap("score", op, v, end, "")
+			if got.GetCardinality() != uint64(len(expected)) || !got.Equals(roaring.BitmapOf(expected...)) {
+				t.Fatalf("unexpected result of %s %d: %d values, expect %d", op, v, got.GetCardinality(), len(expected))
+			}
+		}
+	}
+
+	var expected []uint32
+	for _, member := range []uint32{2, 3, 4, 5, 3000, 3001} {
+		if values[member] >= 0 {
+			expected = append(expected, member)
+		}
+	}
+	if got := bms.Range("score", RangeGE, 0, 0, "filter"); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expect %v but got %v", expected, got)
+	}
+	if n := bms.RangeCard("score", RangeLT, 0, 0, "nonexistent"); n != 0 {
+		t.Fatalf("expect no values for a nonexistent filter but got %d", n)
+	}
+}
+
+func TestBitmaps_FieldAggregate(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("filter", []uint32{1, 3, 4}, false)
+	bms.AddMany("negative", []uint32{1, 4}, false)
+	bms.AddMany("positive", []uint32{0, 2}, false)
+	hash := bms.Hash()
+
+	for i, v := range []int64{5, -3, 10, 0, -7} {
+		bms.SetValue("score", uint32(i), v, false)
+	}
+	bms.SetValue("score", 2, 8, false)
+
+	if v, ok := bms.Value("score", 2); !ok || v != 8 {
+		t.Fatalf("expect value 8 but got %d, %t", v, ok)
+	}
+	if sum, count := bms.Sum("score", ""); sum != 3 || count != 5 {
+		t.Fatalf("expect sum 3 of 5 values but got %d of %d", sum, count)
+	}
+	if min, ok := bms.Min("score", ""); !ok || min != -7 {
+		t.Fatalf("expect min -7 but got %d", min)
+	}
+	if max, ok := bms.Max("score", ""); !ok || max != 8 {
+		t.Fatalf("expect max 8 but got %d", max)
+	}
+
+	if sum, count := bms.Sum("score", "filter"); sum != -10 || count != 3 {
+		t.Fatalf("expect sum -10 of 3 values but got %d of %d", sum, count)
+	}
+	if max, ok := bms.Max("score", "filter"); !ok || max != 0 {
+		t.Fatalf("expect max 0 but got %d", max)
+	}
+	if max, ok := bms.Max("score", "negative"); !ok || max != -3 {
+		t.Fatalf("expect max -3 but got %d", max)
+	}
+	if min, ok := bms.Min("score", "positive"); !ok || min != 5 {
+		t.Fatalf("expect min 5 but got %d", min)
+	}
+
+	bms.DropField("score", false)
+	if _, ok := bms.Min("score", ""); ok {
+		t.Fatal("expect no values after the field is dropped")
+	}
+	if bms.Hash() != hash {
+		t.Fatal("expect the field is removed from the state hash")
+	}
+}
+
+func TestBitmaps_FieldPersistence(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("test", []uint32{1, 2, 3}, false)
+	bms.Expire("test", time.Now().Add(time.Hour), false)
+	for i := uint32(0); i < 100; i++ {
+		bms.SetValue("age", i, int64(i%50), false)
+		bms.SetValue("balance", i, -int64(i)*1000, false)
+	}
+
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	data := buf.Bytes()
+
+	restored := NewBitmaps()
+	restored.SetValue("stale", 1, 1, false)
+	if err := restored.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if restored.Hash() != bms.Hash() {
+		t.Fatal("expect the same state hash after restore")
+	}
+	if !reflect.DeepEqual(restored.Fields(), []string{"age", "balance"}) {
+		t.Fatalf("unexpected fields %v", restored.Fields())
+	}
+	if v, ok := restored.Value("balance", 42); !ok || v != -42000 {
+		t.Fatalf("expect value -42000 but got %d, %t", v, ok)
+	}
+
+	read := NewBitmaps()
+	if err := read.Read(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if read.Hash() != bms.Hash() || read.RangeCard("age", RangeLT, 10, 0, "") != 20 {
+		t.Fatal("expect the same fields after read")
+	}
+}
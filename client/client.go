@@ -0,0 +1,541 @@
+// Package client is the Go client of basalt servers. The same Client interface
+// is implemented over rpcx, redis and http, with retries, connection pooling
+// and routing of writes to the raft leader.
+//
+// This package doesn't import the basalt server package, whose raft
+// dependencies conflict with the etcd packages used by rpcx clients.
+package client
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client is a client of basalt servers. Writes are idempotent so they are
+// retried on errors like ErrDraining and ErrUnavailable.
+type Client interface {
+	// Add adds a value to the bitmap.
+	Add(ctx context.Context, name string, value uint32) error
+	// AddMany adds values to the bitmap.
+	AddMany(ctx context.Context, name string, values []uint32) error
+	// Remove removes a value from the bitmap.
+	Remove(ctx context.Context, name string, value uint32) error
+	// Drop removes the bitmap.
+	Drop(ctx context.Context, name string) error
+	// Clear removes all values of the bitmap.
+	Clear(ctx context.Context, name string) error
+
+	// Exists checks whether the value is in the bitmap.
+	Exists(ctx context.Context, name string, value uint32) (bool, error)
+	// Card returns the number of values of the bitmap.
+	Card(ctx context.Context, name string) (uint64, error)
+	// Scan returns up to count values of the bitmap which are not less than
+	// cursor, and the cursor of the next page which is 0 at the end.
+	Scan(ctx context.Context, name string, cursor uint32, count int) (values []uint32, next uint32, err error)
+	// Stats returns statistics of the bitmap.
+	Stats(ctx context.Context, name string) (*Stats, error)
+
+	// Inter returns the intersection of bitmaps.
+	Inter(ctx context.Context, names ...string) ([]uint32, error)
+	// InterStore stores the intersection of bitmaps to dst.
+	InterStore(ctx context.Context, dst string, names ...string) error
+	// Union returns the union of bitmaps.
+	Union(ctx context.Context, names ...string) ([]uint32, error)
+	// UnionStore stores the union of bitmaps to dst.
+	UnionStore(ctx context.Context, dst string, names ...string) error
+	// Xor returns the symmetric difference of two bitmaps.
+	Xor(ctx context.Context, name1, name2 string) ([]uint32, error)
+	// XorStore stores the symmetric difference of two bitmaps to dst.
+	XorStore(ctx context.Context, dst, name1, name2 string) error
+	// Diff returns values of name1 which are not in name2.
+	Diff(ctx context.Context, name1, name2 string) ([]uint32, error)
+	// DiffStore stores values of name1 which are not in name2 to dst.
+	DiffStore(ctx context.Context, dst, name1, name2 string) error
+
+	// InterCard returns the cardinality of the intersection of bitmaps.
+	InterCard(ctx context.Context, names ...string) (uint64, error)
+	// UnionCard returns the cardinality of the union of bitmaps.
+	UnionCard(ctx context.Context, names ...string) (uint64, error)
+	// XorCard returns the cardinality of the symmetric difference of two bitmaps.
+	XorCard(ctx context.Context, name1, name2 string) (uint64, error)
+	// DiffCard returns the number of values of name1 which are not in name2.
+	DiffCard(ctx context.Context, name1, name2 string) (uint64, error)
+	// Jaccard returns the Jaccard index of two bitmaps.
+	Jaccard(ctx context.Context, name1, name2 string) (float64, error)
+
+	// Query returns the result of a boolean expression over bitmaps like
+	// `(a AND b) OR (c ANDNOT d)`. NOT is the complement within the universe
+	// bitmap, or the union of bitmaps in the expression if universe is empty.
+	Query(ctx context.Context, expr, universe string) ([]uint32, error)
+	// QueryCard returns the cardinality of the result of the expression.
+	QueryCard(ctx context.Context, expr, universe string) (uint64, error)
+	// QueryStore stores the result of the expression to dst.
+	QueryStore(ctx context.Context, dst, expr, universe string) error
+
+	// ClusterInfo returns the status of the raft cluster seen by a server.
+	ClusterInfo(ctx context.Context) (*ClusterInfo, error)
+
+	// Close closes connections to servers.
+	Close() error
+}
+
+// Stats is the statistics of a bitmap.
+type Stats struct {
+	Cardinality uint64
+	Containers  uint64
+
+	ArrayContainers      uint64
+	ArrayContainerBytes  uint64
+	ArrayContainerValues uint64
+
+	BitmapContainers      uint64
+	BitmapContainerBytes  uint64
+	BitmapContainerValues uint64
+
+	RunContainers      uint64
+	RunContainerBytes  uint64
+	RunContainerValues uint64
+}
+
+// ClusterInfo is the status of the raft cluster seen by a server.
+type ClusterInfo struct {
+	ID       uint64 // id of the server
+	LeaderID uint64
+	State    string
+	Term     uint64
+	Commit   uint64
+	Applied  uint64
+	Members  []MemberInfo
+}
+
+// MemberInfo is a member of the raft cluster.
+type MemberInfo struct {
+	ID       uint64
+	Addr     string
+	Role     string
+	Match    uint64
+	Next     uint64
+	Progress string
+	Lag      uint64
+}
+
+// Options configures clients.
+type Options struct {
+	// Timeout of a request to a server, 0 means no timeout
+	// other than the deadline of the context.
+	Timeout time.Duration
+	// Retries is the number of retries of a request after retryable errors.
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubled for every retry.
+	RetryBackoff time.Duration
+	// PoolSize is the number of connections to every server.
+	PoolSize int
+	// LeaderTTL is how long the leader found is used before it's looked up again.
+	LeaderTTL time.Duration
+	// Namespace of bitmaps of requests, empty means the default namespace.
+	Namespace string
+}
+
+// DefaultOptions are the options used if nil options are passed to clients.
+var DefaultOptions = Options{
+	Timeout:      5 * time.Second,
+	Retries:      3,
+	RetryBackoff: 100 * time.Millisecond,
+	PoolSize:     4,
+	LeaderTTL:    10 * time.Second,
+}
+
+// DefaultScanCount is the number of values returned by Scan if count is not positive.
+const DefaultScanCount = 100
+
+// Operations, named after methods of the rpcx service.
+const (
+	opAdd         = "Add"
+	opAddMany     = "AddMany"
+	opRemove      = "Remove"
+	opDrop        = "RemoveBitmap"
+	opClear       = "ClearBitmap"
+	opExists      = "Exists"
+	opCard        = "Card"
+	opScan        = "Scan"
+	opStats       = "Stats"
+	opInter       = "Inter"
+	opInterStore  = "InterStore"
+	opUnion       = "Union"
+	opUnionStore  = "UnionStore"
+	opXor         = "Xor"
+	opXorStore    = "XorStore"
+	opDiff        = "Diff"
+	opDiffStore   = "DiffStore"
+	opInterCard   = "InterCard"
+	opUnionCard   = "UnionCard"
+	opXorCard     = "XorCard"
+	opDiffCard    = "DiffCard"
+	opJaccard     = "Jaccard"
+	opQuery       = "Query"
+	opQueryCard   = "QueryCard"
+	opQueryStore  = "QueryStore"
+	opClusterInfo = "ClusterInfo"
+)
+
+// request is an operation sent to a server. Names of store operations are
+// [dst, names...].
+type request struct {
+	op       string
+	names    []string
+	values   []uint32
+	cursor   uint32
+	count    int
+	expr     string // expression of queries
+	universe string // universe of queries
+}
+
+// response holds the result of a request, depending on its operation.
+type response struct {
+	ok      bool
+	card    uint64
+	index   float64
+	values  []uint32
+	stats   *Stats
+	cluster *ClusterInfo
+}
+
+// conn sends requests to a server.
+type conn interface {
+	addr() string
+	do(ctx context.Context, req *request) (*response, error)
+	close() error
+}
+
+// client implements Client over connections to servers, which sends writes to
+// the raft leader, and spreads reads over servers.
+type client struct {
+	opt   Options
+	conns []conn
+	next  uint32 // round robin index of reads
+	done  int32
+
+	mu         sync.Mutex
+	leader     int // index of the connection to the leader, -1 if unknown
+	leaderTime time.Time
+	standalone bool // servers are not in raft clusters
+}
+
+func newClient(conns []conn, opt *Options) *client {
+	c := &client{conns: conns, leader: -1}
+	if opt == nil {
+		c.opt = DefaultOptions
+	} else {
+		c.opt = *opt
+	}
+	return c
+}
+
+func (c *client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.done, 0, 1) {
+		return nil
+	}
+
+	var err error
+	for _, cn := range c.conns {
+		if cerr := cn.close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// call sends the request and retries it on another server after retryable errors.
+func (c *client) call(ctx context.Context, req *request, write bool) (*response, error) {
+	if atomic.LoadInt32(&c.done) == 1 {
+		return nil, &Error{Op: req.op, Err: ErrClosed}
+	}
+
+	backoff := c.opt.RetryBackoff
+	var err error
+	for i := 0; i <= c.opt.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return nil, &Error{Op: req.op, Err: ctx.Err()}
+			}
+			backoff *= 2
+		}
+
+		idx := c.pick(ctx, write)
+		cn := c.conns[idx]
+
+		var resp *response
+		resp, err = c.doTimeout(ctx, cn, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, &Error{Op: req.op, Addr: cn.addr(), Err: ctx.Err()}
+		}
+		err = wrapError(req.op, cn.addr(), err)
+		if !retryable(err) {
+			return nil, err
+		}
+		c.forgetLeader(idx)
+	}
+	return nil, err
+}
+
+func (c *client) doTimeout(ctx context.Context, cn conn, req *request) (*response, error) {
+	if c.opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opt.Timeout)
+		defer cancel()
+	}
+	return cn.do(ctx, req)
+}
+
+// pick returns the index of the connection for a request. Writes are sent
+// to the leader if it's known.
+func (c *client) pick(ctx context.Context, write bool) int {
+	if write {
+		if idx := c.leaderIndex(ctx); idx >= 0 {
+			return idx
+		}
+	}
+	return int(atomic.AddUint32(&c.next, 1) % uint32(len(c.conns)))
+}
+
+// leaderIndex returns the index of the connection to the leader, which is
+// looked up by cluster info of servers if it's unknown or expired.
+func (c *client) leaderIndex(ctx context.Context) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.standalone || len(c.conns) == 1 {
+		return -1
+	}
+	if c.leader >= 0 && time.Since(c.leaderTime) < c.opt.LeaderTTL {
+		return c.leader
+	}
+
+	c.leader = -1
+	c.leaderTime = time.Now()
+
+	// servers report their own id and the leader id, so the leader is the
+	// server whose id is the leader id.
+	var leaderID uint64
+	ids := make([]uint64, len(c.conns))
+	for i, cn := range c.conns {
+		resp, err := c.doTimeout(ctx, cn, &request{op: opClusterInfo})
+		if err != nil {
+			if isErr(err, ErrClusterDisabled) {
+				c.standalone = true
+				return -1
+			}
+			continue
+		}
+		ids[i] = resp.cluster.ID
+		if resp.cluster.LeaderID != 0 {
+			leaderID = resp.cluster.LeaderID
+		}
+		if leaderID != 0 && ids[i] == leaderID {
+			c.leader = i
+			return i
+		}
+	}
+
+	for i, id := range ids {
+		if leaderID != 0 && id == leaderID {
+			c.leader = i
+		}
+	}
+	return c.leader
+}
+
+func (c *client) forgetLeader(idx int) {
+	c.mu.Lock()
+	if c.leader == idx {
+		c.leader = -1
+	}
+	c.mu.Unlock()
+}
+
+func (c *client) write(ctx context.Context, req *request) error {
+	_, err := c.call(ctx, req, true)
+	return err
+}
+
+func (c *client) read(ctx context.Context, req *request) (*response, error) {
+	return c.call(ctx, req, false)
+}
+
+func (c *client) Add(ctx context.Context, name string, value uint32) error {
+	return c.write(ctx, &request{op: opAdd, names: []string{name}, values: []uint32{value}})
+}
+
+func (c *client) AddMany(ctx context.Context, name string, values []uint32) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return c.write(ctx, &request{op: opAddMany, names: []string{name}, values: values})
+}
+
+func (c *client) Remove(ctx context.Context, name string, value uint32) error {
+	return c.write(ctx, &request{op: opRemove, names: []string{name}, values: []uint32{value}})
+}
+
+func (c *client) Drop(ctx context.Context, name string) error {
+	return c.write(ctx, &request{op: opDrop, names: []string{name}})
+}
+
+func (c *client) Clear(ctx context.Context, name string) error {
+	return c.write(ctx, &request{op: opClear, names: []string{name}})
+}
+
+func (c *client) Exists(ctx context.Context, name string, value uint32) (bool, error) {
+	resp, err := c.read(ctx, &request{op: opExists, names: []string{name}, values: []uint32{value}})
+	if err != nil {
+		return false, err
+	}
+	return resp.ok, nil
+}
+
+func (c *client) Card(ctx context.Context, name string) (uint64, error) {
+	resp, err := c.read(ctx, &request{op: opCard, names: []string{name}})
+	if err != nil {
+		return 0, err
+	}
+	return resp.card, nil
+}
+
+func (c *client) Scan(ctx context.Context, name string, cursor uint32, count int) ([]uint32, uint32, error) {
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+	resp, err := c.read(ctx, &request{op: opScan, names: []string{name}, cursor: cursor, count: count})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	values := resp.values
+	if len(values) < count || values[len(values)-1] == math.MaxUint32 {
+		return values, 0, nil
+	}
+	return values, values[len(values)-1] + 1, nil
+}
+
+func (c *client) Stats(ctx context.Context, name string) (*Stats, error) {
+	resp, err := c.read(ctx, &request{op: opStats, names: []string{name}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.stats, nil
+}
+
+func (c *client) Inter(ctx context.Context, names ...string) ([]uint32, error) {
+	return c.values(ctx, opInter, names)
+}
+
+func (c *client) InterStore(ctx context.Context, dst string, names ...string) error {
+	return c.write(ctx, &request{op: opInterStore, names: append([]string{dst}, names...)})
+}
+
+func (c *client) Union(ctx context.Context, names ...string) ([]uint32, error) {
+	return c.values(ctx, opUnion, names)
+}
+
+func (c *client) UnionStore(ctx context.Context, dst string, names ...string) error {
+	return c.write(ctx, &request{op: opUnionStore, names: append([]string{dst}, names...)})
+}
+
+func (c *client) Xor(ctx context.Context, name1, name2 string) ([]uint32, error) {
+	return c.values(ctx, opXor, []string{name1, name2})
+}
+
+func (c *client) XorStore(ctx context.Context, dst, name1, name2 string) error {
+	return c.write(ctx, &request{op: opXorStore, names: []string{dst, name1, name2}})
+}
+
+func (c *client) Diff(ctx context.Context, name1, name2 string) ([]uint32, error) {
+	return c.values(ctx, opDiff, []string{name1, name2})
+}
+
+func (c *client) DiffStore(ctx context.Context, dst, name1, name2 string) error {
+	return c.write(ctx, &request{op: opDiffStore, names: []string{dst, name1, name2}})
+}
+
+func (c *client) InterCard(ctx context.Context, names ...string) (uint64, error) {
+	return c.card(ctx, opInterCard, names)
+}
+
+func (c *client) UnionCard(ctx context.Context, names ...string) (uint64, error) {
+	return c.card(ctx, opUnionCard, names)
+}
+
+func (c *client) XorCard(ctx context.Context, name1, name2 string) (uint64, error) {
+	return c.card(ctx, opXorCard, []string{name1, name2})
+}
+
+func (c *client) DiffCard(ctx context.Context, name1, name2 string) (uint64, error) {
+	return c.card(ctx, opDiffCard, []string{name1, name2})
+}
+
+func (c *client) Jaccard(ctx context.Context, name1, name2 string) (float64, error) {
+	resp, err := c.read(ctx, &request{op: opJaccard, names: []string{name1, name2}})
+	if err != nil {
+		return 0, err
+	}
+	return resp.index, nil
+}
+
+func (c *client) Query(ctx context.Context, expr, universe string) ([]uint32, error) {
+	resp, err := c.read(ctx, &request{op: opQuery, expr: expr, universe: universe})
+	if err != nil {
+		return nil, err
+	}
+	return resp.values, nil
+}
+
+func (c *client) QueryCard(ctx context.Context, expr, universe string) (uint64, error) {
+	resp, err := c.read(ctx, &request{op: opQueryCard, expr: expr, universe: universe})
+	if err != nil {
+		return 0, err
+	}
+	return resp.card, nil
+}
+
+func (c *client) QueryStore(ctx context.Context, dst, expr, universe string) error {
+	return c.write(ctx, &request{op: opQueryStore, names: []string{dst}, expr: expr, universe: universe})
+}
+
+func (c *client) card(ctx context.Context, op string, names []string) (uint64, error) {
+	if len(names) == 0 {
+		return 0, &Error{Op: op, Err: ErrInvalidArgument}
+	}
+	resp, err := c.read(ctx, &request{op: op, names: names})
+	if err != nil {
+		return 0, err
+	}
+	return resp.card, nil
+}
+
+func (c *client) values(ctx context.Context, op string, names []string) ([]uint32, error) {
+	if len(names) == 0 {
+		return nil, &Error{Op: op, Err: ErrInvalidArgument}
+	}
+	resp, err := c.read(ctx, &request{op: op, names: names})
+	if err != nil {
+		return nil, err
+	}
+	return resp.values, nil
+}
+
+func (c *client) ClusterInfo(ctx context.Context) (*ClusterInfo, error) {
+	resp, err := c.read(ctx, &request{op: opClusterInfo})
+	if err != nil {
+		return nil, err
+	}
+	return resp.cluster, nil
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeConn is a server which replies err to requests, if not nil.
+type fakeConn struct {
+	name     string
+	id       uint64
+	leaderID uint64
+	err      error
+	reqs     []string
+}
+
+func (c *fakeConn) addr() string { return c.name }
+func (c *fakeConn) close() error { return nil }
+
+func (c *fakeConn) do(ctx context.Context, req *request) (*response, error) {
+	if req.op == opClusterInfo {
+		return &response{cluster: &ClusterInfo{ID: c.id, LeaderID: c.leaderID}}, nil
+	}
+	c.reqs = append(c.reqs, req.op)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &response{ok: true}, nil
+}
+
+func testOptions() *Options {
+	opt := DefaultOptions
+	opt.RetryBackoff = time.Millisecond
+	return &opt
+}
+
+func TestClient_Leader(t *testing.T) {
+	conns := []*fakeConn{
+		{name: "a", id: 1, leaderID: 2},
+		{name: "b", id: 2, leaderID: 2},
+		{name: "c", id: 3, leaderID: 2},
+	}
+	c := newClient([]conn{conns[0], conns[1], conns[2]}, testOptions())
+
+	for i := 0; i < 3; i++ {
+		if err := c.Add(context.Background(), "test", 1); err != nil {
+			t.Fatalf("failed to add: %v", err)
+		}
+	}
+	if len(conns[1].reqs) != 3 {
+		t.Fatalf("expect writes are sent to the leader but got %d", len(conns[1].reqs))
+	}
+
+	// the leader moves to c
+	for _, cn := range conns {
+		cn.leaderID = 3
+	}
+	conns[1].err = ErrNotLeader
+	if err := c.Add(context.Background(), "test", 1); err != nil {
+		t.Fatalf("failed to add after the leader moved: %v", err)
+	}
+	if len(conns[2].reqs) != 1 {
+		t.Fatalf("expect the write is retried on the new leader but got %v", conns[2].reqs)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	cn := &fakeConn{name: "a", err: serverError("raft node is draining")}
+	opt := testOptions()
+	opt.Retries = 2
+	c := newClient([]conn{cn}, opt)
+
+	err := c.Remove(context.Background(), "test", 1)
+	if !errors.Is(err, ErrDraining) {
+		t.Fatalf("expect ErrDraining but got %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Op != opRemove || e.Addr != "a" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if len(cn.reqs) != 3 {
+		t.Fatalf("expect 3 tries but got %d", len(cn.reqs))
+	}
+
+	cn.reqs, cn.err = nil, serverError("wrong value for 'bmadd' command")
+	if err := c.Add(context.Background(), "test", 1); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expect ErrInvalidArgument but got %v", err)
+	}
+	if len(cn.reqs) != 1 {
+		t.Fatalf("expect no retry but got %d tries", len(cn.reqs))
+	}
+
+	c.Close()
+	if err := c.Add(context.Background(), "test", 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed but got %v", err)
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	var draining = true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add/a b/1", func(w http.ResponseWriter, r *http.Request) {
+		if draining {
+			draining = false
+			http.Error(w, "raft node is draining", http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/exists/test/1", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/exists/test/2", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/scan/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("cursor") != "5" || r.URL.Query().Get("count") != "2" {
+			http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("[5,7]"))
+	})
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Method != http.MethodPost || body["expr"] != "a AND NOT b" || body["universe"] != "u" {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		if body["count"] == true {
+			w.Write([]byte("2"))
+			return
+		}
+		w.Write([]byte("[1,3]"))
+	})
+	mux.HandleFunc("/cluster", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "cluster mode is disabled", http.StatusNotFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := NewHTTPClient([]string{ts.URL}, testOptions())
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Add(ctx, "a b", 1); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	if ok, err := c.Exists(ctx, "test", 1); err != nil || !ok {
+		t.Fatalf("expect 1 exists but got %v, %v", ok, err)
+	}
+	if ok, err := c.Exists(ctx, "test", 2); err != nil || ok {
+		t.Fatalf("expect 2 doesn't exist but got %v, %v", ok, err)
+	}
+
+	values, next, err := c.Scan(ctx, "test", 5, 2)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if !reflect.DeepEqual(values, []uint32{5, 7}) || next != 8 {
+		t.Fatalf("unexpected scan result %v, %d", values, next)
+	}
+
+	if values, err := c.Query(ctx, "a AND NOT b", "u"); err != nil || !reflect.DeepEqual(values, []uint32{1, 3}) {
+		t.Fatalf("unexpected query result %v, %v", values, err)
+	}
+	if n, err := c.QueryCard(ctx, "a AND NOT b", "u"); err != nil || n != 2 {
+		t.Fatalf("unexpected query cardinality %d, %v", n, err)
+	}
+	if _, err := c.Query(ctx, "a AND", ""); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expect ErrInvalidArgument but got %v", err)
+	}
+
+	if _, err := c.ClusterInfo(ctx); !errors.Is(err, ErrClusterDisabled) {
+		t.Fatalf("expect ErrClusterDisabled but got %v", err)
+	}
+	if _, err := c.Card(ctx, "test"); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expect ErrUnsupported but got %v", err)
+	}
+	if _, err := c.Inter(ctx, "a,b", "c"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expect ErrInvalidArgument but got %v", err)
+	}
+	if err := c.Drop(ctx, "a/b"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expect ErrInvalidArgument but got %v", err)
+	}
+}
+
+func TestRedisReplies(t *testing.T) {
+	values, err := redisValues([]interface{}{int64(1), int64(4294967295)})
+	if err != nil || !reflect.DeepEqual(values, []uint32{1, 4294967295}) {
+		t.Fatalf("unexpected values %v, %v", values, err)
+	}
+	if _, err := redisValues([]interface{}{int64(-1)}); err == nil {
+		t.Fatal("expect error of negative values")
+	}
+
+	info, err := redisClusterInfo("cluster_my_id:2\r\ncluster_leader_id:3\r\ncluster_my_state:StateFollower\r\ncluster_term:4\r\n")
+	if err != nil {
+		t.Fatalf("failed to parse cluster info: %v", err)
+	}
+	if info.ID != 2 || info.LeaderID != 3 || info.State != "StateFollower" || info.Term != 4 {
+		t.Fatalf("unexpected cluster info %+v", info)
+	}
+}
+
+func TestHTTPClient_Namespace(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/add/test/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ns") != "tenant" {
+			http.Error(w, "unexpected namespace "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "quota of bitmaps of the namespace exceeded", http.StatusInsufficientStorage)
+	})
+	mux.HandleFunc("/scan/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("ns") != "tenant" || r.URL.Query().Get("cursor") != "0" {
+			http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("[]"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	opt := testOptions()
+	opt.Namespace = "tenant"
+	c := NewHTTPClient([]string{ts.URL}, opt)
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Add(ctx, "test", 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expect ErrQuotaExceeded but got %v", err)
+	}
+	if _, _, err := c.Scan(ctx, "test", 0, 2); err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrDraining is returned if the server is draining before it's stopped.
+	ErrDraining = errors.New("server is draining")
+	// ErrNotLeader is returned if a write is sent to a raft node which is not the leader.
+	ErrNotLeader = errors.New("server is not the leader")
+	// ErrClusterDisabled is returned by ClusterInfo if the server is not in a raft cluster.
+	ErrClusterDisabled = errors.New("cluster mode is disabled")
+	// ErrUnsupported is returned if the server doesn't support the operation.
+	ErrUnsupported = errors.New("operation is not supported by the server")
+	// ErrInvalidArgument is returned if arguments are rejected by the client or the server.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrOOM is returned if a write is rejected because the server is out of its memory budget.
+	ErrOOM = errors.New("server is out of memory")
+	// ErrQuotaExceeded is returned if a write is rejected by the quota of the namespace.
+	ErrQuotaExceeded = errors.New("quota of the namespace exceeded")
+	// ErrFailed is returned if the server failed to apply a write.
+	ErrFailed = errors.New("operation failed")
+	// ErrUnavailable is returned if the server can't be reached.
+	ErrUnavailable = errors.New("server is unavailable")
+	// ErrClosed is returned if the client is closed.
+	ErrClosed = errors.New("client is closed")
+)
+
+// Error is the error of an operation, which wraps one of the errors above or
+// the error of the context. Use errors.Is to check it.
+type Error struct {
+	Op   string // operation, e.g. Add
+	Addr string // address of the server, empty if no server was called
+	Err  error
+	Msg  string // message from the server, if any
+}
+
+func (e *Error) Error() string {
+	s := "basalt: " + e.Op
+	if e.Addr != "" {
+		s += " " + e.Addr
+	}
+	s += ": " + e.Err.Error()
+	if e.Msg != "" && e.Msg != e.Err.Error() {
+		s += ": " + e.Msg
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// serverError maps the error message of a server to a typed error.
+func serverError(msg string) error {
+	msg = strings.TrimSpace(msg)
+	lower := strings.ToLower(msg)
+
+	var err error
+	switch {
+	case strings.Contains(lower, "draining"):
+		err = ErrDraining
+	case strings.Contains(lower, "not the leader"), strings.Contains(lower, "not leader"):
+		err = ErrNotLeader
+	case strings.Contains(lower, "cluster mode is disabled"),
+		strings.Contains(lower, "cluster support disabled"):
+		err = ErrClusterDisabled
+	case strings.Contains(lower, "can't find method"),
+		strings.Contains(lower, "can't find service"),
+		strings.Contains(lower, "unknown command"),
+		strings.Contains(lower, "unknown subcommand"),
+		lower == "404 page not found":
+		err = ErrUnsupported
+	case strings.HasPrefix(lower, "oom "):
+		err = ErrOOM
+	case strings.Contains(lower, "quota"):
+		err = ErrQuotaExceeded
+	case strings.Contains(lower, "wrong value"),
+		strings.Contains(lower, "wrong number of arguments"),
+		strings.Contains(lower, "invalid"),
+		strings.Contains(lower, "parse"):
+		err = ErrInvalidArgument
+	default:
+		err = ErrFailed
+	}
+	return &Error{Err: err, Msg: msg}
+}
+
+// wrapError sets the operation and server of err, which is returned by connections.
+func wrapError(op, addr string, err error) error {
+	e, ok := err.(*Error)
+	if !ok {
+		return &Error{Op: op, Addr: addr, Err: err}
+	}
+	e.Op, e.Addr = op, addr
+	return e
+}
+
+// unavailable is the error of a request which doesn't reach the server.
+func unavailable(err error) error {
+	return &Error{Err: ErrUnavailable, Msg: err.Error()}
+}
+
+// retryable returns whether the request may succeed on another try or server.
+func retryable(err error) bool {
+	return isErr(err, ErrUnavailable) || isErr(err, ErrDraining) ||
+		isErr(err, ErrNotLeader) || isErr(err, ErrFailed)
+}
+
+func isErr(err, target error) bool {
+	return errors.Is(err, target)
+}
+
+func errUnexpectedReply(v interface{}) error {
+	return fmt.Errorf("unexpected reply %v", v)
+}
@@ -0,0 +1,248 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// NewHTTPClient returns a client of basalt servers by http, addrs are their
+// http addresses like 127.0.0.1:8972 or http://127.0.0.1:8972.
+func NewHTTPClient(addrs []string, opt *Options) Client {
+	c := newClient(nil, opt)
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: c.opt.PoolSize,
+		},
+	}
+	for _, addr := range addrs {
+		base := strings.TrimSuffix(addr, "/")
+		if !strings.Contains(base, "://") {
+			base = "http://" + base
+		}
+		c.conns = append(c.conns, &httpConn{base: base, namespace: c.opt.Namespace, client: hc})
+	}
+	return c
+}
+
+type httpConn struct {
+	base      string
+	namespace string
+	client    *http.Client
+}
+
+func (c *httpConn) addr() string {
+	return c.base
+}
+
+func (c *httpConn) close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// httpPath returns the method and the path of the request.
+func httpPath(req *request) (string, string, error) {
+	// names of bitmaps are escaped in paths, and lists of names are joined by ','.
+	// servers route by unescaped paths so names can't contain '/'.
+	var segs []string
+	for _, name := range req.names {
+		if name == "" || strings.Contains(name, "/") {
+			return "", "", ErrInvalidArgument
+		}
+		if strings.Contains(name, ",") && (req.op == opInter || req.op == opUnion ||
+			req.op == opInterStore || req.op == opUnionStore ||
+			req.op == opInterCard || req.op == opUnionCard) {
+			return "", "", ErrInvalidArgument
+		}
+		segs = append(segs, url.PathEscape(name))
+	}
+
+	switch req.op {
+	case opAdd:
+		return http.MethodPost, "/add/" + segs[0] + "/" + strconv.FormatUint(uint64(req.values[0]), 10), nil
+	case opAddMany:
+		return http.MethodPost, "/addmany/" + segs[0] + "/" + uint32s2str(req.values), nil
+	case opRemove:
+		return http.MethodPost, "/remove/" + segs[0] + "/" + strconv.FormatUint(uint64(req.values[0]), 10), nil
+	case opDrop:
+		return http.MethodPost, "/drop/" + segs[0], nil
+	case opClear:
+		return http.MethodPost, "/clear/" + segs[0], nil
+	case opExists:
+		return http.MethodGet, "/exists/" + segs[0] + "/" + strconv.FormatUint(uint64(req.values[0]), 10), nil
+	case opCard:
+		return http.MethodGet, "/card/" + segs[0], nil
+	case opScan:
+		return http.MethodGet, "/scan/" + segs[0] + "?cursor=" + strconv.FormatUint(uint64(req.cursor), 10) +
+			"&count=" + strconv.Itoa(req.count), nil
+	case opStats:
+		return http.MethodGet, "/stats/" + segs[0], nil
+	case opInter:
+		return http.MethodGet, "/inter/" + strings.Join(segs, ","), nil
+	case opInterStore:
+		return http.MethodGet, "/interstore/" + segs[0] + "/" + strings.Join(segs[1:], ","), nil
+	case opUnion:
+		return http.MethodGet, "/union/" + strings.Join(segs, ","), nil
+	case opUnionStore:
+		return http.MethodGet, "/unionstore/" + segs[0] + "/" + strings.Join(segs[1:], ","), nil
+	case opXor:
+		return http.MethodGet, "/xor/" + segs[0] + "/" + segs[1], nil
+	case opXorStore:
+		return http.MethodGet, "/xorstore/" + strings.Join(segs, "/"), nil
+	case opDiff:
+		return http.MethodGet, "/diff/" + segs[0] + "/" + segs[1], nil
+	case opDiffStore:
+		return http.MethodGet, "/diffstore/" + strings.Join(segs, "/"), nil
+	case opInterCard:
+		return http.MethodGet, "/intercard/" + strings.Join(segs, ","), nil
+	case opUnionCard:
+		return http.MethodGet, "/unioncard/" + strings.Join(segs, ","), nil
+	case opXorCard:
+		return http.MethodGet, "/xorcard/" + segs[0] + "/" + segs[1], nil
+	case opDiffCard:
+		return http.MethodGet, "/diffcard/" + segs[0] + "/" + segs[1], nil
+	case opJaccard:
+		return http.MethodGet, "/jaccard/" + segs[0] + "/" + segs[1], nil
+	case opQuery, opQueryCard, opQueryStore:
+		return http.MethodPost, "/query", nil
+	case opClusterInfo:
+		return http.MethodGet, "/cluster", nil
+	}
+	return "", "", ErrUnsupported
+}
+
+// httpBody returns the body of the request, only queries have bodies.
+func httpBody(req *request) (io.Reader, error) {
+	if req.op != opQuery && req.op != opQueryCard && req.op != opQueryStore {
+		return nil, nil
+	}
+
+	body := map[string]interface{}{
+		"expr":     req.expr,
+		"universe": req.universe,
+		"count":    req.op == opQueryCard,
+	}
+	if req.op == opQueryStore {
+		body["destination"] = req.names[0]
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (c *httpConn) do(ctx context.Context, req *request) (*response, error) {
+	method, path, err := httpPath(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the namespace is a query parameter of all requests
+	if c.namespace != "" && req.op != opClusterInfo {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "ns=" + url.QueryEscape(c.namespace)
+	}
+
+	body, err := httpBody(req)
+	if err != nil {
+		return nil, &Error{Err: ErrInvalidArgument, Msg: err.Error()}
+	}
+	hreq, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, &Error{Err: ErrInvalidArgument, Msg: err.Error()}
+	}
+	hresp, err := c.client.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer hresp.Body.Close()
+
+	data, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	text := strings.TrimSpace(string(data))
+
+	// the basalt server replies 404 if the value doesn't exist
+	if req.op == opExists && hresp.StatusCode == http.StatusNotFound && text == "not found" {
+		return &response{}, nil
+	}
+	if hresp.StatusCode != http.StatusOK {
+		return nil, serverError(text)
+	}
+
+	// dboat servers reply errors with 200
+	switch text {
+	case "OPERATION ERROR":
+		return nil, &Error{Err: ErrFailed, Msg: text}
+	case "INVALID DATA":
+		return nil, &Error{Err: ErrInvalidArgument, Msg: text}
+	}
+
+	resp := &response{}
+	switch req.op {
+	case opExists:
+		// dboat servers reply true or false, and the basalt server replies an empty body
+		resp.ok = text != "false"
+	case opCard, opInterCard, opUnionCard, opXorCard, opDiffCard, opQueryCard, opQueryStore:
+		resp.card, err = strconv.ParseUint(text, 10, 64)
+	case opJaccard:
+		resp.index, err = strconv.ParseFloat(text, 64)
+	case opScan, opInter, opUnion, opXor, opDiff, opQuery:
+		resp.values, err = str2uint32s(text)
+	case opStats:
+		resp.stats = &Stats{}
+		err = json.Unmarshal(data, resp.stats)
+	case opClusterInfo:
+		resp.cluster = &ClusterInfo{}
+		err = json.Unmarshal(data, resp.cluster)
+	default:
+		resp.ok = true
+	}
+	if err != nil {
+		return nil, &Error{Err: ErrFailed, Msg: err.Error()}
+	}
+	return resp, nil
+}
+
+func uint32s2str(values []uint32) string {
+	var sb strings.Builder
+	for i, v := range values {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatUint(uint64(v), 10))
+	}
+	return sb.String()
+}
+
+// str2uint32s parses lists of values like [1,2,3].
+func str2uint32s(s string) ([]uint32, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if s == "" {
+		return []uint32{}, nil
+	}
+
+	fields := strings.Split(s, ",")
+	values := make([]uint32, 0, len(fields))
+	for _, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, uint32(v))
+	}
+	return values, nil
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// NewRedisClient returns a client of basalt servers by the redis protocol,
+// addrs are their redis addresses like 127.0.0.1:8972.
+func NewRedisClient(addrs []string, opt *Options) Client {
+	c := newClient(nil, opt)
+
+	// connections select the namespace once they are established
+	var onConnect func(*redis.Conn) error
+	if ns := c.opt.Namespace; ns != "" {
+		onConnect = func(cn *redis.Conn) error {
+			return cn.Do("select", ns).Err()
+		}
+	}
+	for _, addr := range addrs {
+		c.conns = append(c.conns, &redisConn{
+			client: redis.NewClient(&redis.Options{
+				Addr:      addr,
+				PoolSize:  c.opt.PoolSize,
+				OnConnect: onConnect,
+			}),
+		})
+	}
+	return c
+}
+
+type redisConn struct {
+	client *redis.Client
+}
+
+func (c *redisConn) addr() string {
+	return c.client.Options().Addr
+}
+
+func (c *redisConn) close() error {
+	return c.client.Close()
+}
+
+func (c *redisConn) do(ctx context.Context, req *request) (*response, error) {
+	var args []interface{}
+	switch req.op {
+	case opAdd:
+		args = []interface{}{"bmadd", req.names[0], req.values[0]}
+	case opAddMany:
+		args = []interface{}{"bmaddmany", req.names[0]}
+		for _, v := range req.values {
+			args = append(args, v)
+		}
+	case opRemove:
+		args = []interface{}{"bmdel", req.names[0], req.values[0]}
+	case opDrop:
+		args = []interface{}{"bmdrop", req.names[0]}
+	case opClear:
+		args = []interface{}{"bmclear", req.names[0]}
+	case opExists:
+		args = []interface{}{"bmexists", req.names[0], req.values[0]}
+	case opCard:
+		args = []interface{}{"bmcard", req.names[0]}
+	case opScan:
+		args = []interface{}{"bmscan", req.names[0], req.cursor, req.count}
+	case opStats:
+		args = []interface{}{"bmstats", req.names[0]}
+	case opQuery, opQueryCard, opQueryStore:
+		args = []interface{}{"bmquery", req.expr}
+		if req.universe != "" {
+			args = append(args, "UNIVERSE", req.universe)
+		}
+		switch req.op {
+		case opQueryCard:
+			args = append(args, "COUNT")
+		case opQueryStore:
+			args = append(args, "STORE", req.names[0])
+		}
+	case opClusterInfo:
+		args = []interface{}{"cluster", "info"}
+	default:
+		// the commands of set operations are their names in lower case
+		args = []interface{}{"bm" + strings.ToLower(req.op)}
+		for _, name := range req.names {
+			args = append(args, name)
+		}
+	}
+
+	v, err := c.client.WithContext(ctx).Do(args...).Result()
+	if err != nil {
+		// errors replied by servers start with ERR
+		if strings.HasPrefix(err.Error(), "ERR ") {
+			return nil, serverError(strings.TrimPrefix(err.Error(), "ERR "))
+		}
+		return nil, unavailable(err)
+	}
+
+	resp := &response{}
+	switch req.op {
+	case opExists:
+		resp.ok, err = redisBool(v)
+	case opCard, opInterCard, opUnionCard, opXorCard, opDiffCard, opQueryCard, opQueryStore:
+		resp.card, err = redisUint(v)
+	case opJaccard:
+		resp.index, err = redisFloat(v)
+	case opScan, opInter, opUnion, opXor, opDiff, opQuery:
+		resp.values, err = redisValues(v)
+	case opStats:
+		resp.stats, err = redisStats(v)
+	case opClusterInfo:
+		resp.cluster, err = redisClusterInfo(v)
+	default:
+		resp.ok = true
+	}
+	if err != nil {
+		return nil, &Error{Err: ErrFailed, Msg: err.Error()}
+	}
+	return resp, nil
+}
+
+func redisBool(v interface{}) (bool, error) {
+	n, err := redisUint(v)
+	return n == 1, err
+}
+
+func redisUint(v interface{}) (uint64, error) {
+	n, ok := v.(int64)
+	if !ok || n < 0 {
+		return 0, errUnexpectedReply(v)
+	}
+	return uint64(n), nil
+}
+
+func redisValues(v interface{}) ([]uint32, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, errUnexpectedReply(v)
+	}
+
+	values := make([]uint32, 0, len(a))
+	for _, e := range a {
+		n, ok := e.(int64)
+		if !ok || n < 0 || n > 1<<32-1 {
+			return nil, errUnexpectedReply(e)
+		}
+		values = append(values, uint32(n))
+	}
+	return values, nil
+}
+
+func redisFloat(v interface{}) (float64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, errUnexpectedReply(v)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// redisMetrics parses lines of name:value replied by commands like bmstats.
+func redisMetrics(v interface{}) (map[string]string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errUnexpectedReply(v)
+	}
+
+	metrics := make(map[string]string)
+	for _, line := range strings.Split(s, "\r\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			metrics[line[:i]] = line[i+1:]
+		}
+	}
+	return metrics, nil
+}
+
+func redisStats(v interface{}) (*Stats, error) {
+	m, err := redisMetrics(v)
+	if err != nil {
+		return nil, err
+	}
+
+	u := func(name string) uint64 {
+		n, _ := strconv.ParseUint(m[name], 10, 64)
+		return n
+	}
+	return &Stats{
+		Cardinality: u("cardinality"),
+		Containers:  u("Containers"),
+
+		ArrayContainers:      u("ArrayContainers"),
+		ArrayContainerBytes:  u("ArrayContainerBytes"),
+		ArrayContainerValues: u("ArrayContainerValues"),
+
+		BitmapContainers:      u("BitmapContainers"),
+		BitmapContainerBytes:  u("BitmapContainerBytes"),
+		BitmapContainerValues: u("BitmapContainerValues"),
+
+		RunContainers:      u("RunContainers"),
+		RunContainerBytes:  u("RunContainerBytes"),
+		RunContainerValues: u("RunContainerValues"),
+	}, nil
+}
+
+// redisClusterInfo parses the reply of cluster info, which has no members.
+func redisClusterInfo(v interface{}) (*ClusterInfo, error) {
+	m, err := redisMetrics(v)
+	if err != nil {
+		return nil, err
+	}
+
+	u := func(name string) uint64 {
+		n, _ := strconv.ParseUint(m[name], 10, 64)
+		return n
+	}
+	return &ClusterInfo{
+		ID:       u("cluster_my_id"),
+		LeaderID: u("cluster_leader_id"),
+		State:    m["cluster_my_state"],
+		Term:     u("cluster_term"),
+		Commit:   u("cluster_commit_index"),
+		Applied:  u("cluster_applied_index"),
+	}, nil
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+
+	rpcxclient "github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/share"
+)
+
+// Requests of the rpcx service. They are encoded by msgpack which matches
+// fields by name, so they are compatible with the types of the server.
+type (
+	// BitmapValueRequest contains the name of bitmap and value.
+	BitmapValueRequest struct {
+		Name  string
+		Value uint32
+	}
+
+	// BitmapValuesRequest contains the name of bitmap and values.
+	BitmapValuesRequest struct {
+		Name   string
+		Values []uint32
+	}
+
+	// BitmapScanRequest contains the name of bitmap, the cursor and the count of values.
+	BitmapScanRequest struct {
+		Name   string
+		Cursor uint32
+		Count  int
+	}
+
+	// BitmapStoreRequest contains the name of destination and names of bitmaps.
+	BitmapStoreRequest struct {
+		Destination string
+		Names       []string
+	}
+
+	// BitmapPairRequest contains the name of two bitmaps.
+	BitmapPairRequest struct {
+		Name1 string
+		Name2 string
+	}
+
+	// BitmapDstAndPairRequest contains destination and the name of two bitmaps.
+	BitmapDstAndPairRequest struct {
+		Destination string
+		Name1       string
+		Name2       string
+	}
+
+	// BitmapQueryRequest contains the expression and universe of a query,
+	// and whether to count or store the result.
+	BitmapQueryRequest struct {
+		Expr        string
+		Universe    string
+		Count       bool
+		Destination string
+	}
+
+	// BitmapQueryResult contains the result of a query.
+	BitmapQueryResult struct {
+		Values []uint32
+		Card   uint64
+	}
+)
+
+// rpcxServicePath is the name of the rpcx service of basalt servers.
+const rpcxServicePath = "Bitmap"
+
+// rpcxNamespaceKey is the metadata key of the namespace of requests.
+const rpcxNamespaceKey = "ns"
+
+// NewRpcxClient returns a client of basalt servers by rpcx, addrs are their
+// rpcx addresses like 127.0.0.1:8972.
+func NewRpcxClient(addrs []string, opt *Options) Client {
+	c := newClient(nil, opt)
+
+	for _, addr := range addrs {
+		c.conns = append(c.conns, newRpcxConn(addr, &c.opt))
+	}
+	return c
+}
+
+type rpcxConn struct {
+	address   string
+	namespace string
+	pool      *rpcxclient.XClientPool
+}
+
+func newRpcxConn(addr string, opt *Options) *rpcxConn {
+	size := opt.PoolSize
+	if size <= 0 {
+		size = 1
+	}
+	d := rpcxclient.NewPeer2PeerDiscovery("tcp@"+addr, "")
+	return &rpcxConn{
+		address:   addr,
+		namespace: opt.Namespace,
+		pool:      rpcxclient.NewXClientPool(size, rpcxServicePath, rpcxclient.Failfast, rpcxclient.RandomSelect, d, rpcxclient.DefaultOption),
+	}
+}
+
+func (c *rpcxConn) addr() string {
+	return c.address
+}
+
+func (c *rpcxConn) close() error {
+	c.pool.Close()
+	return nil
+}
+
+func (c *rpcxConn) do(ctx context.Context, req *request) (*response, error) {
+	// queries are all served by the Query method
+	method := req.op
+	var args interface{}
+	switch req.op {
+	case opAdd, opRemove, opExists:
+		args = &BitmapValueRequest{Name: req.names[0], Value: req.values[0]}
+	case opAddMany:
+		args = &BitmapValuesRequest{Name: req.names[0], Values: req.values}
+	case opDrop, opClear, opCard, opStats:
+		args = req.names[0]
+	case opScan:
+		args = &BitmapScanRequest{Name: req.names[0], Cursor: req.cursor, Count: req.count}
+	case opInter, opUnion, opInterCard, opUnionCard:
+		args = req.names
+	case opInterStore, opUnionStore:
+		args = &BitmapStoreRequest{Destination: req.names[0], Names: req.names[1:]}
+	case opXor, opDiff, opXorCard, opDiffCard, opJaccard:
+		args = &BitmapPairRequest{Name1: req.names[0], Name2: req.names[1]}
+	case opXorStore, opDiffStore:
+		args = &BitmapDstAndPairRequest{Destination: req.names[0], Name1: req.names[1], Name2: req.names[2]}
+	case opQuery, opQueryCard, opQueryStore:
+		method = opQuery
+		qreq := &BitmapQueryRequest{Expr: req.expr, Universe: req.universe, Count: req.op == opQueryCard}
+		if req.op == opQueryStore {
+			qreq.Destination = req.names[0]
+		}
+		args = qreq
+	case opClusterInfo:
+		args = ""
+	default:
+		return nil, ErrUnsupported
+	}
+
+	resp := &response{}
+	var reply interface{}
+	switch req.op {
+	case opCard, opInterCard, opUnionCard, opXorCard, opDiffCard:
+		reply = &resp.card
+	case opJaccard:
+		reply = &resp.index
+	case opScan, opInter, opUnion, opXor, opDiff:
+		reply = &resp.values
+	case opStats:
+		resp.stats = &Stats{}
+		reply = resp.stats
+	case opClusterInfo:
+		resp.cluster = &ClusterInfo{}
+		reply = resp.cluster
+	case opQuery, opQueryCard, opQueryStore:
+		reply = &BitmapQueryResult{}
+	default:
+		reply = &resp.ok
+	}
+
+	// the namespace is sent in the metadata of requests
+	if c.namespace != "" {
+		ctx = context.WithValue(ctx, share.ReqMetaDataKey, map[string]string{rpcxNamespaceKey: c.namespace})
+	}
+	if err := c.pool.Get().Call(ctx, method, args, reply); err != nil {
+		if se, ok := err.(rpcxclient.ServiceError); ok {
+			return nil, serverError(string(se))
+		}
+		return nil, unavailable(err)
+	}
+
+	if qr, ok := reply.(*BitmapQueryResult); ok {
+		resp.values, resp.card = qr.Values, qr.Card
+	}
+
+	// writes of dboat servers reply false if they are failed to apply
+	if reply == &resp.ok && req.op != opExists && !resp.ok {
+		return nil, ErrFailed
+	}
+	return resp, nil
+}
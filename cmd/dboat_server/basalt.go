@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/lni/dragonboat/v3"
 	"github.com/lni/dragonboat/v3/config"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -20,11 +24,17 @@ const (
 
 var (
 	port = flag.Int("port", 18419, "server port")
+	advertise = flag.String("advertise", "", "address of this server for other nodes, defaults to the host of the raft address with the server port")
 
 	peers = flag.String("peers", "localhost:63001", "dragonboat peers addresses with comma separated")
 	nodeId = flag.Int("nodeid", 1, "dragonboat node id")
 	join = flag.Bool("join", false, "new added node")
+	observer = flag.Bool("observer", false, "join as a non-voting observer which serves stale reads")
 	dataBaseDir = flag.String("basedir", "/Users/jayn1985/basalt", "dragonboat wal & node host base dir")
+	onDisk = flag.Bool("ondisk", false, "store bitmaps on disk instead of memory")
+	cacheSize = flag.Int64("cache-size", 256<<20, "size of bitmaps cached in memory by the on-disk state machine")
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "timeout of draining on shutdown")
+	hashCheckInterval = flag.Duration("hash-check-interval", time.Minute, "interval of comparing state hashes of replicas, 0 disables it")
 )
 
 func main() {
@@ -57,15 +67,26 @@ func main() {
 		CheckQuorum:  true,
 		SnapshotEntries: 10000,
 		CompactionOverhead: 500,
+		IsObserver: *observer,
+	}
 
+	// a joining node (observers always join) learns members from the cluster
+	if *join || *observer {
+		members = map[uint64]string{}
 	}
 
+	// the metadata cluster runs on every node with the same members as the first shard
+	mc := rc
+	mc.ClusterID = metaClusterId
+
 	dataDir := filepath.Join(*dataBaseDir, fmt.Sprintf("node-%d", *nodeId))
+	events := newRaftEventListener()
 	nhc := config.NodeHostConfig{
 		WALDir: dataDir,
 		NodeHostDir: dataDir,
 		RTTMillisecond: 200,
 		RaftAddress: nodeAddr,
+		RaftEventListener: events,
 	}
 
 	nh, err := dragonboat.NewNodeHost(nhc)
@@ -75,11 +96,20 @@ func main() {
 
 	//bitmaps := basalt.NewBitmaps()
 	//hdr := CreateBasaltStateMachineHandler(bitmaps)
-	if err = nh.StartCluster(members, *join, NewBasalStateMachine, rc); err != nil {
+	if err = nh.StartCluster(members, *join || *observer, NewMetaStateMachine, mc); err != nil {
+		log.Fatalf("failed to start metadata cluster: %v\n", err)
+	}
+	if err = startShard(nh, members, *join || *observer, rc); err != nil {
 		log.Fatalf("failed to start cluster: %v\n", err)
 	}
 
-	srv := NewServer(fmt.Sprintf(":%d", *port), nh, nil)
+	advertiseAddr := *advertise
+	if advertiseAddr == "" {
+		host, _, _ := net.SplitHostPort(nhc.RaftAddress)
+		advertiseAddr = net.JoinHostPort(host, strconv.Itoa(*port))
+	}
+
+	srv := NewServer(fmt.Sprintf(":%d", *port), advertiseAddr, nh, events, rc, members, nil)
 
 	go func() {
 		if err := srv.Serve(); err != nil && err != http.ErrServerClosed {
@@ -87,9 +117,25 @@ func main() {
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// move the leadership off this node and finish in-flight proposals before stopping
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	if err := srv.drain(ctx); err != nil {
+		log.Printf("failed to drain: %v", err)
+	}
+	cancel()
+
 	srv.Close()
 }
+
+// startShard starts a replica of a shard, whose bitmaps are kept in memory or on disk.
+func startShard(nh *dragonboat.NodeHost, members map[uint64]string, join bool, rc config.Config) error {
+	if *onDisk {
+		dir := filepath.Join(*dataBaseDir, fmt.Sprintf("node-%d", rc.NodeID), "bitmaps")
+		return nh.StartOnDiskCluster(members, join, NewBasaltOnDiskStateMachineFactory(dir, *cacheSize), rc)
+	}
+	return nh.StartCluster(members, join, NewBasalStateMachine, rc)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v3"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+// raftEventListener records the latest leader and term of clusters,
+// which are not exposed by NodeHost.
+type raftEventListener struct {
+	mu      sync.RWMutex
+	leaders map[uint64]raftio.LeaderInfo
+}
+
+func newRaftEventListener() *raftEventListener {
+	return &raftEventListener{
+		leaders: make(map[uint64]raftio.LeaderInfo),
+	}
+}
+
+func (l *raftEventListener) LeaderUpdated(info raftio.LeaderInfo) {
+	l.mu.Lock()
+	l.leaders[info.ClusterID] = info
+	l.mu.Unlock()
+}
+
+func (l *raftEventListener) leaderInfo(clusterId uint64) raftio.LeaderInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.leaders[clusterId]
+}
+
+// clusterInfo returns members, roles, leader and term of the basalt cluster.
+// dragonboat doesn't expose commit/applied indexes and replication progress,
+// so they are left empty.
+func (s *BasaltServer) clusterInfo() (*ClusterInfo, error) {
+	var local *dragonboat.ClusterInfo
+	nhi := s.nh.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+	for i := range nhi.ClusterInfoList {
+		if nhi.ClusterInfoList[i].ClusterID == basaltClusterId {
+			local = &nhi.ClusterInfoList[i]
+			break
+		}
+	}
+	if local == nil {
+		return nil, dragonboat.ErrClusterNotFound
+	}
+
+	leaderID, _, err := s.nh.GetLeaderID(basaltClusterId)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ClusterInfo{
+		ID:       local.NodeID,
+		LeaderID: leaderID,
+		Term:     s.events.leaderInfo(basaltClusterId).Term,
+	}
+	switch {
+	case local.IsLeader:
+		info.State = "leader"
+	case local.IsObserver:
+		info.State = "observer"
+	case local.IsWitness:
+		info.State = "witness"
+	default:
+		info.State = "follower"
+	}
+
+	addMember := func(id uint64, addr, role string) {
+		if id == leaderID {
+			role = "leader"
+		}
+		info.Members = append(info.Members, MemberInfo{ID: id, Addr: addr, Role: role})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	m, err := s.nh.SyncGetClusterMembership(ctx, basaltClusterId)
+	if err != nil {
+		// observers may not be able to read the membership linearizably,
+		// fall back to the voters known by the local node.
+		for id, addr := range local.Nodes {
+			addMember(id, addr, "voter")
+		}
+	} else {
+		for id, addr := range m.Nodes {
+			addMember(id, addr, "voter")
+		}
+		for id, addr := range m.Observers {
+			addMember(id, addr, "learner")
+		}
+		for id, addr := range m.Witnesses {
+			addMember(id, addr, "witness")
+		}
+	}
+
+	sort.Slice(info.Members, func(i, j int) bool { return info.Members[i].ID < info.Members[j].ID })
+	return info, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rpcxio/basalt"
+)
+
+// ErrInvalidRequest is returned for malformed requests.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// codecVersion is the first byte of binary encoded BasaltData. Entries written
+// before the binary codec are json objects starting with '{'. Writes with a
+// quota are encoded with codecQuotaVersion, so entries without a quota can
+// still be applied by old versions.
+const (
+	codecVersion      byte = 1
+	codecQuotaVersion byte = 2
+)
+
+// MarshalBinary encodes the request as
+// [version, type, len(names), names..., len(values), values..., len(data), data]
+// where lengths and values are uvarints and names are length prefixed. The
+// quota is appended as [maxmemory, maxbitmaps] if it is set.
+func (bd *BasaltData) MarshalBinary() ([]byte, error) {
+	size := 2 + binary.MaxVarintLen64*5 + len(bd.Data) + len(bd.Values)*binary.MaxVarintLen32
+	for _, name := range bd.Names {
+		size += binary.MaxVarintLen64 + len(name)
+	}
+
+	version := codecVersion
+	if bd.Quota != (basalt.Quota{}) {
+		version = codecQuotaVersion
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, version, byte(bd.Type))
+	buf = appendUvarint(buf, uint64(len(bd.Names)))
+	for _, name := range bd.Names {
+		buf = appendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+	buf = appendUvarint(buf, uint64(len(bd.Values)))
+	for _, v := range bd.Values {
+		buf = appendUvarint(buf, uint64(v))
+	}
+	buf = appendUvarint(buf, uint64(len(bd.Data)))
+	buf = append(buf, bd.Data...)
+	if version == codecQuotaVersion {
+		buf = appendUvarint(buf, bd.Quota.MaxMemory)
+		buf = appendUvarint(buf, bd.Quota.MaxBitmaps)
+	}
+	return buf, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// UnmarshalBinary decodes the request encoded by MarshalBinary.
+func (bd *BasaltData) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || data[0] != codecVersion && data[0] != codecQuotaVersion {
+		return fmt.Errorf("%v: unknown encoding", ErrInvalidRequest)
+	}
+	d := decoder{data: data[2:]}
+
+	*bd = BasaltData{Type: ReqType(data[1])}
+	if n := d.length(); n > 0 {
+		bd.Names = make([]string, n)
+		for i := range bd.Names {
+			bd.Names[i] = string(d.bytes(d.length()))
+		}
+	}
+	if n := d.length(); n > 0 {
+		bd.Values = make([]uint32, n)
+		for i := range bd.Values {
+			v := d.uvarint()
+			if v > 1<<32-1 {
+				d.err = errors.New("value overflows uint32")
+			}
+			bd.Values[i] = uint32(v)
+		}
+	}
+	if n := d.length(); n > 0 {
+		bd.Data = d.bytes(n)
+	}
+	if data[0] == codecQuotaVersion {
+		bd.Quota.MaxMemory = d.uvarint()
+		bd.Quota.MaxBitmaps = d.uvarint()
+	}
+
+	if d.err == nil && len(d.data) > 0 {
+		d.err = errors.New("trailing bytes")
+	}
+	if d.err != nil {
+		return fmt.Errorf("%v: %v", ErrInvalidRequest, d.err)
+	}
+	return nil
+}
+
+// decoder reads fields of binary encoded BasaltData, the first error stops it.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errors.New("bad varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// length reads a length which can't be larger than the remaining bytes,
+// so malformed lengths don't allocate.
+func (d *decoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.err = errors.New("length out of range")
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// decodeBasaltData decodes and validates a request, which is binary encoded
+// or json encoded by old versions.
+func decodeBasaltData(data []byte) (*BasaltData, error) {
+	var reqData BasaltData
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &reqData); err != nil {
+			return nil, fmt.Errorf("%v: %v", ErrInvalidRequest, err)
+		}
+	} else if err := reqData.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	if err := reqData.validate(); err != nil {
+		return nil, err
+	}
+	return &reqData, nil
+}
+
+// validate checks the number of names and values of the request,
+// so applying it never indexes out of range.
+func (bd *BasaltData) validate() error {
+	names, values := len(bd.Names), len(bd.Values)
+
+	var ok bool
+	switch bd.Type {
+	case Add, Remove, Exists:
+		ok = names == 1 && values == 1
+	case AddMany, Drop, Clear, Card, Stats, Put:
+		ok = names == 1
+	case Inter, Union, InterCard, UnionCard:
+		ok = names >= 1
+	case InterStore, UnionStore:
+		ok = names >= 2
+	case Xor, Diff, XorCard, DiffCard:
+		ok = names >= 2
+	case Jaccard:
+		ok = names == 2
+	case XorStore, DiffStore:
+		ok = names >= 3
+	case Fetch:
+		ok = true
+	case FreezeSlot, DumpSlot, LoadSlot, DropSlot:
+		ok = values == 1 && bd.Values[0] < numSlots
+	case Checkpoint:
+		ok = len(bd.Data) == checkpointLen
+	case Hash:
+		ok = true
+	default:
+		return fmt.Errorf("%v: unknown type %d", ErrInvalidRequest, bd.Type)
+	}
+	if !ok {
+		return fmt.Errorf("%v: wrong number of names or values for type %d", ErrInvalidRequest, bd.Type)
+	}
+
+	if bd.Namespace != "" && !basalt.ValidNamespace(bd.Namespace) {
+		return fmt.Errorf("%v: %v", ErrInvalidRequest, basalt.ErrInvalidNamespace)
+	}
+
+	// reserved bitmaps of the shard can't be accessed by clients.
+	if !bd.Type.internal() {
+		for _, name := range bd.Names {
+			if reserved(name) {
+				return fmt.Errorf("%v: reserved name", ErrInvalidRequest)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/rpcxio/basalt"
+)
+
+func TestBasaltData_Codec(t *testing.T) {
+	reqs := []*BasaltData{
+		{Type: Add, Names: []string{"test1"}, Values: []uint32{1}},
+		{Type: AddMany, Names: []string{"test1"}, Values: []uint32{0, 1, 1 << 31, 1<<32 - 1}},
+		{Type: Drop, Names: []string{""}},
+		{Type: InterStore, Names: []string{"dst", "test1", namespaceKey("tenant", "test2")}},
+		{Type: Put, Names: []string{"test1"}, Data: []byte{0, 1, 2, 3}},
+		{Type: FreezeSlot, Values: []uint32{numSlots - 1}},
+		{Type: Fetch},
+		{Type: UnionStore, Names: []string{"dst", "test1"}, Quota: basalt.Quota{MaxMemory: 1 << 20, MaxBitmaps: 1}},
+	}
+
+	for _, req := range reqs {
+		data, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to encode %v: %v", req.Type, err)
+		}
+
+		got, err := decodeBasaltData(data)
+		if err != nil {
+			t.Fatalf("failed to decode %v: %v", req.Type, err)
+		}
+		if !reflect.DeepEqual(got, req) {
+			t.Errorf("expect %+v but got %+v", req, got)
+		}
+
+		// every truncated entry is rejected.
+		for i := 0; i < len(data); i++ {
+			if _, err := decodeBasaltData(data[:i]); err == nil {
+				t.Errorf("expect an error for %v truncated to %d bytes", req.Type, i)
+			}
+		}
+	}
+}
+
+func TestBasaltData_DecodeJSON(t *testing.T) {
+	req := &BasaltData{Type: AddMany, Names: []string{"test1"}, Values: []uint32{1, 2, 3}}
+	data, _ := json.Marshal(req)
+
+	got, err := decodeBasaltData(data)
+	if err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("expect %+v but got %+v", req, got)
+	}
+
+	if _, err := decodeBasaltData([]byte(`{"Type":0,"Names":["test1"]}`)); err == nil {
+		t.Errorf("expect an error for a json entry without values")
+	}
+	if _, err := decodeBasaltData([]byte(`{"Type":`)); err == nil {
+		t.Errorf("expect an error for malformed json")
+	}
+}
+
+func TestBasaltData_DecodeInvalid(t *testing.T) {
+	invalid := [][]byte{
+		nil,
+		{codecVersion},
+		{3, byte(Add), 1, 1, 'a', 1, 1, 0},
+		{codecQuotaVersion, byte(Add), 1, 1, 'a', 1, 1, 0, 1},
+		{codecVersion, byte(Add), 1, 1, 'a', 1, 1, 0, 0},
+		{codecVersion, byte(Add), 1, 10, 'a', 1, 1, 0},
+		{codecVersion, byte(Add), 1, 1, 'a', 1, 0x80, 0x80, 0x80, 0x80, 0x10, 0},
+		{codecVersion, byte(Add), 1, 1, 'a', 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0},
+		{codecVersion, byte(Add), 1, 1, 'a', 0, 0},
+		{codecVersion, 0xff, 0, 0, 0},
+	}
+
+	for _, data := range invalid {
+		if _, err := decodeBasaltData(data); err == nil {
+			t.Errorf("expect an error for %v", data)
+		}
+	}
+}
+
+func TestBasaltData_Validate(t *testing.T) {
+	invalid := []*BasaltData{
+		{Type: Add, Names: []string{"test1"}},
+		{Type: Remove, Names: []string{"test1", "test2"}, Values: []uint32{1}},
+		{Type: Card},
+		{Type: Inter},
+		{Type: UnionStore, Names: []string{"dst"}},
+		{Type: Xor, Names: []string{"test1"}},
+		{Type: DiffStore, Names: []string{"dst", "test1"}},
+		{Type: Jaccard, Names: []string{"test1", "test2", "test3"}},
+		{Type: DumpSlot, Values: []uint32{numSlots}},
+		{Type: Checkpoint, Data: []byte{1}},
+		{Type: Add, Names: []string{frozenSlots}, Values: []uint32{1}},
+		{Type: Card, Names: []string{"\x00ns\x00"}},
+		{Type: Card, Names: []string{"test1"}, Namespace: "bad namespace"},
+		{Type: ReqType(0xff)},
+	}
+
+	for _, req := range invalid {
+		if err := req.validate(); err == nil {
+			t.Errorf("expect an error for %+v", req)
+		}
+	}
+
+	valid := []*BasaltData{
+		{Type: Card, Names: []string{namespaceKey("tenant", "test1")}},
+		{Type: Card, Names: []string{"test1"}, Namespace: "tenant"},
+		{Type: XorCard, Names: []string{"test1", "test2", "test3"}},
+		{Type: DiffStore, Names: []string{"dst", "test1", "test2", "test3"}},
+		{Type: FreezeSlot, Values: []uint32{0}},
+		{Type: Fetch, Names: []string{frozenSlots}},
+	}
+	for _, req := range valid {
+		if err := req.validate(); err != nil {
+			t.Errorf("expect %+v to be valid but got %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rpcxio/basalt"
+)
+
+// The dictionary of string keys is stored in the metadata cluster, so ids
+// are shared by bitmaps of all shards. Keys are assigned by proposals to the
+// metadata cluster before ids are added to bitmaps in their shards. Keys in
+// namespaces other than the default one are prefixed like names of bitmaps.
+
+// keyIDsQuery looks up ids of the keys in the metadata state machine.
+type keyIDsQuery []string
+
+// idKeysQuery looks up keys of the ids in the metadata state machine.
+type idKeysQuery []uint32
+
+// lookupMeta reads the metadata state machine, stale reads are made by
+// observers which can't make sync reads.
+func (s *BasaltServer) lookupMeta(ctx context.Context, query interface{}) (interface{}, error) {
+	if s.observer {
+		return s.nh.StaleRead(metaClusterId, query)
+	}
+	return s.nh.SyncRead(ctx, metaClusterId, query)
+}
+
+// assignKeys assigns ids to the keys of the namespace and returns them in
+// the order of the keys.
+func (s *BasaltServer) assignKeys(ctx context.Context, ns string, keys []string) ([]uint32, error) {
+	nsKeys := make([]string, len(keys))
+	for i, key := range keys {
+		nsKeys[i] = namespaceKey(ns, key)
+	}
+
+	if _, err := s.proposeMeta(ctx, &MetaOp{Type: MetaAssignKeys, Keys: nsKeys}); err != nil {
+		return nil, err
+	}
+	// all keys are assigned after the proposal is applied.
+	return s.keyIDs(ctx, "", nsKeys)
+}
+
+// keyIDs returns ids of the keys of the namespace which are assigned.
+func (s *BasaltServer) keyIDs(ctx context.Context, ns string, keys []string) ([]uint32, error) {
+	nsKeys := make(keyIDsQuery, len(keys))
+	for i, key := range keys {
+		nsKeys[i] = namespaceKey(ns, key)
+	}
+
+	result, err := s.lookupMeta(ctx, nsKeys)
+	if err != nil {
+		return nil, err
+	}
+	return result.([]uint32), nil
+}
+
+// keysOf returns keys of the ids in the namespace, ids which aren't assigned
+// or are assigned to keys of other namespaces are skipped.
+func (s *BasaltServer) keysOf(ctx context.Context, ns string, ids []uint32) ([]string, error) {
+	result, err := s.lookupMeta(ctx, idKeysQuery(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := result.([]string)
+	if ns == "" || ns == basalt.DefaultNamespace {
+		filtered := keys[:0]
+		for _, key := range keys {
+			if _, _, ok := splitNamespaceKey(key); !ok {
+				filtered = append(filtered, key)
+			}
+		}
+		return filtered, nil
+	}
+
+	filtered := keys[:0]
+	for _, key := range keys {
+		if kns, name, ok := splitNamespaceKey(key); ok && kns == ns {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+)
+
+// ErrShardNotHosted is returned by a node which has no replica of the shard.
+var ErrShardNotHosted = errors.New("shard is not hosted by this node")
+
+// A NodeHost can only propose to and read from its own replicas, so requests
+// of shards which are not hosted by this node are forwarded to the basalt
+// server of a replica by http. rpcx clients are not used because they
+// register the protobuf types of etcd raft again.
+
+var forwardClient = &http.Client{Timeout: 10 * time.Second}
+
+// forwardPropose proposes to the shard by a replica on another node.
+func (s *BasaltServer) forwardPropose(ctx context.Context, req *ShardRequest) (sm.Result, error) {
+	var reply ShardReply
+	if err := s.forward(ctx, req, &reply); err != nil {
+		return sm.Result{}, err
+	}
+	result := sm.Result{Value: reply.Value, Data: reply.Data}
+	return result, resultError(result)
+}
+
+// forwardRead looks up reqData in the shard by a replica on another node.
+func (s *BasaltServer) forwardRead(ctx context.Context, shard uint64, reqData *BasaltData) (interface{}, error) {
+	data, _ := reqData.MarshalBinary()
+
+	var reply ShardReply
+	if err := s.forward(ctx, &ShardRequest{Shard: shard, Read: true, Data: data}, &reply); err != nil {
+		return nil, err
+	}
+	return decodeReadResult(reqData.Type, reply.Data)
+}
+
+// forward sends the request to replicas of the shard in turn until one of them serves it.
+func (s *BasaltServer) forward(ctx context.Context, req *ShardRequest, reply *ShardReply) error {
+	m := s.currentShardMap()
+	if m == nil || len(m.Shards[req.Shard]) == 0 {
+		return ErrShardNotFound
+	}
+
+	body, _ := json.Marshal(req)
+
+	err := ErrShardNotHosted
+	for _, nodeId := range m.Shards[req.Shard] {
+		addr := m.Services[nodeId]
+		if addr == "" {
+			continue
+		}
+
+		err = forwardTo(ctx, addr, body, reply)
+		if err == nil || err == ErrWrongShard || err == ErrDraining {
+			return err
+		}
+	}
+	return err
+}
+
+func forwardTo(ctx context.Context, addr string, body []byte, reply *ShardReply) error {
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/internal/shard", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := forwardClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return knownError(strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, reply)
+}
+
+// serveForwarded serves a request forwarded by another node with the local replica of the shard.
+func (s *BasaltServer) serveForwarded(ctx context.Context, req *ShardRequest, reply *ShardReply) error {
+	if !s.hosted(req.Shard) {
+		return ErrShardNotHosted
+	}
+
+	switch {
+	case req.Open:
+		session, err := s.nh.SyncGetSession(ctx, req.Shard)
+		reply.Session = session
+		return err
+	case req.Close:
+		return s.nh.SyncCloseSession(ctx, req.Session)
+	}
+
+	reqData, err := decodeBasaltData(req.Data)
+	if err != nil {
+		return err
+	}
+
+	if req.Read {
+		result, err := s.readFrom(ctx, req.Shard, reqData)
+		if err != nil {
+			return err
+		}
+		reply.Data, err = json.Marshal(result)
+		return err
+	}
+
+	if !s.proposals.Begin() {
+		return ErrDraining
+	}
+	defer s.proposals.End()
+
+	session := req.Session
+	if session == nil {
+		session = s.nh.GetNoOPSession(req.Shard)
+	}
+	// the error of an applied proposal is replied in its result, so the
+	// proposing node knows it has been applied.
+	result, err := s.proposeSession(ctx, req.Shard, session, req.Data)
+	reply.Value, reply.Data = result.Value, result.Data
+	if len(result.Data) > 0 {
+		return nil
+	}
+	return err
+}
+
+// decodeReadResult decodes the result of a forwarded read into the type
+// returned by the state machine for the request.
+func decodeReadResult(typ ReqType, data []byte) (interface{}, error) {
+	var v interface{}
+	switch typ {
+	case Exists:
+		v = new(bool)
+	case Card, InterCard, UnionCard, XorCard, DiffCard:
+		v = new(uint64)
+	case Jaccard:
+		v = new(float64)
+	case Inter, Union, Xor, Diff:
+		v = new([]uint32)
+	case Stats:
+		v = new(basalt.Stats)
+	case Fetch, DumpSlot:
+		v = new([]byte)
+	default:
+		return nil, errors.New("invalid request type")
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(v).Elem().Interface(), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/lni/dragonboat/v3"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+	"github.com/smallnest/log"
+)
+
+// Replicas of a shard are compared by checkpoints, see basalt.Checkpoints.
+// The leader of a shard proposes a Checkpoint request every interval, whose
+// Data is its id, and the id and state hash of the previous checkpoint of the
+// proposer. State machines record their hash when applying it and alert if
+// the previous hash differs from their own.
+
+// checkpointLen is the length of Data of a Checkpoint request.
+const checkpointLen = 24
+
+// ShardHash is the state hash of the local replica of a shard.
+type ShardHash struct {
+	Shard uint64
+	basalt.HashInfo
+}
+
+func encodeCheckpoint(id, prevID, prevHash uint64) []byte {
+	data := make([]byte, checkpointLen)
+	binary.LittleEndian.PutUint64(data, id)
+	binary.LittleEndian.PutUint64(data[8:], prevID)
+	binary.LittleEndian.PutUint64(data[16:], prevHash)
+	return data
+}
+
+// applyCheckpoint records the state hash at the checkpoint in data.
+func applyCheckpoint(c *basalt.Checkpoints, clusterId, hash uint64, data []byte) sm.Result {
+	id := binary.LittleEndian.Uint64(data)
+	prevID := binary.LittleEndian.Uint64(data[8:])
+	prevHash := binary.LittleEndian.Uint64(data[16:])
+
+	if !c.Record(id, hash, prevID, prevHash) {
+		log.Errorf("ALERT: state of shard %d diverged from the leader at checkpoint %x", clusterId, prevID)
+	}
+	return sm.Result{Value: hash}
+}
+
+func hashInfo(c *basalt.Checkpoints, hash uint64) basalt.HashInfo {
+	info := basalt.HashInfo{Hash: hash}
+	c.Info(&info)
+	return info
+}
+
+// shardHashes returns the state hashes of the shards hosted by this node.
+func (s *BasaltServer) shardHashes() ([]ShardHash, error) {
+	s.shardMu.RLock()
+	shards := make([]uint64, 0, len(s.shards))
+	for id := range s.shards {
+		shards = append(shards, id)
+	}
+	s.shardMu.RUnlock()
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+
+	hashes := make([]ShardHash, 0, len(shards))
+	for _, id := range shards {
+		v, err := s.nh.StaleRead(id, &BasaltData{Type: Hash})
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, ShardHash{Shard: id, HashInfo: v.(basalt.HashInfo)})
+	}
+	return hashes, nil
+}
+
+// checkHashes proposes a checkpoint to every shard led by this node every interval.
+func (s *BasaltServer) checkHashes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopc:
+			return
+		}
+
+		nhi := s.nh.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+		for _, ci := range nhi.ClusterInfoList {
+			if ci.IsLeader && ci.ClusterID != metaClusterId {
+				if err := s.proposeCheckpoint(ci.ClusterID); err != nil {
+					log.Errorf("failed to propose checkpoint to shard %d: %v", ci.ClusterID, err)
+				}
+			}
+		}
+	}
+}
+
+func (s *BasaltServer) proposeCheckpoint(shard uint64) error {
+	v, err := s.nh.StaleRead(shard, &BasaltData{Type: Hash})
+	if err != nil {
+		return err
+	}
+	prev := v.(basalt.HashInfo)
+
+	var id uint64
+	for id == 0 {
+		id = rand.Uint64()
+	}
+	data, _ := (&BasaltData{Type: Checkpoint, Data: encodeCheckpoint(id, prev.Checkpoint, prev.CheckpointHash)}).MarshalBinary()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = s.nh.SyncPropose(ctx, s.nh.GetNoOPSession(shard), data)
+	return err
+}
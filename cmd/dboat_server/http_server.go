@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"github.com/julienschmidt/httprouter"
+	"github.com/rpcxio/basalt"
 	"github.com/smallnest/log"
 	"net/http"
 	"strconv"
@@ -41,6 +43,35 @@ func (s *BasaltHttpServer) initRouter() {
 	router.GET("/diff/:name1/:name2", s.diff)
 	router.GET("/diffstore/:dst/:name1/:name2", s.diffStore)
 
+	router.GET("/intercard/:names", s.interCard)
+	router.GET("/unioncard/:names", s.unionCard)
+	router.GET("/xorcard/:name1/:name2", s.xorCard)
+	router.GET("/diffcard/:name1/:name2", s.diffCard)
+	router.GET("/jaccard/:name1/:name2", s.jaccard)
+
+	router.POST("/peers/:nodeID", s.addNode)
+	router.DELETE("/peers/:nodeID", s.removeNode)
+
+	router.GET("/cluster", s.clusterInfo)
+
+	router.POST("/leader/:nodeID", s.transferLeadership)
+	router.POST("/drain", s.drain)
+
+	router.POST("/learners/:nodeID", s.addLearner)
+	router.POST("/learners/:nodeID/promote", s.promoteLearner)
+
+	router.GET("/shards", s.shards)
+	router.POST("/shards/:clusterID", s.addShard)
+	router.POST("/rebalance", s.rebalance)
+	router.GET("/hash", s.hash)
+	router.GET("/quota", s.quota)
+	router.POST("/quota/:maxmemory/:maxbitmaps", s.setQuota)
+
+	router.POST("/sessions", s.openSession)
+	router.DELETE("/sessions/:id", s.closeSession)
+
+	router.POST("/internal/shard", s.forwarded)
+
 	s.srv.Handler = router
 }
 
@@ -60,7 +91,7 @@ func (s *BasaltHttpServer) add(w http.ResponseWriter, r *http.Request, params ht
 		Values: []uint32 { uint32(val) },
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) addMany(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -85,7 +116,7 @@ func (s *BasaltHttpServer) addMany(w http.ResponseWriter, r *http.Request, param
 		Values: vals,
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) drop(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -97,7 +128,7 @@ func (s *BasaltHttpServer) drop(w http.ResponseWriter, r *http.Request, params h
 		Values: nil,
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) clear(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -109,7 +140,7 @@ func (s *BasaltHttpServer) clear(w http.ResponseWriter, r *http.Request, params
 		Values: nil,
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) remove(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -128,7 +159,7 @@ func (s *BasaltHttpServer) remove(w http.ResponseWriter, r *http.Request, params
 		Values: []uint32 { uint32(val) },
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) exists(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -147,7 +178,7 @@ func (s *BasaltHttpServer) exists(w http.ResponseWriter, r *http.Request, params
 		Values: []uint32 { uint32(val) },
 	}
 
-	result := s.doSyncRead(bd)
+	result := s.doSyncRead(r, bd)
 	if _, ok := result.(error); ok {
 		w.Write([]byte("OPERATION ERROR"))
 		return
@@ -165,7 +196,7 @@ func (s *BasaltHttpServer) card(w http.ResponseWriter, r *http.Request, params h
 		Values: nil,
 	}
 
-	result := s.doSyncRead(bd)
+	result := s.doSyncRead(r, bd)
 	if _, ok := result.(error); ok {
 		w.Write([]byte("OPERATION ERROR"))
 		return
@@ -183,7 +214,7 @@ func (s *BasaltHttpServer) inter(w http.ResponseWriter, r *http.Request, params
 		Values: nil,
 	}
 
-	result := s.doSyncRead(bd)
+	result := s.doSyncRead(r, bd)
 	if _, ok := result.(error); ok {
 		w.Write([]byte("OPERATION ERROR"))
 		return
@@ -200,12 +231,12 @@ func (s *BasaltHttpServer) interStore(w http.ResponseWriter, r *http.Request, pa
 	ns = append(ns, strings.Split(names, ",")...)
 
 	bd := &BasaltData{
-		Type: Inter,
+		Type: InterStore,
 		Names: ns,
 		Values: nil,
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) union(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -217,7 +248,7 @@ func (s *BasaltHttpServer) union(w http.ResponseWriter, r *http.Request, params
 		Values: nil,
 	}
 
-	result := s.doSyncRead(bd)
+	result := s.doSyncRead(r, bd)
 	if _, ok := result.(error); ok {
 		w.Write([]byte("OPERATION ERROR"))
 		return
@@ -239,7 +270,7 @@ func (s *BasaltHttpServer) unionStore(w http.ResponseWriter, r *http.Request, pa
 		Values: nil,
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) diff(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -252,7 +283,7 @@ func (s *BasaltHttpServer) diff(w http.ResponseWriter, r *http.Request, params h
 		Values: nil,
 	}
 
-	result := s.doSyncRead(bd)
+	result := s.doSyncRead(r, bd)
 	if _, ok := result.(error); ok {
 		w.Write([]byte("OPERATION ERROR"))
 		return
@@ -272,7 +303,7 @@ func (s *BasaltHttpServer) diffStore(w http.ResponseWriter, r *http.Request, par
 		Values: nil,
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
 }
 
 func (s *BasaltHttpServer) xor(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -285,7 +316,7 @@ func (s *BasaltHttpServer) xor(w http.ResponseWriter, r *http.Request, params ht
 		Values: nil,
 	}
 
-	result := s.doSyncRead(bd)
+	result := s.doSyncRead(r, bd)
 	if _, ok := result.(error); ok {
 		w.Write([]byte("OPERATION ERROR"))
 		return
@@ -305,31 +336,345 @@ func (s *BasaltHttpServer) xorStore(w http.ResponseWriter, r *http.Request, para
 		Values: nil,
 	}
 
-	s.doSyncPropose(bd, w)
+	s.doSyncPropose(r, bd, w)
+}
+
+func (s *BasaltHttpServer) interCard(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	bd := &BasaltData{
+		Type: InterCard,
+		Names: strings.Split(params.ByName("names"), ","),
+	}
+
+	s.writeCard(w, r, bd)
+}
+
+func (s *BasaltHttpServer) unionCard(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	bd := &BasaltData{
+		Type: UnionCard,
+		Names: strings.Split(params.ByName("names"), ","),
+	}
+
+	s.writeCard(w, r, bd)
+}
+
+func (s *BasaltHttpServer) xorCard(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	bd := &BasaltData{
+		Type: XorCard,
+		Names: []string { params.ByName("name1"), params.ByName("name2") },
+	}
+
+	s.writeCard(w, r, bd)
+}
+
+func (s *BasaltHttpServer) diffCard(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	bd := &BasaltData{
+		Type: DiffCard,
+		Names: []string { params.ByName("name1"), params.ByName("name2") },
+	}
+
+	s.writeCard(w, r, bd)
+}
+
+// writeCard writes the cardinality of the set operation in bd.
+func (s *BasaltHttpServer) writeCard(w http.ResponseWriter, r *http.Request, bd *BasaltData) {
+	result := s.doSyncRead(r, bd)
+	if _, ok := result.(error); ok {
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	w.Write([]byte(strconv.FormatUint(result.(uint64), 10)))
+}
+
+func (s *BasaltHttpServer) jaccard(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	bd := &BasaltData{
+		Type: Jaccard,
+		Names: []string { params.ByName("name1"), params.ByName("name2") },
+	}
+
+	result := s.doSyncRead(r, bd)
+	if _, ok := result.(error); ok {
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	w.Write([]byte(strconv.FormatFloat(result.(float64), 'f', -1, 64)))
+}
+
+func (s *BasaltHttpServer) clusterInfo(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	info, err := s.base.clusterInfo()
+	if err != nil {
+		log.Errorf("cluster info error: %v", err)
+
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	data, _ := json.Marshal(info)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *BasaltHttpServer) addNode(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("nodeID"), 0, 64)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+	addr, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+
+	s.writeResult(w, s.base.addNode(id, string(addr)))
 }
 
-func (s *BasaltHttpServer) doSyncPropose(reqData *BasaltData, w http.ResponseWriter) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (s *BasaltHttpServer) removeNode(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("nodeID"), 0, 64)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+
+	s.writeResult(w, s.base.removeNode(id))
+}
+
+func (s *BasaltHttpServer) addLearner(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("nodeID"), 0, 64)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+	addr, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+
+	s.writeResult(w, s.base.addLearner(id, string(addr)))
+}
+
+func (s *BasaltHttpServer) promoteLearner(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("nodeID"), 0, 64)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+
+	s.writeResult(w, s.base.promoteLearner(id))
+}
+
+// transferLeadership moves the leadership to nodeID, 0 means another voter.
+func (s *BasaltHttpServer) transferLeadership(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("nodeID"), 0, 64)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	data, _ := json.Marshal(reqData)
-	_, err := s.base.nh.SyncPropose(ctx, s.base.rs, data)
+	s.writeResult(w, s.base.transferLeadership(ctx, id))
+}
+
+func (s *BasaltHttpServer) drain(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	s.writeResult(w, s.base.drain(ctx))
+}
+
+func (s *BasaltHttpServer) shards(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	m, err := s.base.loadShardMap(ctx)
 	if err != nil {
-		log.Errorf("sync propose error: %v", err)
+		log.Errorf("shard map error: %v", err)
 
 		w.Write([]byte("OPERATION ERROR"))
 		return
 	}
 
-	w.Write([]byte("SUCCESS"))
+	data, _ := json.Marshal(m)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// addShard adds a shard whose replicas are on node ids in the body, separated by comma.
+func (s *BasaltHttpServer) addShard(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("clusterID"), 0, 64)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+	var nodes []uint64
+	for _, v := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		nodeId, err := strconv.ParseUint(strings.TrimSpace(v), 0, 64)
+		if err != nil {
+			w.Write([]byte("INVALID DATA"))
+			return
+		}
+		nodes = append(nodes, nodeId)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	s.writeResult(w, s.base.addShard(ctx, id, nodes))
+}
+
+func (s *BasaltHttpServer) rebalance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Minute)
+	defer cancel()
+
+	s.writeResult(w, s.base.rebalance(ctx))
 }
 
-func (s *BasaltHttpServer) doSyncRead(reqData *BasaltData) interface{} {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// quota returns the quota of the namespace of the ns query parameter.
+func (s *BasaltHttpServer) quota(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
 
-	data, _ := json.Marshal(reqData)
-	result, err := s.base.nh.SyncRead(ctx, basaltClusterId, data)
+	q, err := s.base.quota(ctx, r.URL.Query().Get("ns"))
+	if err != nil {
+		log.Errorf("quota error: %v", err)
+
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	data, _ := json.Marshal(q)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// setQuota sets the quota of the namespace of the ns query parameter, 0 means unlimited.
+func (s *BasaltHttpServer) setQuota(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var q basalt.Quota
+	var err error
+	if q.MaxMemory, err = strconv.ParseUint(params.ByName("maxmemory"), 10, 64); err == nil {
+		q.MaxBitmaps, err = strconv.ParseUint(params.ByName("maxbitmaps"), 10, 64)
+	}
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	s.writeResult(w, s.base.setQuota(ctx, r.URL.Query().Get("ns"), q))
+}
+
+// hash returns the state hashes of shards hosted by this node.
+func (s *BasaltHttpServer) hash(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hashes, err := s.base.shardHashes()
+	if err != nil {
+		log.Errorf("hash error: %v", err)
+
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	data, _ := json.Marshal(hashes)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// openSession opens a client session, whose id is used in the X-Basalt-Session
+// header of writes to make retries exactly-once.
+func (s *BasaltHttpServer) openSession(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := s.base.openSession()
+	if err != nil {
+		log.Errorf("open session error: %v", err)
+
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	w.Write([]byte(strconv.FormatUint(id, 10)))
+}
+
+func (s *BasaltHttpServer) closeSession(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseUint(params.ByName("id"), 10, 64)
+	if err != nil {
+		w.Write([]byte("INVALID DATA"))
+		return
+	}
+
+	s.writeResult(w, s.base.closeSession(id))
+}
+
+// forwarded serves a request forwarded by a node which doesn't host the shard.
+func (s *BasaltHttpServer) forwarded(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req ShardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	var reply ShardReply
+	if err := s.base.serveForwarded(ctx, &req, &reply); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	data, _ := json.Marshal(&reply)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *BasaltHttpServer) writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		log.Errorf("admin operation error: %v", err)
+
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	w.Write([]byte("SUCCESS"))
+}
+
+// doSyncPropose proposes the write in the client session of the X-Basalt-Session
+// header if it is set, and returns the result value in the X-Basalt-Result header.
+// Bitmaps are in the namespace of the ns query parameter.
+func (s *BasaltHttpServer) doSyncPropose(r *http.Request, reqData *BasaltData, w http.ResponseWriter) {
+	reqData.Namespace = r.URL.Query().Get("ns")
+	var session uint64
+	if v := r.Header.Get("X-Basalt-Session"); v != "" {
+		var err error
+		if session, err = strconv.ParseUint(v, 10, 64); err != nil {
+			w.Write([]byte("INVALID DATA"))
+			return
+		}
+	}
+
+	result, err := s.base.propose(session, reqData)
+	if err != nil {
+		log.Errorf("sync propose error: %v", err)
+
+		w.Write([]byte("OPERATION ERROR"))
+		return
+	}
+
+	w.Header().Set("X-Basalt-Result", strconv.FormatUint(result.Value, 10))
+	w.Write([]byte("SUCCESS"))
+}
+
+func (s *BasaltHttpServer) doSyncRead(r *http.Request, reqData *BasaltData) interface{} {
+	reqData.Namespace = r.URL.Query().Get("ns")
+	result, err := s.base.read(reqData)
 	if err != nil {
 		log.Errorf("sync read error: %v", err)
 		return errors.New("sync read error")
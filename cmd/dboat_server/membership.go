@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lni/dragonboat/v3"
+)
+
+// membershipClusters are the clusters whose membership is managed by admin
+// commands, which are the metadata cluster and the first shard. Members of
+// other shards are placed by the shard map.
+var membershipClusters = []uint64{metaClusterId, basaltClusterId}
+
+// addNode adds a voting node into the basalt cluster,
+// and registers it in the shard map so shards can be placed on it.
+func (s *BasaltServer) addNode(id uint64, addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, clusterId := range membershipClusters {
+		if err := s.nh.SyncRequestAddNode(ctx, clusterId, id, addr, 0); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.proposeMeta(ctx, &MetaOp{Type: MetaAddNode, Nodes: map[uint64]string{id: addr}})
+	return err
+}
+
+// removeNode removes a node (voter or observer) from the basalt cluster.
+func (s *BasaltServer) removeNode(id uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, clusterId := range membershipClusters {
+		if err := s.nh.SyncRequestDeleteNode(ctx, clusterId, id, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLearner adds an observer which replicates the log without voting.
+func (s *BasaltServer) addLearner(id uint64, addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	for _, clusterId := range membershipClusters {
+		if err := s.nh.SyncRequestAddObserver(ctx, clusterId, id, addr, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteLearner promotes an observer to be a voter by adding it again
+// with the same address.
+func (s *BasaltServer) promoteLearner(id uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var addr string
+	for _, clusterId := range membershipClusters {
+		m, err := s.nh.SyncGetClusterMembership(ctx, clusterId)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		addr, ok = m.Observers[id]
+		if !ok {
+			return fmt.Errorf("node %d is not an observer", id)
+		}
+
+		if err := s.nh.SyncRequestAddNode(ctx, clusterId, id, addr, m.ConfigChangeID); err != nil {
+			return err
+		}
+	}
+
+	_, err := s.proposeMeta(ctx, &MetaOp{Type: MetaAddNode, Nodes: map[uint64]string{id: addr}})
+	return err
+}
+
+// transferLeadership transfers the leadership of the first shard to target
+// and waits until target takes over. If target is 0 another voter is chosen.
+func (s *BasaltServer) transferLeadership(ctx context.Context, target uint64) error {
+	return s.transferLeadershipOf(ctx, basaltClusterId, target)
+}
+
+func (s *BasaltServer) transferLeadershipOf(ctx context.Context, clusterId, target uint64) error {
+	nhi := s.nh.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+	var self uint64
+	for _, ci := range nhi.ClusterInfoList {
+		if ci.ClusterID == clusterId {
+			self = ci.NodeID
+		}
+	}
+
+	if target == 0 {
+		m, err := s.nh.SyncGetClusterMembership(ctx, clusterId)
+		if err != nil {
+			return err
+		}
+		for id := range m.Nodes {
+			if id != self && (target == 0 || id < target) {
+				target = id
+			}
+		}
+		if target == 0 {
+			return ErrNoTransferee
+		}
+	}
+
+	if err := s.nh.RequestLeaderTransfer(clusterId, target); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			leaderID, ok, err := s.nh.GetLeaderID(clusterId)
+			if err != nil {
+				return err
+			}
+			if ok && leaderID == target {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// drain prepares this node to be stopped: it rejects new proposals, waits for
+// in-flight proposals and transfers the leadership of clusters led by this node.
+func (s *BasaltServer) drain(ctx context.Context) error {
+	select {
+	case <-s.proposals.Drain():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	nhi := s.nh.GetNodeHostInfo(dragonboat.NodeHostInfoOption{SkipLogInfo: true})
+	for _, ci := range nhi.ClusterInfoList {
+		if !ci.IsLeader {
+			continue
+		}
+		err := s.transferLeadershipOf(ctx, ci.ClusterID, 0)
+		if err != nil && err != ErrNoTransferee {
+			return err
+		}
+	}
+	return nil
+}
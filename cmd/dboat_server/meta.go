@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+)
+
+// metaClusterId is the metadata cluster which stores the shard map,
+// it runs on every node.
+const metaClusterId uint64 = 1
+
+// Errors for shard map changes.
+var (
+	ErrShardExists   = errors.New("shard already exists")
+	ErrShardNotFound = errors.New("shard not found")
+	ErrUnknownNode   = errors.New("unknown node")
+)
+
+type MetaOpType byte
+
+const (
+	MetaInit MetaOpType = iota
+	MetaAddNode
+	MetaAddShard
+	MetaMoveSlot
+	MetaSetService
+	MetaAssignKeys
+	MetaSetQuota
+)
+
+// MetaOp is a change of the shard map.
+type MetaOp struct {
+	Type    MetaOpType
+	Nodes   map[uint64]string // MetaInit: initial nodes, MetaAddNode: the added node, MetaSetService: the service address of the node
+	Shard   uint64
+	Members []uint64 // MetaAddShard: node ids of replicas
+	Slot    uint32   // MetaMoveSlot: the slot moved to Shard
+	Keys    []string // MetaAssignKeys: keys assigned ids in the dictionary
+
+	Namespace string       // MetaSetQuota: the namespace whose quota is set
+	Quota     basalt.Quota // MetaSetQuota: the quota, zero removes it
+}
+
+// MetaStateMachine is the state machine of the metadata cluster, which
+// stores the shard map and the dictionary of string keys, see dict.go.
+type MetaStateMachine struct {
+	mu       sync.RWMutex
+	shardMap *ShardMap
+	dict     *basalt.Dictionary
+
+	// hash is the state hash of the shard map, the sum of entryHash of its
+	// entries, which is updated on every change like basalt.Bitmaps.Hash.
+	hash uint64
+}
+
+func NewMetaStateMachine(clusterId, nodeId uint64) sm.IStateMachine {
+	return &MetaStateMachine{
+		shardMap: &ShardMap{},
+		dict:     basalt.NewDictionary(),
+	}
+}
+
+// Lookup returns a copy of the shard map, or ids or keys of the dictionary.
+func (msm *MetaStateMachine) Lookup(query interface{}) (interface{}, error) {
+	msm.mu.RLock()
+	defer msm.mu.RUnlock()
+
+	switch q := query.(type) {
+	case keyIDsQuery:
+		return msm.dict.IDs(q...), nil
+	case idKeysQuery:
+		return msm.dict.Keys(q), nil
+	}
+	return msm.shardMap.clone(), nil
+}
+
+// Update applies a change of the shard map, malformed changes are not applied
+// and the error is returned in the result instead of stopping the node.
+func (msm *MetaStateMachine) Update(data []byte) (sm.Result, error) {
+	var op MetaOp
+	if err := json.Unmarshal(data, &op); err != nil {
+		return errorResult(fmt.Errorf("%v: %v", ErrInvalidRequest, err)), nil
+	}
+
+	msm.mu.Lock()
+	defer msm.mu.Unlock()
+
+	if op.Type == MetaAssignKeys {
+		if _, err := msm.dict.Assign(op.Keys...); err != nil {
+			return errorResult(err), nil
+		}
+		return sm.Result{Value: uint64(len(op.Keys))}, nil
+	}
+
+	m := msm.shardMap
+	switch op.Type {
+	case MetaInit:
+		// every node proposes the initial shard map on bootstrap, the first one wins.
+		if len(m.Slots) > 0 {
+			return sm.Result{}, nil
+		}
+
+		m.Nodes = op.Nodes
+		var ids []uint64
+		for id := range op.Nodes {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		m.Shards = map[uint64][]uint64{basaltClusterId: ids}
+		m.Slots = make([]uint64, numSlots)
+		for i := range m.Slots {
+			m.Slots[i] = basaltClusterId
+		}
+		msm.hash = m.hash()
+	case MetaAddNode:
+		if m.Nodes == nil {
+			m.Nodes = make(map[uint64]string)
+		}
+		for id, addr := range op.Nodes {
+			if old, ok := m.Nodes[id]; ok {
+				msm.hash -= entryHash("node", id, old)
+			}
+			m.Nodes[id] = addr
+			msm.hash += entryHash("node", id, addr)
+		}
+	case MetaSetService:
+		if m.Services == nil {
+			m.Services = make(map[uint64]string)
+		}
+		for id, addr := range op.Nodes {
+			if old, ok := m.Services[id]; ok {
+				msm.hash -= entryHash("service", id, old)
+			}
+			m.Services[id] = addr
+			msm.hash += entryHash("service", id, addr)
+		}
+	case MetaAddShard:
+		if _, ok := m.Shards[op.Shard]; ok || op.Shard == metaClusterId {
+			return errorResult(ErrShardExists), nil
+		}
+		for _, id := range op.Members {
+			if _, ok := m.Nodes[id]; !ok {
+				return errorResult(ErrUnknownNode), nil
+			}
+		}
+		if m.Shards == nil {
+			m.Shards = make(map[uint64][]uint64)
+		}
+		m.Shards[op.Shard] = op.Members
+		msm.hash += entryHash("shard", op.Shard, op.Members)
+	case MetaMoveSlot:
+		if _, ok := m.Shards[op.Shard]; !ok {
+			return errorResult(ErrShardNotFound), nil
+		}
+		if int(op.Slot) >= len(m.Slots) {
+			return errorResult(fmt.Errorf("%v: invalid slot %d", ErrInvalidRequest, op.Slot)), nil
+		}
+		msm.hash += entryHash("slot", op.Slot, op.Shard) - entryHash("slot", op.Slot, m.Slots[op.Slot])
+		m.Slots[op.Slot] = op.Shard
+	case MetaSetQuota:
+		if !basalt.ValidNamespace(op.Namespace) {
+			return errorResult(basalt.ErrInvalidNamespace), nil
+		}
+		if old, ok := m.Quotas[op.Namespace]; ok {
+			msm.hash -= entryHash("quota", op.Namespace, old)
+		}
+		if op.Quota == (basalt.Quota{}) {
+			delete(m.Quotas, op.Namespace)
+			break
+		}
+		if m.Quotas == nil {
+			m.Quotas = make(map[string]basalt.Quota)
+		}
+		m.Quotas[op.Namespace] = op.Quota
+		msm.hash += entryHash("quota", op.Namespace, op.Quota)
+	default:
+		return errorResult(fmt.Errorf("%v: unknown type %d", ErrInvalidRequest, op.Type)), nil
+	}
+
+	msm.hash -= entryHash("version", m.Version)
+	m.Version++
+	msm.hash += entryHash("version", m.Version)
+	return sm.Result{Value: m.Version}, nil
+}
+
+// entryHash returns the hash of an entry of the shard map.
+func entryHash(entry ...interface{}) uint64 {
+	return basalt.StateHashOf(fmt.Sprintln(entry...), 0)
+}
+
+// hash computes the state hash of the shard map from scratch.
+func (m *ShardMap) hash() uint64 {
+	hash := entryHash("version", m.Version)
+	for id, addr := range m.Nodes {
+		hash += entryHash("node", id, addr)
+	}
+	for id, addr := range m.Services {
+		hash += entryHash("service", id, addr)
+	}
+	for id, members := range m.Shards {
+		hash += entryHash("shard", id, members)
+	}
+	for slot, shard := range m.Slots {
+		hash += entryHash("slot", uint32(slot), shard)
+	}
+	for ns, q := range m.Quotas {
+		hash += entryHash("quota", ns, q)
+	}
+	return hash
+}
+
+// SaveSnapshot writes the shard map in json followed by the dictionary,
+// which is absent in snapshots of old versions.
+func (msm *MetaStateMachine) SaveSnapshot(w io.Writer, fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	msm.mu.RLock()
+	defer msm.mu.RUnlock()
+
+	if err := json.NewEncoder(w).Encode(msm.shardMap); err != nil {
+		return err
+	}
+	_, err := msm.dict.WriteTo(w)
+	return err
+}
+
+func (msm *MetaStateMachine) RecoverFromSnapshot(r io.Reader, files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m := &ShardMap{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(m); err != nil {
+		return err
+	}
+
+	// the shard map is followed by a newline written by the encoder.
+	dict := basalt.NewDictionary()
+	if rest := data[dec.InputOffset():]; len(rest) > 1 {
+		if _, err := dict.ReadFrom(bytes.NewReader(rest[1:])); err != nil {
+			return err
+		}
+	}
+
+	msm.mu.Lock()
+	msm.shardMap = m
+	msm.dict = dict
+	msm.hash = m.hash()
+	msm.mu.Unlock()
+	return nil
+}
+
+func (msm *MetaStateMachine) Close() error {
+	return nil
+}
+
+// GetHash returns the state hash of the shard map and the dictionary,
+// which are maintained incrementally.
+func (msm *MetaStateMachine) GetHash() (uint64, error) {
+	msm.mu.RLock()
+	defer msm.mu.RUnlock()
+
+	return msm.hash + msm.dict.Hash(), nil
+}
+
+// errorResult carries an error which is not fatal to the state machine
+// back to the proposer.
+func errorResult(err error) sm.Result {
+	return sm.Result{Data: []byte(err.Error())}
+}
+
+// resultError returns the error carried by result.
+func resultError(result sm.Result) error {
+	if len(result.Data) == 0 {
+		return nil
+	}
+
+	return knownError(string(result.Data))
+}
+
+// knownError returns the known error with the message, so errors of
+// remote shards can be compared.
+func knownError(msg string) error {
+	for _, err := range []error{
+		ErrWrongShard, ErrShardExists, ErrShardNotFound, ErrUnknownNode, ErrShardNotHosted, ErrDraining, ErrInvalidRequest,
+		basalt.ErrDictionaryFull, basalt.ErrKeyTooLong, basalt.ErrOOM, basalt.ErrQuotaExceeded, basalt.ErrInvalidNamespace,
+	} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rpcxio/basalt"
+)
+
+// Bitmaps of namespaces other than the default one are kept in the bitmaps of
+// shards under keys prefixed by their namespace, which can't be used as names
+// by clients. So they are routed, replicated, saved in snapshots and moved
+// with slots like other bitmaps, and a name has the same slot in all
+// namespaces.
+//
+// Quotas of namespaces are stored in the shard map of the metadata cluster,
+// so they are replicated, saved in snapshots and cached by every node. Writes
+// which may create a bitmap carry the quota of its namespace, and shards check
+// it against the usages of namespaces they keep when the write is applied. So
+// a quota limits the part of a namespace in every shard. Bitmaps are not
+// evicted by this server, writes fail with basalt.ErrOOM once a namespace
+// exceeds its memory quota.
+
+// namespaceKeyPrefix is the prefix of keys of bitmaps of namespaces, a key is
+// the prefix, the namespace, a zero byte and the name.
+const namespaceKeyPrefix = "\x00ns\x00"
+
+// namespaceKey returns the key of the bitmap in the namespace.
+func namespaceKey(ns, name string) string {
+	if ns == "" || ns == basalt.DefaultNamespace {
+		return name
+	}
+	return namespaceKeyPrefix + ns + "\x00" + name
+}
+
+// splitNamespaceKey returns the namespace and the name of the key of a bitmap,
+// ok is false if the key isn't in a namespace other than the default one.
+func splitNamespaceKey(key string) (ns, name string, ok bool) {
+	if !strings.HasPrefix(key, namespaceKeyPrefix) {
+		return "", key, false
+	}
+	rest := key[len(namespaceKeyPrefix):]
+	i := strings.IndexByte(rest, 0)
+	if i <= 0 || !basalt.ValidNamespace(rest[:i]) {
+		return "", key, false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// reserved reports whether the key is a reserved bitmap of the shard.
+func reserved(key string) bool {
+	if !strings.HasPrefix(key, "\x00") {
+		return false
+	}
+	_, _, ok := splitNamespaceKey(key)
+	return !ok
+}
+
+// inNamespace returns the request whose names are replaced by the keys of
+// bitmaps in its namespace, bd is not modified.
+func (bd *BasaltData) inNamespace() *BasaltData {
+	if bd.Namespace == "" || bd.Namespace == basalt.DefaultNamespace {
+		return bd
+	}
+
+	req := *bd
+	req.Namespace = ""
+	req.Names = make([]string, len(bd.Names))
+	for i, name := range bd.Names {
+		req.Names[i] = namespaceKey(bd.Namespace, name)
+	}
+	return &req
+}
+
+// namespaceOfKey returns the namespace of the key of a bitmap.
+func namespaceOfKey(key string) string {
+	if ns, _, ok := splitNamespaceKey(key); ok {
+		return ns
+	}
+	return basalt.DefaultNamespace
+}
+
+// namespaceUsage is the usage of bitmaps of a namespace in a shard.
+type namespaceUsage struct {
+	Bitmaps uint64 // number of bitmaps
+	Memory  uint64 // size of bitmaps in bytes
+}
+
+// namespaceUsages are usages of namespaces in a shard, which are updated when
+// bitmaps are written, so quotas are checked without scanning bitmaps. They
+// are derived from bitmaps, so they are rebuilt instead of saved in snapshots.
+type namespaceUsages map[string]*namespaceUsage
+
+// usagesOf counts usages of the bitmaps, size returns the size of a bitmap.
+func usagesOf(names []string, size func(name string) (uint64, bool)) namespaceUsages {
+	usages := make(namespaceUsages)
+	for _, name := range names {
+		n, _ := size(name)
+		usages.add(name, n)
+	}
+	return usages
+}
+
+// add counts a bitmap of the size under the key.
+func (u namespaceUsages) add(key string, size uint64) {
+	if reserved(key) {
+		return
+	}
+	ns := namespaceOfKey(key)
+	usage := u[ns]
+	if usage == nil {
+		usage = new(namespaceUsage)
+		u[ns] = usage
+	}
+	usage.Bitmaps++
+	usage.Memory += size
+}
+
+// remove uncounts a bitmap of the size under the key.
+func (u namespaceUsages) remove(key string, size uint64) {
+	if reserved(key) {
+		return
+	}
+	ns := namespaceOfKey(key)
+	usage := u[ns]
+	if usage == nil {
+		return
+	}
+	usage.Bitmaps--
+	usage.Memory -= size
+	if usage.Bitmaps == 0 {
+		delete(u, ns)
+	}
+}
+
+// quotaError returns the error of a write which may create a bitmap of the
+// namespace with the usage, exists reports whether the bitmap exists.
+func quotaError(q basalt.Quota, usage namespaceUsage, exists bool) error {
+	if q.MaxBitmaps > 0 && usage.Bitmaps >= q.MaxBitmaps && !exists {
+		return basalt.ErrQuotaExceeded
+	}
+	if q.MaxMemory > 0 && usage.Memory > q.MaxMemory {
+		return basalt.ErrOOM
+	}
+	return nil
+}
+
+// checkQuota checks the quota of a write to Names[0] when it is applied, so
+// replicas reject the same writes and concurrent writes can't exceed it.
+func checkQuota(bitmaps *basalt.Bitmaps, reqData *BasaltData, usages namespaceUsages) error {
+	if reqData.Quota == (basalt.Quota{}) {
+		return nil
+	}
+
+	var usage namespaceUsage
+	if u := usages[namespaceOfKey(reqData.Names[0])]; u != nil {
+		usage = *u
+	}
+	_, exists := bitmaps.MemoryUsage(reqData.Names[0])
+	return quotaError(reqData.Quota, usage, exists)
+}
+
+// withQuota returns the write with the quota of the namespace of the written
+// bitmap, reqData is not modified. Quotas are carried by entries, so replicas
+// check the same quota whatever shard map they have cached.
+func (m *ShardMap) withQuota(reqData *BasaltData) *BasaltData {
+	var q basalt.Quota
+	if m != nil && reqData.Type.creates() {
+		q = m.Quotas[namespaceOfKey(reqData.Names[0])]
+	}
+	if reqData.Quota == q {
+		return reqData
+	}
+
+	req := *reqData
+	req.Quota = q
+	return &req
+}
+
+// quota returns the quota of the namespace.
+func (s *BasaltServer) quota(ctx context.Context, ns string) (basalt.Quota, error) {
+	m, err := s.loadShardMap(ctx)
+	if err != nil {
+		return basalt.Quota{}, err
+	}
+	if ns == "" {
+		ns = basalt.DefaultNamespace
+	}
+	return m.Quotas[ns], nil
+}
+
+// setQuota sets the quota of the namespace, 0 means unlimited.
+func (s *BasaltServer) setQuota(ctx context.Context, ns string, q basalt.Quota) error {
+	if ns == "" {
+		ns = basalt.DefaultNamespace
+	}
+	if !basalt.ValidNamespace(ns) {
+		return basalt.ErrInvalidNamespace
+	}
+
+	if _, err := s.proposeMeta(ctx, &MetaOp{Type: MetaSetQuota, Namespace: ns, Quota: q}); err != nil {
+		return err
+	}
+	_, err := s.loadShardMap(ctx)
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+)
+
+func TestStateMachine_Quota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := NewBasalStateMachine(basaltClusterId, 1).(*BasaltStateMachine)
+	disk := newTestOnDiskStateMachine(t, dir)
+	defer func() { disk.Close() }()
+
+	var index uint64
+	updates := map[string]func(data []byte) sm.Result{
+		"memory": func(data []byte) sm.Result {
+			result, err := mem.Update(data)
+			if err != nil {
+				t.Fatalf("failed to update: %v", err)
+			}
+			return result
+		},
+		"disk": func(data []byte) sm.Result {
+			index++
+			entries, err := disk.Update([]sm.Entry{{Index: index, Cmd: data}})
+			if err != nil {
+				t.Fatalf("failed to update: %v", err)
+			}
+			return entries[0].Result
+		},
+	}
+
+	quota := basalt.Quota{MaxBitmaps: 2}
+	cases := []struct {
+		req *BasaltData
+		err error
+	}{
+		{&BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{1}, Namespace: "tenant", Quota: quota}, nil},
+		{&BasaltData{Type: Add, Names: []string{"test2"}, Values: []uint32{1}, Namespace: "tenant", Quota: quota}, nil},
+		{&BasaltData{Type: Add, Names: []string{"test3"}, Values: []uint32{1}, Namespace: "tenant", Quota: quota}, basalt.ErrQuotaExceeded},
+		{&BasaltData{Type: UnionStore, Names: []string{"test3", "test1"}, Namespace: "tenant", Quota: quota}, basalt.ErrQuotaExceeded},
+		{&BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{2}, Namespace: "tenant", Quota: quota}, nil},
+		{&BasaltData{Type: Add, Names: []string{"test3"}, Values: []uint32{1}, Namespace: "other", Quota: quota}, nil},
+		{&BasaltData{Type: Add, Names: []string{"test3"}, Values: []uint32{1}, Quota: quota}, nil},
+		{&BasaltData{Type: Drop, Names: []string{"test2"}, Namespace: "tenant"}, nil},
+		{&BasaltData{Type: Add, Names: []string{"test3"}, Values: []uint32{1}, Namespace: "tenant", Quota: quota}, nil},
+		{&BasaltData{Type: Add, Names: []string{"test4"}, Values: []uint32{1}, Namespace: "tenant", Quota: quota}, basalt.ErrQuotaExceeded},
+		{&BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{3}, Namespace: "tenant", Quota: basalt.Quota{MaxMemory: 1}}, basalt.ErrOOM},
+	}
+	for i, c := range cases {
+		data, _ := c.req.inNamespace().MarshalBinary()
+		for kind, update := range updates {
+			if err := resultError(update(data)); err != c.err {
+				t.Errorf("expect %v of write %d to %s but got %v", c.err, i, kind, err)
+			}
+		}
+	}
+
+	expect := map[string]uint64{basalt.DefaultNamespace: 1, "tenant": 2, "other": 1}
+	usages := map[string]namespaceUsages{"memory": mem.namespaceUsages(), "disk": disk.usages}
+	for kind, u := range usages {
+		if len(u) != len(expect) {
+			t.Errorf("expect usages of %d namespaces in %s but got %d", len(expect), kind, len(u))
+		}
+		for ns, n := range expect {
+			if u[ns] == nil || u[ns].Bitmaps != n || u[ns].Memory == 0 {
+				t.Errorf("expect %d bitmaps of %s in %s but got %+v", n, ns, kind, u[ns])
+			}
+		}
+	}
+
+	// usages kept on apply are the usages counted from bitmaps.
+	counted := usagesOf(mem.Bitmaps.Names(), mem.Bitmaps.MemoryUsage)
+	if !reflect.DeepEqual(counted, mem.usages) {
+		t.Errorf("expect usages %v but got %v", counted, mem.usages)
+	}
+	kept := disk.usages
+	disk.Close()
+	disk = newTestOnDiskStateMachine(t, dir)
+	if !reflect.DeepEqual(disk.usages, kept) {
+		t.Errorf("expect usages %v after reopen but got %v", kept, disk.usages)
+	}
+}
+
+func TestShardMap_WithQuota(t *testing.T) {
+	quota := basalt.Quota{MaxBitmaps: 1}
+	m := &ShardMap{Quotas: map[string]basalt.Quota{"tenant": quota}}
+
+	cases := []struct {
+		req   *BasaltData
+		quota basalt.Quota
+	}{
+		{&BasaltData{Type: Add, Names: []string{namespaceKey("tenant", "test1")}, Values: []uint32{1}}, quota},
+		{&BasaltData{Type: InterStore, Names: []string{namespaceKey("tenant", "dst"), "test1"}}, quota},
+		{&BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{1}}, basalt.Quota{}},
+		{&BasaltData{Type: Remove, Names: []string{namespaceKey("tenant", "test1")}, Values: []uint32{1}, Quota: quota}, basalt.Quota{}},
+		{&BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{1}, Quota: quota}, basalt.Quota{}},
+	}
+	for _, c := range cases {
+		if got := m.withQuota(c.req).Quota; got != c.quota {
+			t.Errorf("expect quota %+v of %+v but got %+v", c.quota, c.req, got)
+		}
+	}
+}
+
+func TestQuotaError(t *testing.T) {
+	cases := []struct {
+		quota  basalt.Quota
+		usage  namespaceUsage
+		exists bool
+		err    error
+	}{
+		{basalt.Quota{}, namespaceUsage{Bitmaps: 10, Memory: 1000}, false, nil},
+		{basalt.Quota{MaxBitmaps: 2}, namespaceUsage{Bitmaps: 1}, false, nil},
+		{basalt.Quota{MaxBitmaps: 2}, namespaceUsage{Bitmaps: 2}, false, basalt.ErrQuotaExceeded},
+		{basalt.Quota{MaxBitmaps: 2}, namespaceUsage{Bitmaps: 2}, true, nil},
+		{basalt.Quota{MaxMemory: 100}, namespaceUsage{Memory: 100}, false, nil},
+		{basalt.Quota{MaxMemory: 100}, namespaceUsage{Memory: 101}, true, basalt.ErrOOM},
+	}
+	for _, c := range cases {
+		if err := quotaError(c.quota, c.usage, c.exists); err != c.err {
+			t.Errorf("expect %v of %+v with %+v but got %v", c.err, c.usage, c.quota, err)
+		}
+	}
+}
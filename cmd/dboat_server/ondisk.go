@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+)
+
+// BasaltOnDiskStateMachine keeps bitmaps in an append-only log file instead
+// of memory, so restarts don't replay the whole raft log and the data set can
+// be larger than memory.
+//
+// Every record of the log is [length, crc32, kind, body]. A bitmap record
+// stores a bitmap in the format of snapshots, a delete record removes a bitmap
+// and a commit record stores the applied index of the preceding records.
+// Records after the last commit record are discarded on open, so a batch of
+// entries is applied atomically. Only the offsets of bitmaps are kept in
+// memory, recently used bitmaps are cached, and requests are computed on a
+// temporary basalt.Bitmaps holding the bitmaps they touch.
+type BasaltOnDiskStateMachine struct {
+	ClusterId uint64
+	NodeId    uint64
+
+	dir string
+
+	mu      sync.RWMutex
+	file    *os.File
+	size    int64 // size of the log
+	live    int64 // size of bitmap records in use
+	index   map[string]recordLoc
+	usages  namespaceUsages // usages of namespaces by the size of records
+	applied uint64
+	cache   *bodyCache
+
+	// hash is the state hash, the sum of basalt.StateHashOf of all bitmaps.
+	hash        uint64
+	checkpoints basalt.Checkpoints
+}
+
+const (
+	recordBitmap byte = iota + 1
+	recordDelete
+	recordCommit
+)
+
+const (
+	logFileName     = "bitmaps.log"
+	logTempFileName = "bitmaps.log.tmp"
+	recordHeaderLen = 9 // length, crc32 and kind
+
+	// the log is compacted if more than half of it is garbage and the garbage
+	// is larger than compactMinGarbage.
+	compactMinGarbage = 64 << 20
+)
+
+// recordLoc is the location of the body of a bitmap record
+// and the checksum of the bitmap.
+type recordLoc struct {
+	offset int64
+	size   int64
+	sum    uint64
+}
+
+// NewBasaltOnDiskStateMachineFactory returns a factory of on-disk state
+// machines which store logs under dir and cache up to cacheSize bytes of bitmaps.
+func NewBasaltOnDiskStateMachineFactory(dir string, cacheSize int64) func(clusterId, nodeId uint64) sm.IOnDiskStateMachine {
+	return func(clusterId, nodeId uint64) sm.IOnDiskStateMachine {
+		return &BasaltOnDiskStateMachine{
+			ClusterId: clusterId,
+			NodeId:    nodeId,
+			dir:       filepath.Join(dir, fmt.Sprintf("cluster-%d-node-%d", clusterId, nodeId)),
+			cache:     newBodyCache(cacheSize),
+		}
+	}
+}
+
+// Open loads the offsets of bitmaps from the log and returns the applied index.
+func (s *BasaltOnDiskStateMachine) Open(stopc <-chan struct{}) (uint64, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return 0, err
+	}
+	// an unfinished compaction or recovery
+	if err := os.Remove(filepath.Join(s.dir, logTempFileName)); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.load(file); err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	return s.applied, nil
+}
+
+// load scans the log and truncates records which are not committed.
+func (s *BasaltOnDiskStateMachine) load(file *os.File) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]recordLoc)
+	pending := make(map[string]*recordLoc)
+	var applied uint64
+	var offset, committed int64
+
+	r := bufio.NewReader(io.NewSectionReader(file, 0, fi.Size()))
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(header))
+		if length == 0 || offset+8+length > fi.Size() {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+
+		body := payload[1:]
+		switch payload[0] {
+		case recordBitmap:
+			name, err := bitmapName(body)
+			if err != nil {
+				return err
+			}
+			pending[name] = &recordLoc{offset: offset + recordHeaderLen, size: int64(len(body))}
+		case recordDelete:
+			pending[string(body)] = nil
+		case recordCommit:
+			for name, loc := range pending {
+				if loc == nil {
+					delete(index, name)
+				} else {
+					index[name] = *loc
+				}
+			}
+			pending = make(map[string]*recordLoc)
+			applied = binary.LittleEndian.Uint64(body)
+			committed = offset + 8 + length
+		}
+		offset += 8 + length
+	}
+
+	if committed < fi.Size() {
+		if err := file.Truncate(committed); err != nil {
+			return err
+		}
+	}
+
+	// checksums are not stored in the log, they are computed once on open.
+	var live int64
+	var hash uint64
+	usages := make(namespaceUsages)
+	for name, loc := range index {
+		live += loc.size
+		usages.add(name, uint64(loc.size))
+
+		body := make([]byte, loc.size)
+		if _, err := file.ReadAt(body, loc.offset); err != nil {
+			return err
+		}
+		bm := roaring.NewBitmap()
+		if _, err := bm.ReadFrom(bytes.NewReader(body[4+len(name):])); err != nil {
+			return err
+		}
+		loc.sum = basalt.Checksum(bm)
+		index[name] = loc
+		hash += basalt.StateHashOf(name, loc.sum)
+	}
+
+	s.file = file
+	s.size = committed
+	s.live = live
+	s.hash = hash
+	s.index = index
+	s.usages = usages
+	s.applied = applied
+	s.cache.reset()
+	return nil
+}
+
+// bitmapName returns the name of a bitmap in the format of snapshots.
+func bitmapName(body []byte) (string, error) {
+	if len(body) < 4 {
+		return "", errors.New("invalid bitmap record")
+	}
+	l := int(binary.LittleEndian.Uint32(body))
+	if len(body) < 4+l {
+		return "", errors.New("invalid bitmap record")
+	}
+	return string(body[4 : 4+l]), nil
+}
+
+// body returns the bitmap in the format of snapshots, or nil if it doesn't exist.
+func (s *BasaltOnDiskStateMachine) body(name string) ([]byte, error) {
+	loc, ok := s.index[name]
+	if !ok {
+		return nil, nil
+	}
+	if body, ok := s.cache.get(name); ok {
+		return body, nil
+	}
+
+	body := make([]byte, loc.size)
+	if _, err := s.file.ReadAt(body, loc.offset); err != nil {
+		return nil, err
+	}
+	s.cache.put(name, body)
+	return body, nil
+}
+
+// bitmaps loads the named bitmaps into a temporary basalt.Bitmaps, and
+// returns their serialized form to find out bitmaps changed by updates.
+func (s *BasaltOnDiskStateMachine) bitmaps(names []string) (*basalt.Bitmaps, map[string][]byte, error) {
+	bodies := make(map[string][]byte, len(names))
+	var buf bytes.Buffer
+	for _, name := range names {
+		if _, ok := bodies[name]; ok {
+			continue
+		}
+
+		body, err := s.body(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		bodies[name] = body
+		buf.Write(body)
+	}
+
+	bitmaps := basalt.NewBitmaps()
+	if err := bitmaps.Read(&buf); err != nil {
+		return nil, nil, err
+	}
+	return bitmaps, bodies, nil
+}
+
+// names returns the names of bitmaps a request touches, including the reserved
+// bitmaps of slots and the bitmaps of the slot for slot requests.
+func (s *BasaltOnDiskStateMachine) names(reqData *BasaltData) []string {
+	names := make([]string, 0, len(reqData.Names)+2)
+	names = append(names, reqData.Names...)
+	names = append(names, frozenSlots, movedSlots)
+
+	switch reqData.Type {
+	case DumpSlot, LoadSlot, DropSlot:
+		all := make([]string, 0, len(s.index))
+		for name := range s.index {
+			all = append(all, name)
+		}
+		names = append(names, namesOfSlot(all, reqData.Values[0])...)
+	}
+	return names
+}
+
+func (s *BasaltOnDiskStateMachine) Lookup(query interface{}) (interface{}, error) {
+	reqData, err := queryData(query)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	switch reqData.Type {
+	case Hash:
+		return hashInfo(&s.checkpoints, s.hash), nil
+	}
+
+	bitmaps, _, err := s.bitmaps(s.names(reqData))
+	if err != nil {
+		return nil, err
+	}
+	return lookupBitmaps(bitmaps, reqData, bitmaps.Names)
+}
+
+func (s *BasaltOnDiskStateMachine) Update(entries []sm.Entry) ([]sm.Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, entry := range entries {
+		reqData, err := decodeBasaltData(entry.Cmd)
+		if err != nil {
+			entries[i].Result = errorResult(err)
+			continue
+		}
+
+		if reqData.Type == Checkpoint {
+			entries[i].Result = applyCheckpoint(&s.checkpoints, s.ClusterId, s.hash, reqData.Data)
+			continue
+		}
+
+		result, err := s.apply(reqData)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Result = result
+	}
+
+	if len(entries) == 0 {
+		return entries, nil
+	}
+
+	applied := entries[len(entries)-1].Index
+	var buf bytes.Buffer
+	commit := make([]byte, 8)
+	binary.LittleEndian.PutUint64(commit, applied)
+	appendRecord(&buf, recordCommit, commit)
+	if _, err := s.file.WriteAt(buf.Bytes(), s.size); err != nil {
+		return nil, err
+	}
+	s.size += int64(buf.Len())
+	s.applied = applied
+
+	if garbage := s.size - s.live; garbage > compactMinGarbage && garbage > s.live {
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// apply applies an update and appends the changed bitmaps to the log.
+func (s *BasaltOnDiskStateMachine) apply(reqData *BasaltData) (sm.Result, error) {
+	bitmaps, before, err := s.bitmaps(s.names(reqData))
+	if err != nil {
+		return sm.Result{}, err
+	}
+
+	result, err := updateBitmaps(bitmaps, reqData, bitmaps.Names, s.usages)
+	if err != nil {
+		return result, err
+	}
+
+	names := bitmaps.Names()
+	for name := range before {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	type change struct {
+		name   string
+		body   []byte
+		offset int64
+	}
+	var changes []change
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+
+		body, err := saveBitmaps(bitmaps, []string{name})
+		if err != nil {
+			return sm.Result{}, err
+		}
+		if bytes.Equal(body, before[name]) {
+			continue
+		}
+
+		if len(body) == 0 {
+			appendRecord(&buf, recordDelete, []byte(name))
+		} else {
+			changes = append(changes, change{name: name, body: body, offset: s.size + int64(buf.Len()) + recordHeaderLen})
+			appendRecord(&buf, recordBitmap, body)
+		}
+		s.remove(name)
+	}
+
+	if buf.Len() == 0 {
+		return result, nil
+	}
+	if _, err := s.file.WriteAt(buf.Bytes(), s.size); err != nil {
+		return sm.Result{}, err
+	}
+	s.size += int64(buf.Len())
+
+	for _, c := range changes {
+		sum := bitmaps.Checksum(c.name)
+		s.index[c.name] = recordLoc{offset: c.offset, size: int64(len(c.body)), sum: sum}
+		s.live += int64(len(c.body))
+		s.usages.add(c.name, uint64(len(c.body)))
+		s.hash += basalt.StateHashOf(c.name, sum)
+		s.cache.put(c.name, c.body)
+	}
+	return result, nil
+}
+
+func (s *BasaltOnDiskStateMachine) remove(name string) {
+	if loc, ok := s.index[name]; ok {
+		s.live -= loc.size
+		s.usages.remove(name, uint64(loc.size))
+		s.hash -= basalt.StateHashOf(name, loc.sum)
+		delete(s.index, name)
+	}
+	s.cache.remove(name)
+}
+
+func appendRecord(buf *bytes.Buffer, kind byte, body []byte) {
+	header := make([]byte, recordHeaderLen)
+	binary.LittleEndian.PutUint32(header, uint32(1+len(body)))
+	header[8] = kind
+	crc := crc32.NewIEEE()
+	crc.Write(header[8:])
+	crc.Write(body)
+	binary.LittleEndian.PutUint32(header[4:], crc.Sum32())
+
+	buf.Write(header)
+	buf.Write(body)
+}
+
+// compact rewrites bitmaps in use to a new log.
+func (s *BasaltOnDiskStateMachine) compact() error {
+	names := s.sortedNames()
+	i := 0
+	return s.rewrite(s.applied, func() ([]byte, error) {
+		if i == len(names) {
+			return nil, io.EOF
+		}
+		loc := s.index[names[i]]
+		i++
+
+		body := make([]byte, loc.size)
+		_, err := s.file.ReadAt(body, loc.offset)
+		return body, err
+	})
+}
+
+// rewrite writes the bitmaps returned by next to a new log with the applied
+// index, and replaces the current log with it. next returns io.EOF at the end.
+func (s *BasaltOnDiskStateMachine) rewrite(applied uint64, next func() ([]byte, error)) error {
+	path := filepath.Join(s.dir, logTempFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		w := bufio.NewWriter(file)
+		var buf bytes.Buffer
+		for {
+			body, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			buf.Reset()
+			appendRecord(&buf, recordBitmap, body)
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		commit := make([]byte, 8)
+		binary.LittleEndian.PutUint64(commit, applied)
+		buf.Reset()
+		appendRecord(&buf, recordCommit, commit)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	if err == nil {
+		err = os.Rename(path, filepath.Join(s.dir, logFileName))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	return s.load(file)
+}
+
+func (s *BasaltOnDiskStateMachine) sortedNames() []string {
+	names := make([]string, 0, len(s.index))
+	for name := range s.index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *BasaltOnDiskStateMachine) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.file.Sync()
+}
+
+// onDiskSnapshot is the state of a snapshot. The log is append-only and
+// replaced by renaming, so the bitmaps stay at their offsets in the opened file.
+type onDiskSnapshot struct {
+	file    *os.File
+	applied uint64
+	names   []string
+	locs    []recordLoc
+}
+
+func (s *BasaltOnDiskStateMachine) PrepareSnapshot() (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, err := os.Open(filepath.Join(s.dir, logFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &onDiskSnapshot{
+		file:    file,
+		applied: s.applied,
+		names:   s.sortedNames(),
+	}
+	for _, name := range snapshot.names {
+		snapshot.locs = append(snapshot.locs, s.index[name])
+	}
+	return snapshot, nil
+}
+
+// SaveSnapshot writes the applied index followed by bitmaps in the format of basalt.Bitmaps.
+func (s *BasaltOnDiskStateMachine) SaveSnapshot(ctx interface{}, w io.Writer, done <-chan struct{}) error {
+	snapshot := ctx.(*onDiskSnapshot)
+	defer snapshot.file.Close()
+
+	if err := binary.Write(w, binary.LittleEndian, snapshot.applied); err != nil {
+		return err
+	}
+	for _, loc := range snapshot.locs {
+		select {
+		case <-done:
+			return sm.ErrSnapshotStopped
+		default:
+		}
+
+		if _, err := io.Copy(w, io.NewSectionReader(snapshot.file, loc.offset, loc.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoverFromSnapshot replaces the log with bitmaps of the snapshot,
+// which are read one by one so the snapshot can be larger than memory.
+func (s *BasaltOnDiskStateMachine) RecoverFromSnapshot(r io.Reader, done <-chan struct{}) error {
+	br := bufio.NewReader(r)
+	var applied uint64
+	if err := binary.Read(br, binary.LittleEndian, &applied); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var body bytes.Buffer
+	return s.rewrite(applied, func() ([]byte, error) {
+		select {
+		case <-done:
+			return nil, sm.ErrSnapshotStopped
+		default:
+		}
+
+		var l uint32
+		if err := binary.Read(br, binary.LittleEndian, &l); err != nil {
+			return nil, err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		bm := roaring.NewBitmap()
+		if _, err := bm.ReadFrom(br); err != nil {
+			return nil, err
+		}
+
+		body.Reset()
+		binary.Write(&body, binary.LittleEndian, l)
+		body.Write(name)
+		if _, err := bm.WriteTo(&body); err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), body.Bytes()...), nil
+	})
+}
+
+func (s *BasaltOnDiskStateMachine) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// GetHash returns the state hash of bitmaps, which is maintained incrementally.
+func (s *BasaltOnDiskStateMachine) GetHash() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.hash, nil
+}
+
+// bodyCache is a LRU cache of serialized bitmaps limited by their total size.
+type bodyCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	name string
+	body []byte
+}
+
+func newBodyCache(capacity int64) *bodyCache {
+	return &bodyCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *bodyCache) get(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[name]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).body, true
+}
+
+func (c *bodyCache) put(name string, body []byte) {
+	if int64(len(body)) > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[name]; ok {
+		c.size -= int64(len(e.Value.(*cacheEntry).body))
+		c.ll.Remove(e)
+	}
+	c.items[name] = c.ll.PushFront(&cacheEntry{name: name, body: body})
+	c.size += int64(len(body))
+
+	for c.size > c.capacity {
+		e := c.ll.Back()
+		entry := e.Value.(*cacheEntry)
+		c.ll.Remove(e)
+		delete(c.items, entry.name)
+		c.size -= int64(len(entry.body))
+	}
+}
+
+func (c *bodyCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[name]; ok {
+		c.size -= int64(len(e.Value.(*cacheEntry).body))
+		c.ll.Remove(e)
+		delete(c.items, name)
+	}
+}
+
+func (c *bodyCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = 0
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
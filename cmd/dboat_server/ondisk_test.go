@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+func newTestOnDiskStateMachine(t *testing.T, dir string) *BasaltOnDiskStateMachine {
+	s := NewBasaltOnDiskStateMachineFactory(dir, 1<<20)(basaltClusterId, 1).(*BasaltOnDiskStateMachine)
+	if _, err := s.Open(nil); err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	return s
+}
+
+// testEntries returns entries of the requests starting at the index.
+func testEntries(index uint64, reqs ...*BasaltData) []sm.Entry {
+	entries := make([]sm.Entry, len(reqs))
+	for i, req := range reqs {
+		data, _ := req.MarshalBinary()
+		entries[i] = sm.Entry{Index: index + uint64(i), Cmd: data}
+	}
+	return entries
+}
+
+func testCard(t *testing.T, s *BasaltOnDiskStateMachine, name string) uint64 {
+	result, err := s.Lookup(&BasaltData{Type: Card, Names: []string{name}})
+	if err != nil {
+		t.Fatalf("failed to lookup %s: %v", name, err)
+	}
+	return result.(uint64)
+}
+
+func TestOnDiskStateMachine_Open(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-ondisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestOnDiskStateMachine(t, dir)
+	entries, err := s.Update(testEntries(1,
+		&BasaltData{Type: AddMany, Names: []string{"test1"}, Values: []uint32{1, 2, 3}},
+		&BasaltData{Type: AddMany, Names: []string{"test2"}, Values: []uint32{2, 3, 4}},
+		&BasaltData{Type: InterStore, Names: []string{"test3", "test1", "test2"}},
+		&BasaltData{Type: Add, Names: []string{"test4"}, Values: []uint32{1}},
+		&BasaltData{Type: Drop, Names: []string{"test4"}},
+	))
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if entries[2].Result.Value != 2 {
+		t.Errorf("expect 2 elements stored but got %d", entries[2].Result.Value)
+	}
+
+	// the in-memory state machine has the same state hash.
+	bsm := NewBasalStateMachine(basaltClusterId, 1).(*BasaltStateMachine)
+	for _, entry := range entries {
+		bsm.Update(entry.Cmd)
+	}
+	hash, _ := s.GetHash()
+	if want, _ := bsm.GetHash(); hash != want {
+		t.Errorf("expect state hash %d but got %d", want, hash)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// records after the last commit record are discarded.
+	path := filepath.Join(dir, "cluster-100-node-1", logFileName)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	appendRecord(&buf, recordDelete, []byte("test1"))
+	buf.Write([]byte{1, 2, 3})
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(buf.Bytes())
+	f.Close()
+
+	s = NewBasaltOnDiskStateMachineFactory(dir, 1<<20)(basaltClusterId, 1).(*BasaltOnDiskStateMachine)
+	applied, err := s.Open(nil)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer s.Close()
+
+	if applied != 5 {
+		t.Errorf("expect applied index 5 but got %d", applied)
+	}
+	if card := testCard(t, s, "test1"); card != 3 {
+		t.Errorf("expect 3 elements in test1 but got %d", card)
+	}
+	if card := testCard(t, s, "test3"); card != 2 {
+		t.Errorf("expect 2 elements in test3 but got %d", card)
+	}
+	if card := testCard(t, s, "test4"); card != 0 {
+		t.Errorf("expect test4 to be dropped but got %d elements", card)
+	}
+	if got, _ := s.GetHash(); got != hash {
+		t.Errorf("expect state hash %d after reopen but got %d", hash, got)
+	}
+	if fi2, _ := os.Stat(path); fi2.Size() != fi.Size() {
+		t.Errorf("expect the log to be truncated to %d bytes but got %d", fi.Size(), fi2.Size())
+	}
+}
+
+func TestOnDiskStateMachine_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-ondisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestOnDiskStateMachine(t, dir)
+	for i := uint32(0); i < 100; i++ {
+		if _, err := s.Update(testEntries(uint64(i)+1,
+			&BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{i}},
+			&BasaltData{Type: Add, Names: []string{"test2"}, Values: []uint32{i}},
+		)); err != nil {
+			t.Fatalf("failed to update: %v", err)
+		}
+	}
+	s.Update(testEntries(101, &BasaltData{Type: Drop, Names: []string{"test2"}}))
+
+	hash, _ := s.GetHash()
+	size := s.size
+	s.mu.Lock()
+	err = s.compact()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+
+	// a bitmap record of test1 and a commit record
+	if s.size >= size || s.size != s.live+2*recordHeaderLen+8 {
+		t.Errorf("expect the log of %d bytes to be compacted to the live bitmaps but got %d bytes", size, s.size)
+	}
+	if got, _ := s.GetHash(); got != hash {
+		t.Errorf("expect state hash %d after compaction but got %d", hash, got)
+	}
+	if card := testCard(t, s, "test1"); card != 100 {
+		t.Errorf("expect 100 elements in test1 but got %d", card)
+	}
+	s.Close()
+
+	s = NewBasaltOnDiskStateMachineFactory(dir, 1<<20)(basaltClusterId, 1).(*BasaltOnDiskStateMachine)
+	applied, err := s.Open(nil)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer s.Close()
+
+	if applied != 101 {
+		t.Errorf("expect applied index 101 but got %d", applied)
+	}
+	if card := testCard(t, s, "test1"); card != 100 {
+		t.Errorf("expect 100 elements in test1 after reopen but got %d", card)
+	}
+	if card := testCard(t, s, "test2"); card != 0 {
+		t.Errorf("expect test2 to be dropped but got %d elements", card)
+	}
+}
+
+func TestOnDiskStateMachine_RecoverFromSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-ondisk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestOnDiskStateMachine(t, filepath.Join(dir, "1"))
+	defer s.Close()
+	s.Update(testEntries(1,
+		&BasaltData{Type: AddMany, Names: []string{"test1"}, Values: []uint32{1, 2, 3}},
+		&BasaltData{Type: AddMany, Names: []string{namespaceKey("tenant", "test1")}, Values: []uint32{1, 1 << 31}},
+	))
+
+	ctx, err := s.PrepareSnapshot()
+	if err != nil {
+		t.Fatalf("failed to prepare snapshot: %v", err)
+	}
+	// updates after the snapshot is prepared are not in the snapshot.
+	s.Update(testEntries(3, &BasaltData{Type: Add, Names: []string{"test2"}, Values: []uint32{1}}))
+
+	var buf bytes.Buffer
+	if err := s.SaveSnapshot(ctx, &buf, nil); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	r := newTestOnDiskStateMachine(t, filepath.Join(dir, "2"))
+	defer r.Close()
+	r.Update(testEntries(1, &BasaltData{Type: Add, Names: []string{"test3"}, Values: []uint32{1}}))
+	if err := r.RecoverFromSnapshot(&buf, nil); err != nil {
+		t.Fatalf("failed to recover from snapshot: %v", err)
+	}
+
+	if r.applied != 2 {
+		t.Errorf("expect applied index 2 but got %d", r.applied)
+	}
+	if card := testCard(t, r, "test1"); card != 3 {
+		t.Errorf("expect 3 elements in test1 but got %d", card)
+	}
+	if card := testCard(t, r, namespaceKey("tenant", "test1")); card != 2 {
+		t.Errorf("expect 2 elements in test1 of the namespace but got %d", card)
+	}
+	if card := testCard(t, r, "test2"); card != 0 {
+		t.Errorf("expect test2 not in the snapshot but got %d elements", card)
+	}
+	if card := testCard(t, r, "test3"); card != 0 {
+		t.Errorf("expect test3 to be replaced by the snapshot but got %d elements", card)
+	}
+
+	s.Update(testEntries(4, &BasaltData{Type: Drop, Names: []string{"test2"}}))
+	want, _ := s.GetHash()
+	if hash, _ := r.GetHash(); hash != want {
+		t.Errorf("expect state hash %d but got %d", want, hash)
+	}
+}
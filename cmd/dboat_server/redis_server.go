@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+	"github.com/smallnest/log"
+	"github.com/tidwall/redcon"
+)
+
+// BasaltRedisServer serves bitmap commands of the redis protocol,
+// writes are proposed to the cluster and reads are looked up in the state machine.
+type BasaltRedisServer struct {
+	base *BasaltServer
+	srv  *redcon.Server
+}
+
+// redisConn is the state of a connection. Writes of a connection are made in
+// a client session opened on the first write and closed with the connection.
+type redisConn struct {
+	session   uint64
+	namespace string // selected namespace, empty means the default one
+}
+
+func (s *BasaltRedisServer) accept(conn redcon.Conn) bool {
+	conn.SetContext(&redisConn{})
+	return true
+}
+
+func (s *BasaltRedisServer) closed(conn redcon.Conn, err error) {
+	if rc, ok := conn.Context().(*redisConn); ok && rc.session != 0 {
+		s.base.closeSession(rc.session)
+	}
+}
+
+func (s *BasaltRedisServer) handle(conn redcon.Conn, cmd redcon.Command) {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	default:
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+	case "ping":
+		conn.WriteString("PONG")
+	case "quit":
+		conn.WriteString("OK")
+		conn.Close()
+	case "select": // select namespace
+		if len(cmd.Args) != 2 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ns := string(cmd.Args[1])
+		if !basalt.ValidNamespace(ns) {
+			conn.WriteError("ERR " + basalt.ErrInvalidNamespace.Error())
+			return
+		}
+		conn.Context().(*redisConn).namespace = ns
+		conn.WriteString("OK")
+	case "bmadd": // bitmap add
+		if len(cmd.Args) != 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		v, err := strconv.ParseUint(string(cmd.Args[2]), 10, 32)
+		if err != nil {
+			writeValueError(conn, cmd, err)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:   Add,
+			Names:  []string{string(cmd.Args[1])},
+			Values: []uint32{uint32(v)},
+		}
+		if _, ok := s.propose(conn, bd); ok {
+			conn.WriteInt(1)
+		}
+	case "bmaddmany": // bitmap addmany
+		if len(cmd.Args) < 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		values, err := parseValues(cmd.Args[2:])
+		if err != nil {
+			writeValueError(conn, cmd, err)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:   AddMany,
+			Names:  []string{string(cmd.Args[1])},
+			Values: values,
+		}
+		if _, ok := s.propose(conn, bd); ok {
+			conn.WriteInt(len(values))
+		}
+	case "bmdel": // bitmap remove
+		if len(cmd.Args) != 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		v, err := strconv.ParseUint(string(cmd.Args[2]), 10, 32)
+		if err != nil {
+			writeValueError(conn, cmd, err)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:   Remove,
+			Names:  []string{string(cmd.Args[1])},
+			Values: []uint32{uint32(v)},
+		}
+		if _, ok := s.propose(conn, bd); ok {
+			conn.WriteInt(1)
+		}
+	case "bmdrop", "bmclear": // bitmap remove_bitmap, clear_bitmap
+		if len(cmd.Args) != 2 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  Drop,
+			Names: []string{string(cmd.Args[1])},
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmclear" {
+			bd.Type = Clear
+		}
+		if _, ok := s.propose(conn, bd); ok {
+			conn.WriteString("OK")
+		}
+	case "bmcard": // bitmap cardinality
+		if len(cmd.Args) != 2 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  Card,
+			Names: []string{string(cmd.Args[1])},
+		}
+		if result, ok := s.read(conn, bd); ok {
+			conn.WriteInt64(int64(result.(uint64)))
+		}
+	case "bmexists": // bitmap exists
+		if len(cmd.Args) != 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		v, err := strconv.ParseUint(string(cmd.Args[2]), 10, 32)
+		if err != nil {
+			writeValueError(conn, cmd, err)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:   Exists,
+			Names:  []string{string(cmd.Args[1])},
+			Values: []uint32{uint32(v)},
+		}
+		if result, ok := s.read(conn, bd); ok {
+			if result.(bool) {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	case "bminter", "bmunion": // bitmap intersect, union
+		if len(cmd.Args) < 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  Inter,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmunion" {
+			bd.Type = Union
+		}
+		if result, ok := s.read(conn, bd); ok {
+			writeValues(conn, result.([]uint32))
+		}
+	case "bmxor", "bmdiff": // bitmap xor, diff
+		if len(cmd.Args) < 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  Xor,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmdiff" {
+			bd.Type = Diff
+		}
+		if result, ok := s.read(conn, bd); ok {
+			writeValues(conn, result.([]uint32))
+		}
+	case "bminterstore", "bmunionstore": // bitmap intersect store, union store
+		if len(cmd.Args) < 4 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  InterStore,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmunionstore" {
+			bd.Type = UnionStore
+		}
+		if result, ok := s.propose(conn, bd); ok {
+			conn.WriteInt64(int64(result.Value))
+		}
+	case "bmxorstore", "bmdiffstore": // bitmap xor store, diff store
+		if len(cmd.Args) < 4 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  XorStore,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmdiffstore" {
+			bd.Type = DiffStore
+		}
+		if result, ok := s.propose(conn, bd); ok {
+			conn.WriteInt64(int64(result.Value))
+		}
+	case "bmintercard", "bmunioncard": // cardinality of bitmap intersect, union
+		if len(cmd.Args) < 2 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  InterCard,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmunioncard" {
+			bd.Type = UnionCard
+		}
+		if result, ok := s.read(conn, bd); ok {
+			conn.WriteInt64(int64(result.(uint64)))
+		}
+	case "bmxorcard", "bmdiffcard": // cardinality of bitmap xor, diff
+		if len(cmd.Args) < 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  XorCard,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmdiffcard" {
+			bd.Type = DiffCard
+		}
+		if result, ok := s.read(conn, bd); ok {
+			conn.WriteInt64(int64(result.(uint64)))
+		}
+	case "bmjaccard": // jaccard index of two bitmaps
+		if len(cmd.Args) != 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  Jaccard,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if result, ok := s.read(conn, bd); ok {
+			conn.WriteBulkString(strconv.FormatFloat(result.(float64), 'f', -1, 64))
+		}
+	case "bmaddkey": // bitmap add string keys, which are assigned ids first
+		if len(cmd.Args) < 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		ns := conn.Context().(*redisConn).namespace
+		ids, err := s.base.assignKeys(ctx, ns, parseNames(cmd.Args[2:]))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+
+		bd := &BasaltData{
+			Type:   AddMany,
+			Names:  []string{string(cmd.Args[1])},
+			Values: ids,
+		}
+		if _, ok := s.propose(conn, bd); ok {
+			conn.WriteInt(len(ids))
+		}
+	case "bmexistskey": // bitmap exists of a string key
+		if len(cmd.Args) != 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		ns := conn.Context().(*redisConn).namespace
+		ids, err := s.base.keyIDs(ctx, ns, []string{string(cmd.Args[2])})
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		if len(ids) == 0 {
+			conn.WriteInt(0)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:   Exists,
+			Names:  []string{string(cmd.Args[1])},
+			Values: ids,
+		}
+		if result, ok := s.read(conn, bd); ok {
+			if result.(bool) {
+				conn.WriteInt(1)
+			} else {
+				conn.WriteInt(0)
+			}
+		}
+	case "bminterkeys", "bmunionkeys": // string keys of bitmap intersect, union
+		if len(cmd.Args) < 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  Inter,
+			Names: parseNames(cmd.Args[1:]),
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "bmunionkeys" {
+			bd.Type = Union
+		}
+		result, ok := s.read(conn, bd)
+		if !ok {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		keys, err := s.base.keysOf(ctx, bd.Namespace, result.([]uint32))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteArray(len(keys))
+		for _, key := range keys {
+			conn.WriteBulkString(key)
+		}
+	case "bmstats": // bitmap stats
+		if len(cmd.Args) != 2 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		bd := &BasaltData{
+			Type:  Stats,
+			Names: []string{string(cmd.Args[1])},
+		}
+		result, ok := s.read(conn, bd)
+		if !ok {
+			return
+		}
+		stats := result.(basalt.Stats)
+
+		var sb strings.Builder
+		appendMetric(&sb, "cardinality", stats.Cardinality)
+		appendMetric(&sb, "Containers", stats.Containers)
+
+		appendMetric(&sb, "ArrayContainers", stats.ArrayContainers)
+		appendMetric(&sb, "ArrayContainerBytes", stats.ArrayContainerBytes)
+		appendMetric(&sb, "ArrayContainerValues", stats.ArrayContainerValues)
+
+		appendMetric(&sb, "BitmapContainers", stats.BitmapContainers)
+		appendMetric(&sb, "BitmapContainerBytes", stats.BitmapContainerBytes)
+		appendMetric(&sb, "BitmapContainerValues", stats.BitmapContainerValues)
+
+		appendMetric(&sb, "RunContainers", stats.RunContainers)
+		appendMetric(&sb, "RunContainerBytes", stats.RunContainerBytes)
+		appendMetric(&sb, "RunContainerValues", stats.RunContainerValues)
+
+		conn.WriteBulkString(sb.String())
+	case "bmsave": // bitmap persist, which is a snapshot of the state machine
+		if len(cmd.Args) != 1 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := s.base.save(ctx); err != nil {
+			conn.WriteError("ERR save because of " + err.Error())
+			return
+		}
+		conn.WriteInt(1)
+	case "shards": // shard map
+		if len(cmd.Args) != 1 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		m, err := s.base.loadShardMap(ctx)
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		data, _ := json.Marshal(m)
+		conn.WriteBulk(data)
+	case "addshard": // addshard id nodeid [nodeid ...]
+		if len(cmd.Args) < 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ids, err := parseIds(cmd.Args[1:])
+		if err != nil {
+			writeValueError(conn, cmd, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := s.base.addShard(ctx, ids[0], ids[1:]); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "bmquota": // bmquota [maxmemory maxbitmaps] of the selected namespace
+		if len(cmd.Args) != 1 && len(cmd.Args) != 3 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ns := conn.Context().(*redisConn).namespace
+		if len(cmd.Args) == 1 {
+			q, err := s.base.quota(ctx, ns)
+			if err != nil {
+				conn.WriteError("ERR " + err.Error())
+				return
+			}
+			conn.WriteArray(2)
+			conn.WriteInt64(int64(q.MaxMemory))
+			conn.WriteInt64(int64(q.MaxBitmaps))
+			return
+		}
+
+		var q basalt.Quota
+		var err error
+		if q.MaxMemory, err = strconv.ParseUint(string(cmd.Args[1]), 10, 64); err == nil {
+			q.MaxBitmaps, err = strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+		}
+		if err != nil {
+			writeValueError(conn, cmd, err)
+			return
+		}
+
+		if err := s.base.setQuota(ctx, ns, q); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "rebalance":
+		if len(cmd.Args) != 1 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		if err := s.base.rebalance(ctx); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "bmhash": // state hashes of shards hosted by this node
+		if len(cmd.Args) != 1 {
+			writeArgsError(conn, cmd)
+			return
+		}
+
+		hashes, err := s.base.shardHashes()
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		data, _ := json.Marshal(hashes)
+		conn.WriteBulk(data)
+	}
+}
+
+// propose proposes the write in the session of the connection and writes an
+// error reply if it fails. Writes are made without session if the state
+// machine doesn't support sessions.
+func (s *BasaltRedisServer) propose(conn redcon.Conn, reqData *BasaltData) (sm.Result, bool) {
+	rc := conn.Context().(*redisConn)
+	reqData.Namespace = rc.namespace
+	if rc.session == 0 {
+		id, err := s.base.openSession()
+		if err != nil && err != ErrSessionUnsupported {
+			conn.WriteError("ERR " + err.Error())
+			return sm.Result{}, false
+		}
+		rc.session = id
+	}
+
+	result, err := s.base.propose(rc.session, reqData)
+	if err == ErrSessionNotFound {
+		// the session expired while the connection was idle
+		rc.session = 0
+		return s.propose(conn, reqData)
+	}
+	if err != nil {
+		log.Errorf("sync propose error: %v", err)
+
+		conn.WriteError("ERR " + err.Error())
+		return result, false
+	}
+
+	return result, true
+}
+
+// read looks up the state machine and writes an error reply if it fails.
+func (s *BasaltRedisServer) read(conn redcon.Conn, reqData *BasaltData) (interface{}, bool) {
+	reqData.Namespace = conn.Context().(*redisConn).namespace
+	result, err := s.base.read(reqData)
+	if err != nil {
+		log.Errorf("sync read error: %v", err)
+
+		conn.WriteError("ERR " + err.Error())
+		return nil, false
+	}
+
+	return result, true
+}
+
+func writeArgsError(conn redcon.Conn, cmd redcon.Command) {
+	conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+}
+
+func writeValueError(conn redcon.Conn, cmd redcon.Command, err error) {
+	conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+}
+
+func writeValues(conn redcon.Conn, values []uint32) {
+	conn.WriteArray(len(values))
+	for _, v := range values {
+		conn.WriteInt64(int64(v))
+	}
+}
+
+func appendMetric(sb *strings.Builder, name string, v uint64) {
+	sb.WriteString(name)
+	sb.WriteString(":")
+	sb.WriteString(strconv.FormatUint(v, 10))
+	sb.WriteString("\r\n")
+}
+
+func parseValues(args [][]byte) ([]uint32, error) {
+	var values []uint32
+	for _, arg := range args {
+		v, err := strconv.ParseUint(string(arg), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, uint32(v))
+	}
+	return values, nil
+}
+
+func parseIds(args [][]byte) ([]uint64, error) {
+	var ids []uint64
+	for _, arg := range args {
+		id, err := strconv.ParseUint(string(arg), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseNames(args [][]byte) []string {
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		names = append(names, string(arg))
+	}
+	return names
+}
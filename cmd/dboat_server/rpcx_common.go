@@ -1,5 +1,7 @@
 package main
 
+import "github.com/lni/dragonboat/v3/client"
+
 // BitmapValueRequest contains the name of bitmap and value.
 type BitmapValueRequest struct {
 	Name  string
@@ -30,3 +32,54 @@ type BitmapDstAndPairRequest struct {
 	Name1       string
 	Name2       string
 }
+
+// AddNodeRequest contains the id and raft address of a node.
+type AddNodeRequest struct {
+	ID   uint64
+	Addr string
+}
+
+// ClusterInfo is the status of the raft cluster seen by the local node.
+type ClusterInfo struct {
+	ID       uint64 // id of the local node
+	LeaderID uint64
+	State    string // leader, follower, observer or witness
+	Term     uint64
+	Commit   uint64
+	Applied  uint64
+	Members  []MemberInfo
+}
+
+// MemberInfo is a member of the raft cluster.
+type MemberInfo struct {
+	ID       uint64
+	Addr     string
+	Role     string // leader, voter, learner or witness
+	Match    uint64
+	Next     uint64
+	Progress string
+	Lag      uint64
+}
+
+// ShardRequest is a request forwarded to a node which hosts the shard by http.
+type ShardRequest struct {
+	Shard   uint64
+	Read    bool
+	Data    []byte          // BasaltData in json
+	Session *client.Session // client session of the proposal or to be closed
+	Open    bool            // opens a client session of the shard
+	Close   bool            // closes Session
+}
+
+// ShardReply is the result of a forwarded request.
+type ShardReply struct {
+	Value   uint64          // result of proposals
+	Data    []byte          // result of reads in json, or the error of an applied proposal
+	Session *client.Session // the opened client session
+}
+
+// AddShardRequest contains the id of a new shard and node ids of its replicas.
+type AddShardRequest struct {
+	ID      uint64
+	Members []uint64
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"github.com/rpcxio/basalt"
 	"github.com/smallnest/log"
 	"github.com/smallnest/rpcx/server"
+	"github.com/smallnest/rpcx/share"
+	"strconv"
 	"time"
 )
 
@@ -24,7 +26,7 @@ func (s *BasaltRpcxServer) Add(ctx context.Context, req *BitmapValueRequest, rep
 		Values: []uint32 { uint32(req.Value) },
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -42,7 +44,7 @@ func (s *BasaltRpcxServer) AddMany(ctx context.Context, req *BitmapValuesRequest
 		Values: req.Values,
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -60,7 +62,7 @@ func (s *BasaltRpcxServer) Remove(ctx context.Context, req *BitmapValueRequest,
 		Values: []uint32 { uint32(req.Value) },
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -78,7 +80,7 @@ func (s *BasaltRpcxServer) RemoveBitmap(ctx context.Context, name string, reply
 		Values: nil,
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -96,7 +98,7 @@ func (s *BasaltRpcxServer) ClearBitmap(ctx context.Context, name string, reply *
 		Values: nil,
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -114,7 +116,7 @@ func (s *BasaltRpcxServer) Exists(ctx context.Context, req *BitmapValueRequest,
 		Values: []uint32 { uint32(req.Value) },
 	}
 
-	result := s.doSyncRead1(bd)
+	result := s.doSyncRead1(ctx, bd)
 	if _, ok := result.(error); ok {
 		*reply = false
 		return nil
@@ -132,7 +134,7 @@ func (s *BasaltRpcxServer) Card(ctx context.Context, name string, reply *uint64)
 		Values: nil,
 	}
 
-	result := s.doSyncRead1(bd)
+	result := s.doSyncRead1(ctx, bd)
 	if _, ok := result.(error); ok {
 		*reply = 0
 		return nil
@@ -150,7 +152,7 @@ func (s *BasaltRpcxServer) Inter(ctx context.Context, names []string, reply *[]u
 		Values: nil,
 	}
 
-	result := s.doSyncRead1(bd)
+	result := s.doSyncRead1(ctx, bd)
 	if _, ok := result.(error); ok {
 		*reply = nil
 		return nil
@@ -171,7 +173,7 @@ func (s *BasaltRpcxServer) InterStore(ctx context.Context, req *BitmapStoreReque
 		Values: nil,
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -189,7 +191,7 @@ func (s *BasaltRpcxServer) Union(ctx context.Context, names []string, reply *[]u
 		Values: nil,
 	}
 
-	result := s.doSyncRead1(bd)
+	result := s.doSyncRead1(ctx, bd)
 	if _, ok := result.(error); ok {
 		*reply = nil
 		return nil
@@ -210,7 +212,7 @@ func (s *BasaltRpcxServer) UnionStore(ctx context.Context, req *BitmapStoreReque
 		Values: nil,
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -228,7 +230,7 @@ func (s *BasaltRpcxServer) Xor(ctx context.Context, names *BitmapPairRequest, re
 		Values: nil,
 	}
 
-	result := s.doSyncRead1(bd)
+	result := s.doSyncRead1(ctx, bd)
 	if _, ok := result.(error); ok {
 		*reply = nil
 		return nil
@@ -246,7 +248,7 @@ func (s *BasaltRpcxServer) XorStore(ctx context.Context, names *BitmapDstAndPair
 		Values: nil,
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -264,7 +266,7 @@ func (s *BasaltRpcxServer) Diff(ctx context.Context, names *BitmapPairRequest, r
 		Values: nil,
 	}
 
-	result := s.doSyncRead1(bd)
+	result := s.doSyncRead1(ctx, bd)
 	if _, ok := result.(error); ok {
 		*reply = nil
 		return nil
@@ -282,7 +284,7 @@ func (s *BasaltRpcxServer) DiffStore(ctx context.Context, names *BitmapDstAndPai
 		Values: nil,
 	}
 
-	err := s.doSyncPropose1(bd)
+	err := s.doSyncPropose1(ctx, bd)
 
 	*reply = true
 	if err != nil {
@@ -292,25 +294,294 @@ func (s *BasaltRpcxServer) DiffStore(ctx context.Context, names *BitmapDstAndPai
 	return nil
 }
 
-func (s *BasaltRpcxServer) doSyncPropose1(reqData *BasaltData) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InterCard gets the cardinality of the intersection of bitmaps.
+func (s *BasaltRpcxServer) InterCard(ctx context.Context, names []string, reply *uint64) error {
+	*reply = s.readCard(ctx, &BasaltData{Type: InterCard, Names: names})
+	return nil
+}
+
+// UnionCard gets the cardinality of the union of bitmaps.
+func (s *BasaltRpcxServer) UnionCard(ctx context.Context, names []string, reply *uint64) error {
+	*reply = s.readCard(ctx, &BasaltData{Type: UnionCard, Names: names})
+	return nil
+}
+
+// XorCard gets the cardinality of the symmetric difference between bitmaps.
+func (s *BasaltRpcxServer) XorCard(ctx context.Context, names *BitmapPairRequest, reply *uint64) error {
+	*reply = s.readCard(ctx, &BasaltData{Type: XorCard, Names: []string { names.Name1, names.Name2 }})
+	return nil
+}
+
+// DiffCard gets the cardinality of the difference between two bitmaps.
+func (s *BasaltRpcxServer) DiffCard(ctx context.Context, names *BitmapPairRequest, reply *uint64) error {
+	*reply = s.readCard(ctx, &BasaltData{Type: DiffCard, Names: []string { names.Name1, names.Name2 }})
+	return nil
+}
+
+// readCard reads the cardinality of the set operation in bd, 0 if it fails.
+func (s *BasaltRpcxServer) readCard(ctx context.Context, bd *BasaltData) uint64 {
+	result := s.doSyncRead1(ctx, bd)
+	if _, ok := result.(error); ok {
+		return 0
+	}
+	return result.(uint64)
+}
+
+// Jaccard gets the Jaccard index of two bitmaps.
+func (s *BasaltRpcxServer) Jaccard(ctx context.Context, names *BitmapPairRequest, reply *float64) error {
+	bd := &BasaltData{
+		Type: Jaccard,
+		Names: []string { names.Name1, names.Name2 },
+	}
+
+	result := s.doSyncRead1(ctx, bd)
+	if _, ok := result.(error); ok {
+		*reply = 0
+		return nil
+	}
+
+	*reply = result.(float64)
+	return nil
+}
+
+// ClusterInfo gets members, roles, leader and term of the raft cluster.
+func (s *BasaltRpcxServer) ClusterInfo(ctx context.Context, dummy string, reply *ClusterInfo) error {
+	info, err := s.base.clusterInfo()
+	if err != nil {
+		log.Errorf("cluster info error: %v", err)
+		return err
+	}
+
+	*reply = *info
+	return nil
+}
+
+// AddNode adds a raft node.
+func (s *BasaltRpcxServer) AddNode(ctx context.Context, req *AddNodeRequest, reply *bool) error {
+	err := s.base.addNode(req.ID, req.Addr)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("add node error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// RemoveNode removes a raft node.
+func (s *BasaltRpcxServer) RemoveNode(ctx context.Context, req uint64, reply *bool) error {
+	err := s.base.removeNode(req)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("remove node error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// AddLearner adds an observer which doesn't vote but serves stale reads.
+func (s *BasaltRpcxServer) AddLearner(ctx context.Context, req *AddNodeRequest, reply *bool) error {
+	err := s.base.addLearner(req.ID, req.Addr)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("add learner error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// PromoteLearner promotes an observer to be a voter.
+func (s *BasaltRpcxServer) PromoteLearner(ctx context.Context, req uint64, reply *bool) error {
+	err := s.base.promoteLearner(req)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("promote learner error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// TransferLeadership transfers the leadership to the node, 0 means another voter.
+func (s *BasaltRpcxServer) TransferLeadership(ctx context.Context, req uint64, reply *bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	data, _ := json.Marshal(reqData)
-	_, err := s.base.nh.SyncPropose(ctx, s.base.rs, data)
+	err := s.base.transferLeadership(ctx, req)
+
+	*reply = true
 	if err != nil {
-		log.Errorf("sync propose error: %v", err)
+		log.Errorf("transfer leadership error: %v", err)
+		*reply = false
 	}
 
-	return err
+	return nil
 }
 
-func (s *BasaltRpcxServer) doSyncRead1(reqData *BasaltData) interface{} {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// Drain rejects new proposals, waits for in-flight proposals and moves the leadership off this node.
+func (s *BasaltRpcxServer) Drain(ctx context.Context, dummy string, reply *bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	data, _ := json.Marshal(reqData)
-	result, err := s.base.nh.SyncRead(ctx, basaltClusterId, data)
+	err := s.base.drain(ctx)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("drain error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// Shards gets the shard map.
+func (s *BasaltRpcxServer) Shards(ctx context.Context, dummy string, reply *ShardMap) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	m, err := s.base.loadShardMap(ctx)
+	if err != nil {
+		log.Errorf("shard map error: %v", err)
+		return err
+	}
+
+	*reply = *m
+	return nil
+}
+
+// AddShard adds a shard, it owns no bitmaps until rebalanced.
+func (s *BasaltRpcxServer) AddShard(ctx context.Context, req *AddShardRequest, reply *bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.base.addShard(ctx, req.ID, req.Members)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("add shard error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// Rebalance moves bitmaps so that every shard owns the same number of slots.
+func (s *BasaltRpcxServer) Rebalance(ctx context.Context, dummy string, reply *bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	err := s.base.rebalance(ctx)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("rebalance error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// Quota gets the quota of the namespace in the "ns" metadata of the request.
+func (s *BasaltRpcxServer) Quota(ctx context.Context, dummy string, reply *basalt.Quota) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	q, err := s.base.quota(ctx, namespaceOf(ctx))
+	if err != nil {
+		log.Errorf("quota error: %v", err)
+		return err
+	}
+
+	*reply = q
+	return nil
+}
+
+// SetQuota sets the quota of the namespace in the "ns" metadata of the
+// request, 0 means unlimited.
+func (s *BasaltRpcxServer) SetQuota(ctx context.Context, req *basalt.Quota, reply *bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := s.base.setQuota(ctx, namespaceOf(ctx), *req); err != nil {
+		log.Errorf("set quota error: %v", err)
+		return err
+	}
+
+	*reply = true
+	return nil
+}
+
+// Hash gets the state hashes of shards hosted by this node.
+func (s *BasaltRpcxServer) Hash(ctx context.Context, dummy string, reply *[]ShardHash) error {
+	hashes, err := s.base.shardHashes()
+	if err != nil {
+		log.Errorf("hash error: %v", err)
+		return err
+	}
+
+	*reply = hashes
+	return nil
+}
+
+// OpenSession opens a client session, whose id is set in the "session"
+// metadata of writes to make retries exactly-once.
+func (s *BasaltRpcxServer) OpenSession(ctx context.Context, dummy string, reply *uint64) error {
+	id, err := s.base.openSession()
+	if err != nil {
+		log.Errorf("open session error: %v", err)
+		return err
+	}
+
+	*reply = id
+	return nil
+}
+
+// CloseSession closes a client session.
+func (s *BasaltRpcxServer) CloseSession(ctx context.Context, id uint64, reply *bool) error {
+	err := s.base.closeSession(id)
+
+	*reply = true
+	if err != nil {
+		log.Errorf("close session error: %v", err)
+		*reply = false
+	}
+
+	return nil
+}
+
+// doSyncPropose1 proposes the write in the client session of the "session"
+// metadata if it is set, and returns the result value in the "result" metadata.
+func (s *BasaltRpcxServer) doSyncPropose1(ctx context.Context, reqData *BasaltData) error {
+	reqData.Namespace = namespaceOf(ctx)
+	var session uint64
+	if meta, ok := ctx.Value(share.ReqMetaDataKey).(map[string]string); ok && meta["session"] != "" {
+		var err error
+		if session, err = strconv.ParseUint(meta["session"], 10, 64); err != nil {
+			return err
+		}
+	}
+
+	result, err := s.base.propose(session, reqData)
+	if err != nil {
+		log.Errorf("sync propose error: %v", err)
+		return err
+	}
+
+	if meta, ok := ctx.Value(share.ResMetaDataKey).(map[string]string); ok {
+		meta["result"] = strconv.FormatUint(result.Value, 10)
+	}
+	return nil
+}
+
+func (s *BasaltRpcxServer) doSyncRead1(ctx context.Context, reqData *BasaltData) interface{} {
+	reqData.Namespace = namespaceOf(ctx)
+	result, err := s.base.read(reqData)
 	if err != nil {
 		log.Errorf("sync read error: %v", err)
 		return errors.New("sync read error")
@@ -318,3 +589,9 @@ func (s *BasaltRpcxServer) doSyncRead1(reqData *BasaltData) interface{} {
 
 	return result
 }
+
+// namespaceOf returns the namespace in the "ns" metadata of the request.
+func namespaceOf(ctx context.Context) string {
+	meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	return meta[basalt.NamespaceMetaKey]
+}
@@ -2,17 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"github.com/lni/dragonboat/v3"
-	"github.com/lni/dragonboat/v3/client"
+	"github.com/lni/dragonboat/v3/config"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
 	"github.com/smallnest/rpcx/protocol"
 	"github.com/smallnest/rpcx/server"
 	"github.com/soheilhy/cmux"
+	"github.com/tidwall/redcon"
 	"io"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
+// Errors for basalt server.
+var (
+	ErrDraining     = errors.New("node is draining")
+	ErrNoTransferee = errors.New("no voter to transfer leadership to")
+)
+
 type ReqType byte
 
 const (
@@ -31,31 +42,106 @@ const (
 	XorStore
 	Diff
 	DiffStore
+	Stats
+
+	// requests between shards
+	Fetch      // serialized bitmaps of names
+	Put        // replaces bitmaps by serialized ones
+	FreezeSlot // rejects writes to the slot in Values[0]
+	DumpSlot   // serialized bitmaps of the slot
+	LoadSlot   // loads serialized bitmaps of the slot and serves it
+	DropSlot   // drops bitmaps of the slot which has been moved
+
+	// consistency checks between replicas, see hashcheck.go
+	Checkpoint // records the state hash at the checkpoint in Data
+	Hash       // state hash of the local replica
+
+	// cardinality of set operations
+	InterCard
+	UnionCard
+	XorCard
+	DiffCard
+	Jaccard
 )
 
+// internal returns whether the request is sent between shards or replicas,
+// which can access reserved bitmaps.
+func (t ReqType) internal() bool {
+	return t >= Fetch && t <= Hash
+}
+
+// creates returns whether the request may create the bitmap Names[0],
+// which is checked against the quota of its namespace.
+func (t ReqType) creates() bool {
+	switch t {
+	case Add, AddMany, InterStore, UnionStore, XorStore, DiffStore, Put:
+		return true
+	}
+	return false
+}
+
 type BasaltData struct {
 	Type ReqType
 	Names []string  // for collection operations, use [dst, name1, name2, ...]
 	Values []uint32
+	Data []byte // serialized bitmaps
+
+	// Namespace of bitmaps, empty means the default namespace. Names are
+	// replaced by keys of the namespace before requests are routed, so it's
+	// not encoded.
+	Namespace string
+
+	// Quota of the namespace of Names[0] for writes which may create it,
+	// checked by shards when the write is applied, see namespace.go.
+	Quota basalt.Quota
 }
 
+// BasaltData is encoded by MarshalBinary in raft entries and forwarded requests,
+// see codec.go.
+
 type BasaltServer struct {
 	addr string
+	advertise string // address of this server for other nodes
 	nh *dragonboat.NodeHost
-	rs *client.Session
+	rc config.Config
+	members map[uint64]string // initial members to bootstrap the shard map
+	observer bool
+	events *raftEventListener
+
+	// shardMap is the cached shard map, shards are the shards started by
+	// the shard watcher on this node.
+	shardMu sync.RWMutex
+	shardMap *ShardMap
+	shards map[uint64]bool
+	rebalancing int32
+	sessionMu sync.Mutex
+	sessions map[uint64]*clientSession
+	stopc chan struct{}
+
+	proposals basalt.Inflight
 	rpcxOpts []ConfigRpcxOption
 
 	httpSrv *BasaltHttpServer
 	rpcxSrv *BasaltRpcxServer
+	redisSrv *BasaltRedisServer
 }
 
-func NewServer(addr string, nh *dragonboat.NodeHost, rpcxOptions []ConfigRpcxOption) *BasaltServer {
-	rs := nh.GetNoOPSession(basaltClusterId)
-
+// NewServer creates a server of the node host. advertise is the address other
+// nodes forward requests to. rc is the config of the first shard which is used
+// to start other shards, members are the initial members of a new deployment
+// and are empty for joining nodes.
+func NewServer(addr, advertise string, nh *dragonboat.NodeHost, events *raftEventListener, rc config.Config, members map[uint64]string, rpcxOptions []ConfigRpcxOption) *BasaltServer {
 	return &BasaltServer{
 		addr: addr,
+		advertise: advertise,
 		nh: nh,
-		rs: rs,
+		rc: rc,
+		members: members,
+		observer: rc.IsObserver,
+		events: events,
+		shards: map[uint64]bool{basaltClusterId: true},
+		sessions: make(map[uint64]*clientSession),
+		stopc: make(chan struct{}),
 		rpcxOpts: rpcxOptions,
 	}
 }
@@ -74,8 +160,17 @@ func (s *BasaltServer) Serve() error {
 	// http
 	hln := m.Match(cmux.HTTP1Fast())
 
+	// redis
+	dln := m.Match(cmux.Any())
+
 	go s.startRpcxServer(rln)
 	go s.startHttpServer(hln)
+	go s.startRedisServer(dln)
+	go s.watchShards()
+	go s.expireSessions()
+	if *hashCheckInterval > 0 {
+		go s.checkHashes(*hashCheckInterval)
+	}
 
 	return m.Serve()
 }
@@ -115,13 +210,95 @@ func (s *BasaltServer) startHttpServer(ln net.Listener) error {
 	return srv.Serve(ln)
 }
 
+func (s *BasaltServer) startRedisServer(ln net.Listener) error {
+	brs := &BasaltRedisServer{
+		base: s,
+	}
+	brs.srv = redcon.NewServer(s.addr, brs.handle, brs.accept, brs.closed)
+	s.redisSrv = brs
+
+	return brs.srv.Serve(ln)
+}
+
+// propose proposes an update to the shard of the bitmaps in the client
+// session, 0 means no session. Stores of bitmaps on different shards are
+// computed here and put to the shard of the destination.
+func (s *BasaltServer) propose(session uint64, reqData *BasaltData) (sm.Result, error) {
+	if !s.proposals.Begin() {
+		return sm.Result{}, ErrDraining
+	}
+	defer s.proposals.End()
+
+	if err := reqData.validate(); err != nil {
+		return sm.Result{}, err
+	}
+	reqData = reqData.inNamespace()
+
+	var cs *clientSession
+	if session != 0 {
+		var err error
+		if cs, err = s.session(session); err != nil {
+			return sm.Result{}, err
+		}
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+	}
+
+	var result sm.Result
+	err := s.withShardMap(func(m *ShardMap) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		req := m.withQuota(reqData)
+
+		var err error
+		if shard, ok := shardOfAll(m, req.Names); ok {
+			result, err = s.proposeTo(ctx, cs, shard, req)
+		} else {
+			result, err = s.crossShardStore(ctx, cs, m, req)
+		}
+		return err
+	})
+
+	return result, err
+}
+
+// read queries the shard of the bitmaps, set operations of bitmaps on
+// different shards are computed here. Observers don't take part in the
+// ReadIndex protocol, so they serve eventually consistent reads locally.
+func (s *BasaltServer) read(reqData *BasaltData) (interface{}, error) {
+	if err := reqData.validate(); err != nil {
+		return nil, err
+	}
+	reqData = reqData.inNamespace()
+
+	var result interface{}
+	err := s.withShardMap(func(m *ShardMap) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		var err error
+		if shard, ok := shardOfAll(m, reqData.Names); ok {
+			result, err = s.readFrom(ctx, shard, reqData)
+		} else {
+			result, err = s.crossShardRead(ctx, m, reqData)
+		}
+		return err
+	})
+
+	return result, err
+}
+
 func (s *BasaltServer) Close() {
+	close(s.stopc)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
 	defer cancel()
 
 	s.nh.Stop()
 	s.httpSrv.srv.Shutdown(ctx)
 	s.rpcxSrv.srv.Close()
+	s.redisSrv.srv.Close()
 }
 
 func rpcxPrefixByteMatcher() cmux.Matcher {
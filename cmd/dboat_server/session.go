@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v3/client"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/smallnest/log"
+)
+
+// Errors for client sessions.
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrSessionUnsupported = errors.New("client sessions are not supported by the on-disk state machine")
+)
+
+// sessionIdleTimeout is how long a session is kept without requests.
+const sessionIdleTimeout = 10 * time.Minute
+
+// clientSession makes writes of a client exactly-once. It holds a dragonboat
+// session of every shard the client writes to, which deduplicates proposals
+// with the same series id. A proposal that failed, e.g. timed out, is kept
+// pending: if the client retries it, it is proposed again with the same series
+// id so it is applied at most once, otherwise it is given up.
+//
+// Writes of a session are serialized.
+type clientSession struct {
+	mu       sync.Mutex
+	shards   map[uint64]*client.Session
+	pending  map[uint64][]byte // shard -> the failed proposal
+	lastUsed int64             // unix nano, accessed atomically
+}
+
+// openSession opens a client session and returns its id.
+func (s *BasaltServer) openSession() (uint64, error) {
+	if *onDisk {
+		return 0, ErrSessionUnsupported
+	}
+
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	var id uint64
+	for id == 0 || s.sessions[id] != nil {
+		id = rand.Uint64()
+	}
+	s.sessions[id] = &clientSession{
+		shards:   make(map[uint64]*client.Session),
+		pending:  make(map[uint64][]byte),
+		lastUsed: time.Now().UnixNano(),
+	}
+	return id, nil
+}
+
+// closeSession closes the client session and its dragonboat sessions.
+func (s *BasaltServer) closeSession(id uint64) error {
+	s.sessionMu.Lock()
+	cs := s.sessions[id]
+	delete(s.sessions, id)
+	s.sessionMu.Unlock()
+
+	if cs == nil {
+		return ErrSessionNotFound
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var err error
+	for shard, session := range cs.shards {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		if cerr := s.closeShardSession(ctx, shard, session); cerr != nil {
+			log.Errorf("failed to close session of shard %d: %v", shard, cerr)
+			err = cerr
+		}
+		cancel()
+	}
+	return err
+}
+
+func (s *BasaltServer) session(id uint64) (*clientSession, error) {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	cs := s.sessions[id]
+	if cs == nil {
+		return nil, ErrSessionNotFound
+	}
+	return cs, nil
+}
+
+// expireSessions closes sessions which are not used for sessionIdleTimeout,
+// e.g. of clients which exited without closing them.
+func (s *BasaltServer) expireSessions() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopc:
+			return
+		}
+
+		var idle []uint64
+		s.sessionMu.Lock()
+		for id, cs := range s.sessions {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&cs.lastUsed))) > sessionIdleTimeout {
+				idle = append(idle, id)
+			}
+		}
+		s.sessionMu.Unlock()
+
+		for _, id := range idle {
+			s.closeSession(id)
+		}
+	}
+}
+
+// proposeInSession proposes data to the shard in the client session,
+// cs must be locked by the caller.
+func (s *BasaltServer) proposeInSession(ctx context.Context, cs *clientSession, shard uint64, data []byte) (sm.Result, error) {
+	atomic.StoreInt64(&cs.lastUsed, time.Now().UnixNano())
+
+	session := cs.shards[shard]
+	if session == nil {
+		var err error
+		if session, err = s.openShardSession(ctx, shard); err != nil {
+			return sm.Result{}, err
+		}
+		cs.shards[shard] = session
+	}
+
+	if pending, ok := cs.pending[shard]; ok {
+		delete(cs.pending, shard)
+		if !bytes.Equal(pending, data) {
+			session.ProposalCompleted()
+		}
+	}
+
+	// errors of applied proposals are returned in their results.
+	result, err := s.proposeSession(ctx, shard, session, data)
+	if err != nil && len(result.Data) == 0 {
+		cs.pending[shard] = data
+		return result, err
+	}
+
+	session.ProposalCompleted()
+	return result, err
+}
+
+// proposeSession proposes data to the shard with the dragonboat session.
+func (s *BasaltServer) proposeSession(ctx context.Context, shard uint64, session *client.Session, data []byte) (sm.Result, error) {
+	if !s.hosted(shard) {
+		return s.forwardPropose(ctx, &ShardRequest{Shard: shard, Data: data, Session: session})
+	}
+
+	result, err := s.nh.SyncPropose(ctx, session, data)
+	if err != nil {
+		return result, err
+	}
+	return result, resultError(result)
+}
+
+func (s *BasaltServer) openShardSession(ctx context.Context, shard uint64) (*client.Session, error) {
+	if !s.hosted(shard) {
+		var reply ShardReply
+		if err := s.forward(ctx, &ShardRequest{Shard: shard, Open: true}, &reply); err != nil {
+			return nil, err
+		}
+		return reply.Session, nil
+	}
+	return s.nh.SyncGetSession(ctx, shard)
+}
+
+func (s *BasaltServer) closeShardSession(ctx context.Context, shard uint64, session *client.Session) error {
+	if !s.hosted(shard) {
+		return s.forward(ctx, &ShardRequest{Shard: shard, Close: true, Session: session}, &ShardReply{})
+	}
+	return s.nh.SyncCloseSession(ctx, session)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3"
+	"github.com/lni/dragonboat/v3/client"
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/plugin/pebble"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+)
+
+// newTestNodeHost starts a single replica of the cluster with the state machine.
+func newTestNodeHost(t *testing.T, dir string, clusterId uint64, create func(uint64, uint64) sm.IStateMachine) *dragonboat.NodeHost {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	nh, err := dragonboat.NewNodeHost(config.NodeHostConfig{
+		NodeHostDir:    dir,
+		RTTMillisecond: 10,
+		RaftAddress:    addr,
+		LogDBFactory:   pebble.NewLogDB,
+	})
+	if err != nil {
+		t.Fatalf("failed to start node host: %v", err)
+	}
+	rc := config.Config{NodeID: 1, ClusterID: clusterId, ElectionRTT: 10, HeartbeatRTT: 1}
+	if err := nh.StartCluster(map[uint64]string{1: addr}, false, create, rc); err != nil {
+		nh.Stop()
+		t.Fatalf("failed to start cluster: %v", err)
+	}
+
+	for i := 0; i < 500; i++ {
+		if _, ok, _ := nh.GetLeaderID(clusterId); ok {
+			return nh
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	nh.Stop()
+	t.Fatal("no leader of the cluster is elected")
+	return nil
+}
+
+func TestBasaltServer_ProposeInSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nh := newTestNodeHost(t, dir, basaltClusterId, NewBasalStateMachine)
+	defer nh.Stop()
+
+	s := &BasaltServer{nh: nh, shards: map[uint64]bool{basaltClusterId: true}}
+	cs := &clientSession{shards: make(map[uint64]*client.Session), pending: make(map[uint64][]byte)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	quota := basalt.Quota{MaxBitmaps: 1}
+	add := func(name string) []byte {
+		data, _ := (&BasaltData{Type: Add, Names: []string{name}, Values: []uint32{1}, Quota: quota}).MarshalBinary()
+		return data
+	}
+
+	if _, err := s.proposeInSession(ctx, cs, basaltClusterId, add("test1")); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	// the entry fails on apply, so it is completed instead of kept pending.
+	if _, err := s.proposeInSession(ctx, cs, basaltClusterId, add("test2")); err != basalt.ErrQuotaExceeded {
+		t.Fatalf("expect %v but got %v", basalt.ErrQuotaExceeded, err)
+	}
+	if len(cs.pending) != 0 {
+		t.Errorf("expect no pending proposal but got %d", len(cs.pending))
+	}
+
+	// a retry after the quota is freed is applied again, not answered by
+	// the result of the failed entry.
+	drop, _ := (&BasaltData{Type: Drop, Names: []string{"test1"}}).MarshalBinary()
+	if _, err := s.proposeInSession(ctx, cs, basaltClusterId, drop); err != nil {
+		t.Fatalf("failed to drop: %v", err)
+	}
+	result, err := s.proposeInSession(ctx, cs, basaltClusterId, add("test2"))
+	if err != nil || result.Value != 1 {
+		t.Errorf("expect 1 integer in test2 but got %d, %v", result.Value, err)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v3"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+	"github.com/rpcxio/basalt"
+)
+
+// Names of bitmaps are hashed onto numSlots slots and every slot is owned by
+// a shard, which is a dragonboat cluster. The shard map is stored in the
+// metadata cluster. basaltClusterId is the first shard and owns all slots
+// until shards are added and rebalanced.
+const numSlots = 1024
+
+// Errors for sharding.
+var (
+	ErrWrongShard  = errors.New("bitmap is not served by this shard")
+	ErrRebalancing = errors.New("rebalancing is in progress")
+)
+
+// ShardMap maps slots to shards.
+type ShardMap struct {
+	Version  uint64
+	Nodes    map[uint64]string   // node id -> raft address
+	Services map[uint64]string   // node id -> address of the basalt server
+	Shards   map[uint64][]uint64 // shard -> node ids of replicas
+	Slots    []uint64            // slot -> shard
+
+	Quotas map[string]basalt.Quota // namespace -> quota, see namespace.go
+}
+
+// slotOf hashes the bitmap name to a slot. If the name contains a {tag}
+// only the tag is hashed, so bitmaps with the same tag are on the same shard.
+// Bitmaps of namespaces are in the slot of their names.
+func slotOf(name string) uint32 {
+	_, name, _ = splitNamespaceKey(name)
+	key := name
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		if j := strings.IndexByte(name[i+1:], '}'); j > 0 {
+			key = name[i+1 : i+1+j]
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(key)) % numSlots
+}
+
+// shardOf returns the shard owning the bitmap.
+func (m *ShardMap) shardOf(name string) uint64 {
+	if m == nil || len(m.Slots) != numSlots {
+		return basaltClusterId
+	}
+	return m.Slots[slotOf(name)]
+}
+
+func (m *ShardMap) clone() *ShardMap {
+	c := &ShardMap{
+		Version:  m.Version,
+		Nodes:    make(map[uint64]string, len(m.Nodes)),
+		Services: make(map[uint64]string, len(m.Services)),
+		Shards:   make(map[uint64][]uint64, len(m.Shards)),
+		Slots:    append([]uint64(nil), m.Slots...),
+	}
+	if m.Quotas != nil {
+		c.Quotas = make(map[string]basalt.Quota, len(m.Quotas))
+		for ns, q := range m.Quotas {
+			c.Quotas[ns] = q
+		}
+	}
+	for id, addr := range m.Nodes {
+		c.Nodes[id] = addr
+	}
+	for id, addr := range m.Services {
+		c.Services[id] = addr
+	}
+	for id, members := range m.Shards {
+		c.Shards[id] = append([]uint64(nil), members...)
+	}
+	return c
+}
+
+// slotMove moves a slot between shards.
+type slotMove struct {
+	slot     uint32
+	from, to uint64
+}
+
+// rebalancePlan spreads slots evenly over shards, moving as few slots as possible.
+func (m *ShardMap) rebalancePlan() []slotMove {
+	var shards []uint64
+	for id := range m.Shards {
+		shards = append(shards, id)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+	if len(shards) == 0 {
+		return nil
+	}
+
+	target := make(map[uint64]int, len(shards))
+	for i, id := range shards {
+		target[id] = len(m.Slots) / len(shards)
+		if i < len(m.Slots)%len(shards) {
+			target[id]++
+		}
+	}
+
+	owned := make(map[uint64]int, len(shards))
+	var surplus []slotMove
+	for slot, id := range m.Slots {
+		owned[id]++
+		if owned[id] > target[id] {
+			surplus = append(surplus, slotMove{slot: uint32(slot), from: id})
+		}
+	}
+
+	var moves []slotMove
+	for _, id := range shards {
+		for owned[id] < target[id] && len(surplus) > 0 {
+			mv := surplus[0]
+			surplus = surplus[1:]
+			mv.to = id
+			owned[id]++
+			moves = append(moves, mv)
+		}
+	}
+	return moves
+}
+
+func (s *BasaltServer) currentShardMap() *ShardMap {
+	s.shardMu.RLock()
+	defer s.shardMu.RUnlock()
+
+	return s.shardMap
+}
+
+// loadShardMap reads the shard map from the metadata cluster and caches it.
+func (s *BasaltServer) loadShardMap(ctx context.Context) (*ShardMap, error) {
+	var result interface{}
+	var err error
+	if s.observer {
+		result, err = s.nh.StaleRead(metaClusterId, nil)
+	} else {
+		result, err = s.nh.SyncRead(ctx, metaClusterId, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := result.(*ShardMap)
+	s.shardMu.Lock()
+	if s.shardMap == nil || m.Version >= s.shardMap.Version {
+		s.shardMap = m
+	}
+	s.shardMu.Unlock()
+	return m, nil
+}
+
+// watchShards bootstraps the shard map, refreshes it periodically
+// and starts replicas of shards placed on this node.
+func (s *BasaltServer) watchShards() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		m, err := s.loadShardMap(ctx)
+		if err == nil && len(m.Slots) == 0 && len(s.members) > 0 {
+			_, err = s.proposeMeta(ctx, &MetaOp{Type: MetaInit, Nodes: s.members})
+		}
+		if err == nil && len(m.Slots) > 0 && !s.observer && m.Services[s.rc.NodeID] != s.advertise {
+			// other nodes forward requests of shards not hosted by them to this address
+			_, err = s.proposeMeta(ctx, &MetaOp{Type: MetaSetService, Nodes: map[uint64]string{s.rc.NodeID: s.advertise}})
+		}
+		cancel()
+
+		if err != nil {
+			log.Printf("failed to refresh shard map: %v", err)
+		} else {
+			s.startShards(m)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stopc:
+			return
+		}
+	}
+}
+
+// startShards starts the shards which have a replica on this node.
+func (s *BasaltServer) startShards(m *ShardMap) {
+	for id, nodes := range m.Shards {
+		if id == basaltClusterId || s.hosted(id) {
+			continue
+		}
+
+		var local bool
+		members := make(map[uint64]string, len(nodes))
+		for _, nodeId := range nodes {
+			members[nodeId] = m.Nodes[nodeId]
+			local = local || nodeId == s.rc.NodeID
+		}
+		if !local {
+			continue
+		}
+
+		rc := s.rc
+		rc.ClusterID = id
+		rc.IsObserver = false
+		err := startShard(s.nh, members, false, rc)
+		if err != nil && err != dragonboat.ErrClusterAlreadyExist {
+			log.Printf("failed to start shard %d: %v", id, err)
+			continue
+		}
+		log.Printf("started shard %d", id)
+
+		s.shardMu.Lock()
+		s.shards[id] = true
+		s.shardMu.Unlock()
+	}
+}
+
+// save requests snapshots of the metadata cluster and shards hosted by this node.
+func (s *BasaltServer) save(ctx context.Context) error {
+	clusters := []uint64{metaClusterId}
+	s.shardMu.RLock()
+	for id := range s.shards {
+		clusters = append(clusters, id)
+	}
+	s.shardMu.RUnlock()
+
+	for _, id := range clusters {
+		if _, err := s.nh.SyncRequestSnapshot(ctx, id, dragonboat.DefaultSnapshotOption); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BasaltServer) hosted(id uint64) bool {
+	s.shardMu.RLock()
+	defer s.shardMu.RUnlock()
+
+	return s.shards[id]
+}
+
+// withShardMap runs fn with the cached shard map, and retries with a
+// refreshed one while fn hits a shard which no longer serves the bitmaps,
+// including slots being moved.
+func (s *BasaltServer) withShardMap(fn func(m *ShardMap) error) error {
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = fn(s.currentShardMap()); err != ErrWrongShard {
+			return err
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		_, lerr := s.loadShardMap(ctx)
+		cancel()
+		if lerr != nil {
+			return lerr
+		}
+	}
+	return err
+}
+
+// proposeTo proposes reqData to the shard in the client session, cs is nil
+// for requests without a session. It is forwarded to a replica of the shard
+// if the shard is not hosted by this node.
+func (s *BasaltServer) proposeTo(ctx context.Context, cs *clientSession, shard uint64, reqData *BasaltData) (sm.Result, error) {
+	data, _ := reqData.MarshalBinary()
+	if cs != nil {
+		return s.proposeInSession(ctx, cs, shard, data)
+	}
+
+	if !s.hosted(shard) {
+		return s.forwardPropose(ctx, &ShardRequest{Shard: shard, Data: data})
+	}
+	return s.proposeSession(ctx, shard, s.nh.GetNoOPSession(shard), data)
+}
+
+// readFrom looks up reqData in the shard, which is forwarded to a replica
+// of the shard if it is not hosted by this node.
+func (s *BasaltServer) readFrom(ctx context.Context, shard uint64, reqData *BasaltData) (interface{}, error) {
+	if !s.hosted(shard) {
+		return s.forwardRead(ctx, shard, reqData)
+	}
+
+	if s.observer {
+		return s.nh.StaleRead(shard, reqData)
+	}
+	return s.nh.SyncRead(ctx, shard, reqData)
+}
+
+func (s *BasaltServer) proposeMeta(ctx context.Context, op *MetaOp) (sm.Result, error) {
+	data, _ := json.Marshal(op)
+	result, err := s.nh.SyncPropose(ctx, s.nh.GetNoOPSession(metaClusterId), data)
+	if err != nil {
+		return result, err
+	}
+	return result, resultError(result)
+}
+
+// shardOfAll returns the shard of names if all of them are on the same shard.
+func shardOfAll(m *ShardMap, names []string) (uint64, bool) {
+	shard := m.shardOf(names[0])
+	for _, name := range names[1:] {
+		if m.shardOf(name) != shard {
+			return 0, false
+		}
+	}
+	return shard, true
+}
+
+// fetch copies the named bitmaps from their shards.
+func (s *BasaltServer) fetch(ctx context.Context, m *ShardMap, names []string) (*basalt.Bitmaps, error) {
+	groups := make(map[uint64][]string)
+	for _, name := range names {
+		shard := m.shardOf(name)
+		groups[shard] = append(groups[shard], name)
+	}
+
+	bitmaps := basalt.NewBitmaps()
+	for shard, group := range groups {
+		result, err := s.readFrom(ctx, shard, &BasaltData{Type: Fetch, Names: group})
+		if err != nil {
+			return nil, err
+		}
+		if err := bitmaps.Read(bytes.NewReader(result.([]byte))); err != nil {
+			return nil, err
+		}
+	}
+	return bitmaps, nil
+}
+
+// crossShardRead computes a set operation of bitmaps on different shards
+// by fetching the operands.
+func (s *BasaltServer) crossShardRead(ctx context.Context, m *ShardMap, reqData *BasaltData) (interface{}, error) {
+	bitmaps, err := s.fetch(ctx, m, reqData.Names)
+	if err != nil {
+		return nil, err
+	}
+
+	names := reqData.Names
+	switch reqData.Type {
+	case Inter:
+		return bitmaps.Inter(names...), nil
+	case Union:
+		return bitmaps.Union(names...), nil
+	case Xor:
+		return bitmaps.Xor(names...), nil
+	case Diff:
+		return bitmaps.Diff(names...), nil
+	case InterCard:
+		return bitmaps.InterCard(names...), nil
+	case UnionCard:
+		return bitmaps.UnionCard(names...), nil
+	case XorCard:
+		return bitmaps.XorCard(names...), nil
+	case DiffCard:
+		return bitmaps.DiffCard(names...), nil
+	case Jaccard:
+		return bitmaps.Jaccard(names[0], names[1]), nil
+	}
+	return nil, errors.New("invalid request type")
+}
+
+// crossShardStore computes a store of bitmaps on different shards by fetching
+// the operands, and puts the result to the shard of the destination.
+func (s *BasaltServer) crossShardStore(ctx context.Context, cs *clientSession, m *ShardMap, reqData *BasaltData) (sm.Result, error) {
+	bitmaps, err := s.fetch(ctx, m, reqData.Names[1:])
+	if err != nil {
+		return sm.Result{}, err
+	}
+
+	dst, names := reqData.Names[0], reqData.Names[1:]
+	switch reqData.Type {
+	case InterStore:
+		bitmaps.InterStore(dst, names, false)
+	case UnionStore:
+		bitmaps.UnionStore(dst, names, false)
+	case XorStore:
+		bitmaps.XorStore(dst, names, false)
+	case DiffStore:
+		bitmaps.DiffStore(dst, names, false)
+	default:
+		return sm.Result{}, errors.New("invalid request type")
+	}
+
+	var buf bytes.Buffer
+	if _, err := bitmaps.SnapshotOf(dst).WriteTo(&buf); err != nil {
+		return sm.Result{}, err
+	}
+	return s.proposeTo(ctx, cs, m.shardOf(dst), &BasaltData{Type: Put, Names: []string{dst}, Data: buf.Bytes(), Quota: reqData.Quota})
+}
+
+// addShard adds a shard replicated on the nodes, it owns no slots until rebalanced.
+func (s *BasaltServer) addShard(ctx context.Context, id uint64, nodes []uint64) error {
+	_, err := s.proposeMeta(ctx, &MetaOp{Type: MetaAddShard, Shard: id, Members: nodes})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.loadShardMap(ctx)
+	return err
+}
+
+// rebalance moves slots so that every shard owns the same number of slots.
+// It can be run again to resume if it fails.
+func (s *BasaltServer) rebalance(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.rebalancing, 0, 1) {
+		return ErrRebalancing
+	}
+	defer atomic.StoreInt32(&s.rebalancing, 0)
+
+	m, err := s.loadShardMap(ctx)
+	if err != nil {
+		return err
+	}
+
+	moves := m.rebalancePlan()
+	targets := make(map[uint64]bool)
+	for _, mv := range moves {
+		targets[mv.to] = true
+	}
+	for id := range targets {
+		if err := s.waitShard(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("rebalancing %d slots", len(moves))
+	for _, mv := range moves {
+		if err := s.moveSlot(ctx, mv); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.loadShardMap(ctx)
+	return err
+}
+
+// waitShard waits until the shard serves requests, new shards are started
+// by the shard watchers of their nodes in a few seconds.
+func (s *BasaltServer) waitShard(ctx context.Context, id uint64) error {
+	for {
+		rctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		_, err := s.readFrom(rctx, id, &BasaltData{Type: Fetch})
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// moveSlot freezes writes of the slot on the source shard, copies its bitmaps
+// to the target shard, switches the owner of the slot and drops them from the
+// source shard. Requests routed to the old owner fail with ErrWrongShard and
+// are retried with the new shard map.
+func (s *BasaltServer) moveSlot(ctx context.Context, mv slotMove) error {
+	slot := []uint32{mv.slot}
+
+	if _, err := s.proposeTo(ctx, nil, mv.from, &BasaltData{Type: FreezeSlot, Values: slot}); err != nil {
+		return err
+	}
+
+	data, err := s.readFrom(ctx, mv.from, &BasaltData{Type: DumpSlot, Values: slot})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.proposeTo(ctx, nil, mv.to, &BasaltData{Type: LoadSlot, Values: slot, Data: data.([]byte)}); err != nil {
+		return err
+	}
+
+	if _, err := s.proposeMeta(ctx, &MetaOp{Type: MetaMoveSlot, Shard: mv.to, Slot: mv.slot}); err != nil {
+		return err
+	}
+
+	_, err = s.proposeTo(ctx, nil, mv.from, &BasaltData{Type: DropSlot, Values: slot})
+	return err
+}
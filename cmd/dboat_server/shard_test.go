@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rpcxio/basalt"
+)
+
+func TestSlotOf(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if slot := slotOf(fmt.Sprintf("test%d", i)); slot >= numSlots {
+			t.Fatalf("expect a slot less than %d but got %d", numSlots, slot)
+		}
+	}
+
+	if slotOf("{user1}:follow") != slotOf("{user1}:fans") {
+		t.Errorf("expect bitmaps with the same tag in the same slot")
+	}
+	if slotOf("{user1}:follow") != slotOf("user1") {
+		t.Errorf("expect only the tag to be hashed")
+	}
+	if slotOf("{}:follow") == slotOf("") {
+		t.Errorf("expect the whole name to be hashed for an empty tag")
+	}
+	if slotOf(namespaceKey("tenant", "follow")) != slotOf("follow") {
+		t.Errorf("expect a name to have the same slot in all namespaces")
+	}
+}
+
+func TestShardMap_ShardOf(t *testing.T) {
+	var m *ShardMap
+	if shard := m.shardOf("test"); shard != basaltClusterId {
+		t.Errorf("expect shard %d without a shard map but got %d", basaltClusterId, shard)
+	}
+
+	m = testShardMap(basaltClusterId)
+	m.Slots[slotOf("test1")] = 200
+	if shard := m.shardOf("test1"); shard != 200 {
+		t.Errorf("expect shard 200 but got %d", shard)
+	}
+	if shard := m.shardOf(namespaceKey("tenant", "test1")); shard != 200 {
+		t.Errorf("expect shard 200 in a namespace but got %d", shard)
+	}
+
+	if shard, ok := shardOfAll(m, []string{"{a}1", "{a}2"}); !ok || shard != m.shardOf("a") {
+		t.Errorf("expect bitmaps with the same tag on shard %d but got %d, %t", m.shardOf("a"), shard, ok)
+	}
+	if _, ok := shardOfAll(m, []string{"test1", "test2"}); ok && slotOf("test1") != slotOf("test2") {
+		t.Errorf("expect bitmaps on different shards")
+	}
+
+	c := m.clone()
+	c.Slots[0] = 300
+	c.Shards[basaltClusterId][0] = 300
+	if m.Slots[0] == 300 || m.Shards[basaltClusterId][0] == 300 {
+		t.Errorf("expect the clone not to share slots and shards")
+	}
+}
+
+func TestShardMap_RebalancePlan(t *testing.T) {
+	m := testShardMap(basaltClusterId)
+	m.Shards[200] = []uint64{1}
+	m.Shards[300] = []uint64{1}
+
+	moves := m.rebalancePlan()
+	if len(moves) != numSlots-numSlots/3-1 {
+		t.Errorf("expect %d moves but got %d", numSlots-numSlots/3-1, len(moves))
+	}
+	for _, mv := range moves {
+		if mv.from != basaltClusterId || m.Slots[mv.slot] != mv.from {
+			t.Fatalf("expect slot %d to be moved from its owner but got %+v", mv.slot, mv)
+		}
+		m.Slots[mv.slot] = mv.to
+	}
+
+	owned := make(map[uint64]int)
+	for _, id := range m.Slots {
+		owned[id]++
+	}
+	for id, n := range owned {
+		if n < numSlots/3 || n > numSlots/3+1 {
+			t.Errorf("expect about %d slots on shard %d but got %d", numSlots/3, id, n)
+		}
+	}
+
+	if moves := m.rebalancePlan(); len(moves) != 0 {
+		t.Errorf("expect no moves after rebalancing but got %d", len(moves))
+	}
+}
+
+func TestMetaStateMachine_Update(t *testing.T) {
+	msm := NewMetaStateMachine(metaClusterId, 1).(*MetaStateMachine)
+
+	update := func(op *MetaOp) error {
+		data, _ := json.Marshal(op)
+		result, err := msm.Update(data)
+		if err != nil {
+			return err
+		}
+		return resultError(result)
+	}
+
+	nodes := map[uint64]string{1: "localhost:63001", 2: "localhost:63002"}
+	if err := update(&MetaOp{Type: MetaInit, Nodes: nodes}); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	// the first shard map wins.
+	if err := update(&MetaOp{Type: MetaInit, Nodes: map[uint64]string{3: "localhost:63003"}}); err != nil {
+		t.Fatalf("failed to init again: %v", err)
+	}
+	if err := update(&MetaOp{Type: MetaAddShard, Shard: 200, Members: []uint64{3}}); err != ErrUnknownNode {
+		t.Errorf("expect %v but got %v", ErrUnknownNode, err)
+	}
+	if err := update(&MetaOp{Type: MetaAddShard, Shard: 200, Members: []uint64{1, 2}}); err != nil {
+		t.Fatalf("failed to add shard: %v", err)
+	}
+	if err := update(&MetaOp{Type: MetaAddShard, Shard: 200, Members: []uint64{1}}); err != ErrShardExists {
+		t.Errorf("expect %v but got %v", ErrShardExists, err)
+	}
+	if err := update(&MetaOp{Type: MetaMoveSlot, Shard: 300, Slot: 1}); err != ErrShardNotFound {
+		t.Errorf("expect %v but got %v", ErrShardNotFound, err)
+	}
+	slot := slotOf("test1")
+	if err := update(&MetaOp{Type: MetaMoveSlot, Shard: 200, Slot: slot}); err != nil {
+		t.Fatalf("failed to move slot: %v", err)
+	}
+
+	result, _ := msm.Lookup(nil)
+	m := result.(*ShardMap)
+	if len(m.Nodes) != 2 || len(m.Shards) != 2 {
+		t.Errorf("expect 2 nodes and 2 shards but got %v and %v", m.Nodes, m.Shards)
+	}
+	if m.shardOf("test1") != 200 || m.Version != 3 {
+		t.Errorf("expect test1 on shard 200 at version 3 but got %d at version %d", m.shardOf("test1"), m.Version)
+	}
+
+	q := basalt.Quota{MaxMemory: 1 << 20, MaxBitmaps: 10}
+	if err := update(&MetaOp{Type: MetaSetQuota, Namespace: "bad name", Quota: q}); err != basalt.ErrInvalidNamespace {
+		t.Errorf("expect %v but got %v", basalt.ErrInvalidNamespace, err)
+	}
+	if err := update(&MetaOp{Type: MetaSetQuota, Namespace: "tenant", Quota: q}); err != nil {
+		t.Fatalf("failed to set quota: %v", err)
+	}
+	// the shard map returned by lookups is a copy.
+	result, _ = msm.Lookup(nil)
+	result.(*ShardMap).Quotas["tenant"] = basalt.Quota{}
+	result, _ = msm.Lookup(nil)
+	if got := result.(*ShardMap).Quotas["tenant"]; got != q {
+		t.Errorf("expect quota %+v but got %+v", q, got)
+	}
+	if err := update(&MetaOp{Type: MetaSetQuota, Namespace: "tenant"}); err != nil {
+		t.Fatalf("failed to remove quota: %v", err)
+	}
+	result, _ = msm.Lookup(nil)
+	if quotas := result.(*ShardMap).Quotas; len(quotas) != 0 {
+		t.Errorf("expect no quotas but got %v", quotas)
+	}
+
+	// the hash kept on updates is the hash of a replica recovered from a snapshot.
+	if _, err := msm.dict.Assign("key1", "key2"); err != nil {
+		t.Fatalf("failed to assign keys: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := msm.SaveSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+	recovered := NewMetaStateMachine(metaClusterId, 2).(*MetaStateMachine)
+	if err := recovered.RecoverFromSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to recover from snapshot: %v", err)
+	}
+	hash, _ := msm.GetHash()
+	if got, _ := recovered.GetHash(); got != hash {
+		t.Errorf("expect hash %x after recovery but got %x", hash, got)
+	}
+	if err := update(&MetaOp{Type: MetaMoveSlot, Shard: basaltClusterId, Slot: slot}); err != nil {
+		t.Fatalf("failed to move slot: %v", err)
+	}
+	if got, _ := msm.GetHash(); got == hash || got != msm.shardMap.hash()+msm.dict.Hash() {
+		t.Errorf("expect hash %x of the shard map after moving the slot but got %x", msm.shardMap.hash()+msm.dict.Hash(), got)
+	}
+}
+
+func TestMetaStateMachine_UpdateMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basalt-meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nh := newTestNodeHost(t, dir, metaClusterId, NewMetaStateMachine)
+	defer nh.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	propose := func(data []byte) error {
+		result, err := nh.SyncPropose(ctx, nh.GetNoOPSession(metaClusterId), data)
+		if err != nil {
+			return err
+		}
+		return resultError(result)
+	}
+
+	init, _ := json.Marshal(&MetaOp{Type: MetaInit, Nodes: map[uint64]string{1: "localhost:63001"}})
+	if err := propose(init); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+
+	// malformed entries fail without stopping the cluster.
+	badSlot, _ := json.Marshal(&MetaOp{Type: MetaMoveSlot, Shard: basaltClusterId, Slot: numSlots})
+	badType, _ := json.Marshal(&MetaOp{Type: MetaOpType(0xff)})
+	for _, data := range [][]byte{[]byte(`{"Type":`), badSlot, badType} {
+		if err := propose(data); err == nil || !strings.HasPrefix(err.Error(), ErrInvalidRequest.Error()) {
+			t.Errorf("expect %v of %s but got %v", ErrInvalidRequest, data, err)
+		}
+	}
+
+	quota, _ := json.Marshal(&MetaOp{Type: MetaSetQuota, Namespace: "tenant", Quota: basalt.Quota{MaxBitmaps: 1}})
+	if err := propose(quota); err != nil {
+		t.Fatalf("failed to set quota after malformed entries: %v", err)
+	}
+	result, err := nh.SyncRead(ctx, metaClusterId, nil)
+	if err != nil {
+		t.Fatalf("failed to read the shard map: %v", err)
+	}
+	if m := result.(*ShardMap); m.Version != 2 || m.Quotas["tenant"].MaxBitmaps != 1 {
+		t.Errorf("expect the quota at version 2 but got %+v", m)
+	}
+}
+
+func TestShard_MoveSlot(t *testing.T) {
+	from, to := basalt.NewBitmaps(), basalt.NewBitmaps()
+	from.AddMany("test1", []uint32{1, 2, 3}, false)
+	slot := []uint32{slotOf("test1")}
+
+	update := func(bitmaps *basalt.Bitmaps, reqData *BasaltData) error {
+		result, err := updateBitmaps(bitmaps, reqData, bitmaps.Names, nil)
+		if err != nil {
+			return err
+		}
+		return resultError(result)
+	}
+
+	if err := update(from, &BasaltData{Type: FreezeSlot, Values: slot}); err != nil {
+		t.Fatalf("failed to freeze slot: %v", err)
+	}
+	if err := update(from, &BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{4}}); err != ErrWrongShard {
+		t.Errorf("expect writes of a frozen slot to fail with %v but got %v", ErrWrongShard, err)
+	}
+	if _, err := lookupBitmaps(from, &BasaltData{Type: Card, Names: []string{"test1"}}, from.Names); err != nil {
+		t.Errorf("expect reads of a frozen slot to be served but got %v", err)
+	}
+
+	data, err := lookupBitmaps(from, &BasaltData{Type: DumpSlot, Values: slot}, from.Names)
+	if err != nil {
+		t.Fatalf("failed to dump slot: %v", err)
+	}
+	if err := update(to, &BasaltData{Type: LoadSlot, Values: slot, Data: data.([]byte)}); err != nil {
+		t.Fatalf("failed to load slot: %v", err)
+	}
+	if err := update(from, &BasaltData{Type: DropSlot, Values: slot}); err != nil {
+		t.Fatalf("failed to drop slot: %v", err)
+	}
+
+	if _, err := lookupBitmaps(from, &BasaltData{Type: Card, Names: []string{"test1"}}, from.Names); err != ErrWrongShard {
+		t.Errorf("expect reads of a moved slot to fail with %v but got %v", ErrWrongShard, err)
+	}
+	if card := to.Card("test1"); card != 3 {
+		t.Errorf("expect 3 elements on the new shard but got %d", card)
+	}
+	if err := update(to, &BasaltData{Type: Add, Names: []string{"test1"}, Values: []uint32{4}}); err != nil {
+		t.Errorf("failed to write to the new shard: %v", err)
+	}
+}
+
+// testShardMap returns a shard map whose slots are all owned by the shard.
+func testShardMap(shard uint64) *ShardMap {
+	m := &ShardMap{
+		Nodes:  map[uint64]string{1: "localhost:63001"},
+		Shards: map[uint64][]uint64{shard: {1}},
+		Slots:  make([]uint64, numSlots),
+	}
+	for i := range m.Slots {
+		m.Slots[i] = shard
+	}
+	return m
+}
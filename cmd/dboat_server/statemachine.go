@@ -1,9 +1,7 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/binary"
-	"encoding/json"
+	"bytes"
 	"errors"
 	sm "github.com/lni/dragonboat/v3/statemachine"
 	"github.com/rpcxio/basalt"
@@ -14,6 +12,9 @@ type BasaltStateMachine struct {
 	ClusterId uint64
 	NodeId uint64
 	Bitmaps *basalt.Bitmaps
+
+	checkpoints basalt.Checkpoints
+	usages      namespaceUsages
 }
 
 func NewBasalStateMachine(clusterId, nodeId uint64) sm.IStateMachine {
@@ -37,62 +38,259 @@ func CreateBasaltStateMachineHandler(bm *basalt.Bitmaps) func(uint64, uint64) sm
 	}
 }
 
+// Slots which are being moved out and have been moved out of the shard are
+// kept in reserved bitmaps, so they are saved in snapshots with bitmaps.
+const (
+	frozenSlots = "\x00frozen-slots"
+	movedSlots  = "\x00moved-slots"
+)
+
+// serves reports whether the shard serves reads (and writes if write is set) of the bitmaps.
+func serves(bitmaps *basalt.Bitmaps, names []string, write bool) bool {
+	for _, name := range names {
+		slot := slotOf(name)
+		if bitmaps.Exists(movedSlots, slot) || write && bitmaps.Exists(frozenSlots, slot) {
+			return false
+		}
+	}
+	return true
+}
+
+// namesOfSlot returns names of bitmaps in the slot.
+func namesOfSlot(names []string, slot uint32) []string {
+	var slotNames []string
+	for _, name := range names {
+		if !reserved(name) && slotOf(name) == slot {
+			slotNames = append(slotNames, name)
+		}
+	}
+	return slotNames
+}
+
 func (bsm *BasaltStateMachine) Lookup(query interface{}) (interface{}, error) {
-	var reqData BasaltData
-	err := json.Unmarshal(query.([]byte), &reqData)
+	reqData, err := queryData(query)
 	if err != nil {
 		return nil, err
 	}
+	switch reqData.Type {
+	case Hash:
+		return hashInfo(&bsm.checkpoints, bsm.Bitmaps.Hash()), nil
+	}
+
+	return lookupBitmaps(bsm.Bitmaps, reqData, bsm.Bitmaps.Names)
+}
+
+// queryData returns the request of a lookup, which is a *BasaltData for local
+// reads and is encoded otherwise.
+func queryData(query interface{}) (*BasaltData, error) {
+	switch q := query.(type) {
+	case *BasaltData:
+		if err := q.validate(); err != nil {
+			return nil, err
+		}
+		return q, nil
+	case []byte:
+		return decodeBasaltData(q)
+	}
+	return nil, ErrInvalidRequest
+}
+
+// lookupBitmaps queries bitmaps, names returns names of all bitmaps of the shard.
+// It is shared by the in-memory and the on-disk state machine.
+func lookupBitmaps(bitmaps *basalt.Bitmaps, reqData *BasaltData, names func() []string) (interface{}, error) {
+	if reqData.Type != DumpSlot && !serves(bitmaps, reqData.Names, false) {
+		return nil, ErrWrongShard
+	}
 
 	switch reqData.Type {
 	case Exists:
-		return bsm.Bitmaps.Exists(reqData.Names[0], reqData.Values[0]), nil
+		return bitmaps.Exists(reqData.Names[0], reqData.Values[0]), nil
 	case Card:
-		return bsm.Bitmaps.Card(reqData.Names[0]), nil
+		return bitmaps.Card(reqData.Names[0]), nil
 	case Inter:
-		return bsm.Bitmaps.Inter(reqData.Names...), nil
+		return bitmaps.Inter(reqData.Names...), nil
 	case Union:
-		return bsm.Bitmaps.Union(reqData.Names...), nil
+		return bitmaps.Union(reqData.Names...), nil
 	case Xor:
-		return bsm.Bitmaps.Xor(reqData.Names[0], reqData.Names[1]), nil
+		return bitmaps.Xor(reqData.Names...), nil
 	case Diff:
-		return bsm.Bitmaps.Diff(reqData.Names[0], reqData.Names[1]), nil
+		return bitmaps.Diff(reqData.Names...), nil
+	case InterCard:
+		return bitmaps.InterCard(reqData.Names...), nil
+	case UnionCard:
+		return bitmaps.UnionCard(reqData.Names...), nil
+	case XorCard:
+		return bitmaps.XorCard(reqData.Names...), nil
+	case DiffCard:
+		return bitmaps.DiffCard(reqData.Names...), nil
+	case Jaccard:
+		return bitmaps.Jaccard(reqData.Names[0], reqData.Names[1]), nil
+	case Stats:
+		return bitmaps.Stats(reqData.Names[0]), nil
+	case Fetch:
+		return saveBitmaps(bitmaps, reqData.Names)
+	case DumpSlot:
+		return saveBitmaps(bitmaps, namesOfSlot(names(), reqData.Values[0]))
 	}
 
 	return nil, errors.New("invalid request type")
 }
 
+func saveBitmaps(bitmaps *basalt.Bitmaps, names []string) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := bitmaps.SnapshotOf(names...).WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Update applies an entry, malformed entries are not applied and the error is
+// returned in the result instead of stopping the node.
 func (bsm *BasaltStateMachine) Update(data []byte) (sm.Result, error) {
-	var reqData BasaltData
-	err := json.Unmarshal(data, &reqData)
+	reqData, err := decodeBasaltData(data)
 	if err != nil {
-		return sm.Result{}, err
+		return errorResult(err), nil
+	}
+	if reqData.Type == Checkpoint {
+		return applyCheckpoint(&bsm.checkpoints, bsm.ClusterId, bsm.Bitmaps.Hash(), reqData.Data), nil
 	}
 
+	usages := bsm.namespaceUsages()
+	switch reqData.Type {
+	case Put, LoadSlot, DropSlot:
+		// they may write any bitmap, so usages are counted again.
+		result, err := updateBitmaps(bsm.Bitmaps, reqData, bsm.Bitmaps.Names, usages)
+		bsm.usages = nil
+		return result, err
+	case FreezeSlot:
+		return updateBitmaps(bsm.Bitmaps, reqData, bsm.Bitmaps.Names, usages)
+	}
+
+	// other writes only change the bitmap Names[0].
+	name := reqData.Names[0]
+	before, existed := bsm.Bitmaps.MemoryUsage(name)
+	result, err := updateBitmaps(bsm.Bitmaps, reqData, bsm.Bitmaps.Names, usages)
+	if existed {
+		usages.remove(name, before)
+	}
+	if size, ok := bsm.Bitmaps.MemoryUsage(name); ok {
+		usages.add(name, size)
+	}
+	return result, err
+}
+
+// namespaceUsages returns usages of namespaces in the shard, which are counted
+// from bitmaps after they are recovered or slots are moved.
+func (bsm *BasaltStateMachine) namespaceUsages() namespaceUsages {
+	if bsm.usages == nil {
+		bsm.usages = usagesOf(bsm.Bitmaps.Names(), bsm.Bitmaps.MemoryUsage)
+	}
+	return bsm.usages
+}
+
+// updateBitmaps applies an update to bitmaps, names returns names of all
+// bitmaps of the shard and usages are usages of namespaces in the shard.
+// It is shared by the in-memory and the on-disk state machine.
+func updateBitmaps(bitmaps *basalt.Bitmaps, reqData *BasaltData, names func() []string, usages namespaceUsages) (sm.Result, error) {
+	// writes of clients are rejected once the slot is being moved out.
+	if reqData.Type < FreezeSlot && !serves(bitmaps, reqData.Names, true) {
+		return errorResult(ErrWrongShard), nil
+	}
+	if reqData.Type.creates() {
+		if err := checkQuota(bitmaps, reqData, usages); err != nil {
+			return errorResult(err), nil
+		}
+	}
+
+	// writes and stores return the number of integers in the bitmap written.
+	var result sm.Result
 	switch reqData.Type {
 	case Add:
-		bsm.Bitmaps.Add(reqData.Names[0], reqData.Values[0], false)
+		if err := bitmaps.Add(reqData.Names[0], reqData.Values[0], false); err != nil {
+			return errorResult(err), nil
+		}
+		result.Value = bitmaps.Card(reqData.Names[0])
 	case AddMany:
-		bsm.Bitmaps.AddMany(reqData.Names[0], reqData.Values, false)
+		if err := bitmaps.AddMany(reqData.Names[0], reqData.Values, false); err != nil {
+			return errorResult(err), nil
+		}
+		result.Value = bitmaps.Card(reqData.Names[0])
 	case Remove:
-		bsm.Bitmaps.Remove(reqData.Names[0], reqData.Values[0], false)
+		if err := bitmaps.Remove(reqData.Names[0], reqData.Values[0], false); err != nil {
+			return errorResult(err), nil
+		}
+		result.Value = bitmaps.Card(reqData.Names[0])
 	case Drop:
-		bsm.Bitmaps.RemoveBitmap(reqData.Names[0], false)
+		bitmaps.RemoveBitmap(reqData.Names[0], false)
 	case Clear:
-		bsm.Bitmaps.ClearBitmap(reqData.Names[0], false)
+		if err := bitmaps.ClearBitmap(reqData.Names[0], false); err != nil {
+			return errorResult(err), nil
+		}
 	case InterStore:
-		bsm.Bitmaps.InterStore(reqData.Names[0], reqData.Names[1:]...)
+		n, err := bitmaps.InterStore(reqData.Names[0], reqData.Names[1:], false)
+		if err != nil {
+			return errorResult(err), nil
+		}
+		result.Value = n
 	case UnionStore:
-		bsm.Bitmaps.UnionStore(reqData.Names[0], reqData.Names[1:]...)
+		n, err := bitmaps.UnionStore(reqData.Names[0], reqData.Names[1:], false)
+		if err != nil {
+			return errorResult(err), nil
+		}
+		result.Value = n
 	case XorStore:
-		bsm.Bitmaps.XorStore(reqData.Names[0], reqData.Names[1], reqData.Names[2])
+		n, err := bitmaps.XorStore(reqData.Names[0], reqData.Names[1:], false)
+		if err != nil {
+			return errorResult(err), nil
+		}
+		result.Value = n
 	case DiffStore:
-		bsm.Bitmaps.DiffStore(reqData.Names[0], reqData.Names[1], reqData.Names[2])
+		n, err := bitmaps.DiffStore(reqData.Names[0], reqData.Names[1:], false)
+		if err != nil {
+			return errorResult(err), nil
+		}
+		result.Value = n
+	case Put:
+		read, err := readBitmaps(reqData.Data)
+		if err != nil {
+			return errorResult(err), nil
+		}
+		bitmaps.Merge(read)
+		result.Value = bitmaps.Card(reqData.Names[0])
+	case FreezeSlot:
+		bitmaps.Add(frozenSlots, reqData.Values[0], false)
+	case LoadSlot:
+		read, err := readBitmaps(reqData.Data)
+		if err != nil {
+			return errorResult(err), nil
+		}
+		for _, name := range namesOfSlot(names(), reqData.Values[0]) {
+			bitmaps.RemoveBitmap(name, false)
+		}
+		bitmaps.Merge(read)
+		bitmaps.Remove(frozenSlots, reqData.Values[0], false)
+		bitmaps.Remove(movedSlots, reqData.Values[0], false)
+	case DropSlot:
+		for _, name := range namesOfSlot(names(), reqData.Values[0]) {
+			bitmaps.RemoveBitmap(name, false)
+		}
+		bitmaps.Add(movedSlots, reqData.Values[0], false)
+		bitmaps.Remove(frozenSlots, reqData.Values[0], false)
 	default:
-		return sm.Result{}, errors.New("invalid request type")
+		return errorResult(ErrInvalidRequest), nil
 	}
 
-	return sm.Result{}, nil
+	return result, nil
+}
+
+// readBitmaps reads bitmaps of an entry before they are applied, so a
+// malformed entry changes nothing.
+func readBitmaps(data []byte) (*basalt.Bitmaps, error) {
+	read := basalt.NewBitmaps()
+	if err := read.Read(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return read, nil
 }
 
 func (bsm *BasaltStateMachine) SaveSnapshot(w io.Writer, fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
@@ -107,6 +305,7 @@ func (bsm *BasaltStateMachine) RecoverFromSnapshot(r io.Reader, files []sm.Snaps
 	}
 
 	bsm.Bitmaps = bm
+	bsm.usages = nil
 	return nil
 }
 
@@ -114,15 +313,9 @@ func (bsm *BasaltStateMachine) Close() error {
 	return nil
 }
 
+// GetHash returns the state hash of bitmaps, which is maintained incrementally.
 func (bsm *BasaltStateMachine) GetHash() (uint64, error) {
-	h := md5.New()
-
-	if err := bsm.Bitmaps.Save(h); err != nil {
-		return 0, err
-	}
-
-	data := h.Sum(nil)
-	return binary.LittleEndian.Uint64(data[:8]), nil
+	return bsm.Bitmaps.Hash(), nil
 }
 
 
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rpcxio/basalt"
+)
+
+func TestUpdateBitmaps_NAry(t *testing.T) {
+	bitmaps := basalt.NewBitmaps()
+	bitmaps.AddMany("test1", []uint32{1, 2, 3, 4}, false)
+	bitmaps.AddMany("test2", []uint32{2, 3, 5}, false)
+	bitmaps.AddMany("test3", []uint32{3, 4, 6}, false)
+	names := []string{"test1", "test2", "test3"}
+
+	lookup := func(typ ReqType) interface{} {
+		result, err := lookupBitmaps(bitmaps, &BasaltData{Type: typ, Names: names}, bitmaps.Names)
+		if err != nil {
+			t.Fatalf("failed to lookup %v: %v", typ, err)
+		}
+		return result
+	}
+
+	if got := lookup(Xor); !reflect.DeepEqual(got, []uint32{1, 3, 5, 6}) {
+		t.Errorf("expect xor [1 3 5 6] but got %v", got)
+	}
+	if got := lookup(Diff); !reflect.DeepEqual(got, []uint32{1}) {
+		t.Errorf("expect diff [1] but got %v", got)
+	}
+	if got := lookup(XorCard); got != uint64(4) {
+		t.Errorf("expect 4 elements in xor but got %v", got)
+	}
+	if got := lookup(DiffCard); got != uint64(1) {
+		t.Errorf("expect 1 element in diff but got %v", got)
+	}
+
+	result, err := updateBitmaps(bitmaps, &BasaltData{Type: XorStore, Names: append([]string{"dst"}, names...)}, bitmaps.Names, nil)
+	if err != nil || result.Value != 4 {
+		t.Errorf("expect 4 elements stored but got %d, %v", result.Value, err)
+	}
+	result, err = updateBitmaps(bitmaps, &BasaltData{Type: DiffStore, Names: append([]string{"dst"}, names...)}, bitmaps.Names, nil)
+	if err != nil || result.Value != 1 {
+		t.Errorf("expect 1 element stored but got %d, %v", result.Value, err)
+	}
+}
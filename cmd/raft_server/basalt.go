@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rpcxio/basalt"
 	"github.com/rpcxio/etcd/raft/raftpb"
@@ -17,6 +22,21 @@ var (
 	peers = flag.String("peers", "http://127.0.0.1:12379", "comma separated peers in a cluster")
 	id    = flag.Int("id", 1, "node ID")
 	join  = flag.Bool("join", false, "join an existing cluster")
+
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "timeout of draining on shutdown")
+
+	hashCheckInterval = flag.Duration("hash-check-interval", time.Minute, "interval of comparing state hashes of replicas, 0 disables it")
+
+	maxMemory       = flag.Uint64("maxmemory", 0, "memory budget of bitmaps in bytes, 0 means unlimited")
+	maxMemoryPolicy = flag.String("maxmemory-policy", "noeviction", "policy when maxmemory is exceeded: noeviction, allkeys-lru or volatile-ttl")
+	maxNamespaces   = flag.Int("max-namespaces", 0, "max number of namespaces created by clients, 0 means unlimited")
+	expireInterval  = flag.Duration("expire-interval", time.Second, "interval of removing expired bitmaps")
+
+	coldDir       = flag.String("cold-dir", "", "directory of cold bitmaps spilled to disk, empty disables spilling")
+	hotBitmaps    = flag.Int("hot-bitmaps", 10000, "max number of bitmaps kept in memory if cold-dir is set")
+	spillInterval = flag.Duration("spill-interval", 10*time.Second, "interval of spilling cold bitmaps")
+
+	rollupInterval = flag.Duration("rollup-interval", time.Minute, "interval of rolling up buckets of series")
 )
 
 func main() {
@@ -32,7 +52,18 @@ func main() {
 
 	// bitmap
 	bitmaps := basalt.NewBitmaps()
+	policy, err := basalt.ParseEvictionPolicy(*maxMemoryPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bitmaps.SetMaxMemory(*maxMemory, policy)
+	if *coldDir != "" {
+		if err := bitmaps.SetColdStorage(*coldDir, *hotBitmaps); err != nil {
+			log.Fatal(err)
+		}
+	}
 	srv := basalt.NewServer(*addr, bitmaps, nil, *dataFile)
+	srv.Namespaces().SetMaxNamespaces(*maxNamespaces)
 
 	// raft
 	proposeC := make(chan string)
@@ -41,16 +72,47 @@ func main() {
 	defer close(confChangeC)
 
 	var raftServer *basalt.RaftServer
-	getSnapshot := func() ([]byte, error) { return raftServer.GetSnapshot() }
-	commitC, errorC, snapshotterReady := basalt.NewRaftNode(*id, strings.Split(*peers, ","), *join, getSnapshot, proposeC, confChangeC)
+	getSnapshot := func() (io.WriterTo, error) { return raftServer.GetSnapshot() }
+	commitC, errorC, snapshotterReady, node := basalt.NewRaftNode(*id, strings.Split(*peers, ","), *join, getSnapshot, proposeC, confChangeC)
 
-	raftServer = basalt.NewRaftServer(srv, <-snapshotterReady, confChangeC, proposeC, commitC, errorC)
+	raftServer = basalt.NewRaftServer(srv, node, <-snapshotterReady, confChangeC, proposeC, commitC, errorC)
 
 	// set confchange handler
 	srv.SetConfChangeCallback(raftServer)
 
-	if err := srv.Serve(); err != nil {
+	// compare state hashes of replicas to detect divergence
+	checkCtx, stopCheck := context.WithCancel(context.Background())
+	defer stopCheck()
+	if *hashCheckInterval > 0 {
+		go raftServer.CheckHashes(checkCtx, *hashCheckInterval)
+	}
+	// removals of expired bitmaps are proposed to raft
+	go srv.Namespaces().ExpireBitmaps(checkCtx, *expireInterval)
+	if *coldDir != "" {
+		go srv.Namespaces().SpillBitmaps(checkCtx, *spillInterval)
+	}
+	// rollups of buckets are proposed to raft
+	go srv.Namespaces().RollupSeries(checkCtx, *rollupInterval)
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.Serve()
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errC:
 		log.Fatalf("failed to start basalt services:%v", err)
+	case <-quit:
 	}
+
+	// move the leadership off this node and finish in-flight proposals before stopping
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	if err := raftServer.Drain(ctx); err != nil {
+		log.Printf("failed to drain: %v", err)
+	}
+	cancel()
+
 	srv.Close()
 }
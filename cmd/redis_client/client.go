@@ -1,10 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 
-	"github.com/go-redis/redis"
+	"github.com/rpcxio/basalt/client"
 )
 
 var (
@@ -14,48 +15,40 @@ var (
 func main() {
 	flag.Parse()
 
-	client := redis.NewClient(&redis.Options{
-		Addr: *addr,
-	})
+	c := client.NewRedisClient([]string{*addr}, nil)
+	defer c.Close()
 
-	_, err := client.Ping().Result()
-	if err != nil {
-		log.Fatalf("failed to ping-pong: %v", err)
-	}
+	ctx := context.Background()
 
-	_, err = client.Do("bmadd", "test1", 1).Result() // int64
-	if err != nil {
+	if err := c.Add(ctx, "test1", 1); err != nil {
 		log.Fatalf("failed to bmadd: %v", err)
 	}
 
-	_, err = client.Do("bmaddmany", "test1", 2, 3, 10, 11).Result() // int64
-	if err != nil {
+	if err := c.AddMany(ctx, "test1", []uint32{2, 3, 10, 11}); err != nil {
 		log.Fatalf("failed to bmaddmany: %v", err)
 	}
 
-	_, err = client.Do("bmaddmany", "test2", 1, 2, 3, 20, 21).Result() // int64
-	if err != nil {
+	if err := c.AddMany(ctx, "test2", []uint32{1, 2, 3, 20, 21}); err != nil {
 		log.Fatalf("failed to bmaddmany: %v", err)
 	}
 
-	_, err = client.Do("bmdiffstore", "test3", "test1", "test2").Result() // int64
-	if err != nil {
-		log.Fatalf("failed to bmaddmany: %v", err)
+	if err := c.DiffStore(ctx, "test3", "test1", "test2"); err != nil {
+		log.Fatalf("failed to bmdiffstore: %v", err)
 	}
 
-	res, err := client.Do("bmexists", "test3", 10).Result() // int64
+	exist, err := c.Exists(ctx, "test3", 10)
 	if err != nil {
-		log.Fatalf("failed to bmaddmany: %v", err)
+		log.Fatalf("failed to bmexists: %v", err)
 	}
-	if res.(int64) != 1 {
+	if !exist {
 		log.Fatalf("expect exists but found none (0)")
 	}
 
-	res, err = client.Do("bmexists", "test3", 20).Result() // int64
+	exist, err = c.Exists(ctx, "test3", 20)
 	if err != nil {
-		log.Fatalf("failed to bmaddmany: %v", err)
+		log.Fatalf("failed to bmexists: %v", err)
 	}
-	if res.(int64) != 0 {
+	if exist {
 		log.Fatalf("expect not found but found one (1)")
 	}
 }
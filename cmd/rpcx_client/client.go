@@ -5,8 +5,7 @@ import (
 	"flag"
 	"log"
 
-	"github.com/rpcxio/basalt"
-	"github.com/smallnest/rpcx/client"
+	"github.com/rpcxio/basalt/client"
 )
 
 var (
@@ -16,26 +15,40 @@ var (
 func main() {
 	flag.Parse()
 
-	d := client.NewPeer2PeerDiscovery("tcp@"+*addr, "")
-	xclient := client.NewXClient("Bitmap", client.Failtry, client.RandomSelect, d, client.DefaultOption)
-	defer xclient.Close()
+	c := client.NewRpcxClient([]string{*addr}, nil)
+	defer c.Close()
 
-	var ok bool
+	ctx := context.Background()
 
-	xclient.Call(context.Background(), "Add", &basalt.BitmapValueRequest{"test1", 1}, &ok)
-	xclient.Call(context.Background(), "AddMany", &basalt.BitmapValuesRequest{"test1", []uint32{2, 3, 10, 11}}, &ok)
+	if err := c.Add(ctx, "test1", 1); err != nil {
+		log.Fatalf("failed to add: %v", err)
+	}
+	if err := c.AddMany(ctx, "test1", []uint32{2, 3, 10, 11}); err != nil {
+		log.Fatalf("failed to addmany: %v", err)
+	}
 
-	xclient.Call(context.Background(), "Add", &basalt.BitmapValueRequest{"test2", 1}, &ok)
-	xclient.Call(context.Background(), "AddMany", &basalt.BitmapValuesRequest{"test2", []uint32{2, 3, 20, 21}}, &ok)
+	if err := c.Add(ctx, "test2", 1); err != nil {
+		log.Fatalf("failed to add: %v", err)
+	}
+	if err := c.AddMany(ctx, "test2", []uint32{2, 3, 20, 21}); err != nil {
+		log.Fatalf("failed to addmany: %v", err)
+	}
 
-	var exist bool
-	xclient.Call(context.Background(), "Exists", &basalt.BitmapValueRequest{"test1", 10}, &exist)
+	exist, err := c.Exists(ctx, "test1", 10)
+	if err != nil {
+		log.Fatalf("failed to check existence: %v", err)
+	}
 	if !exist {
 		log.Fatalf("10 not found")
 	}
 
-	xclient.Call(context.Background(), "DiffStore", &basalt.BitmapDstAndPairRequest{"test3", "test1", "test2"}, &ok)
-	xclient.Call(context.Background(), "Exists", &basalt.BitmapValueRequest{"test3", 10}, &exist)
+	if err := c.DiffStore(ctx, "test3", "test1", "test2"); err != nil {
+		log.Fatalf("failed to diffstore: %v", err)
+	}
+	exist, err = c.Exists(ctx, "test3", 10)
+	if err != nil {
+		log.Fatalf("failed to check existence: %v", err)
+	}
 	if !exist {
 		log.Fatalf("10 not found")
 	}
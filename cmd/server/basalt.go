@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"time"
 
 	"github.com/rpcxio/basalt"
 )
@@ -11,6 +13,17 @@ import (
 var (
 	addr     = flag.String("addr", ":8972", "the listened address")
 	dataFile = flag.String("data", "bitmaps.bdb", "the persisted file")
+
+	maxMemory       = flag.Uint64("maxmemory", 0, "memory budget of bitmaps in bytes, 0 means unlimited")
+	maxMemoryPolicy = flag.String("maxmemory-policy", "noeviction", "policy when maxmemory is exceeded: noeviction, allkeys-lru or volatile-ttl")
+	maxNamespaces   = flag.Int("max-namespaces", 0, "max number of namespaces created by clients, 0 means unlimited")
+	expireInterval  = flag.Duration("expire-interval", time.Second, "interval of removing expired bitmaps")
+
+	coldDir       = flag.String("cold-dir", "", "directory of cold bitmaps spilled to disk, empty disables spilling")
+	hotBitmaps    = flag.Int("hot-bitmaps", 10000, "max number of bitmaps kept in memory if cold-dir is set")
+	spillInterval = flag.Duration("spill-interval", 10*time.Second, "interval of spilling cold bitmaps")
+
+	rollupInterval = flag.Duration("rollup-interval", time.Minute, "interval of rolling up buckets of series")
 )
 
 func main() {
@@ -25,15 +38,32 @@ func main() {
 	}
 
 	bitmaps := basalt.NewBitmaps()
+	policy, err := basalt.ParseEvictionPolicy(*maxMemoryPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bitmaps.SetMaxMemory(*maxMemory, policy)
+	if *coldDir != "" {
+		if err := bitmaps.SetColdStorage(*coldDir, *hotBitmaps); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	srv := basalt.NewServer(*addr, bitmaps, nil, *dataFile)
-	err := srv.Restore()
+	srv.Namespaces().SetMaxNamespaces(*maxNamespaces)
+	err = srv.Restore()
 	if err != nil {
 		log.Fatalf("failed to start basalt services:%v", err)
 	} else {
 		log.Printf("succeeded to restore bitmaps from %s", *dataFile)
 	}
 
+	go srv.Namespaces().ExpireBitmaps(context.Background(), *expireInterval)
+	if *coldDir != "" {
+		go srv.Namespaces().SpillBitmaps(context.Background(), *spillInterval)
+	}
+	go srv.Namespaces().RollupSeries(context.Background(), *rollupInterval)
+
 	if err := srv.Serve(); err != nil {
 		log.Fatalf("failed to start basalt services:%v", err)
 	}
@@ -0,0 +1,358 @@
+package basalt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/smallnest/log"
+)
+
+// A dictionary maps string keys like external user ids to dense uint32 ids,
+// so they can be members of bitmaps without hash collisions and members of
+// results can be printed as keys. Ids are assigned in the order keys are
+// first added, starting from 0, and are never reused or changed. Keys are
+// assigned when writes are applied, so replicas applying the same raft log
+// assign the same ids.
+//
+// Keys are never removed from the dictionary, removing a key from a bitmap
+// keeps its id. The dictionary is saved in snapshots after bitmaps, and it
+// contributes to the state hash like a bitmap whose checksum is the sum of
+// hashes of its keys and ids. Its memory isn't counted in the memory budget.
+
+// dictRecord is set in the length of name of the dictionary record, which is
+// followed by the number of keys and the keys prefixed by their lengths in
+// the order of their ids.
+const dictRecord = 1 << 27
+
+// dictHashName is the name of the dictionary in the state hash.
+const dictHashName = "\x00dict\x00"
+
+// maxKeyLen bounds the length of keys, so reading a malformed dictionary
+// record doesn't allocate more than a key.
+const maxKeyLen = 1 << 16
+
+var (
+	// ErrDictionaryFull is returned if all uint32 ids are assigned.
+	ErrDictionaryFull = errors.New("dictionary is full")
+	// ErrKeyTooLong is returned if a key is longer than 64KB.
+	ErrKeyTooLong = errors.New("key is too long")
+	// errInvalidDictionary is returned if a dictionary record is malformed.
+	errInvalidDictionary = errors.New("invalid record of dictionary")
+)
+
+// Dictionary is the goroutine-safe map between keys and ids.
+type Dictionary struct {
+	mu   sync.RWMutex
+	ids  map[string]uint32
+	keys []string // keys by id, only appended so prefixes can be shared
+	sum  uint64   // checksum of keys and ids
+}
+
+// NewDictionary creates an empty dictionary.
+func NewDictionary() *Dictionary {
+	return &Dictionary{ids: make(map[string]uint32)}
+}
+
+func keyHash(key string, id uint32) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return mix64(h.Sum64() ^ valueHash(id))
+}
+
+// Assign returns ids of the keys, keys not in the dictionary are assigned
+// the next ids. It returns ErrDictionaryFull if ids run out or ErrKeyTooLong,
+// and no keys are assigned.
+func (d *Dictionary) Assign(keys ...string) ([]uint32, error) {
+	if err := checkKeys(keys); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var added int
+	for _, key := range keys {
+		if _, ok := d.ids[key]; !ok {
+			added++
+		}
+	}
+	if uint64(len(d.keys))+uint64(added) > 1<<32 {
+		return nil, ErrDictionaryFull
+	}
+
+	ids := make([]uint32, len(keys))
+	for i, key := range keys {
+		id, ok := d.ids[key]
+		if !ok {
+			id = uint32(len(d.keys))
+			d.ids[key] = id
+			d.keys = append(d.keys, key)
+			d.sum += keyHash(key, id)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// checkKeys returns ErrKeyTooLong if a key is longer than maxKeyLen.
+func checkKeys(keys []string) error {
+	for _, key := range keys {
+		if len(key) > maxKeyLen {
+			return ErrKeyTooLong
+		}
+	}
+	return nil
+}
+
+// ID returns the id of the key, it returns false if the key isn't assigned.
+func (d *Dictionary) ID(key string) (uint32, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	id, ok := d.ids[key]
+	return id, ok
+}
+
+// IDs returns ids of the keys which are assigned.
+func (d *Dictionary) IDs(keys ...string) []uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var ids []uint32
+	for _, key := range keys {
+		if id, ok := d.ids[key]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Key returns the key of the id, it returns false if the id isn't assigned.
+func (d *Dictionary) Key(id uint32) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if uint64(id) >= uint64(len(d.keys)) {
+		return "", false
+	}
+	return d.keys[id], true
+}
+
+// Keys returns keys of the ids, ids which aren't assigned are skipped.
+func (d *Dictionary) Keys(ids []uint32) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if uint64(id) < uint64(len(d.keys)) {
+			keys = append(keys, d.keys[id])
+		}
+	}
+	return keys
+}
+
+// Len returns the number of keys.
+func (d *Dictionary) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.keys)
+}
+
+// Hash returns the part of the state hash contributed by the dictionary,
+// which is 0 if it's empty so bitmaps without keys have the same hash as
+// before dictionaries.
+func (d *Dictionary) Hash() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.keys) == 0 {
+		return 0
+	}
+	return StateHashOf(dictHashName, d.sum)
+}
+
+// snapshot returns keys by id, which are never changed.
+func (d *Dictionary) snapshot() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.keys[:len(d.keys):len(d.keys)]
+}
+
+// WriteTo writes the number of keys and the keys in the order of their ids.
+func (d *Dictionary) WriteTo(w io.Writer) (int64, error) {
+	return writeKeys(w, d.snapshot())
+}
+
+// ReadFrom replaces keys of the dictionary with the ones written by WriteTo.
+func (d *Dictionary) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: r}
+	read, err := readDictionary(cr)
+	if err != nil {
+		return cr.n, err
+	}
+
+	d.mu.Lock()
+	d.ids, d.keys, d.sum = read.ids, read.keys, read.sum
+	d.mu.Unlock()
+	return cr.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func writeKeys(w io.Writer, keys []string) (int64, error) {
+	bw := &bytes.Buffer{}
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(keys)))
+	bw.Write(buf[:])
+	for _, key := range keys {
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(key)))
+		bw.Write(buf[:])
+		bw.WriteString(key)
+	}
+	return bw.WriteTo(w)
+}
+
+// readDictionary reads keys written by writeKeys.
+func readDictionary(r io.Reader) (*Dictionary, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	d := NewDictionary()
+	for i := uint32(0); i < n; i++ {
+		var l uint32
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return nil, err
+		}
+		if l > maxKeyLen {
+			return nil, errInvalidDictionary
+		}
+		// readers which know the remaining input, like bytes.Reader, check it too.
+		if lr, ok := r.(interface{ Len() int }); ok && int(l) > lr.Len() {
+			return nil, errInvalidDictionary
+		}
+		key := make([]byte, l)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		if _, ok := d.ids[string(key)]; ok {
+			return nil, errInvalidDictionary
+		}
+		d.ids[string(key)] = i
+		d.keys = append(d.keys, string(key))
+		d.sum += keyHash(string(key), i)
+	}
+	return d, nil
+}
+
+func writeDictionary(w io.Writer, keys []string) (int64, error) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], dictRecord)
+	n, err := w.Write(buf[:])
+	if err != nil {
+		log.Errorf("failed to write dictionary: %v", err)
+		return int64(n), err
+	}
+
+	m, err := writeKeys(w, keys)
+	if err != nil {
+		log.Errorf("failed to write dictionary: %v", err)
+	}
+	return int64(n) + m, err
+}
+
+// setDictionary replaces the dictionary and updates the state hash.
+func (bs *Bitmaps) setDictionary(d *Dictionary) {
+	bs.dictMu.Lock()
+	atomic.AddUint64(&bs.hash, d.Hash()-bs.dict.Hash())
+	bs.dict = d
+	bs.dictMu.Unlock()
+}
+
+// dictionary returns the current dictionary, which is replaced by restores.
+func (bs *Bitmaps) dictionary() *Dictionary {
+	bs.dictMu.RLock()
+	defer bs.dictMu.RUnlock()
+	return bs.dict
+}
+
+// AddKeys adds the keys to the bitmap, keys not in the dictionary are
+// assigned ids first. It returns errors like AddMany, ErrDictionaryFull or
+// ErrKeyTooLong.
+func (bs *Bitmaps) AddKeys(name string, keys []string, callback bool) error {
+	if err := checkKeys(keys); err != nil {
+		return err
+	}
+	if callback {
+		if err := bs.reserve(name); err != nil {
+			return err
+		}
+	}
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpAddKeys, Name: name, Keys: keys})
+	}
+
+	// ids are assigned under the lock, so the state hash is updated with them.
+	bs.dictMu.Lock()
+	d := bs.dict
+	before := d.Hash()
+	ids, err := d.Assign(keys...)
+	atomic.AddUint64(&bs.hash, d.Hash()-before)
+	bs.dictMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return bs.AddMany(name, ids, false)
+}
+
+// RemoveKeys removes the keys from the bitmap, their ids are kept in the dictionary.
+func (bs *Bitmaps) RemoveKeys(name string, keys []string, callback bool) error {
+	for _, id := range bs.dictionary().IDs(keys...) {
+		if err := bs.Remove(name, id, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExistsKey returns whether the key is in the bitmap.
+func (bs *Bitmaps) ExistsKey(name, key string) bool {
+	id, ok := bs.dictionary().ID(key)
+	return ok && bs.Exists(name, id)
+}
+
+// KeyID returns the id of the key, it returns false if the key isn't assigned.
+func (bs *Bitmaps) KeyID(key string) (uint32, bool) {
+	return bs.dictionary().ID(key)
+}
+
+// Keys returns keys of the ids, ids which aren't assigned are skipped.
+func (bs *Bitmaps) Keys(ids []uint32) []string {
+	return bs.dictionary().Keys(ids)
+}
+
+// InterKeys computes the intersection (AND) of all provided bitmaps and
+// returns keys of the result.
+func (bs *Bitmaps) InterKeys(names ...string) []string {
+	return bs.Keys(bs.Inter(names...))
+}
+
+// UnionKeys computes the union (OR) of all provided bitmaps and returns keys
+// of the result.
+func (bs *Bitmaps) UnionKeys(names ...string) []string {
+	return bs.Keys(bs.Union(names...))
+}
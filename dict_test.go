@@ -0,0 +1,145 @@
+package basalt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDictionary(t *testing.T) {
+	d := NewDictionary()
+	ids, err := d.Assign("a", "b", "a", "c")
+	if err != nil || !reflect.DeepEqual(ids, []uint32{0, 1, 0, 2}) {
+		t.Fatalf("unexpected ids %v: %v", ids, err)
+	}
+	if ids, _ := d.Assign("c", "d"); !reflect.DeepEqual(ids, []uint32{2, 3}) {
+		t.Fatalf("expect ids of assigned keys are stable but got %v", ids)
+	}
+	if key, ok := d.Key(3); !ok || key != "d" {
+		t.Fatalf("expect key d but got %q", key)
+	}
+	if _, ok := d.ID("e"); ok {
+		t.Fatal("expect e is not assigned")
+	}
+	if keys := d.Keys([]uint32{3, 0, 100}); !reflect.DeepEqual(keys, []string{"d", "a"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	var buf bytes.Buffer
+	if _, err := d.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write dictionary: %v", err)
+	}
+	read := NewDictionary()
+	if _, err := read.ReadFrom(&buf); err != nil {
+		t.Fatalf("failed to read dictionary: %v", err)
+	}
+	if read.Len() != 4 || read.Hash() != d.Hash() || !reflect.DeepEqual(read.IDs("b", "d"), []uint32{1, 3}) {
+		t.Fatal("expect the same dictionary after read")
+	}
+}
+
+func TestDictionary_Invalid(t *testing.T) {
+	d := NewDictionary()
+	if _, err := d.Assign("a", string(make([]byte, maxKeyLen+1))); err != ErrKeyTooLong {
+		t.Fatalf("expect %v but got %v", ErrKeyTooLong, err)
+	}
+	if d.Len() != 0 {
+		t.Fatalf("expect no keys assigned but got %d", d.Len())
+	}
+
+	cases := [][]byte{
+		// a key longer than maxKeyLen.
+		{1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff},
+		// a key longer than the remaining input.
+		{1, 0, 0, 0, 4, 0, 0, 0, 'a'},
+		// a duplicate key.
+		{2, 0, 0, 0, 1, 0, 0, 0, 'a', 1, 0, 0, 0, 'a'},
+	}
+	for _, data := range cases {
+		if _, err := readDictionary(bytes.NewReader(data)); err != errInvalidDictionary {
+			t.Errorf("expect %v of %v but got %v", errInvalidDictionary, data, err)
+		}
+	}
+}
+
+func TestBitmaps_Keys(t *testing.T) {
+	bms := NewBitmaps()
+	hash := bms.Hash()
+
+	bms.AddKeys("follow:a", []string{"u1", "u2", "u3"}, false)
+	bms.AddKeys("follow:b", []string{"u3", "u4", "u1"}, false)
+	if !bms.ExistsKey("follow:a", "u2") || bms.ExistsKey("follow:b", "u2") || bms.ExistsKey("follow:a", "u5") {
+		t.Fatal("unexpected membership of keys")
+	}
+	if got := bms.InterKeys("follow:a", "follow:b"); !reflect.DeepEqual(got, []string{"u1", "u3"}) {
+		t.Fatalf("unexpected intersection %v", got)
+	}
+	if got := bms.UnionKeys("follow:a", "follow:b"); !reflect.DeepEqual(got, []string{"u1", "u2", "u3", "u4"}) {
+		t.Fatalf("unexpected union %v", got)
+	}
+	if id, ok := bms.KeyID("u4"); !ok || id != 3 {
+		t.Fatalf("expect id 3 of u4 but got %d", id)
+	}
+
+	bms.RemoveKeys("follow:a", []string{"u1", "u5"}, false)
+	if bms.ExistsKey("follow:a", "u1") || bms.Card("follow:a") != 2 {
+		t.Fatal("expect u1 is removed")
+	}
+	if id, ok := bms.KeyID("u1"); !ok || id != 0 {
+		t.Fatal("expect the id of a removed key is kept")
+	}
+
+	bms.RemoveBitmap("follow:a", false)
+	bms.RemoveBitmap("follow:b", false)
+	if bms.Hash() == hash {
+		t.Fatal("expect keys change the state hash")
+	}
+}
+
+func TestBitmaps_KeysPersistence(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("plain", []uint32{1, 2}, false)
+
+	var plain bytes.Buffer
+	bms.Save(&plain)
+
+	bms.AddKeys("follow", []string{"1766187712-1640571365", "1618051664-1640571365"}, false)
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	restored := NewBitmaps()
+	restored.AddKeys("stale", []string{"x"}, false)
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if restored.Hash() != bms.Hash() {
+		t.Fatal("expect the same state hash after restore")
+	}
+	if !restored.ExistsKey("follow", "1618051664-1640571365") {
+		t.Fatal("expect keys are restored")
+	}
+	if _, ok := restored.KeyID("x"); ok {
+		t.Fatal("expect the dictionary is replaced by restore")
+	}
+
+	read := NewBitmaps()
+	if err := read.Read(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if read.Hash() != bms.Hash() || !reflect.DeepEqual(read.InterKeys("follow"), []string{"1766187712-1640571365", "1618051664-1640571365"}) {
+		t.Fatal("expect the same keys after read")
+	}
+
+	// bitmaps without keys are saved as before
+	empty := NewBitmaps()
+	if err := empty.Restore(bytes.NewReader(plain.Bytes())); err != nil || empty.Hash() == bms.Hash() {
+		t.Fatalf("unexpected restore of bitmaps without keys: %v", err)
+	}
+	var again bytes.Buffer
+	empty.Save(&again)
+	if !bytes.Equal(again.Bytes(), plain.Bytes()) {
+		t.Fatal("expect no dictionary record without keys")
+	}
+}
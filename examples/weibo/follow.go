@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"hash/fnv"
 	"log"
 	"os"
 	"strings"
@@ -17,8 +16,6 @@ var (
 	importData = flag.Bool("import-data", true, "need to import data")
 )
 
-var x = fnv.New32()
-
 var names = make(map[string]string)
 
 func main() {
@@ -34,16 +31,14 @@ func main() {
 	// test
 	followee_id := "1640571365" // 罗永浩
 	follower_id := "1766187712" // 天天动听
-	v := hash(follower_id + "-" + followee_id)
-	if exists(client, v) {
+	if exists(client, follower_id+"-"+followee_id) {
 		log.Printf("%s 关注了 %s", names[follower_id], names[followee_id])
 	} else {
 		log.Printf("%s 没有关注 %s", names[follower_id], names[followee_id])
 	}
 
 	follower_id = "1618051664" // 头条新闻
-	v = hash(follower_id + "-" + followee_id)
-	if exists(client, v) {
+	if exists(client, follower_id+"-"+followee_id) {
 		log.Printf("%s 关注了 %s", names[follower_id], names[followee_id])
 	} else {
 		log.Printf("%s 没有关注 %s", names[follower_id], names[followee_id])
@@ -51,8 +46,7 @@ func main() {
 
 	followee_id = "1618051664" // 头条新闻
 	follower_id = "1640571365" // 罗永浩
-	v = hash(follower_id + "-" + followee_id)
-	if exists(client, v) {
+	if exists(client, follower_id+"-"+followee_id) {
 		log.Printf("%s 关注了 %s", names[follower_id], names[followee_id])
 	} else {
 		log.Printf("%s 没有关注 %s", names[follower_id], names[followee_id])
@@ -62,21 +56,15 @@ func main() {
 	checkFollowEachOther(client)
 }
 
-func exists(client *redis.Client, v uint32) bool {
-	res, err := client.Do("bmadd", "follow", v).Result()
+// exists checks whether the key is in the follow bitmap, keys are mapped
+// to ids by the dictionary of the server so they never collide.
+func exists(client *redis.Client, key string) bool {
+	res, err := client.Do("bmexistskey", "follow", key).Result()
 	if err != nil {
 		return false
 	}
-	if rt, ok := res.(int64); !ok || rt == 1 {
-		return true
-	}
-	return false
-}
-
-func hash(s string) uint32 {
-	x.Reset()
-	x.Write([]byte(s))
-	return x.Sum32()
+	rt, ok := res.(int64)
+	return ok && rt == 1
 }
 
 func importFollowCsv(client *redis.Client) {
@@ -90,18 +78,17 @@ func importFollowCsv(client *redis.Client) {
 	for scanner.Scan() {
 		items := strings.Split(scanner.Text(), ",")
 		key := items[2] + "-" + items[4]
-		v := hash(key)
 
 		names[items[2]] = items[1]
 		names[items[4]] = items[3]
 
 		if *importData {
-			res, err := client.Do("bmadd", "follow", v).Result()
+			res, err := client.Do("bmaddkey", "follow", key).Result()
 			if err != nil {
-				log.Printf("failed to bmadd %s: %v", key, err)
+				log.Printf("failed to bmaddkey %s: %v", key, err)
 			}
 			if rt, ok := res.(int64); !ok || rt != 1 {
-				log.Printf("failed to bmadd %s because the result is %v", key, res)
+				log.Printf("failed to bmaddkey %s because the result is %v", key, res)
 			}
 		}
 
@@ -123,8 +110,7 @@ func checkFollowEachOther(client *redis.Client) {
 	for scanner.Scan() {
 		items := strings.Split(scanner.Text(), ",")
 		key := items[4] + "-" + items[2]
-		v := hash(key)
-		if exists(client, v) {
+		if exists(client, key) {
 			log.Printf("%s: %s 和 %s 互相关注", items[0], names[items[2]], names[items[4]])
 		}
 	}
@@ -0,0 +1,834 @@
+package basalt
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/smallnest/log"
+)
+
+// Filters test the membership of string items like URLs in a bounded size,
+// with a configurable false-positive rate and no false negatives:
+//
+//   - a scalable Bloom filter adds a layer with twice the capacity and half
+//     the error rate of the last one when it's full, so items can always be
+//     added and the total error rate stays below the configured one;
+//   - a Cuckoo filter keeps fingerprints of items in buckets of 4 slots, so
+//     items can be deleted and counted, but adds fail when it's full.
+//
+// Filters are kept apart from bitmaps like fields, so they don't take part in
+// set operations, eviction, TTLs or spilling, and their memory isn't counted
+// in the memory budget. They are replicated by raft and saved in snapshots
+// with bitmaps. Items are placed by their hashes only, so replicas applying
+// the same writes have the same filters, and a filter contributes to the
+// state hash like a bitmap whose checksum is the sum of hashes of its set
+// bits or slots and its config.
+
+// filterRecord is set in the length of name of a filter record, which is
+// followed by the name, the config and the bits or slots of the filter.
+const filterRecord = 1 << 25
+
+// filterHashPrefix separates names of filters from names of bitmaps in the state hash.
+const filterHashPrefix = "\x00filter\x00"
+
+// FilterKind is the kind of a filter.
+type FilterKind byte
+
+const (
+	// BloomFilter is a scalable Bloom filter.
+	BloomFilter FilterKind = 1
+	// CuckooFilter is a Cuckoo filter, which supports deletes.
+	CuckooFilter FilterKind = 2
+)
+
+const (
+	// DefaultFilterErrorRate is the error rate of filters created by adds.
+	DefaultFilterErrorRate = 0.01
+	// DefaultBloomCapacity is the capacity of the first layer of Bloom filters created by adds.
+	DefaultBloomCapacity = 100
+	// DefaultCuckooCapacity is the capacity of Cuckoo filters created by adds.
+	DefaultCuckooCapacity = 1024
+
+	// maxFilterCapacity bounds the capacity of a filter or a layer.
+	maxFilterCapacity = 1 << 32
+	// maxBloomLayers bounds the number of layers of a Bloom filter.
+	maxBloomLayers = 32
+	// cuckooBucketSize is the number of slots of a bucket.
+	cuckooBucketSize = 4
+	// cuckooMaxKicks is the number of fingerprints relocated by an add
+	// before the Cuckoo filter is considered full.
+	cuckooMaxKicks = 500
+)
+
+var (
+	// ErrInvalidFilter is returned if the config of a filter is invalid.
+	ErrInvalidFilter = errors.New("invalid filter: error rate must be in (0, 1) and capacity must be in [1, 2^32]")
+	// ErrFilterExists is returned if a filter to reserve already exists.
+	ErrFilterExists = errors.New("filter exists")
+	// ErrFilterFull is returned if an item can't be added to a Cuckoo filter.
+	ErrFilterFull = errors.New("filter is full")
+	// errInvalidFilterRecord is returned if a filter record is malformed.
+	errInvalidFilterRecord = errors.New("invalid record of filter")
+)
+
+// FilterConfig is the config of a filter.
+type FilterConfig struct {
+	Kind      FilterKind
+	ErrorRate float64 // false-positive rate
+	Capacity  uint64  // items of the first layer of a Bloom filter, or of a Cuckoo filter
+}
+
+func (c FilterConfig) validate() error {
+	if c.Kind != BloomFilter && c.Kind != CuckooFilter {
+		return ErrInvalidFilter
+	}
+	if !(c.ErrorRate > 0 && c.ErrorRate < 1) || c.Capacity < 1 || c.Capacity > maxFilterCapacity {
+		return ErrInvalidFilter
+	}
+	return nil
+}
+
+// filterConfigLen is the length of an encoded config.
+const filterConfigLen = 17
+
+func (c FilterConfig) encode() []byte {
+	buf := make([]byte, filterConfigLen)
+	buf[0] = byte(c.Kind)
+	binary.LittleEndian.PutUint64(buf[1:], math.Float64bits(c.ErrorRate))
+	binary.LittleEndian.PutUint64(buf[9:], c.Capacity)
+	return buf
+}
+
+func decodeFilterConfig(data []byte) (FilterConfig, error) {
+	if len(data) < filterConfigLen {
+		return FilterConfig{}, ErrInvalidFilter
+	}
+	c := FilterConfig{
+		Kind:      FilterKind(data[0]),
+		ErrorRate: math.Float64frombits(binary.LittleEndian.Uint64(data[1:])),
+		Capacity:  binary.LittleEndian.Uint64(data[9:]),
+	}
+	return c, c.validate()
+}
+
+// checksum returns the part of the checksum of a filter contributed by its config.
+func (c FilterConfig) checksum() uint64 {
+	h := fnv.New64a()
+	h.Write(c.encode())
+	return mix64(h.Sum64())
+}
+
+// itemHash returns the hash of an item, which places it in filters.
+func itemHash(item string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	return mix64(h.Sum64())
+}
+
+// bloomLayer is a Bloom filter of fixed capacity.
+type bloomLayer struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint32 // number of hashes
+	capacity uint64
+	count    uint64 // number of items added
+}
+
+func newBloomLayer(capacity uint64, errorRate float64) *bloomLayer {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint32(math.Ceil(-math.Log2(errorRate)))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomLayer{bits: make([]uint64, (m+63)/64), m: m, k: k, capacity: capacity}
+}
+
+// position returns the i-th bit of the item by double hashing.
+func (l *bloomLayer) position(h uint64, i uint32) uint64 {
+	h2 := mix64(h+0x9e3779b97f4a7c15) | 1
+	return (h + uint64(i)*h2) % l.m
+}
+
+func (l *bloomLayer) contains(h uint64) bool {
+	for i := uint32(0); i < l.k; i++ {
+		pos := l.position(h, i)
+		if l.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bitHash returns the part of the checksum of a set bit of the j-th layer.
+func bitHash(j int, pos uint64) uint64 {
+	return mix64(mix64(uint64(j)+1) ^ pos)
+}
+
+// cuckooTable keeps fingerprints in buckets, 0 means an empty slot.
+type cuckooTable struct {
+	slots   []uint16
+	buckets uint64 // number of buckets, which is a power of 2
+	fpMask  uint16 // mask of bits of fingerprints
+}
+
+func newCuckooTable(capacity uint64, errorRate float64) *cuckooTable {
+	// buckets are filled up to about 95% with 4 slots each.
+	buckets := uint64(1)
+	for float64(buckets*cuckooBucketSize)*0.95 < float64(capacity) {
+		buckets <<= 1
+	}
+	// the error rate is about 2 * 4 / 2^bits.
+	fpBits := int(math.Ceil(math.Log2(2 * cuckooBucketSize / errorRate)))
+	if fpBits < 8 {
+		fpBits = 8
+	} else if fpBits > 16 {
+		fpBits = 16
+	}
+	return &cuckooTable{
+		slots:   make([]uint16, buckets*cuckooBucketSize),
+		buckets: buckets,
+		fpMask:  uint16(1<<uint(fpBits) - 1),
+	}
+}
+
+// locate returns the fingerprint and the first bucket of the item.
+func (t *cuckooTable) locate(h uint64) (uint16, uint64) {
+	fp := uint16(h>>32) & t.fpMask
+	if fp == 0 {
+		fp = 1
+	}
+	return fp, h & (t.buckets - 1)
+}
+
+// alt returns the other bucket of the fingerprint in bucket i.
+func (t *cuckooTable) alt(i uint64, fp uint16) uint64 {
+	return (i ^ mix64(uint64(fp))) & (t.buckets - 1)
+}
+
+// count returns the number of slots of the fingerprint in buckets i1 and i2.
+func (t *cuckooTable) count(fp uint16, i1, i2 uint64) uint64 {
+	var n uint64
+	for _, i := range []uint64{i1, i2} {
+		for s := uint64(0); s < cuckooBucketSize; s++ {
+			if t.slots[i*cuckooBucketSize+s] == fp {
+				n++
+			}
+		}
+		if i1 == i2 {
+			break
+		}
+	}
+	return n
+}
+
+// slotHash returns the part of the checksum of a slot, which is 0 if it's empty.
+func slotHash(slot uint64, fp uint16) uint64 {
+	if fp == 0 {
+		return 0
+	}
+	return mix64(slot<<16 | uint64(fp))
+}
+
+// filter is the goroutine-safe Bloom or Cuckoo filter.
+type filter struct {
+	mu      sync.RWMutex
+	config  FilterConfig
+	layers  []*bloomLayer // layers of a Bloom filter
+	table   *cuckooTable  // table of a Cuckoo filter
+	items   uint64        // number of items added, minus deleted ones
+	sum     uint64        // checksum of the config and set bits or slots
+	dropped bool          // removed from bitmaps, so it's not in the state hash
+}
+
+func newFilter(c FilterConfig) *filter {
+	f := &filter{config: c, sum: c.checksum()}
+	if c.Kind == BloomFilter {
+		f.layers = []*bloomLayer{newBloomLayer(c.Capacity, c.ErrorRate/2)}
+	} else {
+		f.table = newCuckooTable(c.Capacity, c.ErrorRate)
+	}
+	return f
+}
+
+// contains returns whether the item may have been added.
+func (f *filter) contains(h uint64) bool {
+	if f.table != nil {
+		fp, i1 := f.table.locate(h)
+		return f.table.count(fp, i1, f.table.alt(i1, fp)) > 0
+	}
+	for _, l := range f.layers {
+		if l.contains(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// bloomAdd adds the item to the Bloom filter if it's not contained, and
+// returns whether it's added. A layer with twice the capacity and half the
+// error rate is added if the last one is full, so the sum of error rates of
+// all layers is less than the configured one.
+func (f *filter) bloomAdd(h uint64) bool {
+	if f.contains(h) {
+		return false
+	}
+
+	last := f.layers[len(f.layers)-1]
+	if last.count >= last.capacity && len(f.layers) < maxBloomLayers {
+		capacity := last.capacity * 2
+		if capacity > maxFilterCapacity {
+			capacity = maxFilterCapacity
+		}
+		last = newBloomLayer(capacity, f.config.ErrorRate/math.Pow(2, float64(len(f.layers)+1)))
+		f.layers = append(f.layers, last)
+	}
+
+	j := len(f.layers) - 1
+	for i := uint32(0); i < last.k; i++ {
+		pos := last.position(h, i)
+		if last.bits[pos/64]&(1<<(pos%64)) == 0 {
+			last.bits[pos/64] |= 1 << (pos % 64)
+			f.sum += bitHash(j, pos)
+		}
+	}
+	last.count++
+	f.items++
+	return true
+}
+
+// setSlot sets the slot of the Cuckoo filter to fp and updates the checksum.
+func (f *filter) setSlot(slot uint64, fp uint16) {
+	f.sum += slotHash(slot, fp) - slotHash(slot, f.table.slots[slot])
+	f.table.slots[slot] = fp
+}
+
+// insert puts fp into an empty slot of bucket i, it returns false if the bucket is full.
+func (f *filter) insert(i uint64, fp uint16) bool {
+	for s := uint64(0); s < cuckooBucketSize; s++ {
+		if slot := i*cuckooBucketSize + s; f.table.slots[slot] == 0 {
+			f.setSlot(slot, fp)
+			return true
+		}
+	}
+	return false
+}
+
+// cuckooAdd adds the item to the Cuckoo filter. Fingerprints are relocated
+// to their other buckets to make room, the victims are chosen by the number
+// of relocations instead of randomly so replicas relocate the same ones. It
+// returns false and keeps the filter unchanged if there is no room.
+func (f *filter) cuckooAdd(h uint64) bool {
+	t := f.table
+	fp, i1 := t.locate(h)
+	i2 := t.alt(i1, fp)
+	if f.insert(i1, fp) || f.insert(i2, fp) {
+		f.items++
+		return true
+	}
+
+	type kick struct {
+		slot uint64
+		fp   uint16
+	}
+	var kicks []kick
+	i := i1
+	if fp&1 == 1 {
+		i = i2
+	}
+	for n := 0; n < cuckooMaxKicks; n++ {
+		slot := i*cuckooBucketSize + uint64(mix64(uint64(fp)+uint64(n))%cuckooBucketSize)
+		kicks = append(kicks, kick{slot, t.slots[slot]})
+		victim := t.slots[slot]
+		f.setSlot(slot, fp)
+		fp = victim
+		i = t.alt(i, fp)
+		if f.insert(i, fp) {
+			f.items++
+			return true
+		}
+	}
+
+	for n := len(kicks) - 1; n >= 0; n-- {
+		f.setSlot(kicks[n].slot, kicks[n].fp)
+	}
+	return false
+}
+
+// cuckooDelete deletes a fingerprint of the item, it returns false if the
+// item isn't contained.
+func (f *filter) cuckooDelete(h uint64) bool {
+	t := f.table
+	fp, i1 := t.locate(h)
+	for _, i := range []uint64{i1, t.alt(i1, fp)} {
+		for s := uint64(0); s < cuckooBucketSize; s++ {
+			if slot := i*cuckooBucketSize + s; t.slots[slot] == fp {
+				f.setSlot(slot, 0)
+				f.items--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// size returns the memory of the bits or slots in bytes.
+func (f *filter) size() uint64 {
+	if f.table != nil {
+		return uint64(len(f.table.slots)) * 2
+	}
+	var size uint64
+	for _, l := range f.layers {
+		size += uint64(len(l.bits)) * 8
+	}
+	return size
+}
+
+// clone returns a deep copy of f, f.mu must be held.
+func (f *filter) clone() *filter {
+	c := &filter{config: f.config, items: f.items, sum: f.sum}
+	if f.table != nil {
+		table := *f.table
+		table.slots = append([]uint16(nil), f.table.slots...)
+		c.table = &table
+	}
+	for _, l := range f.layers {
+		layer := *l
+		layer.bits = append([]uint64(nil), l.bits...)
+		c.layers = append(c.layers, &layer)
+	}
+	return c
+}
+
+// getFilter returns the named filter, which is nil if it doesn't exist.
+func (bs *Bitmaps) getFilter(name string) *filter {
+	bs.filtersMu.RLock()
+	defer bs.filtersMu.RUnlock()
+	return bs.filters[name]
+}
+
+// filterOf returns the named filter of the kind. It's created with the
+// default config of the kind if it doesn't exist and create is true, or it
+// returns nil. It returns ErrWrongType if the filter is of the other kind.
+func (bs *Bitmaps) filterOf(name string, kind FilterKind, create bool) (*filter, error) {
+	f := bs.getFilter(name)
+	if f == nil && create {
+		c := FilterConfig{Kind: kind, ErrorRate: DefaultFilterErrorRate, Capacity: DefaultBloomCapacity}
+		if kind == CuckooFilter {
+			c.Capacity = DefaultCuckooCapacity
+		}
+
+		bs.filtersMu.Lock()
+		if f = bs.filters[name]; f == nil {
+			f = newFilter(c)
+			bs.filters[name] = f
+			atomic.AddUint64(&bs.hash, StateHashOf(filterHashPrefix+name, f.sum))
+		}
+		bs.filtersMu.Unlock()
+	}
+	if f != nil && f.config.Kind != kind {
+		return nil, ErrWrongType
+	}
+	return f, nil
+}
+
+// setFilterChecksum updates the state hash after the checksum of f is
+// changed from old, f.mu must be held.
+func (bs *Bitmaps) setFilterChecksum(name string, f *filter, old uint64) {
+	if !f.dropped {
+		atomic.AddUint64(&bs.hash, StateHashOf(filterHashPrefix+name, f.sum)-StateHashOf(filterHashPrefix+name, old))
+	}
+}
+
+// storeFilter replaces the named filter with f.
+func (bs *Bitmaps) storeFilter(name string, f *filter) {
+	bs.filtersMu.Lock()
+	if old := bs.filters[name]; old != nil {
+		bs.dropFilter(name, old)
+	}
+	bs.filters[name] = f
+	atomic.AddUint64(&bs.hash, StateHashOf(filterHashPrefix+name, f.sum))
+	bs.filtersMu.Unlock()
+}
+
+// dropFilter removes f from the state hash, bs.filtersMu must be held for writing.
+func (bs *Bitmaps) dropFilter(name string, f *filter) {
+	f.mu.Lock()
+	if !f.dropped {
+		f.dropped = true
+		atomic.AddUint64(&bs.hash, -StateHashOf(filterHashPrefix+name, f.sum))
+	}
+	f.mu.Unlock()
+	delete(bs.filters, name)
+}
+
+// ReserveFilter creates the named filter with the config. It returns
+// ErrFilterExists if it exists, or ErrInvalidFilter if the config is invalid.
+func (bs *Bitmaps) ReserveFilter(name string, c FilterConfig, callback bool) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if callback && bs.getFilter(name) != nil {
+		return ErrFilterExists
+	}
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpReserveFilter, Name: name, Config: c.encode()})
+	}
+
+	bs.filtersMu.Lock()
+	defer bs.filtersMu.Unlock()
+	if bs.filters[name] != nil {
+		return ErrFilterExists
+	}
+	f := newFilter(c)
+	bs.filters[name] = f
+	atomic.AddUint64(&bs.hash, StateHashOf(filterHashPrefix+name, f.sum))
+	return nil
+}
+
+// BloomAdd adds the items to the named Bloom filter, which is created with
+// the default config if it doesn't exist. It returns whether each item is
+// added, which is false if the item may have been added. In cluster mode the
+// results are computed from the local state before the write is proposed.
+// It returns ErrWrongType if the filter is a Cuckoo filter.
+func (bs *Bitmaps) BloomAdd(name string, items []string, callback bool) ([]bool, error) {
+	if bs.writeCallback != nil && callback {
+		added, err := bs.BloomExists(name, items...)
+		if err != nil {
+			return nil, err
+		}
+		for i := range added {
+			added[i] = !added[i]
+		}
+		return added, bs.writeCallback(operation{OP: BmOpBloomAdd, Name: name, Keys: items})
+	}
+
+	f, err := bs.filterOf(name, BloomFilter, true)
+	if err != nil {
+		return nil, err
+	}
+
+	added := make([]bool, len(items))
+	f.mu.Lock()
+	old := f.sum
+	for i, item := range items {
+		added[i] = f.bloomAdd(itemHash(item))
+	}
+	bs.setFilterChecksum(name, f, old)
+	f.mu.Unlock()
+
+	return added, nil
+}
+
+// BloomExists returns whether each item may have been added to the named
+// Bloom filter. It returns ErrWrongType if the filter is a Cuckoo filter.
+func (bs *Bitmaps) BloomExists(name string, items ...string) ([]bool, error) {
+	return bs.filterExists(name, BloomFilter, items)
+}
+
+// CuckooExists returns whether each item may have been added to the named
+// Cuckoo filter. It returns ErrWrongType if the filter is a Bloom filter.
+func (bs *Bitmaps) CuckooExists(name string, items ...string) ([]bool, error) {
+	return bs.filterExists(name, CuckooFilter, items)
+}
+
+func (bs *Bitmaps) filterExists(name string, kind FilterKind, items []string) ([]bool, error) {
+	f, err := bs.filterOf(name, kind, false)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make([]bool, len(items))
+	if f == nil {
+		return exists, nil
+	}
+	f.mu.RLock()
+	for i, item := range items {
+		exists[i] = f.contains(itemHash(item))
+	}
+	f.mu.RUnlock()
+	return exists, nil
+}
+
+// CuckooAdd adds the item to the named Cuckoo filter, which is created with
+// the default config if it doesn't exist. An item can be added many times
+// and deleted as many times. It returns ErrFilterFull if there is no room,
+// which is only known when the write is applied in cluster mode, or
+// ErrWrongType if the filter is a Bloom filter.
+func (bs *Bitmaps) CuckooAdd(name, item string, callback bool) error {
+	_, err := bs.cuckooAdd(name, item, false, callback)
+	return err
+}
+
+// CuckooAddNX adds the item to the named Cuckoo filter like CuckooAdd if it
+// isn't contained, and returns whether it's added. In cluster mode the result
+// is computed from the local state before the write is proposed.
+func (bs *Bitmaps) CuckooAddNX(name, item string, callback bool) (bool, error) {
+	return bs.cuckooAdd(name, item, true, callback)
+}
+
+func (bs *Bitmaps) cuckooAdd(name, item string, nx, callback bool) (bool, error) {
+	if bs.writeCallback != nil && callback {
+		f, err := bs.filterOf(name, CuckooFilter, false)
+		if err != nil {
+			return false, err
+		}
+		if f != nil {
+			f.mu.RLock()
+			exists, full := f.contains(itemHash(item)), f.items >= uint64(len(f.table.slots))
+			f.mu.RUnlock()
+			if nx && exists {
+				return false, nil
+			}
+			if full {
+				return false, ErrFilterFull
+			}
+		}
+
+		op := OP(BmOpCuckooAdd)
+		if nx {
+			op = BmOpCuckooAddNX
+		}
+		return true, bs.writeCallback(operation{OP: op, Name: name, Keys: []string{item}})
+	}
+
+	f, err := bs.filterOf(name, CuckooFilter, true)
+	if err != nil {
+		return false, err
+	}
+
+	h := itemHash(item)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if nx && f.contains(h) {
+		return false, nil
+	}
+	old := f.sum
+	if !f.cuckooAdd(h) {
+		return false, ErrFilterFull
+	}
+	bs.setFilterChecksum(name, f, old)
+	return true, nil
+}
+
+// CuckooDelete deletes the item from the named Cuckoo filter once, and
+// returns whether it's deleted. In cluster mode the result is computed from
+// the local state before the write is proposed. It returns ErrWrongType if
+// the filter is a Bloom filter, which doesn't support deletes.
+func (bs *Bitmaps) CuckooDelete(name, item string, callback bool) (bool, error) {
+	f, err := bs.filterOf(name, CuckooFilter, false)
+	if err != nil || f == nil {
+		return false, err
+	}
+
+	h := itemHash(item)
+	if bs.writeCallback != nil && callback {
+		f.mu.RLock()
+		exists := f.contains(h)
+		f.mu.RUnlock()
+		if !exists {
+			return false, nil
+		}
+		return true, bs.writeCallback(operation{OP: BmOpCuckooDelete, Name: name, Keys: []string{item}})
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old := f.sum
+	deleted := f.cuckooDelete(h)
+	bs.setFilterChecksum(name, f, old)
+	return deleted, nil
+}
+
+// CuckooCount returns the number of times the item may have been added to
+// the named Cuckoo filter. It returns ErrWrongType if the filter is a Bloom filter.
+func (bs *Bitmaps) CuckooCount(name, item string) (uint64, error) {
+	f, err := bs.filterOf(name, CuckooFilter, false)
+	if err != nil || f == nil {
+		return 0, err
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fp, i1 := f.table.locate(itemHash(item))
+	return f.table.count(fp, i1, f.table.alt(i1, fp)), nil
+}
+
+// DropFilter removes the filter.
+func (bs *Bitmaps) DropFilter(name string, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpDropFilter, Name: name})
+	}
+
+	bs.filtersMu.Lock()
+	if f := bs.filters[name]; f != nil {
+		bs.dropFilter(name, f)
+	}
+	bs.filtersMu.Unlock()
+
+	return nil
+}
+
+// FilterInfo is the report of a filter.
+type FilterInfo struct {
+	FilterConfig
+	Items  uint64 // number of items added, minus deleted ones
+	Size   uint64 // memory of bits or slots in bytes
+	Layers int    // number of layers of a Bloom filter
+}
+
+// FilterInfo returns the report of the named filter, it returns false if it doesn't exist.
+func (bs *Bitmaps) FilterInfo(name string) (FilterInfo, bool) {
+	f := bs.getFilter(name)
+	if f == nil {
+		return FilterInfo{}, false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return FilterInfo{FilterConfig: f.config, Items: f.items, Size: f.size(), Layers: len(f.layers)}, true
+}
+
+// Filters returns names of all filters.
+func (bs *Bitmaps) Filters() []string {
+	bs.filtersMu.RLock()
+	defer bs.filtersMu.RUnlock()
+
+	names := make([]string, 0, len(bs.filters))
+	for name := range bs.filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// snapshotFilters adds clones of all filters to the snapshot.
+func (bs *Bitmaps) snapshotFilters(snapshot *BitmapsSnapshot) {
+	bs.filtersMu.RLock()
+	defer bs.filtersMu.RUnlock()
+
+	for name, f := range bs.filters {
+		f.mu.RLock()
+		snapshot.filterNames = append(snapshot.filterNames, name)
+		snapshot.filters = append(snapshot.filters, f.clone())
+		f.mu.RUnlock()
+	}
+}
+
+// writeFilter writes the config and the number of items of the filter, and
+// the layers of a Bloom filter, each of them is its capacity, number of
+// items, number of hashes, number of bits and the bits, or the mask of
+// fingerprints, number of buckets and the slots of a Cuckoo filter.
+func writeFilter(w io.Writer, name string, f *filter) (int64, error) {
+	buf := make([]byte, 4+len(name), 4+len(name)+filterConfigLen+8)
+	binary.LittleEndian.PutUint32(buf, uint32(len(name))|filterRecord)
+	copy(buf[4:], name)
+	buf = append(buf, f.config.encode()...)
+	buf = appendUint64(buf, f.items)
+
+	if f.table != nil {
+		buf = appendUint64(buf, uint64(f.table.fpMask))
+		buf = appendUint64(buf, f.table.buckets)
+		for _, fp := range f.table.slots {
+			buf = append(buf, byte(fp), byte(fp>>8))
+		}
+	} else {
+		buf = appendUint64(buf, uint64(len(f.layers)))
+		for _, l := range f.layers {
+			buf = appendUint64(buf, l.capacity)
+			buf = appendUint64(buf, l.count)
+			buf = appendUint64(buf, uint64(l.k))
+			buf = appendUint64(buf, l.m)
+			for _, word := range l.bits {
+				buf = appendUint64(buf, word)
+			}
+		}
+	}
+
+	n, err := w.Write(buf)
+	if err != nil {
+		log.Errorf("failed to write filter %s: %v", name, err)
+	}
+	return int64(n), err
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// readFilter reads a filter after its name.
+func readFilter(r io.Reader) (*filter, error) {
+	data := make([]byte, filterConfigLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	c, err := decodeFilterConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var header [2]uint64
+	if err := binary.Read(r, binary.LittleEndian, header[:]); err != nil {
+		return nil, err
+	}
+	f := &filter{config: c, items: header[0], sum: c.checksum()}
+
+	if c.Kind == CuckooFilter {
+		var buckets uint64
+		if err := binary.Read(r, binary.LittleEndian, &buckets); err != nil {
+			return nil, err
+		}
+		mask := header[1]
+		if mask < 1<<8-1 || mask > 1<<16-1 || buckets == 0 || buckets&(buckets-1) != 0 || buckets > maxFilterCapacity {
+			return nil, errInvalidFilterRecord
+		}
+		slots := make([]uint16, buckets*cuckooBucketSize)
+		if err := binary.Read(r, binary.LittleEndian, slots); err != nil {
+			return nil, err
+		}
+		f.table = &cuckooTable{slots: slots, buckets: buckets, fpMask: uint16(mask)}
+		for slot, fp := range slots {
+			f.sum += slotHash(uint64(slot), fp)
+		}
+		return f, nil
+	}
+
+	layers := header[1]
+	if layers == 0 || layers > maxBloomLayers {
+		return nil, errInvalidFilterRecord
+	}
+	for j := 0; j < int(layers); j++ {
+		var lh [4]uint64
+		if err := binary.Read(r, binary.LittleEndian, lh[:]); err != nil {
+			return nil, err
+		}
+		capacity, count, k, m := lh[0], lh[1], lh[2], lh[3]
+		if k == 0 || k > 64 || m == 0 || m > 64*maxFilterCapacity {
+			return nil, errInvalidFilterRecord
+		}
+		l := &bloomLayer{bits: make([]uint64, (m+63)/64), m: m, k: uint32(k), capacity: capacity, count: count}
+		if err := binary.Read(r, binary.LittleEndian, l.bits); err != nil {
+			return nil, err
+		}
+		for i, word := range l.bits {
+			for word != 0 {
+				pos := uint64(i)*64 + uint64(bits.TrailingZeros64(word))
+				f.sum += bitHash(j, pos)
+				word &= word - 1
+			}
+		}
+		f.layers = append(f.layers, l)
+	}
+	return f, nil
+}
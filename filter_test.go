@@ -0,0 +1,175 @@
+package basalt
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestBitmaps_BloomFilter(t *testing.T) {
+	bms := NewBitmaps()
+	hash := bms.Hash()
+
+	c := FilterConfig{Kind: BloomFilter, ErrorRate: 0.01, Capacity: 1000}
+	if err := bms.ReserveFilter("urls", c, true); err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+	if err := bms.ReserveFilter("urls", c, true); err != ErrFilterExists {
+		t.Fatalf("expect ErrFilterExists but got %v", err)
+	}
+	if err := bms.ReserveFilter("bad", FilterConfig{Kind: BloomFilter, ErrorRate: 1, Capacity: 10}, true); err != ErrInvalidFilter {
+		t.Fatalf("expect ErrInvalidFilter but got %v", err)
+	}
+
+	// the filter scales past its capacity and keeps the error rate.
+	const n = 10000
+	for i := 0; i < n; i++ {
+		item := "https://example.com/" + strconv.Itoa(i)
+		if _, err := bms.BloomAdd("urls", []string{item}, false); err != nil {
+			t.Fatalf("failed to add: %v", err)
+		}
+	}
+	for i := 0; i < n; i += 97 {
+		if exists, _ := bms.BloomExists("urls", "https://example.com/"+strconv.Itoa(i)); !exists[0] {
+			t.Fatalf("expect %d exists", i)
+		}
+	}
+	var positives int
+	for i := n; i < 2*n; i++ {
+		if exists, _ := bms.BloomExists("urls", "https://example.com/"+strconv.Itoa(i)); exists[0] {
+			positives++
+		}
+	}
+	if rate := float64(positives) / n; rate > 0.015 {
+		t.Fatalf("false-positive rate %.4f is too high", rate)
+	}
+	info, ok := bms.FilterInfo("urls")
+	if !ok || info.Layers < 2 || info.Items > n || info.Items < n*9/10 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	added, err := bms.BloomAdd("urls", []string{"https://example.com/0", "new"}, false)
+	if err != nil || added[0] || !added[1] {
+		t.Fatalf("unexpected results %v: %v", added, err)
+	}
+	if exists, err := bms.BloomExists("missing", "new"); err != nil || exists[0] {
+		t.Fatal("expect nothing exists in a missing filter")
+	}
+
+	// filters are created with the default config by adds.
+	bms.CuckooAdd("seen", "a", false)
+	if _, err := bms.BloomAdd("seen", []string{"a"}, false); err != ErrWrongType {
+		t.Fatalf("expect ErrWrongType but got %v", err)
+	}
+	if info, _ := bms.FilterInfo("seen"); info.Capacity != DefaultCuckooCapacity || info.ErrorRate != DefaultFilterErrorRate {
+		t.Fatalf("unexpected info %+v", info)
+	}
+
+	bms.DropFilter("urls", false)
+	bms.DropFilter("seen", false)
+	if bms.Hash() != hash || len(bms.Filters()) != 0 {
+		t.Fatal("expect the state hash is back after drops")
+	}
+}
+
+func TestBitmaps_CuckooFilter(t *testing.T) {
+	bms := NewBitmaps()
+	hash := bms.Hash()
+
+	if err := bms.ReserveFilter("seen", FilterConfig{Kind: CuckooFilter, ErrorRate: 0.001, Capacity: 100}, false); err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+	if added, _ := bms.CuckooAddNX("seen", "a", false); !added {
+		t.Fatal("expect a is added")
+	}
+	if added, _ := bms.CuckooAddNX("seen", "a", false); added {
+		t.Fatal("expect a isn't added twice by addnx")
+	}
+	bms.CuckooAdd("seen", "a", false)
+	bms.CuckooAdd("seen", "b", false)
+	if n, _ := bms.CuckooCount("seen", "a"); n != 2 {
+		t.Fatalf("expect 2 copies but got %d", n)
+	}
+	if exists, _ := bms.CuckooExists("seen", "a", "b", "c"); !exists[0] || !exists[1] || exists[2] {
+		t.Fatalf("unexpected results %v", exists)
+	}
+
+	for _, deleted := range []bool{true, true, false} {
+		if ok, err := bms.CuckooDelete("seen", "a", false); err != nil || ok != deleted {
+			t.Fatalf("expect deleted %v but got %v: %v", deleted, ok, err)
+		}
+	}
+	bms.CuckooDelete("seen", "b", false)
+	if info, _ := bms.FilterInfo("seen"); info.Items != 0 {
+		t.Fatalf("expect no items but got %d", info.Items)
+	}
+
+	// the table is full after all slots are used.
+	var err error
+	var added int
+	for ; err == nil && added < 10000; added++ {
+		err = bms.CuckooAdd("seen", strconv.Itoa(added), false)
+	}
+	if err != ErrFilterFull {
+		t.Fatalf("expect ErrFilterFull but got %v", err)
+	}
+	for i := 0; i < added-1; i++ {
+		if exists, _ := bms.CuckooExists("seen", strconv.Itoa(i)); !exists[0] {
+			t.Fatalf("expect %d exists after the filter is full", i)
+		}
+	}
+
+	bms.BloomAdd("urls", []string{"a"}, false)
+	if _, err := bms.CuckooDelete("urls", "a", false); err != ErrWrongType {
+		t.Fatalf("expect ErrWrongType but got %v", err)
+	}
+
+	bms.DropFilter("seen", false)
+	bms.DropFilter("urls", false)
+	if bms.Hash() != hash {
+		t.Fatal("expect the state hash is back after drops")
+	}
+}
+
+func TestBitmaps_FilterPersistence(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("plain", []uint32{1, 2}, false)
+	for i := 0; i < 500; i++ {
+		bms.BloomAdd("urls", []string{strconv.Itoa(i)}, false)
+		bms.CuckooAdd("seen", strconv.Itoa(i), false)
+	}
+
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	restored := NewBitmaps()
+	restored.BloomAdd("stale", []string{"x"}, false)
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	read := NewBitmaps()
+	if err := read.Read(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	want, _ := bms.FilterInfo("urls")
+	for _, got := range []*Bitmaps{restored, read} {
+		if got.Hash() != bms.Hash() {
+			t.Fatal("expect the same state after restore")
+		}
+		if info, _ := got.FilterInfo("urls"); info != want {
+			t.Fatalf("expect %+v but got %+v", want, info)
+		}
+		if n, _ := got.CuckooCount("seen", "42"); n != 1 {
+			t.Fatalf("expect 1 copy but got %d", n)
+		}
+		if deleted, _ := got.CuckooDelete("seen", "42", false); !deleted {
+			t.Fatal("expect restored items can be deleted")
+		}
+	}
+	if _, ok := restored.FilterInfo("stale"); ok {
+		t.Fatal("expect filters are replaced by restore")
+	}
+}
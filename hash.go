@@ -0,0 +1,125 @@
+package basalt
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// The checksum of a bitmap is the sum of hashes of its values, so it is
+// updated by adding or subtracting the hash of a value on every change. The
+// state hash of bitmaps is the sum of hashes of names and checksums of all
+// bitmaps, which is also independent of the order of bitmaps.
+
+// mix64 is the finalizer of splitmix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func valueHash(v uint32) uint64 {
+	return mix64(uint64(v) + 0x9e3779b97f4a7c15)
+}
+
+// Checksum computes the checksum of the bitmap from scratch.
+func Checksum(bm *roaring.Bitmap) uint64 {
+	var sum uint64
+	buf := make([]uint32, 1024)
+	it := bm.ManyIterator()
+	for n := it.NextMany(buf); n > 0; n = it.NextMany(buf) {
+		for _, v := range buf[:n] {
+			sum += valueHash(v)
+		}
+	}
+	return sum
+}
+
+// StateHashOf returns the part of the state hash contributed by the named
+// bitmap with the checksum. The state hash is the sum of them.
+func StateHashOf(name string, checksum uint64) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return mix64(h.Sum64() ^ mix64(checksum))
+}
+
+// HashInfo is the state hash of a replica.
+type HashInfo struct {
+	Hash           uint64 // state hash of all bitmaps
+	Checkpoint     uint64 // id of the last checkpoint applied
+	CheckpointHash uint64 // state hash at the last checkpoint
+	Divergences    uint64 // number of checkpoints whose hash differs from the proposer's
+	LastDivergence uint64 // id of the last divergent checkpoint
+}
+
+// maxCheckpoints is the number of recent checkpoints kept by Checkpoints.
+const maxCheckpoints = 16
+
+// Checkpoints detects divergence of replicas. A checkpoint is an entry
+// proposed to the raft log periodically, every replica records its state hash
+// when applying it, so hashes of a checkpoint are taken at the same applied
+// index on all replicas. The next checkpoint carries the id and hash of the
+// previous one recorded by its proposer, and replicas compare them with their own.
+type Checkpoints struct {
+	mu             sync.Mutex
+	hashes         map[uint64]uint64
+	ids            []uint64 // recent checkpoints, oldest first
+	divergences    uint64
+	lastDivergence uint64
+}
+
+// Record records the state hash at checkpoint id, and compares the hash at
+// checkpoint prevID recorded by the proposer with the local one. It returns
+// false if they differ. Checkpoints which are unknown, e.g. applied before a
+// snapshot is restored, are not compared.
+func (c *Checkpoints) Record(id, hash, prevID, prevHash uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hashes == nil {
+		c.hashes = make(map[uint64]uint64)
+	}
+
+	ok := true
+	if local, found := c.hashes[prevID]; found && prevID != 0 && local != prevHash {
+		ok = false
+		c.divergences++
+		c.lastDivergence = prevID
+	}
+
+	if _, found := c.hashes[id]; !found {
+		c.ids = append(c.ids, id)
+		if len(c.ids) > maxCheckpoints {
+			delete(c.hashes, c.ids[0])
+			c.ids = c.ids[1:]
+		}
+	}
+	c.hashes[id] = hash
+	return ok
+}
+
+// Last returns the last recorded checkpoint and its hash.
+func (c *Checkpoints) Last() (id, hash uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.ids) == 0 {
+		return 0, 0
+	}
+	id = c.ids[len(c.ids)-1]
+	return id, c.hashes[id]
+}
+
+// Info fills the checkpoint fields of info.
+func (c *Checkpoints) Info(info *HashInfo) {
+	info.Checkpoint, info.CheckpointHash = c.Last()
+
+	c.mu.Lock()
+	info.Divergences = c.divergences
+	info.LastDivergence = c.lastDivergence
+	c.mu.Unlock()
+}
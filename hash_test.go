@@ -0,0 +1,111 @@
+package basalt
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// rehash computes the state hash of bms from scratch.
+func rehash(t *testing.T, bms *Bitmaps) uint64 {
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	restored := NewBitmaps()
+	if err := restored.Read(&buf); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return restored.Hash()
+}
+
+func TestBitmaps_Hash(t *testing.T) {
+	bms := NewBitmaps()
+	empty := bms.Hash()
+
+	for i := 0; i < 1000; i++ {
+		name := []string{"a", "b", "c"}[rand.Intn(3)]
+		v := uint32(rand.Intn(200))
+		switch rand.Intn(10) {
+		case 0:
+			bms.AddMany(name, []uint32{v, v + 1, v + 2}, false)
+		case 1:
+			bms.Remove(name, v, false)
+		case 2:
+			bms.UnionStore("d", []string{"a", "b"}, false)
+		case 3:
+			bms.XorStore("e", []string{name, "c"}, false)
+		default:
+			bms.Add(name, v, false)
+		}
+	}
+
+	if got, want := bms.Hash(), rehash(t, bms); got != want {
+		t.Fatalf("incremental hash %x differs from rehash %x", got, want)
+	}
+
+	bms.ClearBitmap("a", false)
+	if got, want := bms.Hash(), rehash(t, bms); got != want {
+		t.Fatalf("hash %x differs from rehash %x after clear", got, want)
+	}
+	if bms.Checksum("a") != 0 {
+		t.Errorf("expect checksum of cleared bitmap is 0 but got %x", bms.Checksum("a"))
+	}
+
+	for _, name := range bms.Names() {
+		bms.RemoveBitmap(name, false)
+	}
+	if bms.Hash() != empty {
+		t.Errorf("expect hash of empty bitmaps %x but got %x", empty, bms.Hash())
+	}
+}
+
+func TestBitmaps_HashOrder(t *testing.T) {
+	bms1 := NewBitmaps()
+	bms1.Add("a", 1, false)
+	bms1.Add("a", 2, false)
+	bms1.Add("b", 3, false)
+
+	bms2 := NewBitmaps()
+	bms2.Add("b", 3, false)
+	bms2.AddMany("a", []uint32{2, 1, 2}, false)
+	if bms1.Hash() != bms2.Hash() {
+		t.Fatalf("expect the same hash but got %x and %x", bms1.Hash(), bms2.Hash())
+	}
+
+	// the same values in another bitmap
+	bms2.Remove("b", 3, false)
+	bms2.Add("c", 3, false)
+	if bms1.Hash() == bms2.Hash() {
+		t.Fatalf("expect different hashes but got %x", bms1.Hash())
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	var c Checkpoints
+	if !c.Record(1, 100, 0, 0) {
+		t.Fatal("expect no divergence without previous checkpoint")
+	}
+	if !c.Record(2, 200, 1, 100) {
+		t.Fatal("expect no divergence with the same hash")
+	}
+	if c.Record(3, 300, 2, 201) {
+		t.Fatal("expect divergence with different hashes")
+	}
+	if !c.Record(4, 400, 42, 1) {
+		t.Fatal("expect unknown checkpoints are not compared")
+	}
+
+	var info HashInfo
+	c.Info(&info)
+	if info.Checkpoint != 4 || info.CheckpointHash != 400 || info.Divergences != 1 || info.LastDivergence != 2 {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	for i := uint64(5); i < 5+maxCheckpoints; i++ {
+		c.Record(i, i, 0, 0)
+	}
+	if !c.Record(100, 100, 1, 1) {
+		t.Error("expect old checkpoints are forgotten")
+	}
+}
@@ -0,0 +1,449 @@
+package basalt
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smallnest/log"
+)
+
+// A HyperLogLog estimates the number of distinct elements added to it in a
+// fixed size, like PFADD of redis, for streams whose exact bitmaps are too
+// big. It has 2^14 registers of one byte, so it takes 16KB and the standard
+// error of estimates is 0.81%. Estimates use the improved estimator of Ertl,
+// which is accurate for small and large cardinalities without corrections.
+//
+// HyperLogLogs share the name map with bitmaps: a name is either a bitmap or
+// a HyperLogLog, writes of the other type return ErrWrongType. They are
+// removed by RemoveBitmap, expire like bitmaps, and are counted in the memory
+// and the quota of bitmaps, but they are never evicted or spilled to disk.
+
+const (
+	// hllPrecision is the number of bits of hashes which index registers.
+	hllPrecision = 14
+	// hllRegisters is the number of registers, which is also the size.
+	hllRegisters = 1 << hllPrecision
+	// hllQ is the number of bits of hashes which count zeros, the max value
+	// of registers is hllQ + 1.
+	hllQ = 64 - hllPrecision
+)
+
+// hllRecord is set in the length of name of a HyperLogLog record, which is
+// followed by the name, the number of non-zero registers, and the registers:
+// pairs of uint16 indexes and values of the non-zero ones if they are less
+// than a third of all registers, or all of them.
+const hllRecord = 1 << 26
+
+var (
+	// ErrWrongType is returned by writes to a name held by the other type.
+	ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	// errInvalidHLL is returned if a HyperLogLog record is malformed.
+	errInvalidHLL = errors.New("invalid record of hyperloglog")
+)
+
+// hyperLogLog is the goroutine-safe HyperLogLog.
+type hyperLogLog struct {
+	mu        sync.RWMutex
+	registers []byte
+	sum       uint64 // checksum of non-zero registers
+	dropped   bool   // removed from bitmaps, so it's not in the state hash and used memory
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]byte, hllRegisters)}
+}
+
+// registerHash returns the part of the checksum of a register, which is 0
+// for empty registers.
+func registerHash(i int, v byte) uint64 {
+	if v == 0 {
+		return 0
+	}
+	return valueHash(uint32(i)<<8 | uint32(v))
+}
+
+// hllRegister returns the index of the register of the element and the
+// position of the first 1 bit of the rest of its hash.
+func hllRegister(element string) (int, byte) {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	x := mix64(h.Sum64())
+	w := x>>hllPrecision | 1<<hllQ
+	return int(x & (hllRegisters - 1)), byte(bits.TrailingZeros64(w) + 1)
+}
+
+// add adds the elements and returns whether any register is changed, h.mu
+// must be held for writing.
+func (h *hyperLogLog) add(elements []string) bool {
+	changed := false
+	for _, e := range elements {
+		i, v := hllRegister(e)
+		if old := h.registers[i]; v > old {
+			h.registers[i] = v
+			h.sum += registerHash(i, v) - registerHash(i, old)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// merge merges registers into h, h.mu must be held for writing.
+func (h *hyperLogLog) merge(registers []byte) {
+	for i, v := range registers {
+		if old := h.registers[i]; v > old {
+			h.registers[i] = v
+			h.sum += registerHash(i, v) - registerHash(i, old)
+		}
+	}
+}
+
+// snapshot returns a copy of the registers.
+func (h *hyperLogLog) snapshot() []byte {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]byte(nil), h.registers...)
+}
+
+// hllCount estimates the cardinality of the registers.
+func hllCount(registers []byte) uint64 {
+	var hist [hllQ + 2]int
+	for _, v := range registers {
+		hist[v]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(hist[hllQ+1]))/m)
+	for k := hllQ; k >= 1; k-- {
+		z += float64(hist[k])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(hist[0])/m)
+	return uint64(math.Round(0.5 / math.Ln2 * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+func writeHLL(w io.Writer, name string, registers []byte) (int64, error) {
+	var n int
+	for _, v := range registers {
+		if v != 0 {
+			n++
+		}
+	}
+
+	buf := make([]byte, 8+len(name), 8+len(name)+hllRegisters)
+	binary.LittleEndian.PutUint32(buf, uint32(len(name))|hllRecord)
+	copy(buf[4:], name)
+	binary.LittleEndian.PutUint32(buf[4+len(name):], uint32(n))
+	if 3*n < hllRegisters {
+		for i, v := range registers {
+			if v != 0 {
+				buf = append(buf, byte(i), byte(i>>8), v)
+			}
+		}
+	} else {
+		buf = append(buf, registers...)
+	}
+
+	written, err := w.Write(buf)
+	if err != nil {
+		log.Errorf("failed to write hyperloglog %s: %v", name, err)
+	}
+	return int64(written), err
+}
+
+// readHLL reads registers written by writeHLL.
+func readHLL(r io.Reader) (*hyperLogLog, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > hllRegisters {
+		return nil, errInvalidHLL
+	}
+
+	h := newHyperLogLog()
+	if 3*n < hllRegisters {
+		data := make([]byte, 3*n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		for j := 0; j < len(data); j += 3 {
+			i := int(binary.LittleEndian.Uint16(data[j:]))
+			if i >= hllRegisters || data[j+2] == 0 || h.registers[i] != 0 {
+				return nil, errInvalidHLL
+			}
+			h.registers[i] = data[j+2]
+		}
+	} else if _, err := io.ReadFull(r, h.registers); err != nil {
+		return nil, err
+	}
+
+	for i, v := range h.registers {
+		if v > hllQ+1 {
+			return nil, errInvalidHLL
+		}
+		h.sum += registerHash(i, v)
+	}
+	return h, nil
+}
+
+// getHLL returns the named HyperLogLog, which is nil if it doesn't exist.
+func (bs *Bitmaps) getHLL(name string) *hyperLogLog {
+	shard := bs.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.hlls[name]
+}
+
+// isBitmap returns whether the name is held by a bitmap.
+func (bs *Bitmaps) isBitmap(name string) bool {
+	shard := bs.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.bitmaps[name] != nil
+}
+
+// hll returns the named HyperLogLog, which is created if it doesn't exist,
+// and whether it's created. It returns ErrWrongType if the name is held by a
+// bitmap.
+func (bs *Bitmaps) hll(name string) (*hyperLogLog, bool, error) {
+	shard := bs.shard(name)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.bitmaps[name] != nil {
+		return nil, false, ErrWrongType
+	}
+	if h := shard.hlls[name]; h != nil {
+		return h, false, nil
+	}
+
+	h := newHyperLogLog()
+	shard.hlls[name] = h
+	atomic.AddInt64(&bs.count, 1)
+	atomic.AddUint64(&bs.hash, StateHashOf(name, 0))
+	atomic.AddUint64(&bs.used, uint64(len(name))+hllRegisters)
+	return h, true, nil
+}
+
+// setHLLChecksum updates the checksum of h in the state hash, which is
+// changed from old, h.mu must be held.
+func (bs *Bitmaps) setHLLChecksum(name string, h *hyperLogLog, old uint64) {
+	if !h.dropped {
+		atomic.AddUint64(&bs.hash, StateHashOf(name, h.sum)-StateHashOf(name, old))
+	}
+}
+
+// dropHLL removes h from the state hash and used memory, and removes its
+// deadline. The lock of its shard must be held.
+func (bs *Bitmaps) dropHLL(name string, h *hyperLogLog) {
+	h.mu.Lock()
+	if !h.dropped {
+		h.dropped = true
+		atomic.AddInt64(&bs.count, -1)
+		atomic.AddUint64(&bs.hash, -StateHashOf(name, h.sum))
+		atomic.AddUint64(&bs.used, -(uint64(len(name)) + hllRegisters))
+	}
+	h.mu.Unlock()
+	delete(bs.shard(name).deadlines, name)
+}
+
+// storeHLL replaces the named HyperLogLog or bitmap with h, which has no TTL.
+func (bs *Bitmaps) storeHLL(name string, h *hyperLogLog) {
+	shard := bs.shard(name)
+	shard.mu.Lock()
+	if old := shard.bitmaps[name]; old != nil {
+		bs.drop(name, old)
+		delete(shard.bitmaps, name)
+	}
+	if old := shard.hlls[name]; old != nil {
+		bs.dropHLL(name, old)
+	}
+	shard.hlls[name] = h
+	atomic.AddInt64(&bs.count, 1)
+	atomic.AddUint64(&bs.hash, StateHashOf(name, h.sum))
+	atomic.AddUint64(&bs.used, uint64(len(name))+hllRegisters)
+	shard.mu.Unlock()
+}
+
+// reserveHLL checks the type of the name and reserves memory like reserve
+// before the named HyperLogLog is written.
+func (bs *Bitmaps) reserveHLL(name string) error {
+	if bs.isBitmap(name) {
+		return ErrWrongType
+	}
+	return bs.reserveMemory(name)
+}
+
+// PFAdd adds the elements to the named HyperLogLog, which is created if it
+// doesn't exist. It returns whether the HyperLogLog is created or changed,
+// which is computed from the local state before writes are proposed to raft.
+// It returns ErrWrongType if the name is held by a bitmap, or errors like Add.
+func (bs *Bitmaps) PFAdd(name string, elements []string, callback bool) (bool, error) {
+	if callback {
+		if err := bs.reserveHLL(name); err != nil {
+			return false, err
+		}
+	}
+	if bs.writeCallback != nil && callback {
+		changed := true
+		if h := bs.getHLL(name); h != nil {
+			h.mu.RLock()
+			changed = false
+			for _, e := range elements {
+				if i, v := hllRegister(e); v > h.registers[i] {
+					changed = true
+					break
+				}
+			}
+			h.mu.RUnlock()
+		}
+		return changed, bs.writeCallback(operation{OP: BmOpPFAdd, Name: name, Keys: elements})
+	}
+
+	h, created, err := bs.hll(name)
+	if err != nil {
+		return false, err
+	}
+
+	h.mu.Lock()
+	old := h.sum
+	changed := h.add(elements)
+	bs.setHLLChecksum(name, h, old)
+	h.mu.Unlock()
+
+	return changed || created, nil
+}
+
+// registersOf returns the merged registers of the named HyperLogLogs, which
+// is nil if none of them exist. It returns ErrWrongType if any name is held
+// by a bitmap.
+func (bs *Bitmaps) registersOf(names ...string) ([]byte, error) {
+	var merged []byte
+	for _, name := range names {
+		if bs.isBitmap(name) {
+			return nil, ErrWrongType
+		}
+		h := bs.getHLL(name)
+		if h == nil {
+			continue
+		}
+		registers := h.snapshot()
+		if merged == nil {
+			merged = registers
+			continue
+		}
+		for i, v := range registers {
+			if v > merged[i] {
+				merged[i] = v
+			}
+		}
+	}
+	return merged, nil
+}
+
+// PFCount returns the approximate number of distinct elements added to the
+// named HyperLogLogs, the cardinality of their union for multiple names.
+// HyperLogLogs which don't exist are empty. It returns ErrWrongType if any
+// name is held by a bitmap.
+func (bs *Bitmaps) PFCount(names ...string) (uint64, error) {
+	registers, err := bs.registersOf(names...)
+	if err != nil || registers == nil {
+		return 0, err
+	}
+	return hllCount(registers), nil
+}
+
+// PFMerge merges the named HyperLogLogs into the destination, which is
+// created if it doesn't exist, so it estimates the union of them and itself.
+// It returns errors like PFAdd.
+func (bs *Bitmaps) PFMerge(destination string, names []string, callback bool) error {
+	if callback {
+		if err := bs.reserveHLL(destination); err != nil {
+			return err
+		}
+		if _, err := bs.registersOf(names...); err != nil {
+			return err
+		}
+	}
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpPFMerge, Name: destination, Keys: names})
+	}
+
+	registers, err := bs.registersOf(names...)
+	if err != nil {
+		return err
+	}
+	h, _, err := bs.hll(destination)
+	if err != nil {
+		return err
+	}
+
+	if registers != nil {
+		h.mu.Lock()
+		old := h.sum
+		h.merge(registers)
+		bs.setHLLChecksum(destination, h, old)
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// snapshotHLLs adds copies of all HyperLogLogs to the snapshot, all shards
+// must be locked.
+func (bs *Bitmaps) snapshotHLLs(snapshot *BitmapsSnapshot) {
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		for name, h := range shard.hlls {
+			snapshot.hllNames = append(snapshot.hllNames, name)
+			snapshot.hlls = append(snapshot.hlls, h.snapshot())
+			snapshot.hllDeadlines = append(snapshot.hllDeadlines, shard.deadlines[name])
+		}
+	}
+}
+
+// readHLLRecord stores the HyperLogLog of the record with its deadline.
+func (bs *Bitmaps) readHLLRecord(rec record) {
+	bs.storeHLL(rec.name, rec.hll)
+	if rec.deadline != 0 {
+		bs.Expire(rec.name, time.Unix(int64(rec.deadline), 0), false)
+	}
+}
@@ -0,0 +1,135 @@
+package basalt
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	h := newHyperLogLog()
+	if n := hllCount(h.registers); n != 0 {
+		t.Fatalf("expect 0 of an empty hyperloglog but got %d", n)
+	}
+
+	added := 0
+	for _, n := range []int{1, 10, 1000, 100000, 1000000} {
+		for ; added < n; added++ {
+			h.add([]string{"visitor" + strconv.Itoa(added)})
+		}
+		got := hllCount(h.registers)
+		if e := math.Abs(float64(got)-float64(n)) / float64(n); e > 0.03 {
+			t.Fatalf("estimate %d of %d is off by %.2f%%", got, n, e*100)
+		}
+	}
+	if h.add([]string{"visitor0"}) {
+		t.Fatal("expect no change for an added element")
+	}
+}
+
+func TestBitmaps_HyperLogLog(t *testing.T) {
+	bms := NewBitmaps()
+	hash := bms.Hash()
+
+	if changed, err := bms.PFAdd("uv:a", nil, false); err != nil || !changed {
+		t.Fatalf("expect an empty hyperloglog is created: %v", err)
+	}
+	if changed, _ := bms.PFAdd("uv:a", []string{"u1", "u2", "u3"}, false); !changed {
+		t.Fatal("expect new elements change the hyperloglog")
+	}
+	if changed, _ := bms.PFAdd("uv:a", []string{"u1"}, false); changed {
+		t.Fatal("expect added elements don't change the hyperloglog")
+	}
+	bms.PFAdd("uv:b", []string{"u3", "u4"}, false)
+
+	if n, err := bms.PFCount("uv:a"); err != nil || n != 3 {
+		t.Fatalf("expect 3 but got %d: %v", n, err)
+	}
+	if n, _ := bms.PFCount("uv:a", "uv:b", "missing"); n != 4 {
+		t.Fatalf("expect 4 in the union but got %d", n)
+	}
+	if err := bms.PFMerge("uv", []string{"uv:a", "uv:b"}, false); err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+	if n, _ := bms.PFCount("uv"); n != 4 {
+		t.Fatalf("expect 4 after merge but got %d", n)
+	}
+
+	// names are shared with bitmaps
+	bms.Add("bitmap", 1, false)
+	if _, err := bms.PFAdd("bitmap", []string{"u1"}, true); err != ErrWrongType {
+		t.Fatalf("expect ErrWrongType but got %v", err)
+	}
+	if _, err := bms.PFCount("uv", "bitmap"); err != ErrWrongType {
+		t.Fatalf("expect ErrWrongType but got %v", err)
+	}
+	if err := bms.Add("uv", 1, true); err != ErrWrongType {
+		t.Fatalf("expect ErrWrongType but got %v", err)
+	}
+	if info := bms.MemoryInfo(); info.Bitmaps != 1 || info.HyperLogLogs != 3 {
+		t.Fatalf("unexpected memory info %+v", info)
+	}
+
+	// TTLs are shared with bitmaps
+	now := time.Now()
+	bms.Expire("uv:a", now.Add(-time.Second), false)
+	if deadline, ok := bms.Deadline("uv:a"); !ok || deadline.IsZero() {
+		t.Fatal("expect the deadline of the hyperloglog")
+	}
+	if n := bms.RemoveExpired(now); n != 1 {
+		t.Fatalf("expect 1 expired but got %d", n)
+	}
+	if n, _ := bms.PFCount("uv:a"); n != 0 {
+		t.Fatal("expect the expired hyperloglog is removed")
+	}
+
+	bms.RemoveBitmap("uv", false)
+	bms.RemoveBitmap("uv:b", false)
+	bms.RemoveBitmap("bitmap", false)
+	if bms.Hash() != hash {
+		t.Fatal("expect the state hash is back after removals")
+	}
+}
+
+func TestBitmaps_HyperLogLogPersistence(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("plain", []uint32{1, 2}, false)
+	bms.PFAdd("small", []string{"a", "b"}, false)
+	for i := 0; i < 20000; i++ {
+		bms.PFAdd("big", []string{strconv.Itoa(i)}, false)
+	}
+	bms.Expire("small", time.Now().Add(time.Hour), false)
+
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	restored := NewBitmaps()
+	restored.PFAdd("stale", []string{"x"}, false)
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	read := NewBitmaps()
+	if err := read.Read(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	want, _ := bms.PFCount("big")
+	for _, got := range []*Bitmaps{restored, read} {
+		if got.Hash() != bms.Hash() || got.MemoryInfo().UsedMemory < 2*hllRegisters {
+			t.Fatal("expect the same state after restore")
+		}
+		if n, _ := got.PFCount("big"); n != want {
+			t.Fatalf("expect %d but got %d", want, n)
+		}
+		if deadline, _ := got.Deadline("small"); deadline.IsZero() {
+			t.Fatal("expect the deadline is restored")
+		}
+	}
+	if _, ok := restored.Deadline("stale"); ok {
+		t.Fatal("expect hyperloglogs are replaced by restore")
+	}
+}
@@ -0,0 +1,49 @@
+package basalt
+
+import "sync"
+
+// Inflight counts proposals in flight, so draining can reject new ones and
+// wait for them without blocking on a stalled raft loop. It is used by the
+// raft server and the dragonboat server.
+type Inflight struct {
+	mu       sync.Mutex
+	n        int
+	draining bool
+	idle     chan struct{} // closed once draining and no proposals are in flight
+}
+
+// Begin starts a proposal, it returns false if the node is draining.
+func (p *Inflight) Begin() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		return false
+	}
+	p.n++
+	return true
+}
+
+// End ends a proposal started by Begin.
+func (p *Inflight) End() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.n--
+	if p.draining && p.n == 0 {
+		close(p.idle)
+	}
+}
+
+// Drain rejects new proposals and returns a channel which is closed once
+// proposals in flight are done.
+func (p *Inflight) Drain() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.draining {
+		p.draining = true
+		p.idle = make(chan struct{})
+		if p.n == 0 {
+			close(p.idle)
+		}
+	}
+	return p.idle
+}
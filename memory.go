@@ -0,0 +1,419 @@
+package basalt
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/smallnest/log"
+)
+
+// The memory of a bitmap is the length of its name and its serialized size,
+// which is close to the memory held by roaring containers. It is tracked on
+// every change so the used memory of bitmaps is cheap to get. Writes which
+// add values check the used memory against the budget set by SetMaxMemory.
+
+// ErrOOM is returned by writes if the used memory exceeds the budget and no
+// bitmaps can be evicted.
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+// EvictionPolicy decides how bitmaps are evicted when the used memory exceeds the budget.
+type EvictionPolicy string
+
+const (
+	// NoEviction rejects writes with ErrOOM.
+	NoEviction EvictionPolicy = "noeviction"
+	// AllKeysLRU evicts the least recently used bitmaps.
+	AllKeysLRU EvictionPolicy = "allkeys-lru"
+	// VolatileTTL evicts bitmaps with a TTL, the ones expiring first.
+	VolatileTTL EvictionPolicy = "volatile-ttl"
+)
+
+// ParseEvictionPolicy parses the name of an eviction policy.
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(strings.ToLower(s)); p {
+	case NoEviction, AllKeysLRU, VolatileTTL:
+		return p, nil
+	}
+	return "", errors.New("unknown eviction policy " + s)
+}
+
+const (
+	// evictionSamples is the number of bitmaps sampled to choose one to evict.
+	evictionSamples = 5
+	// sizeInterval is the number of changed values after which the size of a
+	// bitmap is computed again instead of estimated.
+	sizeInterval = 256
+)
+
+// SetMaxMemory sets the memory budget in bytes and the eviction policy,
+// 0 means the memory is unlimited.
+func (bs *Bitmaps) SetMaxMemory(max uint64, policy EvictionPolicy) {
+	bs.policy.Store(policy)
+	atomic.StoreUint64(&bs.maxMemory, max)
+}
+
+// Policy returns the eviction policy.
+func (bs *Bitmaps) Policy() EvictionPolicy {
+	if p, ok := bs.policy.Load().(EvictionPolicy); ok {
+		return p
+	}
+	return NoEviction
+}
+
+// touch records the access time of bm for LRU eviction.
+func (bm *Bitmap) touch() {
+	atomic.StoreInt64(&bm.access, time.Now().UnixNano())
+}
+
+// setSize updates the size of bm and the used memory, bm.mu must be held.
+func (bs *Bitmaps) setSize(bm *Bitmap, size uint64) {
+	if !bm.dropped {
+		atomic.AddUint64(&bs.used, size-bm.size)
+	}
+	bm.size = size
+}
+
+// resize updates the size of bm after delta values are added, or removed if
+// it's negative, bm.mu must be held. The size is estimated by 2 bytes per
+// value like values of array containers, and computed again from the
+// serialized size every sizeInterval changed values.
+func (bs *Bitmaps) resize(bm *Bitmap, delta int) {
+	if delta < 0 {
+		bm.changes -= delta
+	} else {
+		bm.changes += delta
+	}
+	if bm.changes >= sizeInterval {
+		bm.changes = 0
+		bs.setSize(bm, bm.bitmap.GetSerializedSizeInBytes())
+		return
+	}
+
+	size := int64(bm.size) + 2*int64(delta)
+	if size < 0 {
+		size = 0
+	}
+	bs.setSize(bm, uint64(size))
+}
+
+// reserve checks the name isn't held by a HyperLogLog and reserves memory
+// by reserveMemory before the named bitmap is written.
+func (bs *Bitmaps) reserve(name string) error {
+	if bs.getHLL(name) != nil {
+		return ErrWrongType
+	}
+	return bs.reserveMemory(name)
+}
+
+// reserveMemory checks the quota of bitmaps before the named bitmap is
+// written, and evicts bitmaps by the policy if the used memory exceeds the
+// budget or the memory quota. It returns ErrOOM if nothing can be evicted.
+// Evictions proposed to raft are applied later, so the memory of bitmaps
+// evicted by this call is counted as freed.
+func (bs *Bitmaps) reserveMemory(name string) error {
+	quota := bs.Quota()
+	if quota.MaxBitmaps > 0 && uint64(atomic.LoadInt64(&bs.count)) >= quota.MaxBitmaps {
+		shard := bs.shard(name)
+		shard.mu.RLock()
+		exists := shard.bitmaps[name] != nil || shard.hlls[name] != nil
+		shard.mu.RUnlock()
+		if !exists {
+			return ErrQuotaExceeded
+		}
+	}
+
+	max := atomic.LoadUint64(&bs.maxMemory)
+	if quota.MaxMemory > 0 && (max == 0 || quota.MaxMemory < max) {
+		max = quota.MaxMemory
+	}
+	used := atomic.LoadUint64(&bs.used)
+	if max == 0 || used <= max {
+		return nil
+	}
+
+	policy := bs.Policy()
+	if policy == NoEviction {
+		return ErrOOM
+	}
+
+	evicted := make(map[string]bool)
+	for used > max {
+		name, size, ok := bs.evictionCandidate(policy, evicted)
+		if !ok {
+			return ErrOOM
+		}
+		evicted[name] = true
+
+		if err := bs.RemoveBitmap(name, true); err != nil {
+			return err
+		}
+		atomic.AddUint64(&bs.evicted, 1)
+		log.Infof("evicted bitmap %s of %d bytes by %s", name, size, policy)
+
+		if size >= used {
+			break
+		}
+		used -= size
+	}
+	return nil
+}
+
+// evictionCandidate samples a bitmap of each of evictionSamples non-empty
+// shards, visited from a random one, and returns the best one to evict by the
+// policy and its memory. Bitmaps in skip and HyperLogLogs are ignored.
+func (bs *Bitmaps) evictionCandidate(policy EvictionPolicy, skip map[string]bool) (string, uint64, bool) {
+	var (
+		bestName  string
+		bestScore int64
+		bestBm    *Bitmap
+	)
+
+	start := rand.Intn(bitmapShards)
+	for i, samples := 0, 0; i < bitmapShards && samples < evictionSamples; i++ {
+		shard := &bs.shards[(start+i)%bitmapShards]
+
+		// bitmaps are picked from the random start of map iteration.
+		var name string
+		var bm *Bitmap
+		var score int64
+		shard.mu.RLock()
+		if policy == VolatileTTL {
+			for n, deadline := range shard.deadlines {
+				if b := shard.bitmaps[n]; b != nil && !skip[n] {
+					name, bm, score = n, b, int64(deadline)
+					break
+				}
+			}
+		} else {
+			for n, b := range shard.bitmaps {
+				if !skip[n] {
+					name, bm, score = n, b, atomic.LoadInt64(&b.access)
+					break
+				}
+			}
+		}
+		shard.mu.RUnlock()
+
+		if bm == nil {
+			continue
+		}
+		samples++
+		if bestBm == nil || score < bestScore {
+			bestName, bestScore, bestBm = name, score, bm
+		}
+	}
+	if bestBm == nil {
+		return "", 0, false
+	}
+
+	size := uint64(len(bestName))
+	bestBm.mu.RLock()
+	if bestBm.bitmap != nil {
+		size += bestBm.size
+	}
+	bestBm.mu.RUnlock()
+	return bestName, size, true
+}
+
+// MemoryUsage returns the memory of the named bitmap in bytes, which is
+// computed from its serialized size, or only its name if it's spilled to disk.
+// HyperLogLogs of the name are reported too.
+// It returns false if it doesn't exist.
+func (bs *Bitmaps) MemoryUsage(name string) (uint64, bool) {
+	bm := bs.get(name)
+	if bm == nil {
+		if bs.getHLL(name) != nil {
+			return uint64(len(name)) + hllRegisters, true
+		}
+		return 0, false
+	}
+
+	var size uint64
+	bm.mu.Lock()
+	if bm.bitmap != nil {
+		bm.changes = 0
+		bs.setSize(bm, bm.bitmap.GetSerializedSizeInBytes())
+		size = bm.size
+	}
+	bm.mu.Unlock()
+
+	return uint64(len(name)) + size, true
+}
+
+// MemoryInfo is the report of the memory of bitmaps.
+type MemoryInfo struct {
+	UsedMemory      uint64 // bytes of all bitmaps
+	MaxMemory       uint64 // memory budget, 0 if it's unlimited
+	Policy          EvictionPolicy
+	Bitmaps         uint64 // number of bitmaps
+	HyperLogLogs    uint64 // number of HyperLogLogs
+	VolatileBitmaps uint64 // number of bitmaps and HyperLogLogs with a TTL
+	EvictedBitmaps  uint64 // number of bitmaps evicted by this node
+	ExpiredBitmaps  uint64 // number of expired bitmaps removed
+	ColdBitmaps     uint64 // number of bitmaps spilled to disk
+	SpilledBitmaps  uint64 // number of times bitmaps are spilled to disk
+	LoadedBitmaps   uint64 // number of times spilled bitmaps are loaded
+}
+
+// MemoryInfo returns the report of the memory of bitmaps.
+func (bs *Bitmaps) MemoryInfo() MemoryInfo {
+	info := MemoryInfo{
+		UsedMemory:     atomic.LoadUint64(&bs.used),
+		MaxMemory:      atomic.LoadUint64(&bs.maxMemory),
+		Policy:         bs.Policy(),
+		EvictedBitmaps: atomic.LoadUint64(&bs.evicted),
+		ExpiredBitmaps: atomic.LoadUint64(&bs.expired),
+	}
+	if bs.tier != nil {
+		info.ColdBitmaps = uint64(atomic.LoadInt64(&bs.tier.cold))
+		info.SpilledBitmaps = atomic.LoadUint64(&bs.tier.spilled)
+		info.LoadedBitmaps = atomic.LoadUint64(&bs.tier.loaded)
+	}
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		shard.mu.RLock()
+		info.Bitmaps += uint64(len(shard.bitmaps))
+		info.HyperLogLogs += uint64(len(shard.hlls))
+		info.VolatileBitmaps += uint64(len(shard.deadlines))
+		shard.mu.RUnlock()
+	}
+	return info
+}
+
+// deadlineOf converts the deadline to unix seconds, 0 means no deadline.
+func deadlineOf(t time.Time) uint32 {
+	if t.IsZero() {
+		return 0
+	}
+	switch sec := t.Unix(); {
+	case sec < 1:
+		return 1
+	case sec > math.MaxUint32:
+		return math.MaxUint32
+	default:
+		return uint32(sec)
+	}
+}
+
+// Expire sets the deadline of the named bitmap or HyperLogLog, after which it
+// is removed by RemoveExpired. The zero deadline removes the TTL of the
+// bitmap. Bitmaps which don't exist are ignored.
+func (bs *Bitmaps) Expire(name string, deadline time.Time, callback bool) error {
+	sec := deadlineOf(deadline)
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpExpire, Name: name, Values: []uint32{sec}})
+	}
+
+	shard := bs.shard(name)
+	shard.mu.Lock()
+	if shard.bitmaps[name] != nil || shard.hlls[name] != nil {
+		if sec == 0 {
+			delete(shard.deadlines, name)
+		} else {
+			shard.deadlines[name] = sec
+		}
+	}
+	shard.mu.Unlock()
+
+	return nil
+}
+
+// Deadline returns the deadline of the named bitmap or HyperLogLog, which is
+// zero if it has no TTL. It returns false if the bitmap doesn't exist.
+func (bs *Bitmaps) Deadline(name string) (time.Time, bool) {
+	shard := bs.shard(name)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if shard.bitmaps[name] == nil && shard.hlls[name] == nil {
+		return time.Time{}, false
+	}
+	if sec := shard.deadlines[name]; sec != 0 {
+		return time.Unix(int64(sec), 0), true
+	}
+	return time.Time{}, true
+}
+
+// removeExpired removes the named bitmap if its deadline is still sec, so a
+// bitmap whose TTL is changed or which is created again after the removal is
+// proposed is not removed.
+func (bs *Bitmaps) removeExpired(name string, sec uint32, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpDropExpired, Name: name, Values: []uint32{sec}})
+	}
+
+	shard := bs.shard(name)
+	shard.mu.Lock()
+	if sec != 0 && shard.deadlines[name] == sec {
+		if bm := shard.bitmaps[name]; bm != nil {
+			bs.drop(name, bm)
+			delete(shard.bitmaps, name)
+		}
+		if h := shard.hlls[name]; h != nil {
+			bs.dropHLL(name, h)
+			delete(shard.hlls, name)
+		}
+		atomic.AddUint64(&bs.expired, 1)
+	}
+	shard.mu.Unlock()
+
+	return nil
+}
+
+// RemoveExpired removes bitmaps whose deadlines are not after now and returns
+// the number of them. In cluster mode the removals are proposed to raft by
+// the leader only, other nodes remove nothing and return 0.
+func (bs *Bitmaps) RemoveExpired(now time.Time) int {
+	if bs.writeCallback != nil && bs.isLeader != nil && !bs.isLeader() {
+		return 0
+	}
+
+	type expired struct {
+		name string
+		sec  uint32
+	}
+
+	var names []expired
+	nowSec := deadlineOf(now)
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		shard.mu.RLock()
+		for name, sec := range shard.deadlines {
+			if sec <= nowSec {
+				names = append(names, expired{name, sec})
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	for _, e := range names {
+		if err := bs.removeExpired(e.name, e.sec, true); err != nil {
+			log.Errorf("failed to remove expired bitmap %s: %v", e.name, err)
+		}
+	}
+	return len(names)
+}
+
+// ExpireBitmaps removes expired bitmaps every interval until ctx is done.
+// It can run on every node of a cluster, only the leader proposes removals,
+// which are conditional on the deadlines so a stale leader can't remove
+// bitmaps whose TTLs are changed.
+func (bs *Bitmaps) ExpireBitmaps(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		bs.RemoveExpired(time.Now())
+	}
+}
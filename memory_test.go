@@ -0,0 +1,200 @@
+package basalt
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBitmaps_NoEviction(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("test", []uint32{1, 2, 3}, true)
+
+	used := bms.MemoryInfo().UsedMemory
+	if used == 0 {
+		t.Fatal("expect used memory of test but got 0")
+	}
+	bms.SetMaxMemory(used-1, NoEviction)
+
+	if err := bms.Add("test", 4, true); err != ErrOOM {
+		t.Fatalf("expect ErrOOM but got %v", err)
+	}
+	// writes applied from raft are not rejected
+	if err := bms.Add("test", 4, false); err != nil {
+		t.Fatalf("failed to apply add: %v", err)
+	}
+	if err := bms.Remove("test", 4, true); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+}
+
+func TestBitmaps_NoEvictionStore(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("a", []uint32{1, 2, 3}, true)
+	bms.AddMany("b", []uint32{2, 3, 4}, true)
+	bms.SetMaxMemory(bms.MemoryInfo().UsedMemory-1, NoEviction)
+
+	names := []string{"a", "b"}
+	stores := map[string]func(string, []string, bool) (uint64, error){
+		"InterStore": bms.InterStore,
+		"UnionStore": bms.UnionStore,
+		"XorStore":   bms.XorStore,
+		"DiffStore":  bms.DiffStore,
+		"QueryStore": func(dst string, names []string, callback bool) (uint64, error) {
+			return bms.QueryStore(dst, "a OR b", "", callback)
+		},
+	}
+	for op, store := range stores {
+		if _, err := store("dst", names, true); err != ErrOOM {
+			t.Errorf("expect ErrOOM of %s but got %v", op, err)
+		}
+		if bms.Card("dst") != 0 {
+			t.Errorf("expect nothing is stored by %s", op)
+		}
+	}
+
+	// stores applied from raft are not rejected
+	if n, err := bms.UnionStore("dst", names, false); err != nil || n != 4 {
+		t.Fatalf("expect 4 values stored but got %d, %v", n, err)
+	}
+}
+
+func TestBitmaps_EvictLRU(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("old", []uint32{1, 2, 3}, true)
+	bms.AddMany("new", []uint32{1, 2, 3}, true)
+	atomic.StoreInt64(&bms.get("old").access, 1)
+
+	bms.SetMaxMemory(bms.MemoryInfo().UsedMemory-1, AllKeysLRU)
+	if err := bms.Add("new", 4, true); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	if bms.Card("old") != 0 || bms.Card("new") != 4 {
+		t.Fatalf("expect old is evicted but got old %d, new %d", bms.Card("old"), bms.Card("new"))
+	}
+	if info := bms.MemoryInfo(); info.Bitmaps != 1 || info.EvictedBitmaps != 1 {
+		t.Fatalf("expect 1 bitmap and 1 evicted but got %+v", info)
+	}
+}
+
+func TestBitmaps_EvictVolatileTTL(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("persistent", []uint32{1, 2, 3}, true)
+	bms.AddMany("volatile", []uint32{1, 2, 3}, true)
+	bms.Expire("volatile", time.Now().Add(time.Hour), true)
+
+	bms.SetMaxMemory(bms.MemoryInfo().UsedMemory-1, VolatileTTL)
+	if err := bms.Add("persistent", 4, true); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, ok := bms.Deadline("volatile"); ok {
+		t.Fatal("expect volatile is evicted")
+	}
+
+	// only bitmaps with a TTL can be evicted
+	bms.SetMaxMemory(bms.MemoryInfo().UsedMemory-1, VolatileTTL)
+	if err := bms.Add("persistent", 5, true); err != ErrOOM {
+		t.Fatalf("expect ErrOOM but got %v", err)
+	}
+}
+
+func TestBitmaps_Expire(t *testing.T) {
+	bms := NewBitmaps()
+	bms.AddMany("test1", []uint32{1, 2, 3}, false)
+	bms.AddMany("test2", []uint32{1, 2, 3}, false)
+
+	now := time.Now()
+	bms.Expire("test1", now.Add(-time.Second), false)
+	bms.Expire("test2", now.Add(time.Hour), false)
+	bms.Expire("nonexistent", now, false)
+
+	if _, ok := bms.Deadline("nonexistent"); ok {
+		t.Fatal("expect nonexistent doesn't exist")
+	}
+	if d, _ := bms.Deadline("test2"); d.Unix() != now.Add(time.Hour).Unix() {
+		t.Fatalf("expect deadline %v but got %v", now.Add(time.Hour), d)
+	}
+
+	if n := bms.RemoveExpired(now); n != 1 {
+		t.Fatalf("expect 1 expired bitmap but got %d", n)
+	}
+	if bms.Card("test1") != 0 || bms.Card("test2") != 3 {
+		t.Fatalf("expect only test1 is removed but got test1 %d, test2 %d", bms.Card("test1"), bms.Card("test2"))
+	}
+
+	// a removal proposed before the TTL is changed is ignored
+	sec := deadlineOf(now.Add(time.Hour))
+	bms.Expire("test2", time.Time{}, false)
+	bms.removeExpired("test2", sec, false)
+	if d, ok := bms.Deadline("test2"); !ok || !d.IsZero() {
+		t.Fatalf("expect test2 exists without a TTL but got %v, %t", d, ok)
+	}
+
+	if info := bms.MemoryInfo(); info.Bitmaps != 1 || info.VolatileBitmaps != 0 || info.ExpiredBitmaps != 1 {
+		t.Fatalf("unexpected memory info %+v", info)
+	}
+}
+
+func TestBitmaps_ExpireLeader(t *testing.T) {
+	bms := NewBitmaps()
+	bms.Add("test", 1, false)
+	bms.Expire("test", time.Now().Add(-time.Second), false)
+
+	var proposed []OP
+	leader := false
+	bms.writeCallback = func(op operation) error {
+		proposed = append(proposed, op.OP)
+		return nil
+	}
+	bms.isLeader = func() bool { return leader }
+
+	// followers don't propose removals.
+	if n := bms.RemoveExpired(time.Now()); n != 0 || len(proposed) != 0 {
+		t.Fatalf("expect no removals are proposed by a follower but got %d", len(proposed))
+	}
+	leader = true
+	if n := bms.RemoveExpired(time.Now()); n != 1 || len(proposed) != 1 || proposed[0] != BmOpDropExpired {
+		t.Fatalf("expect the removal is proposed by the leader but got %v", proposed)
+	}
+}
+
+func TestBitmaps_MemoryPersistence(t *testing.T) {
+	bms := NewBitmaps()
+	for i := 0; i < 1000; i++ {
+		bms.Add("test1", uint32(i*3), false)
+	}
+	bms.AddMany("test2", []uint32{1, 2, 3}, false)
+	deadline := time.Now().Add(time.Hour)
+	bms.Expire("test2", deadline, false)
+
+	var buf = bytes.NewBuffer(nil)
+	if _, err := bms.Snapshot().WriteTo(buf); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	restored := NewBitmaps()
+	if err := restored.Restore(buf); err != nil {
+		t.Fatalf("failed to restore snapshot: %v", err)
+	}
+
+	if d, _ := restored.Deadline("test2"); d.Unix() != deadline.Unix() {
+		t.Fatalf("expect deadline %v but got %v", deadline, d)
+	}
+	if d, ok := restored.Deadline("test1"); !ok || !d.IsZero() {
+		t.Fatalf("expect test1 without a TTL but got %v, %t", d, ok)
+	}
+
+	var used uint64
+	for _, name := range []string{"test1", "test2"} {
+		size, ok := restored.MemoryUsage(name)
+		if !ok {
+			t.Fatalf("expect memory usage of %s", name)
+		}
+		used += size
+	}
+	if got := restored.MemoryInfo().UsedMemory; got != used {
+		t.Fatalf("expect used memory %d but got %d", used, got)
+	}
+}
@@ -0,0 +1,492 @@
+package basalt
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/smallnest/log"
+)
+
+// Namespaces are isolated sets of bitmaps, each with its own name map, state
+// and quota, like databases of redis. The default namespace holds bitmaps of
+// clients which don't select a namespace, and the bitmaps of older versions.
+// Other namespaces are created when they are first used.
+//
+// Bitmaps of all namespaces are saved in one stream: bitmaps of the default
+// namespace come first, and bitmaps of other namespaces follow the header of
+// their namespace, which carries the quota of the namespace.
+
+// DefaultNamespace is the name of the default namespace.
+const DefaultNamespace = "0"
+
+// maxNamespaceLen is the max length of names of namespaces.
+const maxNamespaceLen = 64
+
+// namespaceRecord is set in the length of name of the header of a namespace,
+// which is followed by the name and the quota of the namespace.
+const namespaceRecord = 1 << 30
+
+var (
+	// ErrInvalidNamespace is returned if the name of a namespace is empty,
+	// too long or contains spaces or control characters.
+	ErrInvalidNamespace = errors.New("invalid namespace")
+	// ErrQuotaExceeded is returned by writes which create bitmaps if the
+	// namespace has the max number of bitmaps of its quota.
+	ErrQuotaExceeded = errors.New("quota of bitmaps of the namespace exceeded")
+	// ErrTooManyNamespaces is returned if a namespace is created by a client
+	// but there are the max number of namespaces.
+	ErrTooManyNamespaces = errors.New("too many namespaces")
+)
+
+// Quota limits the bitmaps of a namespace, 0 means unlimited.
+type Quota struct {
+	MaxMemory  uint64 // memory of bitmaps in bytes, bitmaps are evicted by the eviction policy
+	MaxBitmaps uint64 // number of bitmaps
+}
+
+// quotaLen is the length of an encoded quota.
+const quotaLen = 16
+
+func encodeQuota(q Quota) []byte {
+	buf := make([]byte, quotaLen)
+	binary.LittleEndian.PutUint64(buf, q.MaxMemory)
+	binary.LittleEndian.PutUint64(buf[8:], q.MaxBitmaps)
+	return buf
+}
+
+func decodeQuota(data []byte) (Quota, error) {
+	if len(data) != quotaLen {
+		return Quota{}, ErrInvalidEntry
+	}
+	return Quota{
+		MaxMemory:  binary.LittleEndian.Uint64(data),
+		MaxBitmaps: binary.LittleEndian.Uint64(data[8:]),
+	}, nil
+}
+
+func readQuota(r io.Reader) (Quota, error) {
+	buf := make([]byte, quotaLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Quota{}, err
+	}
+	return decodeQuota(buf)
+}
+
+func writeNamespace(w io.Writer, ns string, q Quota) (int64, error) {
+	buf := make([]byte, 4, 4+len(ns)+quotaLen)
+	binary.LittleEndian.PutUint32(buf, uint32(len(ns))|namespaceRecord)
+	buf = append(buf, ns...)
+	buf = append(buf, encodeQuota(q)...)
+	n, err := w.Write(buf)
+	if err != nil {
+		log.Errorf("failed to write header of namespace %s: %v", ns, err)
+	}
+	return int64(n), err
+}
+
+// Quota returns the quota of bitmaps.
+func (bs *Bitmaps) Quota() Quota {
+	q, _ := bs.quota.Load().(Quota)
+	return q
+}
+
+// ValidNamespace returns whether ns is a valid name of a namespace.
+func ValidNamespace(ns string) bool {
+	if ns == "" || len(ns) > maxNamespaceLen {
+		return false
+	}
+	for _, r := range ns {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return false
+		}
+	}
+	return true
+}
+
+// Namespaces contains bitmaps of all namespaces.
+type Namespaces struct {
+	mu            sync.RWMutex
+	namespaces    map[string]*Bitmaps
+	writeCallback func(op operation) error
+	isLeader      func() bool
+	max           int // max number of namespaces created by clients, 0 means unlimited
+}
+
+// NewNamespaces creates Namespaces whose default namespace is bitmaps. New
+// namespaces get the memory budget, eviction policy and cold storage of the
+// default namespace, cold bitmaps of them are spilled to subdirectories.
+func NewNamespaces(bitmaps *Bitmaps) *Namespaces {
+	return &Namespaces{namespaces: map[string]*Bitmaps{DefaultNamespace: bitmaps}}
+}
+
+// Default returns bitmaps of the default namespace.
+func (n *Namespaces) Default() *Bitmaps {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.namespaces[DefaultNamespace]
+}
+
+// Get returns bitmaps of the namespace, which is created if it doesn't exist.
+// The empty name is the default namespace. It returns ErrTooManyNamespaces if
+// the namespace would exceed the max number of namespaces.
+func (n *Namespaces) Get(ns string) (*Bitmaps, error) {
+	return n.get(ns, true)
+}
+
+// get returns bitmaps of the namespace like Get, the max number of namespaces
+// is only checked if limit is set. Writes applied from raft create namespaces
+// without the limit, so all replicas apply the same writes.
+func (n *Namespaces) get(ns string, limit bool) (*Bitmaps, error) {
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+
+	n.mu.RLock()
+	bs := n.namespaces[ns]
+	n.mu.RUnlock()
+	if bs != nil {
+		return bs, nil
+	}
+	if !ValidNamespace(ns) {
+		return nil, ErrInvalidNamespace
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if bs = n.namespaces[ns]; bs == nil {
+		// the default namespace isn't counted.
+		if limit && n.max > 0 && len(n.namespaces)-1 >= n.max {
+			return nil, ErrTooManyNamespaces
+		}
+		bs = n.newBitmaps(ns)
+		n.namespaces[ns] = bs
+	}
+	return bs, nil
+}
+
+// SetMaxNamespaces sets the max number of namespaces other than the default
+// one which can be created by clients, 0 means unlimited. Existing namespaces
+// are kept if there are more of them.
+func (n *Namespaces) SetMaxNamespaces(max int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.max = max
+}
+
+// newBitmaps creates bitmaps of a namespace configured like the default
+// namespace, n.mu must be held.
+func (n *Namespaces) newBitmaps(ns string) *Bitmaps {
+	def := n.namespaces[DefaultNamespace]
+
+	bs := NewBitmaps()
+	bs.SetMaxMemory(atomic.LoadUint64(&def.maxMemory), def.Policy())
+	if def.tier != nil {
+		dir := filepath.Join(def.tier.dir, "ns-"+hex.EncodeToString([]byte(ns)))
+		if err := bs.SetColdStorage(dir, def.tier.hot); err != nil {
+			log.Errorf("failed to set cold storage of namespace %s: %v", ns, err)
+		}
+	}
+	n.setCallback(ns, bs)
+	return bs
+}
+
+// setCallback sets the write callback of bitmaps of the namespace.
+func (n *Namespaces) setCallback(ns string, bs *Bitmaps) {
+	bs.isLeader = n.isLeader
+	if n.writeCallback == nil {
+		bs.writeCallback = nil
+		return
+	}
+	cb := n.writeCallback
+	bs.writeCallback = func(op operation) error {
+		op.Namespace = ns
+		return cb(op)
+	}
+}
+
+// setWriteCallback sets the callback of writes of all namespaces, which
+// proposes them to raft. It must be called before bitmaps are used.
+func (n *Namespaces) setWriteCallback(cb func(op operation) error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.writeCallback = cb
+	for ns, bs := range n.namespaces {
+		n.setCallback(ns, bs)
+	}
+}
+
+// SetLeaderCheck sets the function which reports whether this node is the
+// raft leader, so background removals are only proposed by the leader. It
+// must be called before bitmaps are used.
+func (n *Namespaces) SetLeaderCheck(isLeader func() bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.isLeader = isLeader
+	for ns, bs := range n.namespaces {
+		n.setCallback(ns, bs)
+	}
+}
+
+// SetQuota sets the quota of the namespace.
+func (n *Namespaces) SetQuota(ns string, q Quota, callback bool) error {
+	bs, err := n.get(ns, callback)
+	if err != nil {
+		return err
+	}
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpSetQuota, Config: encodeQuota(q)})
+	}
+
+	bs.quota.Store(q)
+	return nil
+}
+
+// Names returns names of all namespaces in order, the default one first.
+func (n *Namespaces) Names() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.names()
+}
+
+// names returns names of all namespaces, n.mu must be held.
+func (n *Namespaces) names() []string {
+	names := make([]string, 0, len(n.namespaces))
+	for ns := range n.namespaces {
+		if ns != DefaultNamespace {
+			names = append(names, ns)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{DefaultNamespace}, names...)
+}
+
+// all returns bitmaps of all namespaces in the order of Names.
+func (n *Namespaces) all() []*Bitmaps {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var all []*Bitmaps
+	for _, ns := range n.names() {
+		all = append(all, n.namespaces[ns])
+	}
+	return all
+}
+
+// NamespaceInfo is the report of a namespace.
+type NamespaceInfo struct {
+	Name  string
+	Quota Quota
+	MemoryInfo
+}
+
+// Info returns reports of all namespaces in the order of Names.
+func (n *Namespaces) Info() []NamespaceInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var infos []NamespaceInfo
+	for _, ns := range n.names() {
+		bs := n.namespaces[ns]
+		infos = append(infos, NamespaceInfo{Name: ns, Quota: bs.Quota(), MemoryInfo: bs.MemoryInfo()})
+	}
+	return infos
+}
+
+// Hash returns the state hash of all namespaces. The state hash of the
+// default namespace is kept as it is, so it's compatible with older versions,
+// and the ones of other namespaces are mixed with their names.
+func (n *Namespaces) Hash() uint64 {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	var hash uint64
+	for ns, bs := range n.namespaces {
+		h := bs.Hash()
+		if ns != DefaultNamespace && h != 0 {
+			h = StateHashOf(ns, h)
+		}
+		hash += h
+	}
+	return hash
+}
+
+// ExpireBitmaps removes expired bitmaps of all namespaces every interval
+// until ctx is done.
+func (n *Namespaces) ExpireBitmaps(ctx context.Context, interval time.Duration) {
+	n.every(ctx, interval, func(bs *Bitmaps) { bs.RemoveExpired(time.Now()) })
+}
+
+// SpillBitmaps spills cold bitmaps of all namespaces every interval until ctx is done.
+func (n *Namespaces) SpillBitmaps(ctx context.Context, interval time.Duration) {
+	n.every(ctx, interval, func(bs *Bitmaps) { bs.SpillColdBitmaps() })
+}
+
+func (n *Namespaces) every(ctx context.Context, interval time.Duration, fn func(bs *Bitmaps)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, bs := range n.all() {
+			fn(bs)
+		}
+	}
+}
+
+// Save saves bitmaps of all namespaces to the io.Writer.
+func (n *Namespaces) Save(w io.Writer) error {
+	_, err := n.Snapshot().WriteTo(w)
+	return err
+}
+
+// NamespacesSnapshot is a point-in-time copy of bitmaps of all namespaces.
+type NamespacesSnapshot struct {
+	names     []string
+	quotas    []Quota
+	snapshots []*BitmapsSnapshot
+}
+
+// Snapshot takes a point-in-time copy of bitmaps of all namespaces, which
+// are locked at the same time. Namespaces without bitmaps, fields, series,
+// keys and a quota are skipped except the default one.
+func (n *Namespaces) Snapshot() *NamespacesSnapshot {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	names := n.names()
+	for _, ns := range names {
+		bs := n.namespaces[ns]
+		bs.rlockAll()
+		defer bs.runlockAll()
+	}
+
+	snapshot := &NamespacesSnapshot{}
+	for _, ns := range names {
+		bs := n.namespaces[ns]
+		q, snap := bs.Quota(), bs.snapshotLocked()
+		if ns != DefaultNamespace && q == (Quota{}) && len(snap.names) == 0 && len(snap.hllNames) == 0 && len(snap.fieldNames) == 0 && len(snap.seriesNames) == 0 && len(snap.filterNames) == 0 && len(snap.keys) == 0 {
+			continue
+		}
+		snapshot.names = append(snapshot.names, ns)
+		snapshot.quotas = append(snapshot.quotas, q)
+		snapshot.snapshots = append(snapshot.snapshots, snap)
+	}
+	return snapshot
+}
+
+// WriteTo writes bitmaps of the namespaces to w. The default namespace has
+// no header unless it has a quota.
+func (s *NamespacesSnapshot) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for i, ns := range s.names {
+		if ns != DefaultNamespace || s.quotas[i] != (Quota{}) {
+			n, err := writeNamespace(w, ns, s.quotas[i])
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+
+		n, err := s.snapshots[i].WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Read reads bitmaps of namespaces from r, which replace bitmaps of the same
+// names and namespaces.
+func (n *Namespaces) Read(r io.Reader) error {
+	bs := n.Default()
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if rec.header() {
+			if bs, err = n.get(rec.name, false); err != nil {
+				return err
+			}
+			bs.quota.Store(rec.quota)
+			continue
+		}
+		bs.read(rec)
+	}
+}
+
+// Restore replaces bitmaps of all namespaces with the ones read from r.
+// Namespaces which are not in r are removed.
+func (n *Namespaces) Restore(r io.Reader) error {
+	restored := map[string]*restoredBitmaps{DefaultNamespace: newRestoredBitmaps()}
+	quotas := make(map[string]Quota)
+	cur := restored[DefaultNamespace]
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if rec.header() {
+			if !ValidNamespace(rec.name) {
+				return ErrInvalidNamespace
+			}
+			if restored[rec.name] == nil {
+				restored[rec.name] = newRestoredBitmaps()
+			}
+			cur = restored[rec.name]
+			quotas[rec.name] = rec.quota
+			continue
+		}
+		cur.add(rec)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for ns, bs := range n.namespaces {
+		if restored[ns] == nil {
+			bs.lockAll()
+			bs.replace(newRestoredBitmaps())
+			bs.unlockAll()
+			delete(n.namespaces, ns)
+		}
+	}
+	for ns, rb := range restored {
+		bs := n.namespaces[ns]
+		if bs == nil {
+			bs = n.newBitmaps(ns)
+			n.namespaces[ns] = bs
+		}
+		bs.lockAll()
+		bs.replace(rb)
+		bs.quota.Store(quotas[ns])
+		bs.unlockAll()
+	}
+
+	return nil
+}
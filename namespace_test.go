@@ -0,0 +1,142 @@
+package basalt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestNamespaces_Isolation(t *testing.T) {
+	ns := NewNamespaces(NewBitmaps())
+	def, _ := ns.Get("")
+	tenant, err := ns.Get("tenant")
+	if err != nil {
+		t.Fatalf("failed to get namespace: %v", err)
+	}
+	if _, err := ns.Get("bad name"); err != ErrInvalidNamespace {
+		t.Fatalf("expect ErrInvalidNamespace but got %v", err)
+	}
+
+	def.AddMany("test", []uint32{1, 2, 3}, false)
+	tenant.AddMany("test", []uint32{4, 5}, false)
+	if def.Card("test") != 3 || tenant.Card("test") != 2 {
+		t.Fatalf("expect isolated bitmaps but got %d and %d", def.Card("test"), tenant.Card("test"))
+	}
+	if names := ns.Names(); !reflect.DeepEqual(names, []string{DefaultNamespace, "tenant"}) {
+		t.Fatalf("unexpected namespaces %v", names)
+	}
+
+	// the same bitmaps in another namespace change the state hash
+	hash := ns.Hash()
+	if hash == def.Hash() {
+		t.Fatal("expect the state hash includes the tenant namespace")
+	}
+	tenant.RemoveBitmap("test", false)
+	if ns.Hash() != def.Hash() {
+		t.Fatal("expect the state hash of the default namespace only")
+	}
+}
+
+func TestNamespaces_Quota(t *testing.T) {
+	ns := NewNamespaces(NewBitmaps())
+	if err := ns.SetQuota("tenant", Quota{MaxBitmaps: 2}, true); err != nil {
+		t.Fatalf("failed to set quota: %v", err)
+	}
+	tenant, _ := ns.Get("tenant")
+
+	tenant.Add("test1", 1, true)
+	tenant.Add("test2", 1, true)
+	if err := tenant.Add("test3", 1, true); err != ErrQuotaExceeded {
+		t.Fatalf("expect ErrQuotaExceeded but got %v", err)
+	}
+	if err := tenant.Add("test1", 2, true); err != nil {
+		t.Fatalf("failed to add to an existing bitmap: %v", err)
+	}
+	if _, err := tenant.UnionStore("test3", []string{"test1", "test2"}, true); err != ErrQuotaExceeded {
+		t.Fatalf("expect ErrQuotaExceeded of a store but got %v", err)
+	}
+	if _, err := tenant.UnionStore("test2", []string{"test1", "test2"}, true); err != nil {
+		t.Fatalf("failed to store to an existing bitmap: %v", err)
+	}
+
+	// other namespaces are not limited
+	if err := ns.Default().Add("test3", 1, true); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+}
+
+func TestNamespaces_MaxNamespaces(t *testing.T) {
+	ns := NewNamespaces(NewBitmaps())
+	ns.SetMaxNamespaces(1)
+
+	if _, err := ns.Get("tenant1"); err != nil {
+		t.Fatalf("failed to create a namespace: %v", err)
+	}
+	if _, err := ns.Get("tenant2"); err != ErrTooManyNamespaces {
+		t.Fatalf("expect ErrTooManyNamespaces but got %v", err)
+	}
+	if _, err := ns.Get("tenant1"); err != nil {
+		t.Fatalf("failed to get an existing namespace: %v", err)
+	}
+	if _, err := ns.Get(""); err != nil {
+		t.Fatalf("failed to get the default namespace: %v", err)
+	}
+
+	// namespaces of writes applied from raft are always created.
+	if _, err := ns.get("tenant2", false); err != nil {
+		t.Fatalf("failed to create a namespace without the limit: %v", err)
+	}
+	if names := ns.Names(); len(names) != 3 {
+		t.Fatalf("expect 3 namespaces but got %v", names)
+	}
+}
+
+func TestNamespaces_Persistence(t *testing.T) {
+	ns := NewNamespaces(NewBitmaps())
+	ns.Default().AddMany("test", []uint32{1, 2, 3}, false)
+	tenant, _ := ns.Get("tenant")
+	tenant.AddMany("test", []uint32{4, 5}, false)
+	ns.SetQuota("limited", Quota{MaxMemory: 1 << 20, MaxBitmaps: 10}, false)
+	ns.Get("empty")
+
+	var buf = bytes.NewBuffer(nil)
+	if err := ns.Save(buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	data := buf.Bytes()
+
+	restored := NewNamespaces(NewBitmaps())
+	stale, _ := restored.Get("stale")
+	stale.Add("test", 1, false)
+	if err := restored.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+
+	if names := restored.Names(); !reflect.DeepEqual(names, []string{DefaultNamespace, "limited", "tenant"}) {
+		t.Fatalf("unexpected namespaces %v", names)
+	}
+	if restored.Hash() != ns.Hash() {
+		t.Fatal("expect the same state hash after restore")
+	}
+	tenant, _ = restored.Get("tenant")
+	if tenant.Card("test") != 2 || restored.Default().Card("test") != 3 {
+		t.Fatal("expect bitmaps of namespaces are restored")
+	}
+	limited, _ := restored.Get("limited")
+	if q := limited.Quota(); q != (Quota{MaxMemory: 1 << 20, MaxBitmaps: 10}) {
+		t.Fatalf("unexpected quota %+v", q)
+	}
+
+	// bitmaps of one namespace can't be read from namespaces
+	if err := NewBitmaps().Restore(bytes.NewReader(data)); err != errUnexpectedNamespace {
+		t.Fatalf("expect errUnexpectedNamespace but got %v", err)
+	}
+
+	read := NewNamespaces(NewBitmaps())
+	if err := read.Read(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if read.Hash() != ns.Hash() {
+		t.Fatal("expect the same state hash after read")
+	}
+}
@@ -0,0 +1,551 @@
+package basalt
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// ErrInvalidQuery is wrapped by errors of queries which can't be parsed.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// maxQueryDepth limits nested parentheses and NOTs of queries.
+const maxQueryDepth = 64
+
+// QueryError is the error of a query which can't be parsed.
+type QueryError struct {
+	Offset int // byte offset in the query
+	Msg    string
+}
+
+func (e *QueryError) Error() string {
+	return ErrInvalidQuery.Error() + " at offset " + strconv.Itoa(e.Offset) + ": " + e.Msg
+}
+
+func (e *QueryError) Unwrap() error {
+	return ErrInvalidQuery
+}
+
+type queryOp byte
+
+const (
+	queryName queryOp = iota
+	queryNot
+	queryAnd
+	queryOr
+	queryXor
+)
+
+// queryKeywords are operators of queries in upper case.
+var queryKeywords = map[string]bool{"AND": true, "OR": true, "XOR": true, "ANDNOT": true, "NOT": true}
+
+// queryNode is a node of parsed queries. Operators are n-ary, and `a ANDNOT b`
+// is parsed as `a AND NOT b`.
+type queryNode struct {
+	op   queryOp
+	name string       // name of bitmap for queryName
+	args []*queryNode // operands of operators
+}
+
+// String returns the query of the node with all operators in parentheses.
+func (n *queryNode) String() string {
+	switch n.op {
+	case queryName:
+		if n.name == "" || queryKeywords[strings.ToUpper(n.name)] ||
+			strings.ContainsAny(n.name, " \t\r\n()\"") {
+			return strconv.Quote(n.name)
+		}
+		return n.name
+	case queryNot:
+		return "NOT " + n.args[0].String()
+	}
+
+	sep := " AND "
+	switch n.op {
+	case queryOr:
+		sep = " OR "
+	case queryXor:
+		sep = " XOR "
+	}
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for i, arg := range n.args {
+		if i > 0 {
+			sb.WriteString(sep)
+		}
+		sb.WriteString(arg.String())
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
+
+// names appends names of bitmaps in the query to names.
+func (n *queryNode) names(names []string) []string {
+	if n.op == queryName {
+		return append(names, n.name)
+	}
+	for _, arg := range n.args {
+		names = arg.names(names)
+	}
+	return names
+}
+
+type queryToken struct {
+	offset int
+	word   string // keyword in upper case, name of bitmap, "(" or ")"
+	quoted bool   // quoted names are never keywords
+}
+
+func (t queryToken) keyword(kw string) bool {
+	return !t.quoted && t.word == kw
+}
+
+// lexQuery splits the query into parentheses, keywords and names of bitmaps.
+// Names are bare words or quoted strings of Go syntax.
+func lexQuery(expr string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{offset: i, word: expr[i : i+1]})
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(expr) && expr[j] != '"' {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, &QueryError{Offset: i, Msg: "unterminated string"}
+			}
+			name, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return nil, &QueryError{Offset: i, Msg: "malformed string"}
+			}
+			tokens = append(tokens, queryToken{offset: i, word: name, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t\r\n()\"", expr[j]) < 0 {
+				j++
+			}
+			word := expr[i:j]
+			if upper := strings.ToUpper(word); queryKeywords[upper] {
+				word = upper
+			}
+			tokens = append(tokens, queryToken{offset: i, word: word})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseQuery parses the boolean expression over names of bitmaps. The
+// precedence of operators from high to low is NOT, AND and ANDNOT, XOR, OR.
+func parseQuery(expr string) (*queryNode, error) {
+	tokens, err := lexQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens, end: len(expr)}
+	n, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected " + strconv.Quote(p.tokens[p.pos].word))
+	}
+	return n, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	end    int // offset of the end of the query
+}
+
+func (p *queryParser) errorf(msg string) error {
+	offset := p.end
+	if p.pos < len(p.tokens) {
+		offset = p.tokens[p.pos].offset
+	}
+	return &QueryError{Offset: offset, Msg: msg}
+}
+
+// accept consumes the next token if it's the keyword.
+func (p *queryParser) accept(kw string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].keyword(kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// parseBinary parses operands of the n-ary operator joined by kw.
+func (p *queryParser) parseBinary(op queryOp, kw string, depth int, next func(int) (*queryNode, error)) (*queryNode, error) {
+	n, err := next(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(kw) {
+		arg, err := next(depth)
+		if err != nil {
+			return nil, err
+		}
+		n = join(op, n, arg)
+	}
+	return n, nil
+}
+
+func (p *queryParser) parseOr(depth int) (*queryNode, error) {
+	return p.parseBinary(queryOr, "OR", depth, p.parseXor)
+}
+
+func (p *queryParser) parseXor(depth int) (*queryNode, error) {
+	return p.parseBinary(queryXor, "XOR", depth, p.parseAnd)
+}
+
+func (p *queryParser) parseAnd(depth int) (*queryNode, error) {
+	n, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var not bool
+		switch {
+		case p.accept("AND"):
+		case p.accept("ANDNOT"):
+			not = true
+		default:
+			return n, nil
+		}
+
+		arg, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		if not {
+			arg = negate(arg)
+		}
+		n = join(queryAnd, n, arg)
+	}
+}
+
+func (p *queryParser) parseUnary(depth int) (*queryNode, error) {
+	if depth >= maxQueryDepth {
+		return nil, p.errorf("too deeply nested")
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("unexpected end of query")
+	}
+
+	t := p.tokens[p.pos]
+	switch {
+	case t.keyword("NOT"):
+		p.pos++
+		n, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return negate(n), nil
+	case t.keyword("("):
+		p.pos++
+		n, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("expect \")\"")
+		}
+		return n, nil
+	case t.quoted:
+	case t.word == ")", t.word == "AND", t.word == "OR", t.word == "XOR", t.word == "ANDNOT":
+		return nil, p.errorf("unexpected " + strconv.Quote(t.word))
+	}
+
+	p.pos++
+	return &queryNode{op: queryName, name: t.word}, nil
+}
+
+// join returns the node of op over n and arg, operands of the same operator
+// are merged so trees are flat.
+func join(op queryOp, n, arg *queryNode) *queryNode {
+	var args []*queryNode
+	for _, x := range []*queryNode{n, arg} {
+		if x.op == op {
+			args = append(args, x.args...)
+		} else {
+			args = append(args, x)
+		}
+	}
+	return &queryNode{op: op, args: args}
+}
+
+func negate(n *queryNode) *queryNode {
+	if n.op == queryNot {
+		return n.args[0]
+	}
+	return &queryNode{op: queryNot, args: []*queryNode{n}}
+}
+
+// queryEval evaluates queries over the snapshot of their bitmaps.
+type queryEval struct {
+	bitmaps  map[string]*roaring.Bitmap
+	universe *roaring.Bitmap
+	// universeNames are unioned to the universe lazily if it's not named.
+	universeNames []string
+}
+
+var emptyBitmap = roaring.NewBitmap()
+
+// newQueryEval takes the snapshot of the bitmaps of the query. NOT is
+// evaluated within the named universe, or the union of all bitmaps in the
+// query if it's empty.
+func (bs *Bitmaps) newQueryEval(n *queryNode, universe string) *queryEval {
+	names := n.names(nil)
+	e := &queryEval{bitmaps: make(map[string]*roaring.Bitmap, len(names)+1)}
+
+	all := append(names, universe)
+	for i, bm := range bs.snapshot(all...) {
+		if bm != nil {
+			e.bitmaps[all[i]] = bm
+		}
+	}
+
+	if universe != "" {
+		e.universe = e.bitmap(universe)
+	} else {
+		e.universeNames = names
+	}
+	return e
+}
+
+// bitmap returns the named bitmap, which is empty if it doesn't exist.
+func (e *queryEval) bitmap(name string) *roaring.Bitmap {
+	if bm := e.bitmaps[name]; bm != nil {
+		return bm
+	}
+	return emptyBitmap
+}
+
+func (e *queryEval) getUniverse() *roaring.Bitmap {
+	if e.universe == nil {
+		var bms []*roaring.Bitmap
+		for _, name := range e.universeNames {
+			bms = append(bms, e.bitmap(name))
+		}
+		e.universe = roaring.FastOr(bms...)
+	}
+	return e.universe
+}
+
+// estimate returns the upper bound of the cardinality of the node, which is
+// used to evaluate smaller operands of AND first.
+func (e *queryEval) estimate(n *queryNode) uint64 {
+	switch n.op {
+	case queryName:
+		return e.bitmap(n.name).GetCardinality()
+	case queryAnd:
+		min := uint64(math.MaxUint64)
+		for _, arg := range n.args {
+			if arg.op != queryNot {
+				if c := e.estimate(arg); c < min {
+					min = c
+				}
+			}
+		}
+		return min
+	case queryOr, queryXor:
+		var sum uint64
+		for _, arg := range n.args {
+			c := e.estimate(arg)
+			if sum+c < sum {
+				return math.MaxUint64
+			}
+			sum += c
+		}
+		return sum
+	}
+	return math.MaxUint64
+}
+
+// split returns the operands of AND which are not negated in the ascending
+// order of their estimated cardinality, and those which are negated.
+func (e *queryEval) split(n *queryNode) (pos, neg []*queryNode) {
+	for _, arg := range n.args {
+		if arg.op == queryNot {
+			neg = append(neg, arg.args[0])
+		} else {
+			pos = append(pos, arg)
+		}
+	}
+
+	estimates := make(map[*queryNode]uint64, len(pos))
+	for _, arg := range pos {
+		estimates[arg] = e.estimate(arg)
+	}
+	sort.SliceStable(pos, func(i, j int) bool {
+		return estimates[pos[i]] < estimates[pos[j]]
+	})
+	return pos, neg
+}
+
+// eval evaluates the node. The result is owned if it's computed by the
+// evaluation, otherwise it's shared by the evaluation and must not be changed.
+func (e *queryEval) eval(n *queryNode) (bm *roaring.Bitmap, owned bool) {
+	switch n.op {
+	case queryName:
+		return e.bitmap(n.name), false
+	case queryNot:
+		x, _ := e.eval(n.args[0])
+		return roaring.AndNot(e.getUniverse(), x), true
+	case queryAnd:
+		return e.evalAnd(n)
+	}
+
+	bms := make([]*roaring.Bitmap, 0, len(n.args))
+	for _, arg := range n.args {
+		bm, _ := e.eval(arg)
+		bms = append(bms, bm)
+	}
+	if n.op == queryOr {
+		return roaring.FastOr(bms...), true
+	}
+	return roaring.HeapXor(bms...), true
+}
+
+func (e *queryEval) evalAnd(n *queryNode) (bm *roaring.Bitmap, owned bool) {
+	pos, neg := e.split(n)
+	if len(pos) == 0 {
+		bm = e.getUniverse()
+	} else {
+		bm, owned = e.eval(pos[0])
+	}
+
+	for i := 1; i < len(pos) && !bm.IsEmpty(); i++ {
+		x, _ := e.eval(pos[i])
+		if owned {
+			bm.And(x)
+		} else {
+			bm, owned = roaring.And(bm, x), true
+		}
+	}
+	for i := 0; i < len(neg) && !bm.IsEmpty(); i++ {
+		x, _ := e.eval(neg[i])
+		if owned {
+			bm.AndNot(x)
+		} else {
+			bm, owned = roaring.AndNot(bm, x), true
+		}
+	}
+	return bm, owned
+}
+
+// card computes the cardinality of the node. The result is not materialized
+// if the last operand of the top operator is a bitmap.
+func (e *queryEval) card(n *queryNode) uint64 {
+	switch n.op {
+	case queryName:
+		return e.bitmap(n.name).GetCardinality()
+	case queryNot:
+		x, _ := e.eval(n.args[0])
+		u := e.getUniverse()
+		return u.GetCardinality() - u.AndCardinality(x)
+	}
+
+	args := n.args
+	if n.op == queryAnd {
+		pos, neg := e.split(n)
+		if len(neg) > 0 || len(pos) < 2 {
+			bm, _ := e.eval(n)
+			return bm.GetCardinality()
+		}
+		args = pos
+	}
+
+	last := args[len(args)-1]
+	if last.op != queryName {
+		bm, _ := e.eval(n)
+		return bm.GetCardinality()
+	}
+
+	rest := args[0]
+	if len(args) > 2 {
+		rest = &queryNode{op: n.op, args: args[:len(args)-1]}
+	}
+	bm1, _ := e.eval(rest)
+	bm2 := e.bitmap(last.name)
+	switch n.op {
+	case queryAnd:
+		return bm1.AndCardinality(bm2)
+	case queryOr:
+		return bm1.OrCardinality(bm2)
+	}
+	return bm1.GetCardinality() + bm2.GetCardinality() - 2*bm1.AndCardinality(bm2)
+}
+
+func (bs *Bitmaps) query(expr, universe string) (*roaring.Bitmap, bool, error) {
+	n, err := parseQuery(expr)
+	if err != nil {
+		return nil, false, err
+	}
+	bm, owned := bs.newQueryEval(n, universe).eval(n)
+	return bm, owned, nil
+}
+
+// Query evaluates the boolean expression over names of bitmaps and returns
+// the result. Operators are AND, OR, XOR, ANDNOT and NOT in case-insensitive,
+// names are bare words or quoted strings, and bitmaps which don't exist are
+// empty. NOT is the complement within the universe bitmap, which is the union
+// of all bitmaps in the expression if universe is empty, for example
+// `(a AND b) OR (c ANDNOT d)` or `NOT "my bitmap"`.
+func (bs *Bitmaps) Query(expr, universe string) ([]uint32, error) {
+	bm, _, err := bs.query(expr, universe)
+	if err != nil {
+		return nil, err
+	}
+	return bm.ToArray(), nil
+}
+
+// QueryCard evaluates the boolean expression like Query and returns the
+// cardinality of the result.
+func (bs *Bitmaps) QueryCard(expr, universe string) (uint64, error) {
+	n, err := parseQuery(expr)
+	if err != nil {
+		return 0, err
+	}
+	return bs.newQueryEval(n, universe).card(n), nil
+}
+
+// QueryStore evaluates the boolean expression like Query, saves the result
+// to destination and returns its cardinality. It returns errors like Add.
+func (bs *Bitmaps) QueryStore(destination, expr, universe string, callback bool) (uint64, error) {
+	if callback {
+		if err := bs.reserve(destination); err != nil {
+			return 0, err
+		}
+	}
+
+	bm, owned, err := bs.query(expr, universe)
+	if err != nil {
+		return 0, err
+	}
+	if !owned {
+		bm = bm.Clone()
+	}
+
+	if err := bs.storeBitmap(destination, bm, callback); err != nil {
+		return 0, err
+	}
+	return bm.GetCardinality(), nil
+}
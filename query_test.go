@@ -0,0 +1,124 @@
+package basalt
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{"a", "a"},
+		{"a and b AND c", "(a AND b AND c)"},
+		{"a OR b AND c", "(a OR (b AND c))"},
+		{"a OR b XOR c AND d", "(a OR (b XOR (c AND d)))"},
+		{"(a OR b) AND NOT c", "((a OR b) AND NOT c)"},
+		{"a ANDNOT b ANDNOT c", "(a AND NOT b AND NOT c)"},
+		{"NOT NOT a", "a"},
+		{"(a AND b) OR (c ANDNOT d)", "((a AND b) OR (c AND NOT d))"},
+		{`"my bitmap" AND "and" AND "x\"y"`, `("my bitmap" AND "and" AND "x\"y")`},
+		{"a:1 OR b-2", "(a:1 OR b-2)"},
+	}
+	for _, c := range cases {
+		n, err := parseQuery(c.expr)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", c.expr, err)
+			continue
+		}
+		if got := n.String(); got != c.want {
+			t.Errorf("expect %q parsed as %s but got %s", c.expr, c.want, got)
+		}
+	}
+
+	for _, expr := range []string{"", "a AND", "(a OR b", "a OR b)", "a b", "AND a", "NOT", `"a`, "()",
+		strings.Repeat("(", maxQueryDepth+1) + "a" + strings.Repeat(")", maxQueryDepth+1)} {
+		_, err := parseQuery(expr)
+		var qe *QueryError
+		if !errors.As(err, &qe) || !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("expect %q is invalid but got %v", expr, err)
+		}
+	}
+}
+
+func TestBitmaps_Query(t *testing.T) {
+	bms := NewBitmaps()
+
+	sets := make(map[string]map[uint32]bool)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		sets[name] = make(map[uint32]bool)
+		for i := 0; i < 500; i++ {
+			v := uint32(rand.Intn(2000))
+			sets[name][v] = true
+			bms.Add(name, v, false)
+		}
+	}
+
+	// naive evaluation of queries over values in 0..2000
+	contains := func(name string, v uint32) bool { return sets[name][v] }
+	cases := []struct {
+		expr     string
+		universe string
+		match    func(v uint32) bool
+	}{
+		{"a AND b AND c", "", func(v uint32) bool { return contains("a", v) && contains("b", v) && contains("c", v) }},
+		{"a OR missing", "", func(v uint32) bool { return contains("a", v) }},
+		{"a AND missing", "", func(v uint32) bool { return false }},
+		{"a XOR b XOR c", "", func(v uint32) bool { return contains("a", v) != contains("b", v) != contains("c", v) }},
+		{"(a AND b) OR (c ANDNOT d)", "", func(v uint32) bool {
+			return contains("a", v) && contains("b", v) || contains("c", v) && !contains("d", v)
+		}},
+		{"a ANDNOT b ANDNOT c", "", func(v uint32) bool { return contains("a", v) && !contains("b", v) && !contains("c", v) }},
+		{"NOT a", "", func(v uint32) bool { return false }},
+		{"NOT a OR b", "", func(v uint32) bool { return contains("b", v) }},
+		{"NOT a AND NOT b", "c", func(v uint32) bool { return contains("c", v) && !contains("a", v) && !contains("b", v) }},
+		{"NOT (a OR b) XOR d", "c", func(v uint32) bool {
+			return (contains("c", v) && !contains("a", v) && !contains("b", v)) != contains("d", v)
+		}},
+		{"(a OR b) AND (b OR c) AND d", "", func(v uint32) bool {
+			return (contains("a", v) || contains("b", v)) && (contains("b", v) || contains("c", v)) && contains("d", v)
+		}},
+	}
+
+	for _, c := range cases {
+		want := []uint32{}
+		for v := uint32(0); v < 2000; v++ {
+			if c.match(v) {
+				want = append(want, v)
+			}
+		}
+
+		got, err := bms.Query(c.expr, c.universe)
+		if err != nil {
+			t.Fatalf("failed to query %q: %v", c.expr, err)
+		}
+		if len(got) == 0 {
+			got = []uint32{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expect %q in %q returns %v but got %v", c.expr, c.universe, want, got)
+		}
+
+		n, err := bms.QueryCard(c.expr, c.universe)
+		if err != nil || n != uint64(len(want)) {
+			t.Errorf("expect %q in %q counts %d but got %d, %v", c.expr, c.universe, len(want), n, err)
+		}
+	}
+
+	// stored results are copies even if the query is a bitmap
+	if n, err := bms.QueryStore("dst", "a", "", true); err != nil || n != bms.Card("a") {
+		t.Fatalf("expect %d values stored but got %d, %v", bms.Card("a"), n, err)
+	}
+	bms.ClearBitmap("dst", false)
+	if bms.Card("a") != uint64(len(sets["a"])) {
+		t.Fatalf("expect the source is not changed")
+	}
+
+	if _, err := bms.Query("a AND", ""); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("expect ErrInvalidQuery but got %v", err)
+	}
+}
@@ -15,13 +15,19 @@
 package basalt
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/rpcxio/etcd/etcdserver/api/rafthttp"
@@ -49,13 +55,18 @@ type raftNode struct {
 	join        bool     // node is joining an existing cluster
 	waldir      string   // path to WAL directory
 	snapdir     string   // path to snapshot directory
-	getSnapshot func() ([]byte, error)
+	getSnapshot func() (io.WriterTo, error)
 	lastIndex   uint64 // index of log at start
 
 	confState     raftpb.ConfState
 	snapshotIndex uint64
 	appliedIndex  uint64
 
+	// snapshotting is set while a snapshot is written to its file in the
+	// background, which reports the result on snapshotDoneC.
+	snapshotting  bool
+	snapshotDoneC chan snapshotResult
+
 	// raft backing for the commit/error channel
 	node        raft.Node
 	raftStorage *raft.MemoryStorage
@@ -64,6 +75,10 @@ type raftNode struct {
 	snapshotter      *snap.Snapshotter
 	snapshotterReady chan *snap.Snapshotter // signals when snapshotter is ready
 
+	// mu protects node and peerAddrs which are read by ClusterInfo
+	mu        sync.RWMutex
+	peerAddrs map[uint64]string
+
 	snapCount uint64
 	transport *rafthttp.Transport
 	stopc     chan struct{} // signals proposal channel closed
@@ -73,13 +88,25 @@ type raftNode struct {
 
 var defaultSnapshotCount uint64 = 10000
 
+// snapshotBarrier is published on the commit channel before a snapshot is
+// taken. Once it is received all previous entries have been applied.
+var snapshotBarrier = new(string)
+
+// snapshotResult is the result of writing a snapshot file.
+type snapshotResult struct {
+	index     uint64
+	confState raftpb.ConfState
+	err       error
+}
+
 // newRaftNode initiates a raft instance and returns a committed log entry
 // channel and error channel. Proposals for log updates are sent over the
 // provided the proposal channel. All log entries are replayed over the
 // commit channel, followed by a nil message (to indicate the channel is
 // current), then new log entries. To shutdown, close proposeC and read errorC.
-func NewRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte, error), proposeC <-chan string,
-	confChangeC <-chan raftpb.ConfChange) (<-chan *string, <-chan error, <-chan *snap.Snapshotter) {
+// The returned RaftNode reports the state of the raft instance.
+func NewRaftNode(id int, peers []string, join bool, getSnapshot func() (io.WriterTo, error), proposeC <-chan string,
+	confChangeC <-chan raftpb.ConfChange) (<-chan *string, <-chan error, <-chan *snap.Snapshotter, RaftNode) {
 
 	commitC := make(chan *string)
 	errorC := make(chan error)
@@ -101,10 +128,15 @@ func NewRaftNode(id int, peers []string, join bool, getSnapshot func() ([]byte,
 		httpdonec:   make(chan struct{}),
 
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
+		snapshotDoneC:    make(chan snapshotResult, 1),
+		peerAddrs:        make(map[uint64]string),
 		// rest of structure populated after WAL replay
 	}
+	for i, peer := range peers {
+		rc.peerAddrs[uint64(i+1)] = peer
+	}
 	go rc.startRaft()
-	return commitC, errorC, rc.snapshotterReady
+	return commitC, errorC, rc.snapshotterReady, rc
 }
 
 func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
@@ -121,7 +153,33 @@ func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
 	if err := rc.snapshotter.SaveSnap(snap); err != nil {
 		return err
 	}
-	return rc.wal.ReleaseLockTo(snap.Metadata.Index)
+	if err := rc.wal.ReleaseLockTo(snap.Metadata.Index); err != nil {
+		return err
+	}
+	rc.purgeSnapshotFiles(snap.Metadata.Index)
+	return nil
+}
+
+// purgeSnapshotFiles removes the snapshot files older than index.
+func (rc *raftNode) purgeSnapshotFiles(index uint64) {
+	names, err := fileutil.ReadDir(rc.snapdir)
+	if err != nil {
+		log.Printf("failed to read snapshot dir: %v", err)
+		return
+	}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".snap.db") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".snap.db"), 16, 64)
+		if err != nil || id >= index {
+			continue
+		}
+		if err := os.Remove(filepath.Join(rc.snapdir, name)); err != nil {
+			log.Printf("failed to remove snapshot file %s: %v", name, err)
+		}
+	}
 }
 
 func (rc *raftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
@@ -160,16 +218,24 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 			cc.Unmarshal(ents[i].Data)
 			rc.confState = *rc.node.ApplyConfChange(cc)
 			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
-				if len(cc.Context) > 0 {
+			case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+				if len(cc.Context) > 0 && cc.NodeID != uint64(rc.id) {
 					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
 				}
+				if len(cc.Context) > 0 {
+					rc.mu.Lock()
+					rc.peerAddrs[cc.NodeID] = string(cc.Context)
+					rc.mu.Unlock()
+				}
 			case raftpb.ConfChangeRemoveNode:
 				if cc.NodeID == uint64(rc.id) {
 					log.Println("I've been removed from the cluster! Shutting down.")
 					return false
 				}
 				rc.transport.RemovePeer(types.ID(cc.NodeID))
+				rc.mu.Lock()
+				delete(rc.peerAddrs, cc.NodeID)
+				rc.mu.Unlock()
 			}
 		}
 
@@ -283,15 +349,19 @@ func (rc *raftNode) startRaft() {
 		MaxUncommittedEntriesSize: 1 << 30,
 	}
 
+	var node raft.Node
 	if oldwal {
-		rc.node = raft.RestartNode(c)
+		node = raft.RestartNode(c)
 	} else {
 		startPeers := rpeers
 		if rc.join {
 			startPeers = nil
 		}
-		rc.node = raft.StartNode(c, startPeers)
+		node = raft.StartNode(c, startPeers)
 	}
+	rc.mu.Lock()
+	rc.node = node
+	rc.mu.Unlock()
 
 	rc.transport = &rafthttp.Transport{
 		Logger:      zap.NewExample(),
@@ -301,6 +371,7 @@ func (rc *raftNode) startRaft() {
 		ServerStats: stats.NewServerStats("", ""),
 		LeaderStats: stats.NewLeaderStats(zap.NewExample(), strconv.Itoa(rc.id)),
 		ErrorC:      make(chan error),
+		Snapshotter: rc.snapshotter,
 	}
 
 	rc.transport.Start()
@@ -348,17 +419,60 @@ func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
 
 var snapshotCatchUpEntriesN uint64 = 10000
 
+// maybeTriggerSnapshot takes a snapshot of the state machine if enough
+// entries have been applied since the last one. Only a point-in-time copy
+// is taken in the raft loop, it is written to the snapshot file in the
+// background so a big state doesn't stall the raft loop.
 func (rc *raftNode) maybeTriggerSnapshot() {
-	if rc.appliedIndex-rc.snapshotIndex <= rc.snapCount {
+	if rc.snapshotting || rc.appliedIndex-rc.snapshotIndex <= rc.snapCount {
 		return
 	}
 
 	log.Printf("start snapshot [applied index: %d | last snapshot index: %d]", rc.appliedIndex, rc.snapshotIndex)
-	data, err := rc.getSnapshot()
+	rc.commitC <- snapshotBarrier
+	state, err := rc.getSnapshot()
 	if err != nil {
 		log.Panic(err)
 	}
-	snap, err := rc.raftStorage.CreateSnapshot(rc.appliedIndex, &rc.confState, data)
+
+	rc.snapshotting = true
+	index, confState := rc.appliedIndex, rc.confState
+	go func() {
+		err := rc.saveSnapshotFile(index, state)
+		rc.snapshotDoneC <- snapshotResult{index: index, confState: confState, err: err}
+	}()
+}
+
+// saveSnapshotFile streams the state to the snapshot file of index.
+func (rc *raftNode) saveSnapshotFile(index uint64, state io.WriterTo) error {
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		_, err := state.WriteTo(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	_, err := rc.snapshotter.SaveDBFrom(pr, index)
+	pr.Close()
+	return err
+}
+
+// finishSnapshot creates the snapshot once its file is written
+// and compacts the log.
+func (rc *raftNode) finishSnapshot(result snapshotResult) {
+	rc.snapshotting = false
+	if result.err != nil {
+		log.Panic(result.err)
+	}
+
+	snap, err := rc.raftStorage.CreateSnapshot(result.index, &result.confState, nil)
+	if err == raft.ErrSnapOutOfDate {
+		// a newer snapshot has been received from the leader meanwhile
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -367,15 +481,57 @@ func (rc *raftNode) maybeTriggerSnapshot() {
 	}
 
 	compactIndex := uint64(1)
-	if rc.appliedIndex > snapshotCatchUpEntriesN {
-		compactIndex = rc.appliedIndex - snapshotCatchUpEntriesN
+	if result.index > snapshotCatchUpEntriesN {
+		compactIndex = result.index - snapshotCatchUpEntriesN
 	}
-	if err := rc.raftStorage.Compact(compactIndex); err != nil {
+	if err := rc.raftStorage.Compact(compactIndex); err != nil && err != raft.ErrCompacted {
 		panic(err)
 	}
 
 	log.Printf("compacted log at index %d", compactIndex)
-	rc.snapshotIndex = rc.appliedIndex
+	rc.snapshotIndex = result.index
+}
+
+// sendSnapshots streams the snapshot files of MsgSnap messages to the
+// followers and returns the other messages. MsgSnap messages of snapshots
+// taken by older versions carry the state in their data and are returned.
+func (rc *raftNode) sendSnapshots(ms []raftpb.Message) []raftpb.Message {
+	n := 0
+	for _, m := range ms {
+		if m.Type != raftpb.MsgSnap {
+			ms[n] = m
+			n++
+			continue
+		}
+
+		path, err := rc.snapshotter.DBFilePath(m.Snapshot.Metadata.Index)
+		if err == snap.ErrNoDBSnapshot {
+			ms[n] = m
+			n++
+			continue
+		}
+
+		var file *os.File
+		var fi os.FileInfo
+		if err == nil {
+			file, err = os.Open(path)
+		}
+		if err == nil {
+			fi, err = file.Stat()
+			if err != nil {
+				file.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("failed to open snapshot file at index %d: %v", m.Snapshot.Metadata.Index, err)
+			rc.node.ReportSnapshot(m.To, raft.SnapshotFailure)
+			continue
+		}
+
+		rc.transport.SendSnapshot(*snap.NewMessage(m, file, fi.Size()))
+	}
+
+	return ms[:n]
 }
 
 func (rc *raftNode) serveChannels() {
@@ -435,7 +591,7 @@ func (rc *raftNode) serveChannels() {
 				rc.publishSnapshot(rd.Snapshot)
 			}
 			rc.raftStorage.Append(rd.Entries)
-			rc.transport.Send(rd.Messages)
+			rc.transport.Send(rc.sendSnapshots(rd.Messages))
 			if ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries)); !ok {
 				rc.stop()
 				return
@@ -443,6 +599,9 @@ func (rc *raftNode) serveChannels() {
 			rc.maybeTriggerSnapshot()
 			rc.node.Advance()
 
+		case result := <-rc.snapshotDoneC:
+			rc.finishSnapshot(result)
+
 		case err := <-rc.transport.ErrorC:
 			rc.writeError(err)
 			return
@@ -474,9 +633,138 @@ func (rc *raftNode) serveRaft() {
 	close(rc.httpdonec)
 }
 
+// ClusterInfo returns the status of the raft cluster seen by this node.
+// Replication progress of peers is only known by the leader.
+func (rc *raftNode) ClusterInfo() (*ClusterInfo, error) {
+	rc.mu.RLock()
+	node := rc.node
+	rc.mu.RUnlock()
+	if node == nil {
+		return nil, ErrRaftNotReady
+	}
+
+	st := node.Status()
+	info := &ClusterInfo{
+		ID:       st.ID,
+		LeaderID: st.Lead,
+		State:    st.RaftState.String(),
+		Term:     st.Term,
+		Commit:   st.Commit,
+		Applied:  st.Applied,
+	}
+
+	rc.mu.RLock()
+	addMember := func(id uint64, role string) {
+		if id == st.Lead {
+			role = "leader"
+		}
+		m := MemberInfo{ID: id, Addr: rc.peerAddrs[id], Role: role}
+		if pr, ok := st.Progress[id]; ok {
+			m.Match = pr.Match
+			m.Next = pr.Next
+			m.Progress = pr.State.String()
+			if st.Commit > pr.Match {
+				m.Lag = st.Commit - pr.Match
+			}
+		}
+		info.Members = append(info.Members, m)
+	}
+	for id := range st.Config.Voters.IDs() {
+		addMember(id, "voter")
+	}
+	for id := range st.Config.Learners {
+		addMember(id, "learner")
+	}
+	rc.mu.RUnlock()
+
+	sort.Slice(info.Members, func(i, j int) bool { return info.Members[i].ID < info.Members[j].ID })
+	return info, nil
+}
+
+// TransferLeadership transfers the leadership to target and waits until
+// target takes over. If target is 0 the most up-to-date voter is chosen,
+// which is only known by the leader.
+func (rc *raftNode) TransferLeadership(ctx context.Context, target uint64) error {
+	rc.mu.RLock()
+	node := rc.node
+	rc.mu.RUnlock()
+	if node == nil {
+		return ErrRaftNotReady
+	}
+
+	st := node.Status()
+	if target == 0 {
+		if st.RaftState != raft.StateLeader {
+			return ErrNotLeader
+		}
+		for id := range st.Config.Voters.IDs() {
+			if id == st.ID {
+				continue
+			}
+			if target == 0 || st.Progress[id].Match > st.Progress[target].Match {
+				target = id
+			}
+		}
+		if target == 0 {
+			return ErrNoTransferee
+		}
+	}
+	if st.Lead == target {
+		return nil
+	}
+
+	log.Printf("transferring leadership from %d to %d", st.Lead, target)
+	node.TransferLeadership(ctx, st.Lead, target)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if node.Status().Lead == target {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WaitApplied waits until all entries appended by this node are applied,
+// followers wait for the entries they know to be committed.
+func (rc *raftNode) WaitApplied(ctx context.Context) error {
+	rc.mu.RLock()
+	node := rc.node
+	rc.mu.RUnlock()
+	if node == nil {
+		return ErrRaftNotReady
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		st := node.Status()
+		last := st.Commit
+		if pr, ok := st.Progress[st.ID]; ok && pr.Match > last {
+			last = pr.Match
+		}
+		if st.Applied >= last {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func (rc *raftNode) Process(ctx context.Context, m raftpb.Message) error {
 	return rc.node.Step(ctx, m)
 }
-func (rc *raftNode) IsIDRemoved(id uint64) bool                           { return false }
-func (rc *raftNode) ReportUnreachable(id uint64)                          {}
-func (rc *raftNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {}
+func (rc *raftNode) IsIDRemoved(id uint64) bool  { return false }
+func (rc *raftNode) ReportUnreachable(id uint64) { rc.node.ReportUnreachable(id) }
+func (rc *raftNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
+	rc.node.ReportSnapshot(id, status)
+}
@@ -0,0 +1,299 @@
+package basalt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Errors for raft log entries.
+var (
+	ErrInvalidEntry       = errors.New("invalid raft log entry")
+	ErrUnsupportedVersion = errors.New("unsupported raft log entry version")
+)
+
+// A raft log entry is encoded as:
+//
+//	magic(1) version(1) op(1) uvarint(len(name)) name encoding(1) payload
+//
+// Entries of namespaces other than the default one are written with
+// entryNamespaceVersion, which has uvarint(len(namespace)) namespace before
+// the name. Entries of the default namespace keep the older version.
+//
+// Entries which carry a value, keys or a config besides the values are
+// written with entryExtVersion, which has the namespace like
+// entryNamespaceVersion and then, after the name:
+//
+//	varint(value) uvarint(len(keys)) [uvarint(len(key)) key]... uvarint(len(config)) config
+//
+// With valuesDelta the payload is uvarint(count) followed by the sorted
+// values as uvarint deltas. With valuesRoaring the payload is a serialized
+// roaring bitmap, which is used when it is smaller for big batches.
+//
+// Entries written by older versions are gob encoded legacyOperation values.
+// A gob stream never starts with entryMagic so both can be told apart.
+const (
+	entryMagic            byte = 0xBA
+	entryVersion          byte = 1
+	entryNamespaceVersion byte = 2
+	entryExtVersion       byte = 3
+
+	valuesDelta   byte = 0
+	valuesRoaring byte = 1
+
+	// batches smaller than this are always delta encoded.
+	roaringEncodingThreshold = 256
+)
+
+// operation is a write to bitmaps replicated by raft.
+type operation struct {
+	Namespace string // empty for the default namespace
+	OP        OP
+	Name      string
+	Values    []uint32
+	Value     int64    // the signed value, e.g. of a field
+	Keys      []string // the keys, elements or items written to the name
+	Config    []byte   // the encoded config, e.g. of a filter or a series
+}
+
+// extended returns whether op has to be written with entryExtVersion.
+func (op operation) extended() bool {
+	return op.Value != 0 || len(op.Keys) > 0 || len(op.Config) > 0
+}
+
+// legacyOperation is the gob encoded raft log entry of older versions.
+type legacyOperation struct {
+	OP  OP
+	Val string
+}
+
+func encodeOperation(op operation) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(entryMagic)
+	if op.extended() {
+		buf.WriteByte(entryExtVersion)
+		buf.WriteByte(byte(op.OP))
+		ns := op.Namespace
+		if ns == DefaultNamespace {
+			ns = ""
+		}
+		writeUvarint(&buf, uint64(len(ns)))
+		buf.WriteString(ns)
+	} else if op.Namespace == "" || op.Namespace == DefaultNamespace {
+		buf.WriteByte(entryVersion)
+		buf.WriteByte(byte(op.OP))
+	} else {
+		buf.WriteByte(entryNamespaceVersion)
+		buf.WriteByte(byte(op.OP))
+		writeUvarint(&buf, uint64(len(op.Namespace)))
+		buf.WriteString(op.Namespace)
+	}
+	writeUvarint(&buf, uint64(len(op.Name)))
+	buf.WriteString(op.Name)
+
+	if op.extended() {
+		writeVarint(&buf, op.Value)
+		writeUvarint(&buf, uint64(len(op.Keys)))
+		for _, key := range op.Keys {
+			writeUvarint(&buf, uint64(len(key)))
+			buf.WriteString(key)
+		}
+		writeUvarint(&buf, uint64(len(op.Config)))
+		buf.Write(op.Config)
+	}
+
+	values := make([]uint32, len(op.Values))
+	copy(values, op.Values)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	var delta bytes.Buffer
+	writeUvarint(&delta, uint64(len(values)))
+	var prev uint32
+	for _, v := range values {
+		writeUvarint(&delta, uint64(v-prev))
+		prev = v
+	}
+
+	if len(values) >= roaringEncodingThreshold {
+		bm := roaring.BitmapOf(values...)
+		bm.RunOptimize()
+		if bm.GetSerializedSizeInBytes() < uint64(delta.Len()) {
+			buf.WriteByte(valuesRoaring)
+			if _, err := bm.WriteTo(&buf); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}
+	}
+
+	buf.WriteByte(valuesDelta)
+	buf.Write(delta.Bytes())
+	return buf.Bytes(), nil
+}
+
+func decodeOperation(data []byte) (operation, error) {
+	if len(data) == 0 {
+		return operation{}, ErrInvalidEntry
+	}
+	if data[0] != entryMagic {
+		return decodeLegacyOperation(data)
+	}
+	if len(data) < 3 {
+		return operation{}, ErrInvalidEntry
+	}
+	version := data[1]
+	if version != entryVersion && version != entryNamespaceVersion && version != entryExtVersion {
+		return operation{}, ErrUnsupportedVersion
+	}
+
+	op := operation{OP: OP(data[2])}
+	r := bytes.NewReader(data[3:])
+
+	if version == entryNamespaceVersion || version == entryExtVersion {
+		ns, err := readString(r)
+		if err != nil {
+			return operation{}, err
+		}
+		op.Namespace = ns
+	}
+
+	name, err := readString(r)
+	if err != nil {
+		return operation{}, err
+	}
+	op.Name = name
+
+	if version == entryExtVersion {
+		if err := readExt(r, &op); err != nil {
+			return operation{}, err
+		}
+	}
+
+	encoding, err := r.ReadByte()
+	if err != nil {
+		return operation{}, ErrInvalidEntry
+	}
+
+	switch encoding {
+	case valuesDelta:
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return operation{}, ErrInvalidEntry
+		}
+		if n > 0 {
+			op.Values = make([]uint32, 0, n)
+		}
+		var v uint64
+		for i := uint64(0); i < n; i++ {
+			d, err := binary.ReadUvarint(r)
+			if err != nil {
+				return operation{}, ErrInvalidEntry
+			}
+			v += d
+			if v > 1<<32-1 {
+				return operation{}, ErrInvalidEntry
+			}
+			op.Values = append(op.Values, uint32(v))
+		}
+	case valuesRoaring:
+		bm := roaring.NewBitmap()
+		if _, err := bm.ReadFrom(r); err != nil {
+			return operation{}, ErrInvalidEntry
+		}
+		op.Values = bm.ToArray()
+	default:
+		return operation{}, ErrInvalidEntry
+	}
+
+	return op, nil
+}
+
+// readExt reads the value, keys and config of an entryExtVersion entry.
+func readExt(r *bytes.Reader, op *operation) error {
+	value, err := binary.ReadVarint(r)
+	if err != nil {
+		return ErrInvalidEntry
+	}
+	op.Value = value
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return ErrInvalidEntry
+	}
+	if n > 0 {
+		op.Keys = make([]string, 0, n)
+	}
+	for i := uint64(0); i < n; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return err
+		}
+		op.Keys = append(op.Keys, key)
+	}
+
+	config, err := readString(r)
+	if err != nil {
+		return err
+	}
+	if config != "" {
+		op.Config = []byte(config)
+	}
+	return nil
+}
+
+// decodeLegacyOperation decodes a gob entry whose value is formatted as
+// "name" or "name,values".
+func decodeLegacyOperation(data []byte) (operation, error) {
+	var lop legacyOperation
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&lop); err != nil {
+		return operation{}, err
+	}
+
+	op := operation{OP: lop.OP, Name: lop.Val}
+	switch lop.OP {
+	case BmOpAdd, BmOpAddMany, BmOpRemove:
+		items := strings.SplitN(lop.Val, ",", 2)
+		if len(items) != 2 {
+			return operation{}, ErrInvalidEntry
+		}
+		op.Name = items[0]
+
+		// older AddMany entries were formatted with %d and look like "%!d(string=1,2,3)".
+		values := strings.TrimSuffix(strings.TrimPrefix(items[1], "%!d(string="), ")")
+		vs, err := str2uint32s(values)
+		if err != nil {
+			return operation{}, err
+		}
+		op.Values = vs
+	}
+
+	return op, nil
+}
+
+// readString reads a string prefixed by its uvarint length.
+func readString(r *bytes.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil || l > uint64(r.Len()) {
+		return "", ErrInvalidEntry
+	}
+	s := make([]byte, l)
+	r.Read(s)
+	return string(s), nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	buf.Write(b[:n])
+}
+
+func writeVarint(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	buf.Write(b[:n])
+}
@@ -0,0 +1,121 @@
+package basalt
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestOperation_Codec(t *testing.T) {
+	var many []uint32
+	for i := 0; i < 10000; i++ {
+		many = append(many, uint32(i*3))
+	}
+	var sparse []uint32
+	for i := 0; i < 1000; i++ {
+		sparse = append(sparse, rand.Uint32())
+	}
+	sort.Slice(sparse, func(i, j int) bool { return sparse[i] < sparse[j] })
+
+	ops := []operation{
+		{OP: BmOpAdd, Name: "test1", Values: []uint32{1}},
+		{OP: BmOpAddMany, Name: "test1", Values: []uint32{1, 2, 3, 10, 11, 4294967295}},
+		{OP: BmOpAddMany, Name: "test2", Values: many},
+		{OP: BmOpAddMany, Name: "test3", Values: sparse},
+		{OP: BmOpRemove, Name: "test1", Values: []uint32{0}},
+		{OP: BmOpDrop, Name: "test1"},
+		{OP: BmOpClear, Name: ""},
+		{Namespace: "tenant", OP: BmOpAddMany, Name: "test1", Values: []uint32{1, 2, 3}},
+		{Namespace: "tenant", OP: BmOpSetQuota, Config: encodeQuota(Quota{MaxMemory: 1 << 20, MaxBitmaps: 10})},
+		{OP: BmOpSetValue, Name: "score", Values: []uint32{7}, Value: -100},
+		{Namespace: "tenant", OP: BmOpSetValue, Name: "score", Values: []uint32{7}, Value: 1 << 40},
+		{OP: BmOpClearValue, Name: "score", Values: []uint32{7}},
+		{Namespace: "tenant", OP: BmOpCreateSeries, Name: "active", Config: []byte(SeriesConfig{Granularity: Day, Retention: []int{30, 12, 0}}.encode())},
+		{OP: BmOpRollupBucket, Name: "active:2026-10-17"},
+		{OP: BmOpAddKeys, Name: "follow", Keys: []string{"1766187712-1640571365", "", "a,b"}},
+		{OP: BmOpPFAdd, Name: "uv:page1", Keys: []string{"visitor1", "visitor2"}},
+		{Namespace: "tenant", OP: BmOpPFMerge, Name: "uv", Keys: []string{"uv:page1", "uv:page2"}},
+		{OP: BmOpReserveFilter, Name: "seen", Config: FilterConfig{Kind: CuckooFilter, ErrorRate: 0.001, Capacity: 1 << 20}.encode()},
+		{OP: BmOpBloomAdd, Name: "urls", Keys: []string{"https://example.com/?a=1&b=2", ""}},
+		{OP: BmOpStore, Name: "dst", Config: []byte{0x3a, 0x30, 0, 0}},
+	}
+
+	for _, op := range ops {
+		data, err := encodeOperation(op)
+		if err != nil {
+			t.Fatalf("failed to encode %v: %v", op.OP, err)
+		}
+
+		got, err := decodeOperation(data)
+		if err != nil {
+			t.Fatalf("failed to decode %v: %v", op.OP, err)
+		}
+		if !reflect.DeepEqual(op, got) {
+			t.Fatalf("expect %+v but got %+v", op, got)
+		}
+	}
+}
+
+func TestOperation_CodecSize(t *testing.T) {
+	var values []uint32
+	for i := 0; i < 100000; i++ {
+		values = append(values, uint32(i))
+	}
+
+	data, err := encodeOperation(operation{OP: BmOpAddMany, Name: "test", Values: values})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 1024 {
+		t.Fatalf("expect dense values to be roaring encoded but got %d bytes", len(data))
+	}
+}
+
+func TestOperation_DecodeLegacy(t *testing.T) {
+	legacy := []struct {
+		op   legacyOperation
+		want operation
+	}{
+		{legacyOperation{BmOpAdd, "test1,1"}, operation{OP: BmOpAdd, Name: "test1", Values: []uint32{1}}},
+		{legacyOperation{BmOpAddMany, "test1,%!d(string=1,2,3)"}, operation{OP: BmOpAddMany, Name: "test1", Values: []uint32{1, 2, 3}}},
+		{legacyOperation{BmOpRemove, "test1,2"}, operation{OP: BmOpRemove, Name: "test1", Values: []uint32{2}}},
+		{legacyOperation{BmOpDrop, "test1"}, operation{OP: BmOpDrop, Name: "test1"}},
+	}
+
+	for _, l := range legacy {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(l.op); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := decodeOperation(buf.Bytes())
+		if err != nil {
+			t.Fatalf("failed to decode legacy %+v: %v", l.op, err)
+		}
+		if !reflect.DeepEqual(l.want, got) {
+			t.Fatalf("expect %+v but got %+v", l.want, got)
+		}
+	}
+}
+
+func TestOperation_DecodeInvalid(t *testing.T) {
+	invalid := [][]byte{
+		nil,
+		{entryMagic},
+		{entryMagic, 99, byte(BmOpAdd)},
+		{entryMagic, entryVersion, byte(BmOpAdd), 10, 'a'},
+		{entryMagic, entryVersion, byte(BmOpAdd), 1, 'a', valuesDelta, 5, 1},
+		{entryMagic, entryVersion, byte(BmOpAdd), 1, 'a', 9},
+		{entryMagic, entryExtVersion, byte(BmOpSetValue), 0, 1, 'a', 2, 5, 1, 'k'},
+		{entryMagic, entryExtVersion, byte(BmOpSetValue), 0, 1, 'a', 2, 0, 3, 'c'},
+	}
+
+	for _, data := range invalid {
+		if _, err := decodeOperation(data); err == nil {
+			t.Fatalf("expect error for %v", data)
+		}
+	}
+}
@@ -1,69 +1,160 @@
 package basalt
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/gob"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
 	"log"
-	"strings"
+	"math/rand"
+	"os"
+	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/rpcxio/etcd/etcdserver/api/snap"
 	"github.com/rpcxio/etcd/raft/raftpb"
 )
 
+// Errors for raft cluster.
+var (
+	ErrRaftNotReady    = errors.New("raft node is not ready")
+	ErrClusterDisabled = errors.New("cluster mode is disabled")
+	ErrNotLeader       = errors.New("raft node is not the leader")
+	ErrNoTransferee    = errors.New("no voter to transfer leadership to")
+	ErrDraining        = errors.New("raft node is draining")
+)
+
+// Timeouts of leadership transfer and drain issued by admin commands.
+const (
+	leaderTransferTimeout = 5 * time.Second
+	drainTimeout          = 30 * time.Second
+)
+
+// ConfChange changes and inspects the membership of the raft cluster.
 type ConfChange interface {
 	AddNode(id uint64, addr []byte) error
 	RemoveNode(id uint64) error
+	// AddLearner adds a non-voting node which replicates the log
+	// and serves eventually consistent reads.
+	AddLearner(id uint64, addr []byte) error
+	// PromoteLearner promotes a learner to be a voter.
+	PromoteLearner(id uint64) error
+	// ClusterInfo returns members, roles and progress of the cluster.
+	ClusterInfo() (*ClusterInfo, error)
+	// TransferLeadership moves the leadership to target,
+	// 0 means the most up-to-date voter.
+	TransferLeadership(ctx context.Context, target uint64) error
+	// Drain rejects new writes, waits for in-flight proposals
+	// and moves the leadership off this node.
+	Drain(ctx context.Context) error
+	// Hash returns the state hash of the local replica
+	// and the result of comparing it with other replicas.
+	Hash() (*HashInfo, error)
 }
+
+// RaftNode is the handle of the local raft node.
+type RaftNode interface {
+	ClusterInfo() (*ClusterInfo, error)
+	TransferLeadership(ctx context.Context, target uint64) error
+	WaitApplied(ctx context.Context) error
+}
+
+// ClusterInfo is the status of the raft cluster seen by the local node.
+type ClusterInfo struct {
+	ID       uint64 // id of the local node
+	LeaderID uint64
+	State    string // raft state of the local node
+	Term     uint64
+	Commit   uint64
+	Applied  uint64
+	Members  []MemberInfo
+}
+
+// MemberInfo is a member of the raft cluster.
+// Match, Next, Progress and Lag are only reported by the leader.
+type MemberInfo struct {
+	ID       uint64
+	Addr     string
+	Role     string // leader, voter or learner
+	Match    uint64
+	Next     uint64
+	Progress string // probe, replicate or snapshot
+	Lag      uint64 // entries committed but not yet replicated to this member
+}
+
 type RaftServer struct {
+	node        RaftNode
 	proposeC    chan<- string
 	confChangeC chan raftpb.ConfChange
 	bmServer    *Server
 	snapshotter *snap.Snapshotter
-}
+	checkpoints Checkpoints
 
-type operaton struct {
-	OP  OP
-	Val string
+	proposals Inflight
 }
 
-func NewRaftServer(bmServer *Server, snapshotter *snap.Snapshotter, confChangeC chan raftpb.ConfChange, proposeC chan<- string, commitC <-chan *string, errorC <-chan error) *RaftServer {
-	s := &RaftServer{proposeC: proposeC, confChangeC: confChangeC, bmServer: bmServer, snapshotter: snapshotter}
-	bmServer.bitmaps.writeCallback = s.Propose
-	s.readCommits(commitC, errorC)
-	go s.readCommits(commitC, errorC)
+func NewRaftServer(bmServer *Server, node RaftNode, snapshotter *snap.Snapshotter, confChangeC chan raftpb.ConfChange, proposeC chan<- string, commitC <-chan *string, errorC <-chan error) *RaftServer {
+	s := &RaftServer{node: node, proposeC: proposeC, confChangeC: confChangeC, bmServer: bmServer, snapshotter: snapshotter}
+	bmServer.namespaces.setWriteCallback(s.propose)
+	bmServer.namespaces.SetLeaderCheck(s.IsLeader)
+	if err := s.loadSnapshot(); err != nil {
+		log.Panic(err)
+	}
+	s.readCommits(commitC, errorC, true)
+	go s.readCommits(commitC, errorC, false)
 
 	return s
 }
 
-func (s *RaftServer) Propose(op OP, value string) {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(operaton{op, value}); err != nil {
-		log.Fatal(err)
+// Propose proposes a write operation of bitmaps of the default namespace to raft.
+func (s *RaftServer) Propose(op OP, name string, values []uint32) error {
+	return s.propose(operation{OP: op, Name: name, Values: values})
+}
+
+// propose proposes a write operation of bitmaps to raft.
+func (s *RaftServer) propose(op operation) error {
+	data, err := encodeOperation(op)
+	if err != nil {
+		return err
+	}
+
+	if !s.proposals.Begin() {
+		return ErrDraining
 	}
+	defer s.proposals.End()
 
-	s.proposeC <- buf.String()
+	s.proposeC <- string(data)
+	return nil
 }
 
-func (s *RaftServer) readCommits(commitC <-chan *string, errorC <-chan error) {
+// IsLeader returns whether this node is the leader of the raft cluster.
+func (s *RaftServer) IsLeader() bool {
+	info, err := s.node.ClusterInfo()
+	return err == nil && info.LeaderID == info.ID
+}
+
+// readCommits applies committed entries. With replay it returns once
+// the entries in WAL are replayed.
+func (s *RaftServer) readCommits(commitC <-chan *string, errorC <-chan error, replay bool) {
 	for data := range commitC {
+		if data == snapshotBarrier {
+			continue
+		}
 		if data == nil {
-			snapshot, err := s.snapshotter.Load()
-			if err == snap.ErrNoSnapshot {
+			// replaying is done, or a snapshot is received from the leader.
+			if replay {
 				return
 			}
-			if err != nil {
-				log.Panic(err)
-			}
-			log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
-			if err := s.recoverFromSnapshot(snapshot.Data); err != nil {
+			if err := s.loadSnapshot(); err != nil {
 				log.Panic(err)
 			}
 			continue
 		}
 
-		var op operaton
-		dec := gob.NewDecoder(bytes.NewBufferString(*data))
-		if err := dec.Decode(&op); err != nil {
+		op, err := decodeOperation([]byte(*data))
+		if err != nil {
 			log.Fatalf("raftexample: could not decode message (%v)", err)
 		}
 		s.processOP(op)
@@ -73,45 +164,274 @@ func (s *RaftServer) readCommits(commitC <-chan *string, errorC <-chan error) {
 	}
 }
 
-func (s *RaftServer) processOP(op operaton) {
+func (s *RaftServer) processOP(op operation) {
+	bitmaps, err := s.bmServer.namespaces.get(op.Namespace, false)
+	if err != nil {
+		log.Printf("wrong namespace of request: %+v", op)
+		return
+	}
+
 	switch op.OP {
 	case BmOpAdd:
-		items := strings.SplitN(op.Val, ",", 2)
-		if len(items) != 2 {
+		if len(op.Values) != 1 {
 			log.Printf("wrong request: %+v", op)
 			return
 		}
-		s.bmServer.add(items[0], items[1], false)
+		s.apply(op, func() error { return bitmaps.Add(op.Name, op.Values[0], false) })
 	case BmOpAddMany:
-		items := strings.SplitN(op.Val, ",", 2)
-		if len(items) != 2 {
-			log.Printf("wrong request: %+v", op)
-			return
-		}
-		s.bmServer.addMany(items[0], items[1], false)
+		s.apply(op, func() error { return bitmaps.AddMany(op.Name, op.Values, false) })
 	case BmOpRemove:
-		items := strings.SplitN(op.Val, ",", 2)
-		if len(items) != 2 {
+		if len(op.Values) != 1 {
 			log.Printf("wrong request: %+v", op)
 			return
 		}
-		s.bmServer.remove(items[0], items[1], false)
+		s.apply(op, func() error { return bitmaps.Remove(op.Name, op.Values[0], false) })
 	case BmOpDrop:
-		s.bmServer.drop(op.Val, false)
+		bitmaps.RemoveBitmap(op.Name, false)
 	case BmOpClear:
-		s.bmServer.clear(op.Val, false)
+		s.apply(op, func() error { return bitmaps.ClearBitmap(op.Name, false) })
+	case BmOpExpire:
+		if len(op.Values) != 1 {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		var deadline time.Time
+		if op.Values[0] != 0 {
+			deadline = time.Unix(int64(op.Values[0]), 0)
+		}
+		bitmaps.Expire(op.Name, deadline, false)
+	case BmOpDropExpired:
+		if len(op.Values) != 1 {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		bitmaps.removeExpired(op.Name, op.Values[0], false)
+	case BmOpSetQuota:
+		q, err := decodeQuota(op.Config)
+		if err != nil {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		s.bmServer.namespaces.SetQuota(op.Namespace, q, false)
+	case BmOpSetValue:
+		if len(op.Values) != 1 {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		bitmaps.SetValue(op.Name, op.Values[0], op.Value, false)
+	case BmOpClearValue:
+		if len(op.Values) != 1 {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		bitmaps.ClearValue(op.Name, op.Values[0], false)
+	case BmOpDropField:
+		bitmaps.DropField(op.Name, false)
+	case BmOpCreateSeries:
+		c, err := decodeSeriesConfig(op.Config)
+		if err != nil {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		bitmaps.CreateSeries(op.Name, c, false)
+	case BmOpDropSeries:
+		bitmaps.DropSeries(op.Name, false)
+	case BmOpRollupBucket:
+		s.apply(op, func() error { return bitmaps.rollupBucket(op.Name, false) })
+	case BmOpAddKeys:
+		if err := bitmaps.AddKeys(op.Name, op.Keys, false); err != nil {
+			log.Printf("failed to add keys to %s: %v", op.Name, err)
+		}
+	case BmOpPFAdd:
+		if _, err := bitmaps.PFAdd(op.Name, op.Keys, false); err != nil {
+			log.Printf("failed to add elements to %s: %v", op.Name, err)
+		}
+	case BmOpPFMerge:
+		if err := bitmaps.PFMerge(op.Name, op.Keys, false); err != nil {
+			log.Printf("failed to merge hyperloglogs to %s: %v", op.Name, err)
+		}
+	case BmOpReserveFilter:
+		c, err := decodeFilterConfig(op.Config)
+		if err != nil {
+			log.Printf("wrong request: %+v", op)
+			return
+		}
+		if err := bitmaps.ReserveFilter(op.Name, c, false); err != nil {
+			log.Printf("failed to reserve filter %s: %v", op.Name, err)
+		}
+	case BmOpBloomAdd, BmOpCuckooAdd, BmOpCuckooAddNX, BmOpCuckooDelete:
+		s.applyFilterOP(bitmaps, op.OP, op.Name, op.Keys)
+	case BmOpDropFilter:
+		bitmaps.DropFilter(op.Name, false)
+	case BmOpStore:
+		bm := roaring.NewBitmap()
+		if err := bm.UnmarshalBinary(op.Config); err != nil {
+			log.Printf("wrong bitmap of %s: %v", op.Name, err)
+			return
+		}
+		bitmaps.storeBitmap(op.Name, bm, false)
+	case BmOpCheckpoint:
+		data := op.Config
+		if len(data) == 0 {
+			// checkpoints of older versions are carried in the name.
+			data = []byte(op.Name)
+		}
+		s.applyCheckpoint(data)
+	}
+}
+
+// applyRetries is the number of times a committed write is retried while a
+// spilled bitmap it writes can't be loaded, applyRetryInterval is the
+// interval between retries.
+var (
+	applyRetries       = 10
+	applyRetryInterval = 500 * time.Millisecond
+)
+
+// apply applies a write of a committed entry. Committed entries must never be
+// skipped, so the write is retried while a spilled bitmap it writes can't be
+// loaded, and the node stops if it still can't be loaded instead of silently
+// diverging from other replicas. Other errors are the same on all replicas.
+func (s *RaftServer) apply(op operation, write func() error) {
+	err := write()
+	for i := 0; err == ErrColdBitmapUnavailable && i < applyRetries; i++ {
+		log.Printf("failed to apply %+v, retrying: %v", op, err)
+		time.Sleep(applyRetryInterval)
+		err = write()
+	}
+
+	switch err {
+	case nil:
+	case ErrColdBitmapUnavailable:
+		log.Fatalf("failed to apply %+v: %v", op, err)
+	default:
+		log.Printf("failed to apply %+v: %v", op, err)
+	}
+}
+
+// A checkpoint entry carries its id, and the id and state hash of the
+// previous checkpoint of the proposer, in its config.
+const checkpointLen = 24
+
+func encodeCheckpoint(id, prevID, prevHash uint64) []byte {
+	buf := make([]byte, checkpointLen)
+	binary.LittleEndian.PutUint64(buf, id)
+	binary.LittleEndian.PutUint64(buf[8:], prevID)
+	binary.LittleEndian.PutUint64(buf[16:], prevHash)
+	return buf
+}
+
+// applyFilterOP applies a write of items to a filter.
+func (s *RaftServer) applyFilterOP(bitmaps *Bitmaps, op OP, name string, items []string) {
+	var err error
+	switch op {
+	case BmOpBloomAdd:
+		_, err = bitmaps.BloomAdd(name, items, false)
+	case BmOpCuckooAdd, BmOpCuckooAddNX, BmOpCuckooDelete:
+		if len(items) != 1 {
+			log.Printf("wrong request of filter %s: %d items", name, len(items))
+			return
+		}
+		switch op {
+		case BmOpCuckooAdd:
+			err = bitmaps.CuckooAdd(name, items[0], false)
+		case BmOpCuckooAddNX:
+			_, err = bitmaps.CuckooAddNX(name, items[0], false)
+		default:
+			_, err = bitmaps.CuckooDelete(name, items[0], false)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to write filter %s: %v", name, err)
+	}
+}
+
+func (s *RaftServer) applyCheckpoint(data []byte) {
+	if len(data) != checkpointLen {
+		log.Printf("wrong checkpoint: %x", data)
+		return
+	}
+	id := binary.LittleEndian.Uint64(data)
+	prevID := binary.LittleEndian.Uint64(data[8:])
+	prevHash := binary.LittleEndian.Uint64(data[16:])
+
+	if !s.checkpoints.Record(id, s.bmServer.namespaces.Hash(), prevID, prevHash) {
+		log.Printf("ALERT: state of this replica diverged at checkpoint %x", prevID)
+	}
+}
+
+// Hash returns the state hash of bitmaps and the result of checkpoints.
+func (s *RaftServer) Hash() (*HashInfo, error) {
+	info := &HashInfo{Hash: s.bmServer.namespaces.Hash()}
+	s.checkpoints.Info(info)
+	return info, nil
+}
+
+// CheckHashes proposes a checkpoint every interval while this node is the
+// leader until ctx is done, so replicas compare their state hashes.
+func (s *RaftServer) CheckHashes(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if !s.IsLeader() {
+			continue
+		}
+
+		var id uint64
+		for id == 0 {
+			id = rand.Uint64()
+		}
+		prevID, prevHash := s.checkpoints.Last()
+		if err := s.propose(operation{OP: BmOpCheckpoint, Config: encodeCheckpoint(id, prevID, prevHash)}); err != nil {
+			log.Printf("failed to propose checkpoint: %v", err)
+		}
 	}
 }
 
-func (s *RaftServer) GetSnapshot() ([]byte, error) {
-	var buf bytes.Buffer
-	err := s.bmServer.bitmaps.Save(&buf)
-	return buf.Bytes(), err
+// GetSnapshot takes a point-in-time snapshot of bitmaps of all namespaces,
+// which is written to the snapshot file by the raft node.
+func (s *RaftServer) GetSnapshot() (io.WriterTo, error) {
+	return s.bmServer.namespaces.Snapshot(), nil
 }
 
-func (s *RaftServer) recoverFromSnapshot(snapshot []byte) error {
-	var buf = bytes.NewBuffer(snapshot)
-	return s.bmServer.bitmaps.Read(buf)
+func (s *RaftServer) loadSnapshot() error {
+	snapshot, err := s.snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
+	return s.recoverFromSnapshot(snapshot)
+}
+
+// recoverFromSnapshot streams bitmaps from the snapshot file. Snapshots taken
+// by older versions carry bitmaps in their data instead of a file.
+func (s *RaftServer) recoverFromSnapshot(snapshot *raftpb.Snapshot) error {
+	path, err := s.snapshotter.DBFilePath(snapshot.Metadata.Index)
+	if err == snap.ErrNoDBSnapshot {
+		return s.bmServer.namespaces.Restore(bytes.NewReader(snapshot.Data))
+	}
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return s.bmServer.namespaces.Restore(bufio.NewReader(file))
 }
 
 func (s *RaftServer) AddNode(id uint64, addr []byte) error {
@@ -132,3 +452,64 @@ func (s *RaftServer) RemoveNode(id uint64) error {
 	s.confChangeC <- cc
 	return nil
 }
+
+func (s *RaftServer) AddLearner(id uint64, addr []byte) error {
+	cc := raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddLearnerNode,
+		NodeID:  id,
+		Context: addr,
+	}
+	s.confChangeC <- cc
+	return nil
+}
+
+// PromoteLearner promotes a learner by adding it again as a voter,
+// its address is already known by the transport.
+func (s *RaftServer) PromoteLearner(id uint64) error {
+	cc := raftpb.ConfChange{
+		Type:   raftpb.ConfChangeAddNode,
+		NodeID: id,
+	}
+	s.confChangeC <- cc
+	return nil
+}
+
+// ClusterInfo returns the status of the raft cluster.
+func (s *RaftServer) ClusterInfo() (*ClusterInfo, error) {
+	return s.node.ClusterInfo()
+}
+
+// TransferLeadership transfers the leadership to target.
+// If target is 0 the most up-to-date voter is chosen.
+func (s *RaftServer) TransferLeadership(ctx context.Context, target uint64) error {
+	return s.node.TransferLeadership(ctx, target)
+}
+
+// Drain prepares this node to be stopped: it rejects new writes, waits for
+// in-flight proposals to be applied and transfers the leadership if this
+// node is the leader. The node keeps rejecting writes after Drain.
+func (s *RaftServer) Drain(ctx context.Context) error {
+	select {
+	case <-s.proposals.Drain():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := s.node.WaitApplied(ctx); err != nil {
+		return err
+	}
+
+	info, err := s.node.ClusterInfo()
+	if err != nil {
+		return err
+	}
+	if info.LeaderID != info.ID {
+		return nil
+	}
+
+	err = s.node.TransferLeadership(ctx, 0)
+	if err == ErrNoTransferee {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package basalt
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestReplicas returns raft servers of n replicas sharing a log, proposals
+// of any replica are committed to all of them in order. The first one is the
+// leader. Close the returned channel to stop them.
+func newTestReplicas(n int) ([]*RaftServer, chan<- string) {
+	proposeC := make(chan string)
+	errorC := make(chan error)
+	close(errorC)
+
+	var replicas []*RaftServer
+	var commitCs []chan *string
+	for i := 0; i < n; i++ {
+		s := &RaftServer{proposeC: proposeC, bmServer: NewServer("", NewBitmaps(), nil, "")}
+		s.bmServer.namespaces.setWriteCallback(s.propose)
+		commitC := make(chan *string, 16)
+		go s.readCommits(commitC, errorC, false)
+
+		replicas = append(replicas, s)
+		commitCs = append(commitCs, commitC)
+	}
+
+	go func() {
+		for data := range proposeC {
+			data := data
+			for _, commitC := range commitCs {
+				commitC <- &data
+			}
+		}
+		for _, commitC := range commitCs {
+			close(commitC)
+		}
+	}()
+	return replicas, proposeC
+}
+
+// waitFor waits until cond is true or a second passes.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestRaftServer_DrainStalled(t *testing.T) {
+	proposeC := make(chan string)
+	s := &RaftServer{proposeC: proposeC}
+
+	// the raft loop is stalled, so the proposal blocks.
+	proposed := make(chan error)
+	go func() { proposed <- s.Propose(BmOpAdd, "test", []uint32{1}) }()
+	for {
+		s.proposals.mu.Lock()
+		n := s.proposals.n
+		s.proposals.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect the deadline is exceeded but got %v", err)
+	}
+	if err := s.Propose(BmOpAdd, "test", []uint32{2}); err != ErrDraining {
+		t.Fatalf("expect ErrDraining but got %v", err)
+	}
+
+	<-proposeC
+	if err := <-proposed; err != nil {
+		t.Fatalf("failed to propose: %v", err)
+	}
+	select {
+	case <-s.proposals.Drain():
+	default:
+		t.Fatal("expect no proposals in flight")
+	}
+}
+
+func TestRaftServer_Checkpoint(t *testing.T) {
+	s := &RaftServer{bmServer: NewServer("", NewBitmaps(), nil, "")}
+
+	data, err := encodeOperation(operation{OP: BmOpCheckpoint, Config: encodeCheckpoint(1, 0, 0)})
+	if err != nil {
+		t.Fatalf("failed to encode checkpoint: %v", err)
+	}
+	op, err := decodeOperation(data)
+	if err != nil {
+		t.Fatalf("failed to decode checkpoint: %v", err)
+	}
+	s.processOP(op)
+	if id, _ := s.checkpoints.Last(); id != 1 {
+		t.Errorf("expect checkpoint 1 but got %d", id)
+	}
+
+	// checkpoints of older versions carry the payload in the name.
+	_, hash := s.checkpoints.Last()
+	s.processOP(operation{OP: BmOpCheckpoint, Name: string(encodeCheckpoint(2, 1, hash))})
+	if id, _ := s.checkpoints.Last(); id != 2 {
+		t.Errorf("expect checkpoint 2 but got %d", id)
+	}
+}
+
+func TestRaftServer_QueryStore(t *testing.T) {
+	replicas, proposeC := newTestReplicas(2)
+	defer close(proposeC)
+	leader := replicas[0].bmServer.namespaces.Default()
+	follower := replicas[1].bmServer.namespaces.Default()
+
+	leader.AddMany("a", []uint32{1, 2, 3}, true)
+	leader.AddMany("b", []uint32{2, 3, 4}, true)
+	if !waitFor(func() bool { return follower.Card("b") == 3 }) {
+		t.Fatal("expect writes to be applied on the follower")
+	}
+
+	n, err := leader.QueryStore("dst", "a AND b", "", true)
+	if err != nil || n != 2 {
+		t.Fatalf("expect 2 elements stored but got %d, %v", n, err)
+	}
+	if !waitFor(func() bool { return follower.Card("dst") == 2 }) {
+		t.Fatalf("expect the destination on the follower but got %v", follower.Inter("dst"))
+	}
+	if !waitFor(func() bool { return leader.Hash() == follower.Hash() }) {
+		t.Errorf("expect the same state hash on replicas")
+	}
+}
+
+func TestRaftServer_Store(t *testing.T) {
+	replicas, proposeC := newTestReplicas(2)
+	defer close(proposeC)
+	leader := replicas[0].bmServer.namespaces.Default()
+	follower := replicas[1].bmServer.namespaces.Default()
+
+	leader.AddMany("a", []uint32{1, 2, 3}, true)
+	leader.AddMany("b", []uint32{2, 3, 4}, true)
+	if !waitFor(func() bool { return follower.Card("b") == 3 }) {
+		t.Fatal("expect writes to be applied on the follower")
+	}
+
+	if n, err := leader.XorStore("dst", []string{"a", "b"}, true); err != nil || n != 2 {
+		t.Fatalf("expect 2 elements stored but got %d, %v", n, err)
+	}
+	if !waitFor(func() bool { return follower.Card("dst") == 2 }) {
+		t.Fatalf("expect the destination on the follower but got %v", follower.Inter("dst"))
+	}
+	if !waitFor(func() bool { return leader.Hash() == follower.Hash() }) {
+		t.Errorf("expect the same state hash on replicas")
+	}
+}
+
+func TestRaftServer_ApplyColdBitmapUnavailable(t *testing.T) {
+	defer func(interval time.Duration) { applyRetryInterval = interval }(applyRetryInterval)
+	applyRetryInterval = 10 * time.Millisecond
+
+	bms, _ := newColdBitmaps(t, 0)
+	s := &RaftServer{bmServer: NewServer("", bms, nil, "")}
+	bms.AddMany("test", []uint32{1, 2, 3}, false)
+	if n := bms.SpillColdBitmaps(); n != 1 {
+		t.Fatalf("expect 1 spilled bitmap but got %d", n)
+	}
+
+	// the committed write is applied once the file can be read again.
+	file := bms.get("test").file
+	if err := os.Rename(file, file+".moved"); err != nil {
+		t.Fatalf("failed to move the file: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.processOP(operation{OP: BmOpAdd, Name: "test", Values: []uint32{4}})
+		close(done)
+	}()
+	time.Sleep(5 * applyRetryInterval)
+	if err := os.Rename(file+".moved", file); err != nil {
+		t.Fatalf("failed to move the file back: %v", err)
+	}
+	<-done
+	if n := bms.Card("test"); n != 4 {
+		t.Fatalf("expect 4 values but got %d", n)
+	}
+}
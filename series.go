@@ -0,0 +1,591 @@
+package basalt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/smallnest/log"
+)
+
+// A series keeps members active at some time in buckets of a granularity,
+// like DAU bitmaps of days. Buckets are ordinary bitmaps named by the series
+// and the UTC time span they cover, such as active:2026-10-17 or
+// active:2026-W42, so they can be used in set operations and take part in
+// eviction, TTLs, spilling and replication like other bitmaps.
+//
+// The retention of a series is the number of buckets kept at its granularity
+// and each coarser one up to month. A bucket of the finest granularity older
+// than its retention is rolled up, which merges it into the buckets of the
+// coarser granularities containing it and removes it, and a coarser bucket
+// older than its retention is removed. Queries of times whose buckets are
+// rolled up use the coarser buckets, so their windows are widened to them.
+
+// seriesRecord is set in the length of name of a series record, which is
+// followed by the config of the series instead of a bitmap.
+const seriesRecord = 1 << 28
+
+// seriesHashPrefix separates names of series from names of bitmaps in the state hash.
+const seriesHashPrefix = "\x00series\x00"
+
+// Granularity is the time span of buckets of a series.
+type Granularity byte
+
+const (
+	// Hour buckets are named like 2026-10-17T08.
+	Hour Granularity = iota + 1
+	// Day buckets are named like 2026-10-17.
+	Day
+	// Week buckets are ISO weeks starting on Monday, named like 2026-W42.
+	Week
+	// Month buckets are named like 2026-10.
+	Month
+)
+
+var granularityNames = []string{Hour: "hour", Day: "day", Week: "week", Month: "month"}
+
+var (
+	// ErrInvalidSeries is returned for invalid configs of series.
+	ErrInvalidSeries = errors.New("invalid series config")
+	// ErrSeriesNotFound is returned if a series doesn't exist.
+	ErrSeriesNotFound = errors.New("series not found")
+	// ErrInvalidPeriods is returned if the number of periods of a retention
+	// matrix is not positive or exceeds maxRetentionPeriods.
+	ErrInvalidPeriods = errors.New("invalid number of periods")
+)
+
+// maxRetentionPeriods limits the size of a retention matrix.
+const maxRetentionPeriods = 400
+
+// ParseGranularity parses the name of a granularity like day or WEEK.
+func ParseGranularity(s string) (Granularity, error) {
+	s = strings.ToLower(s)
+	for g := Hour; g <= Month; g++ {
+		if granularityNames[g] == s {
+			return g, nil
+		}
+	}
+	return 0, ErrInvalidSeries
+}
+
+func (g Granularity) String() string {
+	if g < Hour || g > Month {
+		return strconv.Itoa(int(g))
+	}
+	return granularityNames[g]
+}
+
+// start returns the start of the bucket containing t.
+func (g Granularity) start(t time.Time) time.Time {
+	t = t.UTC()
+	switch g {
+	case Hour:
+		return t.Truncate(time.Hour)
+	case Week:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// add returns the start of the n-th bucket after the one starting at t.
+func (g Granularity) add(t time.Time, n int) time.Time {
+	switch g {
+	case Hour:
+		return t.Add(time.Duration(n) * time.Hour)
+	case Week:
+		return t.AddDate(0, 0, 7*n)
+	case Month:
+		return t.AddDate(0, n, 0)
+	}
+	return t.AddDate(0, 0, n)
+}
+
+// key returns the name of the bucket containing t in its series.
+func (g Granularity) key(t time.Time) string {
+	t = t.UTC()
+	switch g {
+	case Hour:
+		return t.Format("2006-01-02T15")
+	case Week:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	case Month:
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// parseBucketKey returns the granularity and the start of the bucket named key.
+func parseBucketKey(key string) (Granularity, time.Time, bool) {
+	if i := strings.Index(key, "-W"); i == 4 && len(key) == 8 {
+		year, err1 := strconv.Atoi(key[:4])
+		week, err2 := strconv.Atoi(key[6:])
+		if err1 != nil || err2 != nil || week < 1 || week > 53 {
+			return 0, time.Time{}, false
+		}
+		// January 4th is always in the first ISO week.
+		start := Week.start(time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)).AddDate(0, 0, 7*(week-1))
+		return Week, start, Week.key(start) == key
+	}
+
+	for _, g := range []Granularity{Hour, Day, Month} {
+		if t, err := time.Parse(g.layout(), key); err == nil {
+			return g, t, true
+		}
+	}
+	return 0, time.Time{}, false
+}
+
+func (g Granularity) layout() string {
+	switch g {
+	case Hour:
+		return "2006-01-02T15"
+	case Month:
+		return "2006-01"
+	}
+	return "2006-01-02"
+}
+
+// bucketName returns the name of the bucket of the series containing t.
+func bucketName(series string, g Granularity, t time.Time) string {
+	return series + ":" + g.key(t)
+}
+
+// splitBucketName returns the series, the granularity and the start of the
+// bucket, it returns false if name isn't a bucket.
+func splitBucketName(name string) (string, Granularity, time.Time, bool) {
+	i := strings.LastIndexByte(name, ':')
+	if i <= 0 {
+		return "", 0, time.Time{}, false
+	}
+	g, start, ok := parseBucketKey(name[i+1:])
+	return name[:i], g, start, ok
+}
+
+// ParseTime parses a time of a series, which is unix seconds, a date like
+// 2026-10-17 or a RFC3339 time.
+func ParseTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// SeriesConfig is the config of a series.
+type SeriesConfig struct {
+	// Granularity is the granularity of buckets members are added to.
+	Granularity Granularity
+	// Retention is the number of buckets kept at Granularity and each coarser
+	// granularity, the last one may be 0 which keeps buckets forever. Buckets
+	// are kept forever if it's empty.
+	Retention []int
+}
+
+// levels returns the number of granularities with buckets of the series.
+func (c SeriesConfig) levels() int {
+	if len(c.Retention) == 0 {
+		return 1
+	}
+	return len(c.Retention)
+}
+
+func (c SeriesConfig) validate() error {
+	if c.Granularity < Hour || c.Granularity > Month || len(c.Retention) > int(Month-c.Granularity)+1 {
+		return ErrInvalidSeries
+	}
+	for i, n := range c.Retention {
+		if n < 0 || n > 1<<20 || n == 0 && i != len(c.Retention)-1 {
+			return ErrInvalidSeries
+		}
+	}
+	return nil
+}
+
+// retained returns whether the bucket of the level starting at start is
+// within the retention at now.
+func (c SeriesConfig) retained(level int, start, now time.Time) bool {
+	if level >= len(c.Retention) {
+		return len(c.Retention) == 0
+	}
+	n := c.Retention[level]
+	if n == 0 {
+		return true
+	}
+	g := c.Granularity + Granularity(level)
+	return !start.Before(g.add(g.start(now), 1-n))
+}
+
+// encode encodes the config as the granularity, the number of retentions
+// and the retentions.
+func (c SeriesConfig) encode() string {
+	buf := make([]byte, 2+4*len(c.Retention))
+	buf[0], buf[1] = byte(c.Granularity), byte(len(c.Retention))
+	for i, n := range c.Retention {
+		binary.LittleEndian.PutUint32(buf[2+4*i:], uint32(n))
+	}
+	return string(buf)
+}
+
+func (c SeriesConfig) checksum() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(c.encode()))
+	return h.Sum64()
+}
+
+// readSeriesConfig reads an encoded config from r.
+func readSeriesConfig(r io.Reader) (SeriesConfig, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return SeriesConfig{}, err
+	}
+	c := SeriesConfig{Granularity: Granularity(head[0])}
+	if head[1] > 0 {
+		buf := make([]byte, 4*int(head[1]))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return SeriesConfig{}, err
+		}
+		for i := 0; i < len(buf); i += 4 {
+			c.Retention = append(c.Retention, int(binary.LittleEndian.Uint32(buf[i:])))
+		}
+	}
+	return c, c.validate()
+}
+
+// decodeSeriesConfig decodes the config of a raft log entry.
+func decodeSeriesConfig(data []byte) (SeriesConfig, error) {
+	r := bytes.NewReader(data)
+	c, err := readSeriesConfig(r)
+	if err != nil || r.Len() != 0 {
+		return SeriesConfig{}, ErrInvalidEntry
+	}
+	return c, nil
+}
+
+// seriesConfig returns the config of the series.
+func (bs *Bitmaps) seriesConfig(name string) (SeriesConfig, bool) {
+	bs.seriesMu.RLock()
+	defer bs.seriesMu.RUnlock()
+	c, ok := bs.series[name]
+	return c, ok
+}
+
+// setSeries sets the config of the series and updates the state hash.
+func (bs *Bitmaps) setSeries(name string, c SeriesConfig) {
+	bs.seriesMu.Lock()
+	if old, ok := bs.series[name]; ok {
+		atomic.AddUint64(&bs.hash, -StateHashOf(seriesHashPrefix+name, old.checksum()))
+	}
+	bs.series[name] = c
+	atomic.AddUint64(&bs.hash, StateHashOf(seriesHashPrefix+name, c.checksum()))
+	bs.seriesMu.Unlock()
+}
+
+// CreateSeries creates the series or changes its config. Buckets which
+// don't fit the new config are rolled up or removed by the next rollup.
+func (bs *Bitmaps) CreateSeries(name string, c SeriesConfig, callback bool) error {
+	if name == "" || strings.HasPrefix(name, "\x00") {
+		return ErrInvalidSeries
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpCreateSeries, Name: name, Config: []byte(c.encode())})
+	}
+
+	bs.setSeries(name, c)
+	return nil
+}
+
+// DropSeries removes the series and all its buckets.
+func (bs *Bitmaps) DropSeries(name string, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpDropSeries, Name: name})
+	}
+
+	bs.seriesMu.Lock()
+	c, ok := bs.series[name]
+	if ok {
+		delete(bs.series, name)
+		atomic.AddUint64(&bs.hash, -StateHashOf(seriesHashPrefix+name, c.checksum()))
+	}
+	bs.seriesMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		shard.mu.Lock()
+		for bucket, bm := range shard.bitmaps {
+			if series, g, _, ok := splitBucketName(bucket); ok && series == name && g >= c.Granularity {
+				bs.drop(bucket, bm)
+				delete(shard.bitmaps, bucket)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// SeriesConfigOf returns the config of the series, it returns false if the
+// series doesn't exist.
+func (bs *Bitmaps) SeriesConfigOf(name string) (SeriesConfig, bool) {
+	c, ok := bs.seriesConfig(name)
+	c.Retention = append([]int(nil), c.Retention...)
+	return c, ok
+}
+
+// Series returns names of all series.
+func (bs *Bitmaps) Series() []string {
+	bs.seriesMu.RLock()
+	defer bs.seriesMu.RUnlock()
+
+	names := make([]string, 0, len(bs.series))
+	for name := range bs.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddAt adds the member to the bucket of the series containing t. It
+// returns ErrSeriesNotFound if the series doesn't exist, and errors like
+// Add. A member added to a bucket older than the retention is rolled up by
+// the next rollup.
+func (bs *Bitmaps) AddAt(series string, member uint32, t time.Time, callback bool) error {
+	c, ok := bs.seriesConfig(series)
+	if !ok {
+		return ErrSeriesNotFound
+	}
+	return bs.Add(bucketName(series, c.Granularity, t), member, callback)
+}
+
+// bucketAt returns the bucket of the series used by queries for t, which is
+// the finest bucket containing t that exists or is not rolled up yet.
+func (bs *Bitmaps) bucketAt(series string, c SeriesConfig, t, now time.Time) string {
+	var name string
+	for level := 0; level < c.levels(); level++ {
+		g := c.Granularity + Granularity(level)
+		name = bucketName(series, g, t)
+		if bs.get(name) != nil || c.retained(level, g.start(t), now) {
+			break
+		}
+	}
+	return name
+}
+
+// buckets returns buckets of the series covering times from from to to.
+func (bs *Bitmaps) buckets(series string, c SeriesConfig, from, to, now time.Time) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for t := c.Granularity.start(from); !t.After(to); t = c.Granularity.add(t, 1) {
+		name := bs.bucketAt(series, c, t, now)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// WindowBitmap returns members of the series active at some time from from
+// to to inclusive, which is the union of buckets covering the window.
+func (bs *Bitmaps) WindowBitmap(series string, from, to time.Time) *roaring.Bitmap {
+	c, ok := bs.seriesConfig(series)
+	if !ok {
+		return roaring.NewBitmap()
+	}
+	return bs.union(bs.buckets(series, c, from, to, time.Now())...)
+}
+
+// Window returns members of the series active at some time from from to to.
+func (bs *Bitmaps) Window(series string, from, to time.Time) []uint32 {
+	return bs.WindowBitmap(series, from, to).ToArray()
+}
+
+// WindowCard returns the number of members of the series active at some
+// time from from to to, like the DAU, WAU or MAU of a window.
+func (bs *Bitmaps) WindowCard(series string, from, to time.Time) uint64 {
+	return bs.WindowBitmap(series, from, to).GetCardinality()
+}
+
+// RetentionMatrix returns the retention of cohorts of periods of the
+// granularity of the cohort series starting at the period containing from.
+// The i-th row is the cohort of members of the cohort series in the i-th
+// period, and its j-th value is the number of them active in the active
+// series in the (i+j)-th period, so the first value is the size of the
+// cohort if both series are the same.
+func (bs *Bitmaps) RetentionMatrix(cohort, active string, from time.Time, periods int) ([][]uint64, error) {
+	if periods <= 0 || periods > maxRetentionPeriods {
+		return nil, ErrInvalidPeriods
+	}
+	c, ok := bs.seriesConfig(cohort)
+	if !ok {
+		return nil, ErrSeriesNotFound
+	}
+	if _, ok := bs.seriesConfig(active); !ok {
+		return nil, ErrSeriesNotFound
+	}
+
+	g := c.Granularity
+	start := g.start(from)
+	actives := make([]*roaring.Bitmap, periods)
+	for i := range actives {
+		actives[i] = bs.WindowBitmap(active, g.add(start, i), g.add(start, i+1).Add(-time.Nanosecond))
+	}
+
+	matrix := make([][]uint64, periods)
+	for i := range matrix {
+		members := bs.WindowBitmap(cohort, g.add(start, i), g.add(start, i+1).Add(-time.Nanosecond))
+		matrix[i] = make([]uint64, periods-i)
+		for j := range matrix[i] {
+			matrix[i][j] = members.AndCardinality(actives[i+j])
+		}
+	}
+	return matrix, nil
+}
+
+// rollupBucket merges the bucket into the buckets of coarser granularities
+// of its series if it's of the finest granularity, and removes it. It's
+// conditional on the config of the series but not on time, so replicas apply
+// it alike and a rollup proposed more than once is harmless.
+func (bs *Bitmaps) rollupBucket(name string, callback bool) error {
+	if bs.writeCallback != nil && callback {
+		return bs.writeCallback(operation{OP: BmOpRollupBucket, Name: name})
+	}
+
+	series, g, start, ok := splitBucketName(name)
+	if !ok {
+		return nil
+	}
+	c, ok := bs.seriesConfig(series)
+	if !ok || g < c.Granularity {
+		return nil
+	}
+
+	shard := bs.shard(name)
+	shard.mu.RLock()
+	bm := shard.bitmaps[name]
+	shard.mu.RUnlock()
+	if bm == nil {
+		return nil
+	}
+	if err := bs.lockBitmap(bm); err != nil {
+		return err
+	}
+	values := bm.bitmap.ToArray()
+	bm.mu.Unlock()
+
+	// the bucket is dropped after it's merged, so a rollup which fails to
+	// load a coarser bucket can be retried.
+	if g == c.Granularity {
+		for level := 1; level < c.levels() && len(values) > 0; level++ {
+			if err := bs.AddMany(bucketName(series, c.Granularity+Granularity(level), start), values, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	shard.mu.Lock()
+	if shard.bitmaps[name] == bm {
+		bs.drop(name, bm)
+		delete(shard.bitmaps, name)
+	}
+	shard.mu.Unlock()
+	return nil
+}
+
+// RollupSeries rolls up or removes buckets of all series older than their
+// retention at now and returns the number of them. In cluster mode the
+// rollups are proposed to raft by the leader only, followers roll up nothing.
+func (bs *Bitmaps) RollupSeries(now time.Time) int {
+	if bs.writeCallback != nil && bs.isLeader != nil && !bs.isLeader() {
+		return 0
+	}
+
+	bs.seriesMu.RLock()
+	configs := make(map[string]SeriesConfig, len(bs.series))
+	for name, c := range bs.series {
+		configs[name] = c
+	}
+	bs.seriesMu.RUnlock()
+	if len(configs) == 0 {
+		return 0
+	}
+
+	var names []string
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		shard.mu.RLock()
+		for name := range shard.bitmaps {
+			series, g, start, ok := splitBucketName(name)
+			if !ok {
+				continue
+			}
+			c, ok := configs[series]
+			if ok && g >= c.Granularity && !c.retained(int(g-c.Granularity), start, now) {
+				names = append(names, name)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	// finer buckets are rolled up before the coarser ones they are merged into
+	sort.Slice(names, func(i, j int) bool {
+		_, gi, _, _ := splitBucketName(names[i])
+		_, gj, _, _ := splitBucketName(names[j])
+		return gi < gj
+	})
+	for _, name := range names {
+		if err := bs.rollupBucket(name, true); err != nil {
+			log.Errorf("failed to roll up bucket %s: %v", name, err)
+		}
+	}
+	return len(names)
+}
+
+// RollupSeries rolls up buckets of series of all namespaces every interval
+// until ctx is done. It can run on every node of a cluster, only the leader
+// proposes rollups, so buckets aren't rolled up once by every node.
+func (n *Namespaces) RollupSeries(ctx context.Context, interval time.Duration) {
+	n.every(ctx, interval, func(bs *Bitmaps) { bs.RollupSeries(time.Now()) })
+}
+
+// snapshotSeries adds configs of all series to the snapshot.
+func (bs *Bitmaps) snapshotSeries(snapshot *BitmapsSnapshot) {
+	bs.seriesMu.RLock()
+	defer bs.seriesMu.RUnlock()
+
+	for name, c := range bs.series {
+		snapshot.seriesNames = append(snapshot.seriesNames, name)
+		snapshot.series = append(snapshot.series, c)
+	}
+}
+
+func writeSeries(w io.Writer, name string, c SeriesConfig) (int64, error) {
+	buf := make([]byte, 4+len(name))
+	binary.LittleEndian.PutUint32(buf, uint32(len(name))|seriesRecord)
+	copy(buf[4:], name)
+	n, err := w.Write(append(buf, c.encode()...))
+	if err != nil {
+		log.Errorf("failed to write series %s: %v", name, err)
+	}
+	return int64(n), err
+}
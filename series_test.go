@@ -0,0 +1,263 @@
+package basalt
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGranularity_Buckets(t *testing.T) {
+	ts := time.Date(2027, 1, 2, 15, 4, 5, 0, time.UTC) // Saturday of the 53rd week of 2026
+	cases := []struct {
+		g     Granularity
+		key   string
+		start time.Time
+	}{
+		{Hour, "2027-01-02T15", time.Date(2027, 1, 2, 15, 0, 0, 0, time.UTC)},
+		{Day, "2027-01-02", time.Date(2027, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{Week, "2026-W53", time.Date(2026, 12, 28, 0, 0, 0, 0, time.UTC)},
+		{Month, "2027-01", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		if key := c.g.key(ts); key != c.key {
+			t.Fatalf("expect key %s of %s but got %s", c.key, c.g, key)
+		}
+		if start := c.g.start(ts); !start.Equal(c.start) {
+			t.Fatalf("expect start %v of %s but got %v", c.start, c.g, start)
+		}
+		series, g, start, ok := splitBucketName(bucketName("a:b", c.g, ts))
+		if !ok || series != "a:b" || g != c.g || !start.Equal(c.start) {
+			t.Fatalf("unexpected bucket %s %s %v of %s", series, g, start, c.key)
+		}
+	}
+
+	for _, name := range []string{"test", "test:1", "test:2026-W54", "test:2026-13"} {
+		if _, _, _, ok := splitBucketName(name); ok {
+			t.Fatalf("expect %s is not a bucket", name)
+		}
+	}
+}
+
+func TestBitmaps_SeriesWindow(t *testing.T) {
+	bms := NewBitmaps()
+	day := time.Date(2026, 10, 12, 8, 0, 0, 0, time.UTC) // Monday
+	if err := bms.AddAt("active", 1, day, false); err != ErrSeriesNotFound {
+		t.Fatalf("expect ErrSeriesNotFound but got %v", err)
+	}
+	if err := bms.CreateSeries("active", SeriesConfig{Granularity: Day, Retention: []int{0, 3}}, false); err != ErrInvalidSeries {
+		t.Fatalf("expect ErrInvalidSeries but got %v", err)
+	}
+	if err := bms.CreateSeries("active", SeriesConfig{Granularity: Day}, false); err != nil {
+		t.Fatalf("failed to create series: %v", err)
+	}
+
+	for i := 0; i < 7; i++ {
+		bms.AddAt("active", uint32(i), day.AddDate(0, 0, i), false)
+		bms.AddAt("active", 100, day.AddDate(0, 0, i), false)
+	}
+	if !reflect.DeepEqual(bms.Inter("active:2026-10-14"), []uint32{2, 100}) {
+		t.Fatalf("unexpected bucket %v", bms.Inter("active:2026-10-14"))
+	}
+	if n := bms.WindowCard("active", day, day); n != 2 {
+		t.Fatalf("expect 2 members on a day but got %d", n)
+	}
+	if got := bms.Window("active", day.AddDate(0, 0, 1), day.AddDate(0, 0, 3)); !reflect.DeepEqual(got, []uint32{1, 2, 3, 100}) {
+		t.Fatalf("unexpected window %v", got)
+	}
+	if n := bms.WindowCard("active", day, day.AddDate(0, 0, 30)); n != 8 {
+		t.Fatalf("expect 8 members in a month but got %d", n)
+	}
+	if n := bms.WindowCard("nonexistent", day, day); n != 0 {
+		t.Fatalf("expect no members of a nonexistent series but got %d", n)
+	}
+
+	bms.AddMany("other", []uint32{1}, false)
+	bms.DropSeries("active", false)
+	if !reflect.DeepEqual(bms.Names(), []string{"other"}) || len(bms.Series()) != 0 {
+		t.Fatalf("expect buckets are removed with the series but got %v", bms.Names())
+	}
+}
+
+func TestBitmaps_SeriesRollup(t *testing.T) {
+	bms := NewBitmaps()
+	bms.CreateSeries("active", SeriesConfig{Granularity: Day, Retention: []int{7, 2, 0}}, false)
+	hash := bms.Hash()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC) // Monday
+	for i := 0; i < 30; i++ {
+		bms.AddAt("active", uint32(i), now.AddDate(0, 0, -i), false)
+	}
+	if n := bms.RollupSeries(now); n != 23 {
+		t.Fatalf("expect 23 buckets rolled up but got %d", n)
+	}
+	if bms.get("active:2026-10-13") == nil || bms.get("active:2026-10-12") != nil {
+		t.Fatal("expect buckets of the last 7 days are kept")
+	}
+	// days before October 12 are merged into weeks and months
+	if got := bms.Inter("active:2026-W41"); !reflect.DeepEqual(got, []uint32{8, 9, 10, 11, 12, 13, 14}) {
+		t.Fatalf("unexpected week bucket %v", got)
+	}
+	if n := bms.Card("active:2026-09"); n != 11 {
+		t.Fatalf("expect 11 members in September but got %d", n)
+	}
+
+	// weeks before the last two are removed but months are kept forever
+	if n := bms.RollupSeries(now); n != 4 || bms.get("active:2026-W41") != nil || bms.get("active:2026-W42") == nil {
+		t.Fatalf("expect 4 week buckets removed but got %d", n)
+	}
+	if bms.RollupSeries(now) != 0 {
+		t.Fatal("expect no more rollups")
+	}
+
+	window := func(from, to time.Time) uint64 {
+		var n uint64
+		for _, name := range bms.buckets("active", SeriesConfig{Granularity: Day, Retention: []int{7, 2, 0}}, from, to, now) {
+			n += bms.Card(name)
+		}
+		return n
+	}
+	if n := window(now.AddDate(0, 0, -2), now); n != 3 {
+		t.Fatalf("expect 3 members in recent days but got %d", n)
+	}
+	if n := window(now.AddDate(0, 0, -7), now.AddDate(0, 0, -7)); n != 1 {
+		t.Fatalf("expect a rolled up day is widened to its week but got %d", n)
+	}
+	if n := window(now.AddDate(0, 0, -8), now.AddDate(0, 0, -8)); n != 12 {
+		t.Fatalf("expect a day of a removed week is widened to its month but got %d", n)
+	}
+
+	bms.DropSeries("active", false)
+	bms.CreateSeries("active", SeriesConfig{Granularity: Day, Retention: []int{7, 2, 0}}, false)
+	if bms.Hash() != hash {
+		t.Fatal("expect the same state hash of the same series")
+	}
+}
+
+func TestBitmaps_SeriesRollupUnavailable(t *testing.T) {
+	bms, _ := newColdBitmaps(t, 0)
+	bms.CreateSeries("active", SeriesConfig{Granularity: Day, Retention: []int{1, 0}}, false)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	bms.AddAt("active", 1, now.AddDate(0, 0, -3), false)
+	day := bucketName("active", Day, now.AddDate(0, 0, -3))
+	week := bucketName("active", Week, now.AddDate(0, 0, -3))
+	bms.Add(week, 2, false)
+	if n := bms.SpillColdBitmaps(); n != 2 {
+		t.Fatalf("expect 2 spilled bitmaps but got %d", n)
+	}
+
+	// the week bucket can't be loaded, so the day bucket is kept for a retry.
+	file := bms.get(week).file
+	if err := os.Rename(file, file+".moved"); err != nil {
+		t.Fatalf("failed to move the file: %v", err)
+	}
+	if err := bms.rollupBucket(day, false); err != ErrColdBitmapUnavailable {
+		t.Fatalf("expect ErrColdBitmapUnavailable but got %v", err)
+	}
+	if bms.get(day) == nil {
+		t.Fatal("expect the day bucket is kept")
+	}
+
+	if err := os.Rename(file+".moved", file); err != nil {
+		t.Fatalf("failed to move the file back: %v", err)
+	}
+	if err := bms.rollupBucket(day, false); err != nil {
+		t.Fatalf("failed to roll up: %v", err)
+	}
+	if bms.get(day) != nil || bms.Card(week) != 2 {
+		t.Fatalf("expect the day bucket is merged but got %v", bms.Inter(week))
+	}
+}
+
+func TestBitmaps_SeriesRollupLeader(t *testing.T) {
+	bms := NewBitmaps()
+	bms.CreateSeries("active", SeriesConfig{Granularity: Day, Retention: []int{1, 0}}, false)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	bms.AddAt("active", 1, now.AddDate(0, 0, -3), false)
+
+	var proposed []OP
+	leader := false
+	bms.writeCallback = func(op operation) error {
+		proposed = append(proposed, op.OP)
+		return nil
+	}
+	bms.isLeader = func() bool { return leader }
+
+	// followers don't propose rollups.
+	if n := bms.RollupSeries(now); n != 0 || len(proposed) != 0 {
+		t.Fatalf("expect no rollups are proposed by a follower but got %v", proposed)
+	}
+	leader = true
+	if n := bms.RollupSeries(now); n != 1 || len(proposed) == 0 {
+		t.Fatalf("expect the rollup is proposed by the leader but got %d, %v", n, proposed)
+	}
+}
+
+func TestBitmaps_RetentionMatrix(t *testing.T) {
+	bms := NewBitmaps()
+	bms.CreateSeries("signup", SeriesConfig{Granularity: Day}, false)
+	bms.CreateSeries("active", SeriesConfig{Granularity: Hour}, false)
+
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i := uint32(0); i < 10; i++ {
+		bms.AddAt("signup", i, day, false)
+		bms.AddAt("signup", 10+i, day.AddDate(0, 0, 1), false)
+	}
+	for i := uint32(0); i < 20; i++ {
+		if i%2 == 0 {
+			bms.AddAt("active", i, day.AddDate(0, 0, 1).Add(time.Duration(i)*time.Hour), false)
+		}
+		if i%5 == 0 {
+			bms.AddAt("active", i, day.AddDate(0, 0, 2).Add(time.Hour), false)
+		}
+	}
+
+	matrix, err := bms.RetentionMatrix("signup", "active", day.Add(time.Hour), 3)
+	if err != nil {
+		t.Fatalf("failed to get retention matrix: %v", err)
+	}
+	expected := [][]uint64{{0, 5, 2}, {5, 2}, {0}}
+	if !reflect.DeepEqual(matrix, expected) {
+		t.Fatalf("expect %v but got %v", expected, matrix)
+	}
+
+	if _, err := bms.RetentionMatrix("signup", "nonexistent", day, 3); err != ErrSeriesNotFound {
+		t.Fatalf("expect ErrSeriesNotFound but got %v", err)
+	}
+	if _, err := bms.RetentionMatrix("signup", "active", day, 0); err != ErrInvalidPeriods {
+		t.Fatalf("expect ErrInvalidPeriods but got %v", err)
+	}
+}
+
+func TestBitmaps_SeriesPersistence(t *testing.T) {
+	bms := NewBitmaps()
+	bms.CreateSeries("active", SeriesConfig{Granularity: Week, Retention: []int{4, 0}}, false)
+	bms.CreateSeries("login", SeriesConfig{Granularity: Hour}, false)
+	bms.AddAt("active", 1, time.Now(), false)
+
+	var buf bytes.Buffer
+	if err := bms.Save(&buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	restored := NewBitmaps()
+	restored.CreateSeries("stale", SeriesConfig{Granularity: Day}, false)
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if restored.Hash() != bms.Hash() || !reflect.DeepEqual(restored.Series(), []string{"active", "login"}) {
+		t.Fatalf("unexpected series %v after restore", restored.Series())
+	}
+	if c, ok := restored.SeriesConfigOf("active"); !ok || !reflect.DeepEqual(c, SeriesConfig{Granularity: Week, Retention: []int{4, 0}}) {
+		t.Fatalf("unexpected config %+v", c)
+	}
+
+	read := NewBitmaps()
+	if err := read.Read(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if read.Hash() != bms.Hash() || read.WindowCard("active", time.Now(), time.Now()) != 1 {
+		t.Fatal("expect the same series after read")
+	}
+}
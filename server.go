@@ -22,7 +22,7 @@ var (
 // Server is the bitmap server that supports multiple services.
 type Server struct {
 	addr               string
-	bitmaps            *Bitmaps
+	namespaces         *Namespaces
 	ln                 net.Listener
 	confChangeCallback ConfChange
 
@@ -31,16 +31,21 @@ type Server struct {
 	persistFile string
 }
 
-// NewServer returns a server.
+// NewServer returns a server, bitmaps are the default namespace.
 func NewServer(addr string, bitmaps *Bitmaps, rpcxOptions []ConfigRpcxOption, persistFile string) *Server {
 	return &Server{
 		addr:        addr,
-		bitmaps:     bitmaps,
+		namespaces:  NewNamespaces(bitmaps),
 		rpcxOptions: rpcxOptions,
 		persistFile: persistFile,
 	}
 }
 
+// Namespaces returns bitmaps of all namespaces.
+func (s *Server) Namespaces() *Namespaces {
+	return s.namespaces
+}
+
 // SetConfChangeCallback must invoke before Serve.
 func (s *Server) SetConfChangeCallback(confChangeCallback ConfChange) {
 	s.confChangeCallback = confChangeCallback
@@ -52,6 +57,7 @@ func (s *Server) Serve() error {
 	if err != nil {
 		return err
 	}
+	s.ln = ln
 
 	return s.configListener(ln)
 }
@@ -140,7 +146,7 @@ func (s *Server) Save() error {
 	}
 
 	w := bufio.NewWriter(file)
-	err = s.bitmaps.Save(w)
+	err = s.namespaces.Save(w)
 	if err != nil {
 		file.Close()
 		return err
@@ -153,6 +159,15 @@ func (s *Server) Save() error {
 	return file.Close()
 }
 
+// Hash returns the state hash of bitmaps, and the result of comparing it
+// with other replicas in cluster mode.
+func (s *Server) Hash() (*HashInfo, error) {
+	if s.confChangeCallback == nil {
+		return &HashInfo{Hash: s.namespaces.Hash()}, nil
+	}
+	return s.confChangeCallback.Hash()
+}
+
 // Restore retores the data from file.
 func (s *Server) Restore() error {
 	if s.persistFile == "" {
@@ -165,7 +180,7 @@ func (s *Server) Restore() error {
 	}
 
 	r := bufio.NewReader(file)
-	err = s.bitmaps.Read(r)
+	err = s.namespaces.Read(r)
 	if err != nil {
 		return err
 	}
@@ -173,40 +188,47 @@ func (s *Server) Restore() error {
 	return file.Close()
 }
 
-func (s *Server) add(name, value string, callback bool) error {
+// defaultScanCount is the number of values returned by a scan without count.
+const defaultScanCount = 100
+
+func scanCount(count int) int {
+	if count <= 0 {
+		return defaultScanCount
+	}
+	return count
+}
+
+func (s *Server) add(bs *Bitmaps, name, value string, callback bool) error {
 	v, err := str2uint32(value)
 	if err != nil {
 		return err
 	}
 
-	s.bitmaps.Add(name, v, callback)
-	return nil
+	return bs.Add(name, v, callback)
 }
 
-func (s *Server) addMany(name, values string, callback bool) error {
+func (s *Server) addMany(bs *Bitmaps, name, values string, callback bool) error {
 	vs, err := str2uint32s(values)
 	if err != nil {
 		return err
 	}
 
-	s.bitmaps.AddMany(name, vs, callback)
-	return nil
+	return bs.AddMany(name, vs, callback)
 }
 
-func (s *Server) remove(name, value string, callback bool) error {
+func (s *Server) remove(bs *Bitmaps, name, value string, callback bool) error {
 	v, err := str2uint32(value)
 	if err != nil {
 		return err
 	}
 
-	s.bitmaps.Remove(name, v, callback)
-	return err
+	return bs.Remove(name, v, callback)
 }
 
-func (s *Server) drop(name string, callback bool) {
-	s.bitmaps.RemoveBitmap(name, callback)
+func (s *Server) drop(bs *Bitmaps, name string, callback bool) error {
+	return bs.RemoveBitmap(name, callback)
 }
 
-func (s *Server) clear(name string, callback bool) {
-	s.bitmaps.ClearBitmap(name, callback)
+func (s *Server) clear(bs *Bitmaps, name string, callback bool) error {
+	return bs.ClearBitmap(name, callback)
 }
@@ -1,6 +1,7 @@
 package basalt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -37,6 +39,7 @@ func (s *HTTPService) config() {
 	router.POST("/clear/:name", s.clear)
 	router.GET("/exists/:name/:value", s.exists)
 	router.GET("/card/:name", s.card)
+	router.GET("/scan/:name", s.scan)
 
 	router.GET("/inter/:names", s.inter)
 	router.GET("/interstore/:dst/:names", s.interStore)
@@ -50,60 +53,174 @@ func (s *HTTPService) config() {
 	router.GET("/diff/:name1/:name2", s.diff)
 	router.GET("/diffstore/:dst/:name1/:name2", s.diffStore)
 
+	router.GET("/intercard/:names", s.interCard)
+	router.GET("/unioncard/:names", s.unionCard)
+	router.GET("/xorcard/:name1/:name2", s.xorCard)
+	router.GET("/diffcard/:name1/:name2", s.diffCard)
+	router.GET("/jaccard/:name1/:name2", s.jaccard)
+	router.POST("/query", s.query)
+
 	router.GET("/stats/:name", s.stats)
+
+	router.POST("/setvalue/:field/:member/:value", s.setValue)
+	router.GET("/value/:field/:member", s.value)
+	router.POST("/clearvalue/:field/:member", s.clearValue)
+	router.POST("/dropfield/:field", s.dropField)
+	router.GET("/range/:field/:op/:value", s.rangeOf)
+	router.GET("/sum/:field", s.sum)
+	router.GET("/min/:field", s.min)
+	router.GET("/max/:field", s.max)
+
+	router.POST("/addkeys/:name", s.addKeys)
+	router.POST("/delkeys/:name", s.removeKeys)
+	router.GET("/existskey/:name/:key", s.existsKey)
+	router.GET("/interkeys/:names", s.interKeys)
+	router.GET("/unionkeys/:names", s.unionKeys)
+	router.GET("/keyid/:key", s.keyID)
+	router.GET("/keys/:ids", s.keys)
+
+	router.POST("/pfadd/:name", s.pfAdd)
+	router.GET("/pfcount/:names", s.pfCount)
+	router.POST("/pfmerge/:dst/:names", s.pfMerge)
+
+	router.POST("/bfreserve/:name/:rate/:capacity", s.reserveBloom)
+	router.POST("/cfreserve/:name/:capacity", s.reserveCuckoo)
+	router.POST("/bfadd/:name", s.bloomAdd)
+	router.GET("/bfexists/:name", s.bloomExists)
+	router.POST("/cfadd/:name", s.cuckooAdd)
+	router.POST("/cfaddnx/:name", s.cuckooAdd)
+	router.POST("/cfdel/:name", s.cuckooDelete)
+	router.GET("/cfexists/:name", s.cuckooExists)
+	router.GET("/cfcount/:name", s.cuckooCount)
+	router.GET("/filter/:name", s.filterInfo)
+	router.POST("/dropfilter/:name", s.dropFilter)
+
+	router.POST("/series/:series/:granularity", s.createSeries)
+	router.POST("/dropseries/:series", s.dropSeries)
+	router.POST("/tsadd/:series/:member", s.addAt)
+	router.GET("/window/:series/:from/:to", s.window)
+	router.GET("/retention/:cohort/:active/:from/:periods", s.retention)
+
+	router.GET("/namespaces", s.namespaces)
+	router.GET("/quota", s.quota)
+	router.POST("/quota/:maxmemory/:maxbitmaps", s.setQuota)
 	router.POST("/save", s.save)
+	router.GET("/hash", s.hash)
 
 	router.POST("/peers/:nodeID", s.addNode)
 	router.DELETE("/peers/:nodeID", s.removeNode)
+
+	router.GET("/cluster", s.clusterInfo)
+
+	router.POST("/leader/:nodeID", s.transferLeadership)
+	router.POST("/drain", s.drain)
+
+	router.POST("/learners/:nodeID", s.addLearner)
+	router.POST("/learners/:nodeID/promote", s.promoteLearner)
+}
+
+// bitmaps returns bitmaps of the namespace of the ns query parameter, which is
+// the default namespace if it's not set. It writes the error and returns false
+// if the namespace is invalid.
+func (s *HTTPService) bitmaps(w http.ResponseWriter, r *http.Request) (*Bitmaps, bool) {
+	bs, err := s.s.namespaces.Get(r.URL.Query().Get("ns"))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return nil, false
+	}
+	return bs, true
 }
 
 func (s *HTTPService) add(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
 	value := ps.ByName("value")
-	err := s.s.add(name, value, true)
+	err := s.s.add(bs, name, value, true)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 }
 
 func (s *HTTPService) addMany(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
 	values := ps.ByName("values")
-	err := s.s.addMany(name, values, true)
+	err := s.s.addMany(bs, name, values, true)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 }
 
 func (s *HTTPService) remove(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
 	value := ps.ByName("value")
-	err := s.s.remove(name, value, true)
+	err := s.s.remove(bs, name, value, true)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 }
 
 func (s *HTTPService) drop(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
-	s.s.drop(name, true)
+	err := s.s.drop(bs, name, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
 }
 
 func (s *HTTPService) clear(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
-	s.s.clear(name, true)
+	err := s.s.clear(bs, name, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
 }
 
 func (s *HTTPService) card(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
-	count := s.s.bitmaps.Card(name)
+	count := bs.Card(name)
 	w.Write([]byte(strconv.FormatUint(count, 10)))
 }
 
 func (s *HTTPService) exists(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
 	value := ps.ByName("value")
 	v, err := str2uint32(value)
@@ -111,79 +228,264 @@ func (s *HTTPService) exists(w http.ResponseWriter, r *http.Request, ps httprout
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
 
-	existed := s.s.bitmaps.Exists(name, v)
+	existed := bs.Exists(name, v)
 	if !existed {
 		http.Error(w, "not found", http.StatusNotFound)
 	}
 }
 
+// scan returns values of the bitmap starting from the cursor query parameter,
+// at most count of them.
+func (s *HTTPService) scan(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var cursor uint32
+	var count int
+	var err error
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if cursor, err = str2uint32(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rt := bs.Scan(ps.ByName("name"), cursor, scanCount(count))
+	w.Write([]byte(ints2str(rt)))
+}
+
 func (s *HTTPService) inter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	names := strings.Split(ps.ByName("name"), ",")
-	rt := s.s.bitmaps.Inter(names...)
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	names := strings.Split(ps.ByName("names"), ",")
+	rt := bs.Inter(names...)
 
 	w.Write([]byte(ints2str(rt)))
 }
 
 func (s *HTTPService) interStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	dst := ps.ByName("dst")
-	names := strings.Split(ps.ByName("name"), ",")
-	count := s.s.bitmaps.InterStore(dst, names...)
+	names := strings.Split(ps.ByName("names"), ",")
+	count, err := bs.InterStore(dst, names, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
 
 	w.Write([]byte(strconv.FormatUint(count, 10)))
 }
 
 func (s *HTTPService) union(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	names := strings.Split(ps.ByName("name"), ",")
-	rt := s.s.bitmaps.Union(names...)
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	names := strings.Split(ps.ByName("names"), ",")
+	rt := bs.Union(names...)
 
 	w.Write([]byte(ints2str(rt)))
 }
 
 func (s *HTTPService) unionStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	dst := ps.ByName("dst")
-	names := strings.Split(ps.ByName("name"), ",")
-	count := s.s.bitmaps.UnionStore(dst, names...)
+	names := strings.Split(ps.ByName("names"), ",")
+	count, err := bs.UnionStore(dst, names, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
 
 	w.Write([]byte(strconv.FormatUint(count, 10)))
 }
 
 func (s *HTTPService) xor(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	rt := s.s.bitmaps.Xor(name1, name2)
+	rt := bs.Xor(name1, name2)
 
 	w.Write([]byte(ints2str(rt)))
 }
 
 func (s *HTTPService) xorStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	dst := ps.ByName("dst")
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	count := s.s.bitmaps.XorStore(dst, name1, name2)
+	count, err := bs.XorStore(dst, []string{name1, name2}, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
 
 	w.Write([]byte(strconv.FormatUint(count, 10)))
 }
 
 func (s *HTTPService) diff(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	rt := s.s.bitmaps.Diff(name1, name2)
+	rt := bs.Diff(name1, name2)
 
 	w.Write([]byte(ints2str(rt)))
 }
 
 func (s *HTTPService) diffStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	dst := ps.ByName("dst")
 	name1 := ps.ByName("name1")
 	name2 := ps.ByName("name2")
-	count := s.s.bitmaps.DiffStore(dst, name1, name2)
+	count, err := bs.DiffStore(dst, []string{name1, name2}, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	w.Write([]byte(strconv.FormatUint(count, 10)))
+}
+
+func (s *HTTPService) interCard(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	names := strings.Split(ps.ByName("names"), ",")
+	count := bs.InterCard(names...)
+	w.Write([]byte(strconv.FormatUint(count, 10)))
+}
+
+func (s *HTTPService) unionCard(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	names := strings.Split(ps.ByName("names"), ",")
+	count := bs.UnionCard(names...)
+	w.Write([]byte(strconv.FormatUint(count, 10)))
+}
+
+func (s *HTTPService) xorCard(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	count := bs.XorCard(ps.ByName("name1"), ps.ByName("name2"))
+	w.Write([]byte(strconv.FormatUint(count, 10)))
+}
+
+func (s *HTTPService) diffCard(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	count := bs.DiffCard(ps.ByName("name1"), ps.ByName("name2"))
+	w.Write([]byte(strconv.FormatUint(count, 10)))
+}
+
+func (s *HTTPService) jaccard(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	j := bs.Jaccard(ps.ByName("name1"), ps.ByName("name2"))
+	w.Write([]byte(strconv.FormatFloat(j, 'f', -1, 64)))
+}
+
+// queryRequest is the body of /query, see BitmapQueryRequest.
+type queryRequest struct {
+	Expr        string `json:"expr"`
+	Universe    string `json:"universe"`
+	Count       bool   `json:"count"`
+	Destination string `json:"destination"`
+}
+
+func (s *HTTPService) query(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var req queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Destination == "" && !req.Count {
+		rt, err := bs.Query(req.Expr, req.Universe)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		w.Write([]byte(ints2str(rt)))
+		return
+	}
 
+	var count uint64
+	var err error
+	if req.Destination != "" {
+		count, err = bs.QueryStore(req.Destination, req.Expr, req.Universe, true)
+	} else {
+		count, err = bs.QueryCard(req.Expr, req.Universe)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
 	w.Write([]byte(strconv.FormatUint(count, 10)))
 }
 
 func (s *HTTPService) stats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
 	name := ps.ByName("name")
-	stats := s.s.bitmaps.Stats(name)
+	stats := bs.Stats(name)
 	w.Header().Set("Content-Type", "application/json")
 	data, err := json.Marshal(stats)
 	if err != nil {
@@ -192,50 +494,867 @@ func (s *HTTPService) stats(w http.ResponseWriter, r *http.Request, ps httproute
 	w.Write(data)
 }
 
-func (s *HTTPService) save(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	err := s.s.Save()
+func (s *HTTPService) setValue(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	member, err := str2uint32(ps.ByName("member"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, err := strconv.ParseInt(ps.ByName("value"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bs.SetValue(ps.ByName("field"), member, value, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
 	}
 }
 
-func (s *HTTPService) addNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	nodeID := ps.ByName("nodeID")
-	url, err := ioutil.ReadAll(r.Body)
+// value returns the value of the member, or 404 if it has none.
+func (s *HTTPService) value(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	member, err := str2uint32(ps.ByName("member"))
 	if err != nil {
-		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	id, err := strconv.ParseUint(nodeID, 0, 64)
+	value, ok := bs.Value(ps.ByName("field"), member)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(strconv.FormatInt(value, 10)))
+}
+
+func (s *HTTPService) clearValue(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	member, err := str2uint32(ps.ByName("member"))
 	if err != nil {
-		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := bs.ClearValue(ps.ByName("field"), member, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
 
-	if s.confChangeCallback != nil {
-		err = s.confChangeCallback.AddNode(id, url)
-		if err != nil {
-			http.Error(w, "failed to add node: "+err.Error(), http.StatusInternalServerError)
+func (s *HTTPService) dropField(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	if err := bs.DropField(ps.ByName("field"), true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// rangeOf returns members of the field whose value matches the comparison,
+// with the end query parameter for between, the filter query parameter for
+// the filter bitmap, and only the number of them if count=true.
+func (s *HTTPService) rangeOf(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	op, err := ParseRangeOp(ps.ByName("op"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, err := strconv.ParseInt(ps.ByName("value"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var end int64
+	if op == RangeBetween {
+		if end, err = strconv.ParseInt(r.URL.Query().Get("end"), 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
+
+	bm := bs.RangeBitmap(ps.ByName("field"), op, value, end, r.URL.Query().Get("filter"))
+	if r.URL.Query().Get("count") == "true" {
+		w.Write([]byte(strconv.FormatUint(bm.GetCardinality(), 10)))
+		return
+	}
+	w.Write([]byte(ints2str(bm.ToArray())))
 }
 
-func (s *HTTPService) removeNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	nodeID := ps.ByName("nodeID")
-	id, err := strconv.ParseUint(nodeID, 0, 64)
+// sum returns the sum of values of the field and the number of them in json.
+func (s *HTTPService) sum(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var result FieldSumResult
+	result.Sum, result.Count = bs.Sum(ps.ByName("field"), r.URL.Query().Get("filter"))
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(result)
 	if err != nil {
-		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	w.Write(data)
+}
 
-	if s.confChangeCallback != nil {
-		err = s.confChangeCallback.RemoveNode(id)
-		if err != nil {
-			http.Error(w, "failed to remove node: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+func (s *HTTPService) min(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.extreme(w, r, ps, false)
+}
+
+func (s *HTTPService) max(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.extreme(w, r, ps, true)
+}
+
+// extreme returns the min or max value of the field, or 404 if it has no
+// values in the filter bitmap.
+func (s *HTTPService) extreme(w http.ResponseWriter, r *http.Request, ps httprouter.Params, max bool) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var value int64
+	field, filter := ps.ByName("field"), r.URL.Query().Get("filter")
+	if max {
+		value, ok = bs.Max(field, filter)
+	} else {
+		value, ok = bs.Min(field, filter)
+	}
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(strconv.FormatInt(value, 10)))
+}
+
+// addKeys adds string keys in the json array of the body to the bitmap.
+func (s *HTTPService) addKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil || len(keys) == 0 {
+		http.Error(w, "invalid request: a json array of keys is expected", http.StatusBadRequest)
+		return
+	}
+	if err := bs.AddKeys(ps.ByName("name"), keys, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// removeKeys removes string keys in the json array of the body from the bitmap.
+func (s *HTTPService) removeKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, "invalid request: a json array of keys is expected", http.StatusBadRequest)
+		return
+	}
+	if err := bs.RemoveKeys(ps.ByName("name"), keys, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+func (s *HTTPService) existsKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	w.Write([]byte(strconv.FormatBool(bs.ExistsKey(ps.ByName("name"), ps.ByName("key")))))
+}
+
+func (s *HTTPService) interKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
 	}
+
+	writeJSONKeys(w, bs.InterKeys(strings.Split(ps.ByName("names"), ",")...))
+}
+
+func (s *HTTPService) unionKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSONKeys(w, bs.UnionKeys(strings.Split(ps.ByName("names"), ",")...))
+}
+
+// keyID returns the id of the key, or 404 if it's not assigned.
+func (s *HTTPService) keyID(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	id, ok := bs.KeyID(ps.ByName("key"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(strconv.FormatUint(uint64(id), 10)))
+}
+
+// keys returns keys of the ids separated by commas.
+func (s *HTTPService) keys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	ids, err := str2uint32s(ps.ByName("ids"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSONKeys(w, bs.Keys(ids))
+}
+
+// writeJSONKeys writes keys as a json array, since keys may contain commas.
+func writeJSONKeys(w http.ResponseWriter, keys []string) {
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// pfAdd adds elements in the json array of the body to the HyperLogLog and
+// returns whether it's created or changed.
+func (s *HTTPService) pfAdd(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var elements []string
+	if err := json.NewDecoder(r.Body).Decode(&elements); err != nil {
+		http.Error(w, "invalid request: a json array of elements is expected", http.StatusBadRequest)
+		return
+	}
+	changed, err := bs.PFAdd(ps.ByName("name"), elements, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte(strconv.FormatBool(changed)))
+}
+
+func (s *HTTPService) pfCount(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	count, err := bs.PFCount(strings.Split(ps.ByName("names"), ",")...)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte(strconv.FormatUint(count, 10)))
+}
+
+func (s *HTTPService) pfMerge(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	if err := bs.PFMerge(ps.ByName("dst"), strings.Split(ps.ByName("names"), ","), true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// reserveBloom creates a Bloom filter with the error rate and the capacity.
+func (s *HTTPService) reserveBloom(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	c := FilterConfig{Kind: BloomFilter}
+	var err error
+	if c.ErrorRate, err = strconv.ParseFloat(ps.ByName("rate"), 64); err == nil {
+		c.Capacity, err = strconv.ParseUint(ps.ByName("capacity"), 10, 64)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bs.ReserveFilter(ps.ByName("name"), c, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// reserveCuckoo creates a Cuckoo filter with the capacity and the error rate
+// of the error_rate query parameter, which is DefaultFilterErrorRate if it's not set.
+func (s *HTTPService) reserveCuckoo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	c := FilterConfig{Kind: CuckooFilter, ErrorRate: DefaultFilterErrorRate}
+	var err error
+	if rate := r.URL.Query().Get("error_rate"); rate != "" {
+		c.ErrorRate, err = strconv.ParseFloat(rate, 64)
+	}
+	if err == nil {
+		c.Capacity, err = strconv.ParseUint(ps.ByName("capacity"), 10, 64)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bs.ReserveFilter(ps.ByName("name"), c, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// filterItems returns the item query parameters, items may contain any
+// characters like URLs. It writes the error and returns false if there are none.
+func filterItems(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	items := r.URL.Query()["item"]
+	if len(items) == 0 {
+		http.Error(w, "invalid request: the item query parameter is expected", http.StatusBadRequest)
+		return nil, false
+	}
+	return items, true
+}
+
+// writeJSONBools writes results of items as a json array.
+func writeJSONBools(w http.ResponseWriter, results []bool) {
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// bloomAdd adds items in the json array of the body to the Bloom filter and
+// returns whether each of them is added.
+func (s *HTTPService) bloomAdd(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	var items []string
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		http.Error(w, "invalid request: a json array of items is expected", http.StatusBadRequest)
+		return
+	}
+
+	added, err := bs.BloomAdd(ps.ByName("name"), items, true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	writeJSONBools(w, added)
+}
+
+func (s *HTTPService) bloomExists(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+	items, ok := filterItems(w, r)
+	if !ok {
+		return
+	}
+
+	exists, err := bs.BloomExists(ps.ByName("name"), items...)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	writeJSONBools(w, exists)
+}
+
+// cuckooAdd adds the item to the Cuckoo filter, only if it's not contained
+// for /cfaddnx, and returns whether it's added.
+func (s *HTTPService) cuckooAdd(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+	items, ok := filterItems(w, r)
+	if !ok {
+		return
+	}
+
+	added, err := true, error(nil)
+	if strings.HasPrefix(r.URL.Path, "/cfaddnx/") {
+		added, err = bs.CuckooAddNX(ps.ByName("name"), items[0], true)
+	} else {
+		err = bs.CuckooAdd(ps.ByName("name"), items[0], true)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte(strconv.FormatBool(added)))
+}
+
+func (s *HTTPService) cuckooDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+	items, ok := filterItems(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := bs.CuckooDelete(ps.ByName("name"), items[0], true)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte(strconv.FormatBool(deleted)))
+}
+
+func (s *HTTPService) cuckooExists(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+	items, ok := filterItems(w, r)
+	if !ok {
+		return
+	}
+
+	exists, err := bs.CuckooExists(ps.ByName("name"), items...)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	writeJSONBools(w, exists)
+}
+
+func (s *HTTPService) cuckooCount(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+	items, ok := filterItems(w, r)
+	if !ok {
+		return
+	}
+
+	count, err := bs.CuckooCount(ps.ByName("name"), items[0])
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte(strconv.FormatUint(count, 10)))
+}
+
+// filterInfo returns the info of the filter, or 404 if it doesn't exist.
+func (s *HTTPService) filterInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	info, ok := bs.FilterInfo(ps.ByName("name"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func (s *HTTPService) dropFilter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	if err := bs.DropFilter(ps.ByName("name"), true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// createSeries creates or configures the series with retentions separated by
+// commas in the retention query parameter.
+func (s *HTTPService) createSeries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	g, err := ParseGranularity(ps.ByName("granularity"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := SeriesConfig{Granularity: g}
+	if retention := r.URL.Query().Get("retention"); retention != "" {
+		for _, n := range strings.Split(retention, ",") {
+			v, err := strconv.Atoi(n)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.Retention = append(c.Retention, v)
+		}
+	}
+	if err := bs.CreateSeries(ps.ByName("series"), c, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+func (s *HTTPService) dropSeries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	if err := bs.DropSeries(ps.ByName("series"), true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// addAt adds the member to the series at the time query parameter, or now
+// if it's absent.
+func (s *HTTPService) addAt(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	member, err := str2uint32(ps.ByName("member"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := time.Now()
+	if v := r.URL.Query().Get("time"); v != "" {
+		if t, err = ParseTime(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := bs.AddAt(ps.ByName("series"), member, t, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+	}
+}
+
+// window returns members of the series active in the window, and only the
+// number of them if count=true.
+func (s *HTTPService) window(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	from, err := ParseTime(ps.ByName("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := ParseTime(ps.ByName("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bm := bs.WindowBitmap(ps.ByName("series"), from, to)
+	if r.URL.Query().Get("count") == "true" {
+		w.Write([]byte(strconv.FormatUint(bm.GetCardinality(), 10)))
+		return
+	}
+	w.Write([]byte(ints2str(bm.ToArray())))
+}
+
+// retention returns the retention matrix in json.
+func (s *HTTPService) retention(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	from, err := ParseTime(ps.ByName("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	periods, err := strconv.Atoi(ps.ByName("periods"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	matrix, err := bs.RetentionMatrix(ps.ByName("cohort"), ps.ByName("active"), from, periods)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(matrix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func (s *HTTPService) namespaces(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(s.s.namespaces.Info())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func (s *HTTPService) quota(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	bs, ok := s.bitmaps(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(bs.Quota())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// setQuota sets the quota of the namespace, 0 means unlimited.
+func (s *HTTPService) setQuota(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var q Quota
+	var err error
+	if q.MaxMemory, err = strconv.ParseUint(ps.ByName("maxmemory"), 10, 64); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.MaxBitmaps, err = strconv.ParseUint(ps.ByName("maxbitmaps"), 10, 64); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.s.namespaces.SetQuota(r.URL.Query().Get("ns"), q, true); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+}
+
+func (s *HTTPService) save(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := s.s.Save()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+func (s *HTTPService) hash(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	info, err := s.s.Hash()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+func (s *HTTPService) addNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	nodeID := ps.ByName("nodeID")
+	url, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseUint(nodeID, 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		err = s.confChangeCallback.AddNode(id, url)
+		if err != nil {
+			http.Error(w, "failed to add node: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (s *HTTPService) removeNode(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	nodeID := ps.ByName("nodeID")
+	id, err := strconv.ParseUint(nodeID, 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		err = s.confChangeCallback.RemoveNode(id)
+		if err != nil {
+			http.Error(w, "failed to remove node: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (s *HTTPService) clusterInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.confChangeCallback == nil {
+		http.Error(w, ErrClusterDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	info, err := s.confChangeCallback.ClusterInfo()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// transferLeadership moves the leadership to nodeID, 0 means the most up-to-date voter.
+func (s *HTTPService) transferLeadership(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.confChangeCallback == nil {
+		http.Error(w, ErrClusterDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	id, err := strconv.ParseUint(ps.ByName("nodeID"), 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), leaderTransferTimeout)
+	defer cancel()
+	if err := s.confChangeCallback.TransferLeadership(ctx, id); err != nil {
+		http.Error(w, "failed to transfer leadership: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *HTTPService) drain(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.confChangeCallback == nil {
+		http.Error(w, ErrClusterDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), drainTimeout)
+	defer cancel()
+	if err := s.confChangeCallback.Drain(ctx); err != nil {
+		http.Error(w, "failed to drain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *HTTPService) addLearner(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	nodeID := ps.ByName("nodeID")
+	url, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed on POST", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseUint(nodeID, 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		err = s.confChangeCallback.AddLearner(id, url)
+		if err != nil {
+			http.Error(w, "failed to add learner: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (s *HTTPService) promoteLearner(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	nodeID := ps.ByName("nodeID")
+	id, err := strconv.ParseUint(nodeID, 0, 64)
+	if err != nil {
+		http.Error(w, "Failed on convert ID", http.StatusBadRequest)
+		return
+	}
+
+	if s.confChangeCallback != nil {
+		err = s.confChangeCallback.PromoteLearner(id)
+		if err != nil {
+			http.Error(w, "failed to promote learner: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// httpStatus maps the error of a write to the http status code.
+func httpStatus(err error) int {
+	switch err.(type) {
+	case *strconv.NumError, *QueryError:
+		return http.StatusBadRequest
+	}
+
+	switch err {
+	case ErrDraining:
+		return http.StatusServiceUnavailable
+	case ErrOOM, ErrQuotaExceeded, ErrFilterFull, ErrTooManyNamespaces:
+		return http.StatusInsufficientStorage
+	case ErrInvalidNamespace, ErrInvalidSeries, ErrInvalidPeriods, ErrInvalidFilter:
+		return http.StatusBadRequest
+	case ErrSeriesNotFound:
+		return http.StatusNotFound
+	case ErrWrongType, ErrFilterExists:
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
 }
 
 func ints2str(vs []uint32) string {
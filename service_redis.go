@@ -1,8 +1,10 @@
 package basalt
 
 import (
+	"context"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tidwall/redcon"
 )
@@ -19,6 +21,17 @@ func (rs *RedisService) redisAccept(conn redcon.Conn) bool {
 func (rs *RedisService) redisClose(conn redcon.Conn, err error) {
 }
 
+// bitmaps returns bitmaps of the namespace selected by the connection.
+func (rs *RedisService) bitmaps(conn redcon.Conn) *Bitmaps {
+	ns, _ := conn.Context().(string)
+	bs, err := rs.s.namespaces.Get(ns)
+	if err != nil {
+		// namespaces are checked when they are selected.
+		return rs.s.namespaces.Default()
+	}
+	return bs
+}
+
 // redisHandler handles redis commands.
 func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 	switch strings.ToLower(string(cmd.Args[0])) {
@@ -29,6 +42,50 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 	case "quit":
 		conn.WriteString("OK")
 		conn.Close()
+	case "select": // select namespace
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		ns := string(cmd.Args[1])
+		if _, err := rs.s.namespaces.Get(ns); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.SetContext(ns)
+		conn.WriteString("OK")
+
+	case "bmquota": // bmquota [maxmemory maxbitmaps]
+		if len(cmd.Args) != 1 && len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if len(cmd.Args) == 1 {
+			q := rs.bitmaps(conn).Quota()
+			conn.WriteArray(2)
+			conn.WriteInt64(int64(q.MaxMemory))
+			conn.WriteInt64(int64(q.MaxBitmaps))
+			return
+		}
+
+		var q Quota
+		var err error
+		if q.MaxMemory, err = strconv.ParseUint(string(cmd.Args[1]), 10, 64); err == nil {
+			q.MaxBitmaps, err = strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+		}
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+
+		ns, _ := conn.Context().(string)
+		if err := rs.s.namespaces.SetQuota(ns, q, true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
 	case "bmadd": // bitmap add
 		if len(cmd.Args) != 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
@@ -41,7 +98,10 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.Add(string(cmd.Args[1]), v, true)
+		if err := rs.bitmaps(conn).Add(string(cmd.Args[1]), v, true); err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
 		conn.WriteInt(1)
 
 	case "bmaddmany": // bitmap addmany
@@ -56,7 +116,10 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.AddMany(string(cmd.Args[1]), values, true)
+		if err := rs.bitmaps(conn).AddMany(string(cmd.Args[1]), values, true); err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
 		conn.WriteInt(len(values))
 
 	case "bmdel": // bitmap remove
@@ -71,7 +134,10 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.Remove(string(cmd.Args[1]), v, true)
+		if err := rs.bitmaps(conn).Remove(string(cmd.Args[1]), v, true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
 		conn.WriteInt(1)
 
 	case "bmdrop": // bitmap remove_bitmap
@@ -80,7 +146,10 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.RemoveBitmap(string(cmd.Args[1]), true)
+		if err := rs.bitmaps(conn).RemoveBitmap(string(cmd.Args[1]), true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
 		conn.WriteString("OK")
 
 	case "bmclear": // bitmap clear_bitmap
@@ -89,7 +158,10 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		rs.s.bitmaps.ClearBitmap(string(cmd.Args[1]), true)
+		if err := rs.bitmaps(conn).ClearBitmap(string(cmd.Args[1]), true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
 		conn.WriteString("OK")
 	case "bmcard": // bitmap clear_bitmap
 		if len(cmd.Args) != 2 {
@@ -97,7 +169,7 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		count := rs.s.bitmaps.Card(string(cmd.Args[1]))
+		count := rs.bitmaps(conn).Card(string(cmd.Args[1]))
 		conn.WriteInt64(int64(count))
 
 	case "bmexists": // bitmap exists
@@ -112,13 +184,39 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		existed := rs.s.bitmaps.Exists(string(cmd.Args[1]), v)
+		existed := rs.bitmaps(conn).Exists(string(cmd.Args[1]), v)
 		if existed {
 			conn.WriteInt(1)
 		} else {
 			conn.WriteInt(0)
 		}
 
+	case "bmscan": // bitmap scan: bmscan name cursor [count]
+		if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		cursor, err := byte2uint32(cmd.Args[2])
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		var count int
+		if len(cmd.Args) == 4 {
+			if count, err = strconv.Atoi(string(cmd.Args[3])); err != nil {
+				conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+				return
+			}
+		}
+
+		rt := rs.bitmaps(conn).Scan(string(cmd.Args[1]), cursor, scanCount(count))
+
+		conn.WriteArray(len(rt))
+		for _, v := range rt {
+			conn.WriteInt64(int64(v))
+		}
+
 	case "bminter": // bitmap intersect
 		if len(cmd.Args) < 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
@@ -126,7 +224,7 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 		}
 
 		names := bytes2string(cmd.Args[1:])
-		rt := rs.s.bitmaps.Inter(names...)
+		rt := rs.bitmaps(conn).Inter(names...)
 
 		conn.WriteArray(len(rt))
 		for _, v := range rt {
@@ -140,7 +238,11 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 		}
 
 		names := bytes2string(cmd.Args[1:])
-		count := rs.s.bitmaps.InterStore(names[0], names[1:]...)
+		count, err := rs.bitmaps(conn).InterStore(names[0], names[1:], true)
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
 		conn.WriteInt64(int64(count))
 
 	case "bmunion": // bitmap union
@@ -150,7 +252,7 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 		}
 
 		names := bytes2string(cmd.Args[1:])
-		rt := rs.s.bitmaps.Union(names...)
+		rt := rs.bitmaps(conn).Union(names...)
 
 		conn.WriteArray(len(rt))
 		for _, v := range rt {
@@ -163,162 +265,1133 @@ func (rs *RedisService) redisHandler(conn redcon.Conn, cmd redcon.Command) {
 		}
 
 		names := bytes2string(cmd.Args[1:])
-		count := rs.s.bitmaps.UnionStore(names[0], names[1:]...)
+		count, err := rs.bitmaps(conn).UnionStore(names[0], names[1:], true)
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
 		conn.WriteInt64(int64(count))
 
 	case "bmxor": // bitmap xor
-		if len(cmd.Args) != 3 {
+		if len(cmd.Args) < 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		rt := rs.s.bitmaps.Xor(string(cmd.Args[1]), string(cmd.Args[2]))
+		names := bytes2string(cmd.Args[1:])
+		rt := rs.bitmaps(conn).Xor(names...)
 
 		conn.WriteArray(len(rt))
 		for _, v := range rt {
 			conn.WriteInt64(int64(v))
 		}
 	case "bmxorstore": // bitmap xor store
-		if len(cmd.Args) != 4 {
+		if len(cmd.Args) < 4 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		count := rs.s.bitmaps.XorStore(string(cmd.Args[1]), string(cmd.Args[2]), string(cmd.Args[3]))
+		names := bytes2string(cmd.Args[1:])
+		count, err := rs.bitmaps(conn).XorStore(names[0], names[1:], true)
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
 		conn.WriteInt64(int64(count))
 
 	case "bmdiff": // bitmap diff
-		if len(cmd.Args) != 3 {
+		if len(cmd.Args) < 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		rt := rs.s.bitmaps.Diff(string(cmd.Args[1]), string(cmd.Args[2]))
+		names := bytes2string(cmd.Args[1:])
+		rt := rs.bitmaps(conn).Diff(names...)
 
 		conn.WriteArray(len(rt))
 		for _, v := range rt {
 			conn.WriteInt64(int64(v))
 		}
 	case "bmdiffstore": // bitmap diff store
-		if len(cmd.Args) != 4 {
+		if len(cmd.Args) < 4 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		count := rs.s.bitmaps.DiffStore(string(cmd.Args[1]), string(cmd.Args[2]), string(cmd.Args[3]))
+		names := bytes2string(cmd.Args[1:])
+		count, err := rs.bitmaps(conn).DiffStore(names[0], names[1:], true)
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
 		conn.WriteInt64(int64(count))
-	case "bmstats": // bitmap diff store
-		if len(cmd.Args) != 2 {
+	case "bmintercard", "bmunioncard": // cardinality of bitmap intersect, union
+		if len(cmd.Args) < 2 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		stats := rs.s.bitmaps.Stats(string(cmd.Args[1]))
-
-		var sb strings.Builder
-		appendMetric(&sb, "cardinality", stats.Cardinality)
-		appendMetric(&sb, "Containers", stats.Containers)
-
-		appendMetric(&sb, "ArrayContainers", stats.ArrayContainers)
-		appendMetric(&sb, "ArrayContainerBytes", stats.ArrayContainerBytes)
-		appendMetric(&sb, "ArrayContainerValues", stats.ArrayContainerValues)
-
-		appendMetric(&sb, "BitmapContainers", stats.BitmapContainers)
-		appendMetric(&sb, "BitmapContainerBytes", stats.BitmapContainerBytes)
-		appendMetric(&sb, "BitmapContainerValues", stats.BitmapContainerValues)
-
-		appendMetric(&sb, "RunContainers", stats.RunContainers)
-		appendMetric(&sb, "RunContainerBytes", stats.RunContainerBytes)
-		appendMetric(&sb, "RunContainerValues", stats.RunContainerValues)
+		names := bytes2string(cmd.Args[1:])
+		var count uint64
+		if strings.ToLower(string(cmd.Args[0])) == "bmintercard" {
+			count = rs.bitmaps(conn).InterCard(names...)
+		} else {
+			count = rs.bitmaps(conn).UnionCard(names...)
+		}
+		conn.WriteInt64(int64(count))
 
-		conn.WriteBulkString(sb.String())
-	case "bmsave": // bitmap persist
-		if len(cmd.Args) != 1 {
+	case "bmxorcard", "bmdiffcard": // cardinality of bitmap xor, diff
+		if len(cmd.Args) < 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		err := rs.s.Save()
-		if err != nil {
-			conn.WriteError("ERR save because of " + err.Error())
-			return
+		names := bytes2string(cmd.Args[1:])
+		var count uint64
+		if strings.ToLower(string(cmd.Args[0])) == "bmxorcard" {
+			count = rs.bitmaps(conn).XorCard(names...)
+		} else {
+			count = rs.bitmaps(conn).DiffCard(names...)
 		}
+		conn.WriteInt64(int64(count))
 
-		conn.WriteInt(1)
-	case "addnode": // add raft node
+	case "bmjaccard": // jaccard index of two bitmaps
 		if len(cmd.Args) != 3 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		if rs.confChangeCallback != nil {
+		j := rs.bitmaps(conn).Jaccard(string(cmd.Args[1]), string(cmd.Args[2]))
+		conn.WriteBulkString(strconv.FormatFloat(j, 'f', -1, 64))
 
-			nodeID := string(cmd.Args[1])
-			url := cmd.Args[2]
+	case "bmquery": // bitmap query: bmquery expr [UNIVERSE name] [COUNT | STORE dst]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
-			id, err := strconv.ParseUint(nodeID, 0, 64)
-			if err != nil {
-				conn.WriteError("ERR parse id because of " + err.Error())
+		var universe, dst string
+		var count bool
+		for i := 2; i < len(cmd.Args); i++ {
+			opt := strings.ToLower(string(cmd.Args[i]))
+			switch {
+			case opt == "count":
+				count = true
+			case opt == "universe" && i+1 < len(cmd.Args):
+				i++
+				universe = string(cmd.Args[i])
+			case opt == "store" && i+1 < len(cmd.Args):
+				i++
+				dst = string(cmd.Args[i])
+			default:
+				conn.WriteError("ERR syntax error")
 				return
 			}
+		}
+		if count && dst != "" {
+			conn.WriteError("ERR syntax error")
+			return
+		}
 
-			err = rs.confChangeCallback.AddNode(id, url)
+		expr := string(cmd.Args[1])
+		switch {
+		case dst != "":
+			n, err := rs.bitmaps(conn).QueryStore(dst, expr, universe, true)
 			if err != nil {
-				conn.WriteError("ERR failed to add node because of " + err.Error())
+				conn.WriteError("ERR " + err.Error())
+				return
+			}
+			conn.WriteInt64(int64(n))
+		case count:
+			n, err := rs.bitmaps(conn).QueryCard(expr, universe)
+			if err != nil {
+				conn.WriteError("ERR " + err.Error())
 				return
 			}
+			conn.WriteInt64(int64(n))
+		default:
+			rt, err := rs.bitmaps(conn).Query(expr, universe)
+			if err != nil {
+				conn.WriteError("ERR " + err.Error())
+				return
+			}
+			conn.WriteArray(len(rt))
+			for _, v := range rt {
+				conn.WriteInt64(int64(v))
+			}
+		}
+
+	case "bmexpire": // set TTL of bitmap in seconds
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		seconds, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
 
+		name := string(cmd.Args[1])
+		if _, ok := rs.bitmaps(conn).Deadline(name); !ok {
+			conn.WriteInt(0)
+			return
+		}
+		if err := rs.bitmaps(conn).Expire(name, time.Now().Add(time.Duration(seconds)*time.Second), true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
 		}
 		conn.WriteInt(1)
-	case "removenode": // remove raft node
+
+	case "bmpersist": // remove TTL of bitmap
 		if len(cmd.Args) != 2 {
 			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 			return
 		}
 
-		if rs.confChangeCallback != nil {
+		name := string(cmd.Args[1])
+		if deadline, _ := rs.bitmaps(conn).Deadline(name); deadline.IsZero() {
+			conn.WriteInt(0)
+			return
+		}
+		if err := rs.bitmaps(conn).Expire(name, time.Time{}, true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteInt(1)
 
-			nodeID := string(cmd.Args[1])
+	case "bmttl": // TTL of bitmap in seconds, -2 if it doesn't exist and -1 if it has no TTL
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
-			id, err := strconv.ParseUint(nodeID, 0, 64)
-			if err != nil {
-				conn.WriteError("ERR parse id because of " + err.Error())
-				return
+		deadline, ok := rs.bitmaps(conn).Deadline(string(cmd.Args[1]))
+		switch {
+		case !ok:
+			conn.WriteInt(-2)
+		case deadline.IsZero():
+			conn.WriteInt(-1)
+		default:
+			ttl := time.Until(deadline).Round(time.Second)
+			if ttl < 0 {
+				ttl = 0
 			}
+			conn.WriteInt64(int64(ttl / time.Second))
+		}
 
-			err = rs.confChangeCallback.RemoveNode(id)
-			if err != nil {
-				conn.WriteError("ERR failed to remove node because of " + err.Error())
-				return
-			}
+	case "bmsetvalue": // set value of member in field: bmsetvalue field member value
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		member, err := byte2uint32(cmd.Args[2])
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		value, err := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		if err := rs.bitmaps(conn).SetValue(string(cmd.Args[1]), member, value, true); err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		conn.WriteString("OK")
+
+	case "bmgetvalue": // value of member in field
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		member, err := byte2uint32(cmd.Args[2])
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		value, ok := rs.bitmaps(conn).Value(string(cmd.Args[1]), member)
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteInt64(value)
+
+	case "bmclearvalue": // remove value of member from field
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
+		member, err := byte2uint32(cmd.Args[2])
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		field := string(cmd.Args[1])
+		if _, ok := rs.bitmaps(conn).Value(field, member); !ok {
+			conn.WriteInt(0)
+			return
+		}
+		if err := rs.bitmaps(conn).ClearValue(field, member, true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
 		}
 		conn.WriteInt(1)
-	}
-}
 
-func appendMetric(sb *strings.Builder, name string, v uint64) {
-	sb.WriteString(name)
-	sb.WriteString(":")
-	sb.WriteString(strconv.FormatUint(v, 10))
-	sb.WriteString("\r\n")
-}
+	case "bmdropfield": // remove field
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
-func byte2uint32(b []byte) (uint32, error) {
-	i, err := strconv.ParseUint(string(b), 10, 32)
-	return uint32(i), err
-}
+		if err := rs.bitmaps(conn).DropField(string(cmd.Args[1]), true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
 
-func bytes2uint32(b [][]byte) ([]uint32, error) {
-	var rt []uint32
-	for _, bt := range b {
-		i, err := strconv.ParseUint(string(bt), 10, 32)
+	case "bmrange": // members by value: bmrange field op value [end] [FILTER name] [COUNT]
+		if len(cmd.Args) < 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		op, err := ParseRangeOp(string(cmd.Args[2]))
 		if err != nil {
-			return nil, err
+			conn.WriteError("ERR " + err.Error())
+			return
 		}
-		rt = append(rt, uint32(i))
-	}
-	return rt, nil
+		value, err := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		args := cmd.Args[4:]
+		var end int64
+		if op == RangeBetween {
+			if len(args) == 0 {
+				conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+				return
+			}
+			if end, err = strconv.ParseInt(string(args[0]), 10, 64); err != nil {
+				conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+				return
+			}
+			args = args[1:]
+		}
+		filter, count, ok := parseFieldOptions(args, true)
+		if !ok {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+
+		field := string(cmd.Args[1])
+		if count {
+			conn.WriteInt64(int64(rs.bitmaps(conn).RangeCard(field, op, value, end, filter)))
+			return
+		}
+		rt := rs.bitmaps(conn).Range(field, op, value, end, filter)
+		conn.WriteArray(len(rt))
+		for _, v := range rt {
+			conn.WriteInt64(int64(v))
+		}
+
+	case "bmsum": // sum and number of values: bmsum field [FILTER name]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		filter, _, ok := parseFieldOptions(cmd.Args[2:], false)
+		if !ok {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		sum, count := rs.bitmaps(conn).Sum(string(cmd.Args[1]), filter)
+		conn.WriteArray(2)
+		conn.WriteInt64(sum)
+		conn.WriteInt64(int64(count))
+
+	case "bmmin", "bmmax": // min or max value: bmmin field [FILTER name]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		filter, _, ok := parseFieldOptions(cmd.Args[2:], false)
+		if !ok {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		var value int64
+		if strings.ToLower(string(cmd.Args[0])) == "bmmin" {
+			value, ok = rs.bitmaps(conn).Min(string(cmd.Args[1]), filter)
+		} else {
+			value, ok = rs.bitmaps(conn).Max(string(cmd.Args[1]), filter)
+		}
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteInt64(value)
+
+	case "bmaddkey": // add string keys to bitmap: bmaddkey name key [key ...]
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		keys := bytes2string(cmd.Args[2:])
+		if err := rs.bitmaps(conn).AddKeys(string(cmd.Args[1]), keys, true); err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		conn.WriteInt(len(keys))
+
+	case "bmdelkey": // remove string keys from bitmap: bmdelkey name key [key ...]
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		keys := bytes2string(cmd.Args[2:])
+		if err := rs.bitmaps(conn).RemoveKeys(string(cmd.Args[1]), keys, true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteInt(len(keys))
+
+	case "bmexistskey": // whether string key is in bitmap
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.bitmaps(conn).ExistsKey(string(cmd.Args[1]), string(cmd.Args[2])) {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+
+	case "bminterkeys", "bmunionkeys": // string keys of intersection or union
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		var rt []string
+		names := bytes2string(cmd.Args[1:])
+		if strings.ToLower(string(cmd.Args[0])) == "bminterkeys" {
+			rt = rs.bitmaps(conn).InterKeys(names...)
+		} else {
+			rt = rs.bitmaps(conn).UnionKeys(names...)
+		}
+		conn.WriteArray(len(rt))
+		for _, key := range rt {
+			conn.WriteBulkString(key)
+		}
+
+	case "bmkeyid": // id of string key, nil if it's not assigned
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		id, ok := rs.bitmaps(conn).KeyID(string(cmd.Args[1]))
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteInt64(int64(id))
+
+	case "bmkeys": // string keys of ids: bmkeys id [id ...]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		ids, err := bytes2uint32(cmd.Args[1:])
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		rt := rs.bitmaps(conn).Keys(ids)
+		conn.WriteArray(len(rt))
+		for _, key := range rt {
+			conn.WriteBulkString(key)
+		}
+
+	case "pfadd": // add elements to hyperloglog: pfadd name [element ...]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		changed, err := rs.bitmaps(conn).PFAdd(string(cmd.Args[1]), bytes2string(cmd.Args[2:]), true)
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		if changed {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+
+	case "pfcount": // approximate cardinality of hyperloglogs: pfcount name [name ...]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		count, err := rs.bitmaps(conn).PFCount(bytes2string(cmd.Args[1:])...)
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		conn.WriteInt64(int64(count))
+
+	case "pfmerge": // merge hyperloglogs: pfmerge dst name [name ...]
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if err := rs.bitmaps(conn).PFMerge(string(cmd.Args[1]), bytes2string(cmd.Args[2:]), true); err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		conn.WriteString("OK")
+
+	case "bf.reserve", "cf.reserve": // create filter: bf.reserve name error_rate capacity, cf.reserve name capacity [error_rate]
+		bloom := strings.ToLower(string(cmd.Args[0])) == "bf.reserve"
+		if (bloom && len(cmd.Args) != 4) || (!bloom && len(cmd.Args) != 3 && len(cmd.Args) != 4) {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		c := FilterConfig{Kind: BloomFilter, ErrorRate: DefaultFilterErrorRate}
+		rate, capacity := cmd.Args[2], cmd.Args[3:]
+		if !bloom {
+			c.Kind = CuckooFilter
+			rate, capacity = nil, cmd.Args[2:3]
+			if len(cmd.Args) == 4 {
+				rate = cmd.Args[3]
+			}
+		}
+		var err error
+		if rate != nil {
+			c.ErrorRate, err = strconv.ParseFloat(string(rate), 64)
+		}
+		if err == nil {
+			c.Capacity, err = strconv.ParseUint(string(capacity[0]), 10, 64)
+		}
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		if err := rs.bitmaps(conn).ReserveFilter(string(cmd.Args[1]), c, true); err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		conn.WriteString("OK")
+
+	case "bf.add", "bf.madd": // add items to bloom filter: bf.madd name item [item ...]
+		if len(cmd.Args) < 3 || (strings.ToLower(string(cmd.Args[0])) == "bf.add" && len(cmd.Args) != 3) {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		added, err := rs.bitmaps(conn).BloomAdd(string(cmd.Args[1]), bytes2string(cmd.Args[2:]), true)
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		writeBools(conn, added, strings.ToLower(string(cmd.Args[0])) == "bf.madd")
+
+	case "bf.exists", "bf.mexists", "cf.exists", "cf.mexists": // whether items may be in filter: bf.mexists name item [item ...]
+		cmdName := strings.ToLower(string(cmd.Args[0]))
+		multi := strings.HasSuffix(cmdName, "mexists")
+		if len(cmd.Args) < 3 || (!multi && len(cmd.Args) != 3) {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		var exists []bool
+		var err error
+		if strings.HasPrefix(cmdName, "bf.") {
+			exists, err = rs.bitmaps(conn).BloomExists(string(cmd.Args[1]), bytes2string(cmd.Args[2:])...)
+		} else {
+			exists, err = rs.bitmaps(conn).CuckooExists(string(cmd.Args[1]), bytes2string(cmd.Args[2:])...)
+		}
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		writeBools(conn, exists, multi)
+
+	case "cf.add", "cf.addnx", "cf.del": // add or delete an item of cuckoo filter: cf.add name item
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		var ok bool
+		var err error
+		name, item := string(cmd.Args[1]), string(cmd.Args[2])
+		switch strings.ToLower(string(cmd.Args[0])) {
+		case "cf.add":
+			ok, err = true, rs.bitmaps(conn).CuckooAdd(name, item, true)
+		case "cf.addnx":
+			ok, err = rs.bitmaps(conn).CuckooAddNX(name, item, true)
+		default:
+			ok, err = rs.bitmaps(conn).CuckooDelete(name, item, true)
+		}
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		writeBools(conn, []bool{ok}, false)
+
+	case "cf.count": // times an item may have been added to cuckoo filter
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		count, err := rs.bitmaps(conn).CuckooCount(string(cmd.Args[1]), string(cmd.Args[2]))
+		if err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		conn.WriteInt64(int64(count))
+
+	case "bf.info", "cf.info": // info of filter, nil if it doesn't exist
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		info, ok := rs.bitmaps(conn).FilterInfo(string(cmd.Args[1]))
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		var sb strings.Builder
+		if info.Kind == BloomFilter {
+			sb.WriteString("type:bloom\r\n")
+		} else {
+			sb.WriteString("type:cuckoo\r\n")
+		}
+		sb.WriteString("error_rate:" + strconv.FormatFloat(info.ErrorRate, 'g', -1, 64) + "\r\n")
+		appendMetric(&sb, "capacity", info.Capacity)
+		appendMetric(&sb, "items", info.Items)
+		appendMetric(&sb, "size", info.Size)
+		appendMetric(&sb, "layers", uint64(info.Layers))
+		conn.WriteBulkString(sb.String())
+
+	case "bf.drop", "cf.drop": // remove filter
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if err := rs.bitmaps(conn).DropFilter(string(cmd.Args[1]), true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+
+	case "bmseries": // create or configure series: bmseries series granularity [retention ...]
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		g, err := ParseGranularity(string(cmd.Args[2]))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		c := SeriesConfig{Granularity: g}
+		for _, arg := range cmd.Args[3:] {
+			n, err := strconv.Atoi(string(arg))
+			if err != nil {
+				conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+				return
+			}
+			c.Retention = append(c.Retention, n)
+		}
+		if err := rs.bitmaps(conn).CreateSeries(string(cmd.Args[1]), c, true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+
+	case "bmdropseries": // remove series and its buckets
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if err := rs.bitmaps(conn).DropSeries(string(cmd.Args[1]), true); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+
+	case "bmtsadd": // add member to bucket of series: bmtsadd series member [time]
+		if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		member, err := byte2uint32(cmd.Args[2])
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		t := time.Now()
+		if len(cmd.Args) == 4 {
+			if t, err = ParseTime(string(cmd.Args[3])); err != nil {
+				conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+				return
+			}
+		}
+		if err := rs.bitmaps(conn).AddAt(string(cmd.Args[1]), member, t, true); err != nil {
+			conn.WriteError(redisError(err))
+			return
+		}
+		conn.WriteString("OK")
+
+	case "bmwindow": // members active in window: bmwindow series from to [COUNT]
+		if len(cmd.Args) != 4 && len(cmd.Args) != 5 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		from, err1 := ParseTime(string(cmd.Args[2]))
+		to, err2 := ParseTime(string(cmd.Args[3]))
+		if err1 != nil || err2 != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		if len(cmd.Args) == 5 {
+			if strings.ToLower(string(cmd.Args[4])) != "count" {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			conn.WriteInt64(int64(rs.bitmaps(conn).WindowCard(string(cmd.Args[1]), from, to)))
+			return
+		}
+		rt := rs.bitmaps(conn).Window(string(cmd.Args[1]), from, to)
+		conn.WriteArray(len(rt))
+		for _, v := range rt {
+			conn.WriteInt64(int64(v))
+		}
+
+	case "bmretention": // retention matrix: bmretention cohort active from periods
+		if len(cmd.Args) != 5 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		from, err := ParseTime(string(cmd.Args[3]))
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command because of " + err.Error())
+			return
+		}
+		periods, err := strconv.Atoi(string(cmd.Args[4]))
+		if err != nil {
+			conn.WriteError("ERR wrong value for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		matrix, err := rs.bitmaps(conn).RetentionMatrix(string(cmd.Args[1]), string(cmd.Args[2]), from, periods)
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteArray(len(matrix))
+		for _, row := range matrix {
+			conn.WriteArray(len(row))
+			for _, n := range row {
+				conn.WriteInt64(int64(n))
+			}
+		}
+
+	case "memory": // memory usage name
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if strings.ToLower(string(cmd.Args[1])) != "usage" {
+			conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+			return
+		}
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		size, ok := rs.bitmaps(conn).MemoryUsage(string(cmd.Args[2]))
+		if !ok {
+			conn.WriteNull()
+			return
+		}
+		conn.WriteInt64(int64(size))
+
+	case "info": // info [memory | keyspace]
+		if len(cmd.Args) > 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		var sb strings.Builder
+		if len(cmd.Args) == 1 || strings.EqualFold(string(cmd.Args[1]), "memory") {
+			info := rs.bitmaps(conn).MemoryInfo()
+			sb.WriteString("# Memory\r\n")
+			appendMetric(&sb, "used_memory", info.UsedMemory)
+			appendMetric(&sb, "maxmemory", info.MaxMemory)
+			sb.WriteString("maxmemory_policy:" + string(info.Policy) + "\r\n")
+			appendMetric(&sb, "bitmaps", info.Bitmaps)
+			appendMetric(&sb, "hyperloglogs", info.HyperLogLogs)
+			appendMetric(&sb, "volatile_bitmaps", info.VolatileBitmaps)
+			appendMetric(&sb, "evicted_bitmaps", info.EvictedBitmaps)
+			appendMetric(&sb, "expired_bitmaps", info.ExpiredBitmaps)
+			appendMetric(&sb, "cold_bitmaps", info.ColdBitmaps)
+			appendMetric(&sb, "spilled_bitmaps", info.SpilledBitmaps)
+			appendMetric(&sb, "loaded_bitmaps", info.LoadedBitmaps)
+		}
+		if len(cmd.Args) == 1 || strings.EqualFold(string(cmd.Args[1]), "keyspace") {
+			if len(cmd.Args) == 1 {
+				sb.WriteString("\r\n")
+			}
+			sb.WriteString("# Keyspace\r\n")
+			for _, info := range rs.s.namespaces.Info() {
+				if info.Bitmaps == 0 && info.HyperLogLogs == 0 {
+					continue
+				}
+				sb.WriteString(info.Name +
+					":bitmaps=" + strconv.FormatUint(info.Bitmaps, 10) +
+					",hyperloglogs=" + strconv.FormatUint(info.HyperLogLogs, 10) +
+					",volatile=" + strconv.FormatUint(info.VolatileBitmaps, 10) +
+					",used_memory=" + strconv.FormatUint(info.UsedMemory, 10) + "\r\n")
+			}
+		}
+		conn.WriteBulkString(sb.String())
+
+	case "bmstats": // bitmap diff store
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		stats := rs.bitmaps(conn).Stats(string(cmd.Args[1]))
+
+		var sb strings.Builder
+		appendMetric(&sb, "cardinality", stats.Cardinality)
+		appendMetric(&sb, "Containers", stats.Containers)
+
+		appendMetric(&sb, "ArrayContainers", stats.ArrayContainers)
+		appendMetric(&sb, "ArrayContainerBytes", stats.ArrayContainerBytes)
+		appendMetric(&sb, "ArrayContainerValues", stats.ArrayContainerValues)
+
+		appendMetric(&sb, "BitmapContainers", stats.BitmapContainers)
+		appendMetric(&sb, "BitmapContainerBytes", stats.BitmapContainerBytes)
+		appendMetric(&sb, "BitmapContainerValues", stats.BitmapContainerValues)
+
+		appendMetric(&sb, "RunContainers", stats.RunContainers)
+		appendMetric(&sb, "RunContainerBytes", stats.RunContainerBytes)
+		appendMetric(&sb, "RunContainerValues", stats.RunContainerValues)
+
+		conn.WriteBulkString(sb.String())
+	case "bmsave": // bitmap persist
+		if len(cmd.Args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		err := rs.s.Save()
+		if err != nil {
+			conn.WriteError("ERR save because of " + err.Error())
+			return
+		}
+
+		conn.WriteInt(1)
+	case "addnode": // add raft node
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+
+			nodeID := string(cmd.Args[1])
+			url := cmd.Args[2]
+
+			id, err := strconv.ParseUint(nodeID, 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+
+			err = rs.confChangeCallback.AddNode(id, url)
+			if err != nil {
+				conn.WriteError("ERR failed to add node because of " + err.Error())
+				return
+			}
+
+		}
+		conn.WriteInt(1)
+	case "removenode": // remove raft node
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+
+			nodeID := string(cmd.Args[1])
+
+			id, err := strconv.ParseUint(nodeID, 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+
+			err = rs.confChangeCallback.RemoveNode(id)
+			if err != nil {
+				conn.WriteError("ERR failed to remove node because of " + err.Error())
+				return
+			}
+
+		}
+		conn.WriteInt(1)
+	case "bmhash": // state hash of bitmaps
+		if len(cmd.Args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		info, err := rs.s.Hash()
+		if err != nil {
+			conn.WriteError("ERR failed to get hash because of " + err.Error())
+			return
+		}
+
+		var sb strings.Builder
+		appendMetric(&sb, "hash", info.Hash)
+		appendMetric(&sb, "checkpoint", info.Checkpoint)
+		appendMetric(&sb, "checkpoint_hash", info.CheckpointHash)
+		appendMetric(&sb, "divergences", info.Divergences)
+		appendMetric(&sb, "last_divergence", info.LastDivergence)
+		conn.WriteBulkString(sb.String())
+	case "cluster": // raft cluster status
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback == nil {
+			conn.WriteError("ERR This instance has cluster support disabled")
+			return
+		}
+
+		info, err := rs.confChangeCallback.ClusterInfo()
+		if err != nil {
+			conn.WriteError("ERR failed to get cluster info because of " + err.Error())
+			return
+		}
+
+		var sb strings.Builder
+		switch strings.ToLower(string(cmd.Args[1])) {
+		case "info":
+			appendMetric(&sb, "cluster_my_id", info.ID)
+			appendMetric(&sb, "cluster_leader_id", info.LeaderID)
+			sb.WriteString("cluster_my_state:" + info.State + "\r\n")
+			appendMetric(&sb, "cluster_term", info.Term)
+			appendMetric(&sb, "cluster_commit_index", info.Commit)
+			appendMetric(&sb, "cluster_applied_index", info.Applied)
+			appendMetric(&sb, "cluster_size", uint64(len(info.Members)))
+		case "nodes":
+			for _, m := range info.Members {
+				sb.WriteString(strconv.FormatUint(m.ID, 10) + " " + m.Addr + " " + m.Role)
+				if m.Progress != "" {
+					sb.WriteString(" " + m.Progress +
+						" match=" + strconv.FormatUint(m.Match, 10) +
+						" next=" + strconv.FormatUint(m.Next, 10) +
+						" lag=" + strconv.FormatUint(m.Lag, 10))
+				}
+				sb.WriteString("\r\n")
+			}
+		default:
+			conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'")
+			return
+		}
+
+		conn.WriteBulkString(sb.String())
+	case "transferleader": // transfer raft leadership
+		if len(cmd.Args) > 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback == nil {
+			conn.WriteError("ERR This instance has cluster support disabled")
+			return
+		}
+
+		var target uint64
+		if len(cmd.Args) == 2 {
+			id, err := strconv.ParseUint(string(cmd.Args[1]), 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+			target = id
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), leaderTransferTimeout)
+		defer cancel()
+		if err := rs.confChangeCallback.TransferLeadership(ctx, target); err != nil {
+			conn.WriteError("ERR failed to transfer leadership because of " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "drain": // drain raft node before stopping it
+		if len(cmd.Args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback == nil {
+			conn.WriteError("ERR This instance has cluster support disabled")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := rs.confChangeCallback.Drain(ctx); err != nil {
+			conn.WriteError("ERR failed to drain because of " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "addlearner": // add raft learner
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+			nodeID := string(cmd.Args[1])
+			url := cmd.Args[2]
+
+			id, err := strconv.ParseUint(nodeID, 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+
+			err = rs.confChangeCallback.AddLearner(id, url)
+			if err != nil {
+				conn.WriteError("ERR failed to add learner because of " + err.Error())
+				return
+			}
+		}
+		conn.WriteInt(1)
+	case "promotelearner": // promote raft learner to voter
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		if rs.confChangeCallback != nil {
+			nodeID := string(cmd.Args[1])
+
+			id, err := strconv.ParseUint(nodeID, 0, 64)
+			if err != nil {
+				conn.WriteError("ERR parse id because of " + err.Error())
+				return
+			}
+
+			err = rs.confChangeCallback.PromoteLearner(id)
+			if err != nil {
+				conn.WriteError("ERR failed to promote learner because of " + err.Error())
+				return
+			}
+		}
+		conn.WriteInt(1)
+	}
+}
+
+// redisError returns the error reply of err, which is prefixed by ERR unless
+// it has its own prefix like OOM.
+func redisError(err error) string {
+	if err == ErrOOM || err == ErrWrongType {
+		return err.Error()
+	}
+	return "ERR " + err.Error()
+}
+
+// parseFieldOptions parses [FILTER name] and [COUNT] if count is allowed.
+func parseFieldOptions(args [][]byte, allowCount bool) (filter string, count, ok bool) {
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		switch {
+		case opt == "count" && allowCount:
+			count = true
+		case opt == "filter" && i+1 < len(args):
+			i++
+			filter = string(args[i])
+		default:
+			return "", false, false
+		}
+	}
+	return filter, count, true
+}
+
+func appendMetric(sb *strings.Builder, name string, v uint64) {
+	sb.WriteString(name)
+	sb.WriteString(":")
+	sb.WriteString(strconv.FormatUint(v, 10))
+	sb.WriteString("\r\n")
+}
+
+func byte2uint32(b []byte) (uint32, error) {
+	i, err := strconv.ParseUint(string(b), 10, 32)
+	return uint32(i), err
+}
+
+func bytes2uint32(b [][]byte) ([]uint32, error) {
+	var rt []uint32
+	for _, bt := range b {
+		i, err := strconv.ParseUint(string(bt), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		rt = append(rt, uint32(i))
+	}
+	return rt, nil
+}
+
+// writeBools writes results of items as integers 1 or 0, in an array if multi is true.
+func writeBools(conn redcon.Conn, results []bool, multi bool) {
+	if multi {
+		conn.WriteArray(len(results))
+	}
+	for _, ok := range results {
+		if ok {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	}
 }
 
 func bytes2string(b [][]byte) []string {
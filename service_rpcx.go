@@ -2,8 +2,11 @@ package basalt
 
 import (
 	"context"
+	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/smallnest/rpcx/server"
+	"github.com/smallnest/rpcx/share"
 )
 
 // ConfigRpcxOption defines the rpcx config function.
@@ -27,6 +30,14 @@ type BitmapValuesRequest struct {
 	Values []uint32
 }
 
+// BitmapScanRequest contains the name of bitmap, the value to start from
+// and the max number of values to return.
+type BitmapScanRequest struct {
+	Name   string
+	Cursor uint32
+	Count  int
+}
+
 // BitmapStoreRequest contains the name of destination and names of bitmaps.
 type BitmapStoreRequest struct {
 	Destination string
@@ -46,112 +57,954 @@ type BitmapDstAndPairRequest struct {
 	Name2       string
 }
 
+// BitmapQueryRequest contains a boolean expression over bitmaps, the name of
+// the universe for NOT, and whether to reply only the cardinality of the
+// result or store it to destination.
+type BitmapQueryRequest struct {
+	Expr        string
+	Universe    string
+	Count       bool
+	Destination string
+}
+
+// BitmapQueryResult contains the result of a query, only the cardinality
+// is set if it's counted or stored.
+type BitmapQueryResult struct {
+	Values []uint32
+	Card   uint64
+}
+
+// FieldValueRequest contains the name of field, the member and its value.
+type FieldValueRequest struct {
+	Field  string
+	Member uint32
+	Value  int64
+}
+
+// FieldRangeRequest contains the name of field, the comparison and the name
+// of the filter bitmap, which is empty for all members. End is only used by
+// between, and only the number of members is replied if Count is set.
+type FieldRangeRequest struct {
+	Field  string
+	Op     RangeOp
+	Value  int64
+	End    int64
+	Filter string
+	Count  bool
+}
+
+// FieldAggregateRequest contains the name of field and the name of the
+// filter bitmap, which is empty for all members.
+type FieldAggregateRequest struct {
+	Field  string
+	Filter string
+}
+
+// FieldValueResult contains a value, OK is false if there is none.
+type FieldValueResult struct {
+	Value int64
+	OK    bool
+}
+
+// FieldSumResult contains the sum of values and the number of them.
+type FieldSumResult struct {
+	Sum   int64
+	Count uint64
+}
+
+// BitmapKeysRequest contains the name of bitmap and string keys, or the name of
+// HyperLogLog or filter and its elements.
+type BitmapKeysRequest struct {
+	Name string
+	Keys []string
+}
+
+// SeriesRequest contains the name of series, its granularity like day and
+// its retentions.
+type SeriesRequest struct {
+	Series      string
+	Granularity string
+	Retention   []int
+}
+
+// FilterRequest contains the name of filter and its config. The error rate
+// and the capacity are the defaults of its kind if they're zero.
+type FilterRequest struct {
+	Name string
+	FilterConfig
+}
+
+// FilterItemRequest contains the name of filter and an item of it.
+type FilterItemRequest struct {
+	Name string
+	Item string
+}
+
+// SeriesAddRequest contains the name of series, the member and the time it's
+// active, which is now if it's zero.
+type SeriesAddRequest struct {
+	Series string
+	Member uint32
+	Time   time.Time
+}
+
+// WindowRequest contains the name of series and the window, only the number
+// of members is replied if Count is set.
+type WindowRequest struct {
+	Series   string
+	From, To time.Time
+	Count    bool
+}
+
+// RetentionRequest contains names of the cohort series and the active
+// series, the start and the number of periods of a retention matrix.
+type RetentionRequest struct {
+	Cohort  string
+	Active  string
+	From    time.Time
+	Periods int
+}
+
+// NamespaceMetaKey is the key of rpcx request metadata which selects the
+// namespace of bitmaps, the default namespace is used if it's not set.
+const NamespaceMetaKey = "ns"
+
+// bitmaps returns bitmaps of the namespace selected by the request metadata.
+func (s *RpcxBitmapService) bitmaps(ctx context.Context) (*Bitmaps, error) {
+	meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	return s.s.namespaces.Get(meta[NamespaceMetaKey])
+}
+
 // Add adds a value in the bitmap with name.
 func (s *RpcxBitmapService) Add(ctx context.Context, req *BitmapValueRequest, reply *bool) error {
-	s.s.bitmaps.Add(req.Name, req.Value, true)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.Add(req.Name, req.Value, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // AddMany adds multiple values in the bitmap with name.
 func (s *RpcxBitmapService) AddMany(ctx context.Context, req *BitmapValuesRequest, reply *bool) error {
-	s.s.bitmaps.AddMany(req.Name, req.Values, true)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.AddMany(req.Name, req.Values, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Remove removes a value in the bitmap with name.
 func (s *RpcxBitmapService) Remove(ctx context.Context, req *BitmapValueRequest, reply *bool) error {
-	s.s.bitmaps.Remove(req.Name, req.Value, true)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.Remove(req.Name, req.Value, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // RemoveBitmap removes the bitmap.
 func (s *RpcxBitmapService) RemoveBitmap(ctx context.Context, name string, reply *bool) error {
-	s.s.bitmaps.RemoveBitmap(name, true)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.RemoveBitmap(name, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // ClearBitmap clears the bitmap and set it to be empty.
 func (s *RpcxBitmapService) ClearBitmap(ctx context.Context, name string, reply *bool) error {
-	s.s.bitmaps.ClearBitmap(name, true)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.ClearBitmap(name, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Exists checks whether the value exists.
 func (s *RpcxBitmapService) Exists(ctx context.Context, req *BitmapValueRequest, reply *bool) error {
-	*reply = s.s.bitmaps.Exists(req.Name, req.Value)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Exists(req.Name, req.Value)
 	return nil
 }
 
 // Card gets number of integers in the bitmap.
 func (s *RpcxBitmapService) Card(ctx context.Context, name string, reply *uint64) error {
-	*reply = s.s.bitmaps.Card(name)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Card(name)
+	return nil
+}
+
+// Scan gets values of the bitmap starting from the cursor.
+func (s *RpcxBitmapService) Scan(ctx context.Context, req *BitmapScanRequest, reply *[]uint32) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Scan(req.Name, req.Cursor, scanCount(req.Count))
 	return nil
 }
 
 // Inter gets the intersection of bitmaps.
 func (s *RpcxBitmapService) Inter(ctx context.Context, names []string, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Inter(names...)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Inter(names...)
 	return nil
 }
 
 // InterStore gets the intersection of bitmaps and stores into destination.
 func (s *RpcxBitmapService) InterStore(ctx context.Context, req *BitmapStoreRequest, reply *bool) error {
-	s.s.bitmaps.InterStore(req.Destination, req.Names...)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := bs.InterStore(req.Destination, req.Names, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Union gets the union of bitmaps.
 func (s *RpcxBitmapService) Union(ctx context.Context, names []string, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Union(names...)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Union(names...)
 	return nil
 }
 
 // UnionStore gets the union of bitmaps and stores into destination.
 func (s *RpcxBitmapService) UnionStore(ctx context.Context, req *BitmapStoreRequest, reply *bool) error {
-	s.s.bitmaps.UnionStore(req.Destination, req.Names...)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := bs.UnionStore(req.Destination, req.Names, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Xor gets the symmetric difference between bitmaps.
 func (s *RpcxBitmapService) Xor(ctx context.Context, names *BitmapPairRequest, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Xor(names.Name1, names.Name2)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Xor(names.Name1, names.Name2)
 	return nil
 }
 
 // XorStore gets the symmetric difference between bitmaps and stores into destination.
 func (s *RpcxBitmapService) XorStore(ctx context.Context, names *BitmapDstAndPairRequest, reply *bool) error {
-	s.s.bitmaps.XorStore(names.Destination, names.Name1, names.Name2)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := bs.XorStore(names.Destination, []string{names.Name1, names.Name2}, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
 // Diff gets the difference between two bitmaps.
 func (s *RpcxBitmapService) Diff(ctx context.Context, names *BitmapPairRequest, reply *[]uint32) error {
-	*reply = s.s.bitmaps.Diff(names.Name1, names.Name2)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Diff(names.Name1, names.Name2)
 	return nil
 }
 
 // DiffStore gets the difference between two bitmaps and stores into destination.
 func (s *RpcxBitmapService) DiffStore(ctx context.Context, names *BitmapDstAndPairRequest, reply *bool) error {
-	s.s.bitmaps.DiffStore(names.Destination, names.Name1, names.Name2)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := bs.DiffStore(names.Destination, []string{names.Name1, names.Name2}, true); err != nil {
+		return err
+	}
 	*reply = true
 	return nil
 }
 
+// Results of big set operations are huge as []uint32, the *Bitmap methods
+// reply them serialized in the roaring format instead, which are read by
+// roaring.Bitmap.UnmarshalBinary, and the *Card methods reply only their
+// cardinality without materializing them. The *Count methods are the older
+// names of the *Card methods.
+
+// InterBitmap gets the intersection of bitmaps in the roaring format.
+func (s *RpcxBitmapService) InterBitmap(ctx context.Context, names []string, reply *[]byte) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	return marshalBitmap(bs.InterBitmap(names...), reply)
+}
+
+// InterCard gets the cardinality of the intersection of bitmaps.
+func (s *RpcxBitmapService) InterCard(ctx context.Context, names []string, reply *uint64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.InterCard(names...)
+	return nil
+}
+
+// InterCount is the older name of InterCard.
+//
+// Deprecated: use InterCard.
+func (s *RpcxBitmapService) InterCount(ctx context.Context, names []string, reply *uint64) error {
+	return s.InterCard(ctx, names, reply)
+}
+
+// UnionBitmap gets the union of bitmaps in the roaring format.
+func (s *RpcxBitmapService) UnionBitmap(ctx context.Context, names []string, reply *[]byte) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	return marshalBitmap(bs.UnionBitmap(names...), reply)
+}
+
+// UnionCard gets the cardinality of the union of bitmaps.
+func (s *RpcxBitmapService) UnionCard(ctx context.Context, names []string, reply *uint64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.UnionCard(names...)
+	return nil
+}
+
+// UnionCount is the older name of UnionCard.
+//
+// Deprecated: use UnionCard.
+func (s *RpcxBitmapService) UnionCount(ctx context.Context, names []string, reply *uint64) error {
+	return s.UnionCard(ctx, names, reply)
+}
+
+// XorBitmap gets the symmetric difference between bitmaps in the roaring format.
+func (s *RpcxBitmapService) XorBitmap(ctx context.Context, names *BitmapPairRequest, reply *[]byte) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	return marshalBitmap(bs.XorBitmap(names.Name1, names.Name2), reply)
+}
+
+// XorCard gets the cardinality of the symmetric difference between bitmaps.
+func (s *RpcxBitmapService) XorCard(ctx context.Context, names *BitmapPairRequest, reply *uint64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.XorCard(names.Name1, names.Name2)
+	return nil
+}
+
+// XorCount is the older name of XorCard.
+//
+// Deprecated: use XorCard.
+func (s *RpcxBitmapService) XorCount(ctx context.Context, names *BitmapPairRequest, reply *uint64) error {
+	return s.XorCard(ctx, names, reply)
+}
+
+// DiffBitmap gets the difference between two bitmaps in the roaring format.
+func (s *RpcxBitmapService) DiffBitmap(ctx context.Context, names *BitmapPairRequest, reply *[]byte) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	return marshalBitmap(bs.DiffBitmap(names.Name1, names.Name2), reply)
+}
+
+// DiffCard gets the cardinality of the difference between two bitmaps.
+func (s *RpcxBitmapService) DiffCard(ctx context.Context, names *BitmapPairRequest, reply *uint64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.DiffCard(names.Name1, names.Name2)
+	return nil
+}
+
+// DiffCount is the older name of DiffCard.
+//
+// Deprecated: use DiffCard.
+func (s *RpcxBitmapService) DiffCount(ctx context.Context, names *BitmapPairRequest, reply *uint64) error {
+	return s.DiffCard(ctx, names, reply)
+}
+
+// Jaccard gets the Jaccard index of two bitmaps.
+func (s *RpcxBitmapService) Jaccard(ctx context.Context, names *BitmapPairRequest, reply *float64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Jaccard(names.Name1, names.Name2)
+	return nil
+}
+
+// Query evaluates the boolean expression over bitmaps, see Bitmaps.Query.
+func (s *RpcxBitmapService) Query(ctx context.Context, req *BitmapQueryRequest, reply *BitmapQueryResult) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case req.Destination != "":
+		reply.Card, err = bs.QueryStore(req.Destination, req.Expr, req.Universe, true)
+	case req.Count:
+		reply.Card, err = bs.QueryCard(req.Expr, req.Universe)
+	default:
+		reply.Values, err = bs.Query(req.Expr, req.Universe)
+		reply.Card = uint64(len(reply.Values))
+	}
+	return err
+}
+
+func marshalBitmap(bm *roaring.Bitmap, reply *[]byte) error {
+	data, err := bm.ToBytes()
+	if err != nil {
+		return err
+	}
+	*reply = data
+	return nil
+}
+
 // Stats get the stats of bitmap `name`.
 func (s *RpcxBitmapService) Stats(ctx context.Context, name string, reply *Stats) error {
-	stats := s.s.bitmaps.Stats(name)
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	stats := bs.Stats(name)
 	*reply = stats
 	return nil
 }
 
+// SetValue sets the value of the member in the field.
+func (s *RpcxBitmapService) SetValue(ctx context.Context, req *FieldValueRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.SetValue(req.Field, req.Member, req.Value, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Value gets the value of the member in the field, Value of the request is ignored.
+func (s *RpcxBitmapService) Value(ctx context.Context, req *FieldValueRequest, reply *FieldValueResult) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	reply.Value, reply.OK = bs.Value(req.Field, req.Member)
+	return nil
+}
+
+// ClearValue removes the value of the member from the field, Value of the
+// request is ignored.
+func (s *RpcxBitmapService) ClearValue(ctx context.Context, req *FieldValueRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.ClearValue(req.Field, req.Member, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// DropField removes the field.
+func (s *RpcxBitmapService) DropField(ctx context.Context, field string, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.DropField(field, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Range gets members of the field whose value matches the comparison.
+func (s *RpcxBitmapService) Range(ctx context.Context, req *FieldRangeRequest, reply *BitmapQueryResult) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	op, err := ParseRangeOp(string(req.Op))
+	if err != nil {
+		return err
+	}
+	bm := bs.RangeBitmap(req.Field, op, req.Value, req.End, req.Filter)
+	if !req.Count {
+		reply.Values = bm.ToArray()
+	}
+	reply.Card = bm.GetCardinality()
+	return nil
+}
+
+// Sum gets the sum of values of the field and the number of them.
+func (s *RpcxBitmapService) Sum(ctx context.Context, req *FieldAggregateRequest, reply *FieldSumResult) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	reply.Sum, reply.Count = bs.Sum(req.Field, req.Filter)
+	return nil
+}
+
+// Min gets the min value of the field.
+func (s *RpcxBitmapService) Min(ctx context.Context, req *FieldAggregateRequest, reply *FieldValueResult) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	reply.Value, reply.OK = bs.Min(req.Field, req.Filter)
+	return nil
+}
+
+// Max gets the max value of the field.
+func (s *RpcxBitmapService) Max(ctx context.Context, req *FieldAggregateRequest, reply *FieldValueResult) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	reply.Value, reply.OK = bs.Max(req.Field, req.Filter)
+	return nil
+}
+
+// AddKeys adds string keys in the bitmap, keys are assigned ids first.
+func (s *RpcxBitmapService) AddKeys(ctx context.Context, req *BitmapKeysRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.AddKeys(req.Name, req.Keys, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// RemoveKeys removes string keys from the bitmap.
+func (s *RpcxBitmapService) RemoveKeys(ctx context.Context, req *BitmapKeysRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.RemoveKeys(req.Name, req.Keys, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// ExistsKey checks whether all string keys exist in the bitmap.
+func (s *RpcxBitmapService) ExistsKey(ctx context.Context, req *BitmapKeysRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = true
+	for _, key := range req.Keys {
+		if !bs.ExistsKey(req.Name, key) {
+			*reply = false
+			break
+		}
+	}
+	return nil
+}
+
+// InterKeys gets string keys of the intersection of bitmaps.
+func (s *RpcxBitmapService) InterKeys(ctx context.Context, names []string, reply *[]string) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.InterKeys(names...)
+	return nil
+}
+
+// UnionKeys gets string keys of the union of bitmaps.
+func (s *RpcxBitmapService) UnionKeys(ctx context.Context, names []string, reply *[]string) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.UnionKeys(names...)
+	return nil
+}
+
+// Keys gets string keys of ids, like members of results of other methods.
+func (s *RpcxBitmapService) Keys(ctx context.Context, ids []uint32, reply *[]string) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Keys(ids)
+	return nil
+}
+
+// PFAdd adds elements to the HyperLogLog and returns whether it's created or changed.
+func (s *RpcxBitmapService) PFAdd(ctx context.Context, req *BitmapKeysRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.PFAdd(req.Name, req.Keys, true)
+	return err
+}
+
+// PFCount gets the approximate cardinality of the union of HyperLogLogs.
+func (s *RpcxBitmapService) PFCount(ctx context.Context, names []string, reply *uint64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.PFCount(names...)
+	return err
+}
+
+// PFMerge merges HyperLogLogs of Names into Destination.
+func (s *RpcxBitmapService) PFMerge(ctx context.Context, req *BitmapStoreRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.PFMerge(req.Destination, req.Names, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// ReserveFilter creates a Bloom or Cuckoo filter.
+func (s *RpcxBitmapService) ReserveFilter(ctx context.Context, req *FilterRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	c := req.FilterConfig
+	if c.ErrorRate == 0 {
+		c.ErrorRate = DefaultFilterErrorRate
+	}
+	if c.Capacity == 0 {
+		c.Capacity = DefaultBloomCapacity
+		if c.Kind == CuckooFilter {
+			c.Capacity = DefaultCuckooCapacity
+		}
+	}
+	if err = bs.ReserveFilter(req.Name, c, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// BloomAdd adds Keys to the Bloom filter and returns whether each of them is added.
+func (s *RpcxBitmapService) BloomAdd(ctx context.Context, req *BitmapKeysRequest, reply *[]bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.BloomAdd(req.Name, req.Keys, true)
+	return err
+}
+
+// BloomExists returns whether each of Keys may be in the Bloom filter.
+func (s *RpcxBitmapService) BloomExists(ctx context.Context, req *BitmapKeysRequest, reply *[]bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.BloomExists(req.Name, req.Keys...)
+	return err
+}
+
+// CuckooAdd adds the item to the Cuckoo filter even if it's contained.
+func (s *RpcxBitmapService) CuckooAdd(ctx context.Context, req *FilterItemRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.CuckooAdd(req.Name, req.Item, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// CuckooAddNX adds the item to the Cuckoo filter if it's not contained and
+// returns whether it's added.
+func (s *RpcxBitmapService) CuckooAddNX(ctx context.Context, req *FilterItemRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.CuckooAddNX(req.Name, req.Item, true)
+	return err
+}
+
+// CuckooDelete deletes a copy of the item from the Cuckoo filter and returns
+// whether it's deleted.
+func (s *RpcxBitmapService) CuckooDelete(ctx context.Context, req *FilterItemRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.CuckooDelete(req.Name, req.Item, true)
+	return err
+}
+
+// CuckooExists returns whether each of Keys may be in the Cuckoo filter.
+func (s *RpcxBitmapService) CuckooExists(ctx context.Context, req *BitmapKeysRequest, reply *[]bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.CuckooExists(req.Name, req.Keys...)
+	return err
+}
+
+// CuckooCount returns the approximate number of copies of the item in the Cuckoo filter.
+func (s *RpcxBitmapService) CuckooCount(ctx context.Context, req *FilterItemRequest, reply *uint64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, err = bs.CuckooCount(req.Name, req.Item)
+	return err
+}
+
+// FilterInfo returns the info of the filter, Kind of it is 0 if it doesn't exist.
+func (s *RpcxBitmapService) FilterInfo(ctx context.Context, name string, reply *FilterInfo) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply, _ = bs.FilterInfo(name)
+	return nil
+}
+
+// DropFilter removes the filter.
+func (s *RpcxBitmapService) DropFilter(ctx context.Context, name string, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.DropFilter(name, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// CreateSeries creates the series or changes its config.
+func (s *RpcxBitmapService) CreateSeries(ctx context.Context, req *SeriesRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	g, err := ParseGranularity(req.Granularity)
+	if err != nil {
+		return err
+	}
+	if err = bs.CreateSeries(req.Series, SeriesConfig{Granularity: g, Retention: req.Retention}, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// DropSeries removes the series and its buckets.
+func (s *RpcxBitmapService) DropSeries(ctx context.Context, series string, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = bs.DropSeries(series, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// AddAt adds the member to the bucket of the series containing the time.
+func (s *RpcxBitmapService) AddAt(ctx context.Context, req *SeriesAddRequest, reply *bool) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	t := req.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	if err = bs.AddAt(req.Series, req.Member, t, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// Window gets members of the series active in the window.
+func (s *RpcxBitmapService) Window(ctx context.Context, req *WindowRequest, reply *BitmapQueryResult) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	bm := bs.WindowBitmap(req.Series, req.From, req.To)
+	if !req.Count {
+		reply.Values = bm.ToArray()
+	}
+	reply.Card = bm.GetCardinality()
+	return nil
+}
+
+// Retention gets the retention matrix of cohorts.
+func (s *RpcxBitmapService) Retention(ctx context.Context, req *RetentionRequest, reply *[][]uint64) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	matrix, err := bs.RetentionMatrix(req.Cohort, req.Active, req.From, req.Periods)
+	if err != nil {
+		return err
+	}
+	*reply = matrix
+	return nil
+}
+
+// Namespaces gets reports of all namespaces.
+func (s *RpcxBitmapService) Namespaces(ctx context.Context, dummy string, reply *[]NamespaceInfo) error {
+	*reply = s.s.namespaces.Info()
+	return nil
+}
+
+// Quota gets the quota of the namespace.
+func (s *RpcxBitmapService) Quota(ctx context.Context, dummy string, reply *Quota) error {
+	bs, err := s.bitmaps(ctx)
+	if err != nil {
+		return err
+	}
+
+	*reply = bs.Quota()
+	return nil
+}
+
+// SetQuota sets the quota of the namespace, 0 means unlimited.
+func (s *RpcxBitmapService) SetQuota(ctx context.Context, req *Quota, reply *bool) error {
+	meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	if err := s.s.namespaces.SetQuota(meta[NamespaceMetaKey], *req, true); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
 // Save persists bitmaps.
 func (s *RpcxBitmapService) Save(ctx context.Context, dummy string, reply *bool) error {
 	err := s.s.Save()
@@ -185,3 +1038,84 @@ func (s *RpcxBitmapService) RemoveNode(ctx context.Context, req uint64, reply *b
 	*reply = true
 	return nil
 }
+
+// AddLearner adds a raft learner which doesn't vote but serves reads.
+func (s *RpcxBitmapService) AddLearner(ctx context.Context, req *AddNodeRequest, reply *bool) error {
+	if s.confChangeCallback != nil {
+		if err := s.confChangeCallback.AddLearner(req.ID, []byte(req.Addr)); err != nil {
+			return err
+		}
+	}
+
+	*reply = true
+	return nil
+}
+
+// PromoteLearner promotes a raft learner to be a voter.
+func (s *RpcxBitmapService) PromoteLearner(ctx context.Context, req uint64, reply *bool) error {
+	if s.confChangeCallback != nil {
+		if err := s.confChangeCallback.PromoteLearner(req); err != nil {
+			return err
+		}
+	}
+
+	*reply = true
+	return nil
+}
+
+// Hash gets the state hash of bitmaps and the result of comparing it with other replicas.
+func (s *RpcxBitmapService) Hash(ctx context.Context, dummy string, reply *HashInfo) error {
+	info, err := s.s.Hash()
+	if err != nil {
+		return err
+	}
+	*reply = *info
+	return nil
+}
+
+// ClusterInfo gets members, roles and progress of the raft cluster.
+func (s *RpcxBitmapService) ClusterInfo(ctx context.Context, dummy string, reply *ClusterInfo) error {
+	if s.confChangeCallback == nil {
+		return ErrClusterDisabled
+	}
+
+	info, err := s.confChangeCallback.ClusterInfo()
+	if err != nil {
+		return err
+	}
+	*reply = *info
+	return nil
+}
+
+// TransferLeadership transfers the raft leadership to the node,
+// 0 means the most up-to-date voter.
+func (s *RpcxBitmapService) TransferLeadership(ctx context.Context, req uint64, reply *bool) error {
+	if s.confChangeCallback == nil {
+		return ErrClusterDisabled
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, leaderTransferTimeout)
+	defer cancel()
+	if err := s.confChangeCallback.TransferLeadership(ctx, req); err != nil {
+		return err
+	}
+
+	*reply = true
+	return nil
+}
+
+// Drain rejects new writes, waits for in-flight proposals and moves the leadership off this node.
+func (s *RpcxBitmapService) Drain(ctx context.Context, dummy string, reply *bool) error {
+	if s.confChangeCallback == nil {
+		return ErrClusterDisabled
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+	if err := s.confChangeCallback.Drain(ctx); err != nil {
+		return err
+	}
+
+	*reply = true
+	return nil
+}
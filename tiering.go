@@ -0,0 +1,288 @@
+package basalt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/smallnest/log"
+)
+
+// Cold bitmaps are spilled to files of a directory, one file per bitmap in
+// the roaring format, and loaded again when they are accessed. Spilling is
+// local to a node: spilled bitmaps keep their checksums and are written to
+// snapshots, so the state hash and raft are not aware of it. Spilled files
+// are read into the heap instead of being memory-mapped, because roaring
+// bitmaps built on a buffer may modify it and may be cloned into snapshots
+// which outlive the mapping.
+//
+// A spilled bitmap whose file can't be read stays spilled, so the access can
+// be retried: writes return ErrColdBitmapUnavailable, and reads which can't
+// return errors see an empty bitmap. A file which is read but can't be
+// decoded is handled the same way and logged as corrupt, so the data is kept
+// on disk for repairing instead of being replaced by an empty bitmap.
+// Committed raft entries can't be skipped, so their writes are retried and
+// the node stops if the bitmap still can't be loaded, see RaftServer.apply.
+
+// ErrColdBitmapUnavailable is returned if a spilled bitmap can't be read from its file.
+var ErrColdBitmapUnavailable = errors.New("spilled bitmap is unavailable")
+
+// corruptColdFileError is returned if a spilled file is read but is not a
+// serialized bitmap.
+type corruptColdFileError struct {
+	file string
+	err  error
+}
+
+func (e *corruptColdFileError) Error() string {
+	return fmt.Sprintf("corrupt file %s of spilled bitmap: %v", e.file, e.err)
+}
+
+// coldFileExt is the extension of files of spilled bitmaps.
+const coldFileExt = ".bitmap"
+
+// coldTier is the storage of spilled bitmaps.
+type coldTier struct {
+	dir     string
+	hot     int    // max number of bitmaps in memory
+	seq     uint64 // sequence of file names, accessed atomically
+	cold    int64  // number of spilled bitmaps, accessed atomically
+	spilled uint64 // number of spills, accessed atomically
+	loaded  uint64 // number of loads, accessed atomically
+}
+
+// SetColdStorage enables spilling bitmaps to files of dir, so at most hot
+// bitmaps are kept in memory by SpillColdBitmaps. Stale files of spilled
+// bitmaps in dir are removed. It must be called before bitmaps are used.
+func (bs *Bitmaps) SetColdStorage(dir string, hot int) error {
+	if hot < 0 {
+		return errors.New("number of hot bitmaps must not be negative")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), coldFileExt) {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	bs.tier = &coldTier{dir: dir, hot: hot}
+	return nil
+}
+
+// lockBitmap locks bm for writing and loads it if it's spilled. bm is not
+// locked if it returns an error.
+func (bs *Bitmaps) lockBitmap(bm *Bitmap) error {
+	bm.mu.Lock()
+	if bm.bitmap == nil {
+		if err := bs.load(bm); err != nil {
+			bm.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// rlockBitmap locks bm for reading, it's loaded first if it's spilled. bm is
+// not locked if it returns an error.
+func (bs *Bitmaps) rlockBitmap(bm *Bitmap) error {
+	bm.mu.RLock()
+	for bm.bitmap == nil {
+		bm.mu.RUnlock()
+		if err := bs.lockBitmap(bm); err != nil {
+			return err
+		}
+		bm.mu.Unlock()
+		bm.mu.RLock()
+	}
+	return nil
+}
+
+// load reads the spilled bm from its file, bm.mu must be held for writing.
+// It returns ErrColdBitmapUnavailable if the file can't be read or decoded,
+// and bm is kept spilled.
+func (bs *Bitmaps) load(bm *Bitmap) error {
+	b, err := readColdFile(bm.file)
+	if cerr, ok := err.(*corruptColdFileError); ok {
+		log.Errorf("failed to load spilled bitmap: %v", cerr)
+		return ErrColdBitmapUnavailable
+	}
+	if err != nil {
+		log.Errorf("failed to load spilled bitmap from %s: %v", bm.file, err)
+		return ErrColdBitmapUnavailable
+	}
+	if err := os.Remove(bm.file); err != nil {
+		log.Warnf("failed to remove file of loaded bitmap %s: %v", bm.file, err)
+	}
+
+	bm.bitmap = b
+	bm.file = ""
+	atomic.AddUint64(&bs.used, bm.size)
+	atomic.AddInt64(&bs.tier.cold, -1)
+	atomic.AddUint64(&bs.tier.loaded, 1)
+	return nil
+}
+
+// discard removes the file of the spilled bm which is dropped, bm.mu must be
+// held for writing. bm becomes empty for readers which still hold it.
+func (bs *Bitmaps) discard(bm *Bitmap) {
+	if err := os.Remove(bm.file); err != nil {
+		log.Warnf("failed to remove file of dropped bitmap %s: %v", bm.file, err)
+	}
+	bm.bitmap = roaring.NewBitmap()
+	bm.file = ""
+	atomic.AddInt64(&bs.tier.cold, -1)
+}
+
+// spill writes bm to a new file and releases its memory.
+func (bs *Bitmaps) spill(name string, bm *Bitmap) error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if bm.dropped || bm.bitmap == nil {
+		return nil
+	}
+
+	seq := atomic.AddUint64(&bs.tier.seq, 1)
+	file := filepath.Join(bs.tier.dir, strconv.FormatUint(seq, 10)+coldFileExt)
+	if err := writeColdFile(file, bm.bitmap); err != nil {
+		os.Remove(file)
+		return err
+	}
+
+	bm.bitmap = nil
+	bm.file = file
+	atomic.AddUint64(&bs.used, -bm.size)
+	atomic.AddInt64(&bs.tier.cold, 1)
+	atomic.AddUint64(&bs.tier.spilled, 1)
+	log.Debugf("spilled bitmap %s to %s", name, file)
+	return nil
+}
+
+func writeColdFile(file string, bm *roaring.Bitmap) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if _, err = bm.WriteTo(w); err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readColdFile reads the bitmap of a spilled file, which is read as a whole
+// first so errors of reading it and of decoding it can be told apart.
+func readColdFile(file string) (*roaring.Bitmap, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	bm := roaring.NewBitmap()
+	if _, err := bm.ReadFrom(bytes.NewReader(data)); err != nil {
+		return nil, &corruptColdFileError{file, err}
+	}
+	return bm, nil
+}
+
+// SpillColdBitmaps spills the least recently used bitmaps until at most the
+// number of hot bitmaps set by SetColdStorage are in memory, and returns the
+// number of spilled bitmaps.
+func (bs *Bitmaps) SpillColdBitmaps() int {
+	if bs.tier == nil {
+		return 0
+	}
+
+	type hotBitmap struct {
+		name   string
+		bm     *Bitmap
+		access int64
+	}
+
+	var hot []hotBitmap
+	for i := range bs.shards {
+		shard := &bs.shards[i]
+		shard.mu.RLock()
+		for name, bm := range shard.bitmaps {
+			bm.mu.RLock()
+			if bm.bitmap != nil {
+				hot = append(hot, hotBitmap{name, bm, atomic.LoadInt64(&bm.access)})
+			}
+			bm.mu.RUnlock()
+		}
+		shard.mu.RUnlock()
+	}
+	if len(hot) <= bs.tier.hot {
+		return 0
+	}
+
+	sort.Slice(hot, func(i, j int) bool {
+		return hot[i].access < hot[j].access
+	})
+
+	spilled := 0
+	for _, h := range hot[:len(hot)-bs.tier.hot] {
+		if err := bs.spill(h.name, h.bm); err != nil {
+			log.Errorf("failed to spill bitmap %s: %v", h.name, err)
+			continue
+		}
+		spilled++
+	}
+	return spilled
+}
+
+// SpillBitmaps spills cold bitmaps every interval until ctx is done.
+func (bs *Bitmaps) SpillBitmaps(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		bs.SpillColdBitmaps()
+	}
+}
+
+// Spilled returns whether the named bitmap is spilled to disk and the last
+// time it was accessed, which is not updated by this call. It returns false
+// if the bitmap doesn't exist.
+func (bs *Bitmaps) Spilled(name string) (spilled bool, access time.Time, ok bool) {
+	shard := bs.shard(name)
+	shard.mu.RLock()
+	bm := shard.bitmaps[name]
+	shard.mu.RUnlock()
+	if bm == nil {
+		return false, time.Time{}, false
+	}
+
+	bm.mu.RLock()
+	spilled = bm.bitmap == nil
+	bm.mu.RUnlock()
+	return spilled, time.Unix(0, atomic.LoadInt64(&bm.access)), true
+}
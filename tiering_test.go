@@ -0,0 +1,210 @@
+package basalt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newColdBitmaps(t *testing.T, hot int) (*Bitmaps, string) {
+	dir, err := ioutil.TempDir("", "basalt-cold")
+	if err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	bms := NewBitmaps()
+	if err := bms.SetColdStorage(dir, hot); err != nil {
+		t.Fatalf("failed to set cold storage: %v", err)
+	}
+	return bms, dir
+}
+
+func coldFiles(t *testing.T, dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	return len(files)
+}
+
+func TestBitmaps_SpillAndLoad(t *testing.T) {
+	bms, dir := newColdBitmaps(t, 1)
+	for i := 0; i < 1000; i++ {
+		bms.Add("old", uint32(i*7), false)
+	}
+	bms.AddMany("new", []uint32{1, 2, 3}, false)
+	atomic.StoreInt64(&bms.get("old").access, 1)
+
+	hash, used := bms.Hash(), bms.MemoryInfo().UsedMemory
+	if n := bms.SpillColdBitmaps(); n != 1 {
+		t.Fatalf("expect 1 spilled bitmap but got %d", n)
+	}
+	if spilled, _, _ := bms.Spilled("old"); !spilled {
+		t.Fatal("expect old is spilled")
+	}
+	if coldFiles(t, dir) != 1 {
+		t.Fatal("expect the file of old")
+	}
+	if bms.Hash() != hash {
+		t.Fatal("expect the state hash isn't changed by spilling")
+	}
+	if info := bms.MemoryInfo(); info.UsedMemory >= used || info.ColdBitmaps != 1 {
+		t.Fatalf("expect memory of old is released but got %+v", info)
+	}
+
+	// spilled bitmaps are written to snapshots without being loaded
+	var buf = bytes.NewBuffer(nil)
+	if err := bms.Save(buf); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	restored := NewBitmaps()
+	if err := restored.Restore(buf); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if restored.Card("old") != 1000 || restored.Hash() != hash {
+		t.Fatalf("expect old is restored but got %d values", restored.Card("old"))
+	}
+	if spilled, _, _ := bms.Spilled("old"); !spilled {
+		t.Fatal("expect old is still spilled")
+	}
+
+	// accessing a spilled bitmap loads it
+	if !bms.Exists("old", 7) || bms.Card("old") != 1000 {
+		t.Fatal("expect values of old after it's loaded")
+	}
+	if spilled, _, _ := bms.Spilled("old"); spilled {
+		t.Fatal("expect old is loaded")
+	}
+	if coldFiles(t, dir) != 0 {
+		t.Fatal("expect the file of old is removed")
+	}
+	if info := bms.MemoryInfo(); info.UsedMemory != used || info.ColdBitmaps != 0 || info.LoadedBitmaps != 1 {
+		t.Fatalf("unexpected memory info %+v", info)
+	}
+
+	// new is spilled now because old is accessed later
+	if n := bms.SpillColdBitmaps(); n != 1 {
+		t.Fatalf("expect 1 spilled bitmap but got %d", n)
+	}
+	if spilled, _, _ := bms.Spilled("new"); !spilled {
+		t.Fatal("expect new is spilled")
+	}
+	bms.RemoveBitmap("new", false)
+	if coldFiles(t, dir) != 0 {
+		t.Fatal("expect the file of new is removed")
+	}
+	if info := bms.MemoryInfo(); info.Bitmaps != 1 || info.ColdBitmaps != 0 {
+		t.Fatalf("unexpected memory info %+v", info)
+	}
+}
+
+func TestBitmaps_ColdBitmapUnavailable(t *testing.T) {
+	bms, _ := newColdBitmaps(t, 0)
+	bms.AddMany("old", []uint32{1, 2, 3}, false)
+	if n := bms.SpillColdBitmaps(); n != 1 {
+		t.Fatalf("expect 1 spilled bitmap but got %d", n)
+	}
+
+	// the file can't be read, so accesses fail and the bitmap stays spilled.
+	file := bms.get("old").file
+	if err := os.Rename(file, file+".moved"); err != nil {
+		t.Fatalf("failed to move the file: %v", err)
+	}
+	if err := bms.Add("old", 4, false); err != ErrColdBitmapUnavailable {
+		t.Fatalf("expect ErrColdBitmapUnavailable but got %v", err)
+	}
+	if bms.Card("old") != 0 || bms.Inter("old") != nil {
+		t.Fatal("expect the unavailable bitmap reads as empty")
+	}
+	if spilled, _, _ := bms.Spilled("old"); !spilled {
+		t.Fatal("expect old is still spilled")
+	}
+
+	// the access succeeds once the file can be read again.
+	if err := os.Rename(file+".moved", file); err != nil {
+		t.Fatalf("failed to move the file back: %v", err)
+	}
+	if err := bms.Add("old", 4, false); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if bms.Card("old") != 4 {
+		t.Fatalf("expect 4 values but got %d", bms.Card("old"))
+	}
+}
+
+func TestBitmaps_CorruptColdFile(t *testing.T) {
+	bms, _ := newColdBitmaps(t, 0)
+	bms.AddMany("old", []uint32{1, 2, 3}, false)
+	if n := bms.SpillColdBitmaps(); n != 1 {
+		t.Fatalf("expect 1 spilled bitmap but got %d", n)
+	}
+
+	// the truncated file is kept, so accesses fail instead of losing data.
+	file := bms.get("old").file
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("failed to stat the file: %v", err)
+	}
+	if err := os.Truncate(file, fi.Size()/2); err != nil {
+		t.Fatalf("failed to truncate the file: %v", err)
+	}
+	if err := bms.Add("old", 4, false); err != ErrColdBitmapUnavailable {
+		t.Fatalf("expect ErrColdBitmapUnavailable but got %v", err)
+	}
+	if bms.Card("old") != 0 || bms.Inter("old") != nil {
+		t.Fatal("expect the corrupt bitmap reads as empty")
+	}
+	if spilled, _, _ := bms.Spilled("old"); !spilled {
+		t.Fatal("expect old is still spilled")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("expect the corrupt file is kept: %v", err)
+	}
+}
+
+func TestBitmaps_ConcurrentSpill(t *testing.T) {
+	bms, _ := newColdBitmaps(t, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := "test" + strconv.Itoa(i)
+			for j := 0; j < 500; j++ {
+				bms.Add(name, uint32(j), false)
+				if bms.Card(name) != uint64(j+1) {
+					t.Errorf("expect %d values of %s but got %d", j+1, name, bms.Card(name))
+					return
+				}
+			}
+		}(i)
+	}
+
+	stop := make(chan struct{})
+	var spiller sync.WaitGroup
+	spiller.Add(1)
+	go func() {
+		defer spiller.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				bms.SpillColdBitmaps()
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	spiller.Wait()
+
+	if n := bms.UnionCard("test0", "test1", "test2", "test3"); n != 500 {
+		t.Fatalf("expect 500 values but got %d", n)
+	}
+}